@@ -6,12 +6,15 @@ package git
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"mime"
 	"net/mail"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
@@ -20,10 +23,17 @@ import (
 
 const zeroWidthSpace = "\u200b"
 
+// mboxPlaceholderDate is the fixed date with which git format-patch
+// dates the "From " lines of the patches it writes.
+const mboxPlaceholderDate = "Mon Sep 17 00:00:00 2001"
+
 // A Diff represents a set of changes to a single file.
 type Diff struct {
 	// Path holds the path of the file to be changed.
 	Path string
+	// OldPath holds the path from which the file was renamed, if
+	// the diff represents a rename.
+	OldPath string
 	// Meta holds the diff's metadata, treated opaquely.
 	Meta []byte
 	// Body is the actual diff contents. It is interpreted by
@@ -31,6 +41,134 @@ type Diff struct {
 	Body []byte
 }
 
+var (
+	gitlinkMode = []byte(" 160000")
+	binaryPatch = []byte("GIT binary patch")
+	binaryFiles = []byte("Binary files ")
+)
+
+// IsSubmodule tells whether the diff changes a submodule's gitlink,
+// that is, the commit that the submodule refers to.
+func (d Diff) IsSubmodule() bool {
+	for meta := d.Meta; meta != nil; {
+		if bytes.HasSuffix(scanLine(&meta), gitlinkMode) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsBinary tells whether the diff changes a binary file: that is,
+// whether it is a binary patch, or its body contains NUL bytes, which
+// git does not produce in text diffs.
+func (d Diff) IsBinary() bool {
+	for meta := d.Meta; meta != nil; {
+		line := scanLine(&meta)
+		if bytes.Equal(line, binaryPatch) || bytes.HasPrefix(line, binaryFiles) {
+			return true
+		}
+	}
+	return bytes.IndexByte(d.Body, 0) >= 0
+}
+
+var (
+	newFileMode     = []byte("new file mode ")
+	deletedFileMode = []byte("deleted file mode ")
+)
+
+// IsNew tells whether the diff adds the file.
+func (d Diff) IsNew() bool {
+	return d.hasMeta(newFileMode)
+}
+
+// IsDeleted tells whether the diff deletes the file.
+func (d Diff) IsDeleted() bool {
+	return d.hasMeta(deletedFileMode)
+}
+
+// hasMeta tells whether a line of the diff's metadata begins with the
+// provided prefix.
+func (d Diff) hasMeta(prefix []byte) bool {
+	for meta := d.Meta; meta != nil; {
+		if bytes.HasPrefix(scanLine(&meta), prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+var indexLine = []byte("index ")
+
+// Blobs returns the abbreviated IDs of the blobs of the file before
+// and after the diff, as given by its index line, and whether it has
+// one. Diffs that do not change the file's content, such as pure
+// renames and mode changes, have none.
+func (d Diff) Blobs() (old, new string, ok bool) {
+	for meta := d.Meta; meta != nil; {
+		line := scanLine(&meta)
+		if !bytes.HasPrefix(line, indexLine) {
+			continue
+		}
+		ids := strings.Fields(string(line[len(indexLine):]))
+		if len(ids) == 0 {
+			break
+		}
+		if i := strings.Index(ids[0], ".."); i >= 0 {
+			return ids[0][:i], ids[0][i+2:], true
+		}
+	}
+	return "", "", false
+}
+
+var similarityIndex = []byte("similarity index ")
+
+// SetPaths changes the paths of the file before and after the diff to
+// oldPath and path, respectively, rewriting the diff's metadata to
+// match. If the paths differ, the diff becomes a rename; if they are
+// the same, it is no longer one. The paths of diffs that add or delete
+// a file should be the same. Binary patches refer to the file by
+// content only, so their data is unaffected.
+func (d *Diff) SetPaths(oldPath, path string) {
+	meta := d.Meta
+	d.Meta = nil
+	// binary holds binary patch data, which is copied as is.
+	var binary []byte
+	if oldPath != path && d.OldPath == "" {
+		d.Meta = append(d.Meta, fmt.Sprintf("%s%s\n%s%s\n", renameFrom, oldPath, renameTo, path)...)
+	}
+	for meta != nil {
+		line := scanLine(&meta)
+		switch {
+		case bytes.HasPrefix(line, prefixA):
+			line = append(prefixA[:len(prefixA):len(prefixA)], oldPath...)
+		case bytes.HasPrefix(line, prefixB):
+			line = append(prefixB[:len(prefixB):len(prefixB)], path...)
+		case bytes.HasPrefix(line, renameFrom), bytes.HasPrefix(line, renameTo), bytes.HasPrefix(line, similarityIndex):
+			if oldPath == path {
+				continue
+			}
+			if bytes.HasPrefix(line, renameFrom) {
+				line = append(renameFrom[:len(renameFrom):len(renameFrom)], oldPath...)
+			} else if bytes.HasPrefix(line, renameTo) {
+				line = append(renameTo[:len(renameTo):len(renameTo)], path...)
+			}
+		case bytes.Equal(line, binaryPatch):
+			binary = append(append(line[:len(line):len(line)], '\n'), meta...)
+			meta = nil
+			continue
+		}
+		d.Meta = append(d.Meta, line...)
+		d.Meta = append(d.Meta, '\n')
+	}
+	d.Meta = append(d.Meta, binary...)
+	d.Meta = bytes.TrimSuffix(d.Meta, []byte{'\n'})
+	d.Path = path
+	d.OldPath = ""
+	if oldPath != path {
+		d.OldPath = oldPath
+	}
+}
+
 // A Patch is a single, atomic change, originating in a Repo. Patches
 // comprise one or more diffs, representing file changes in a
 // repository. Patches may be derived from commits and applied to a
@@ -48,6 +186,11 @@ type Patch struct {
 	Subject string
 	// Body is the patch's description.
 	Body string
+	// Charset is the character set in which the patch's message,
+	// including its encoded author and subject, is written, e.g.,
+	// "UTF-8", as declared by the patch's Content-Type header. It is
+	// empty if the patch does not declare one.
+	Charset string
 	// Diffs contains a set of diffs that represent the patch's
 	// change.
 	Diffs []Diff
@@ -68,6 +211,100 @@ func (p Patch) Paths() map[string]bool {
 	return paths
 }
 
+// A Stat summarizes the changes made to a file, like git diff --stat.
+type Stat struct {
+	// Insertions and Deletions are the numbers of lines added to and
+	// removed from the file.
+	Insertions, Deletions int
+	// Binary tells whether the file was changed by a binary diff,
+	// whose changes are not counted.
+	Binary bool
+}
+
+// Stat returns a Stat for each path touched by this Patch. Lines are
+// counted from the diffs' hunks, so the stats reflect any rewriting
+// of the diffs.
+func (p Patch) Stat() map[string]Stat {
+	stats := make(map[string]Stat)
+	for _, diff := range p.Diffs {
+		stat := stats[diff.Path]
+		if diff.IsBinary() {
+			stat.Binary = true
+		} else {
+			insertions, deletions := countLines(diff.Body)
+			stat.Insertions += insertions
+			stat.Deletions += deletions
+		}
+		stats[diff.Path] = stat
+	}
+	return stats
+}
+
+// MarshalJSON encodes the patch as a JSON object, for consumption by
+// tools that do not parse the git patch format. The object has the
+// patch's id, author, time (in RFC 3339 format), subject, and body,
+// with MIME encoded words in the author and subject decoded and the
+// subject's "[PATCH] " prefix removed; and its diffs. Each diff has
+// its path, oldPath (for renames), meta, insertions, deletions, and
+// binary fields. The bodies of text diffs are given by their body
+// field; the bodies of binary diffs, which need not be valid UTF-8,
+// are instead given, base64-encoded, by their binaryBody field. The
+// body of a "GIT binary patch" diff is the patch data following that
+// line, which git includes in the diff's meta.
+func (p Patch) MarshalJSON() ([]byte, error) {
+	type jsonDiff struct {
+		Path       string `json:"path"`
+		OldPath    string `json:"oldPath,omitempty"`
+		Meta       string `json:"meta"`
+		Insertions int    `json:"insertions"`
+		Deletions  int    `json:"deletions"`
+		Binary     bool   `json:"binary"`
+		Body       string `json:"body,omitempty"`
+		BinaryBody []byte `json:"binaryBody,omitempty"`
+	}
+	var dec mime.WordDecoder
+	decode := func(s string) string {
+		if d, err := dec.DecodeHeader(s); err == nil {
+			return d
+		}
+		return s
+	}
+	v := struct {
+		ID      string     `json:"id"`
+		Author  string     `json:"author"`
+		Time    time.Time  `json:"time"`
+		Subject string     `json:"subject"`
+		Body    string     `json:"body"`
+		Diffs   []jsonDiff `json:"diffs"`
+	}{
+		ID:      p.ID.Hex(),
+		Author:  decode(p.Author),
+		Time:    p.Time,
+		Subject: strings.TrimPrefix(decode(p.Subject), "[PATCH] "),
+		Body:    p.Body,
+		Diffs:   []jsonDiff{},
+	}
+	for _, diff := range p.Diffs {
+		d := jsonDiff{Path: diff.Path, OldPath: diff.OldPath, Meta: string(diff.Meta)}
+		if diff.IsBinary() {
+			d.Binary = true
+			d.BinaryBody = diff.Body
+			if i := bytes.Index(diff.Meta, binaryPatch); i >= 0 && (i == 0 || diff.Meta[i-1] == '\n') {
+				end := i + len(binaryPatch)
+				d.Meta = string(diff.Meta[:end])
+				if end < len(diff.Meta) {
+					d.BinaryBody = diff.Meta[end+1:]
+				}
+			}
+		} else {
+			d.Insertions, d.Deletions = countLines(diff.Body)
+			d.Body = string(diff.Body)
+		}
+		v.Diffs = append(v.Diffs, d)
+	}
+	return json.Marshal(v)
+}
+
 // Patch returns the serialized patch as a string.
 func (p Patch) Patch() string {
 	var b strings.Builder
@@ -82,19 +319,40 @@ func (p Patch) Patch() string {
 // This is to avoid ambiguity in git's patch parsing. This appears to
 // be an issue with git itself: patches that contain other patches
 // embedded in the patch description fail to apply properly using
-// standard git tooling.
+// standard git tooling. Lines that already begin with zero width
+// spaces followed by such content are also prefixed, so that the
+// escaping can be reversed unambiguously: parsed patches have their
+// bodies unescaped. Patches without diffs are written without a diff
+// section.
+//
+// The patch's mbox "From " line is dated with the patch's time, in
+// UTC, rather than with the fixed date used by git format-patch, which
+// some mbox parsers reject; git am accepts either.
 func (p Patch) Write(w io.Writer) error {
 	ew := &errWriter{Writer: w}
-	fmt.Fprintf(ew, "From %s Mon Sep 17 00:00:00 2001\n", p.ID.Hex())
+	fmt.Fprintf(ew, "From %s %s\n", p.ID.Hex(), mboxDate(p.Time))
 	fmt.Fprintf(ew, "From: %s\n", p.Author)
 	fmt.Fprintf(ew, "Date: %s\n", p.Time.Format(gitTimeLayout))
 	fmt.Fprintf(ew, "Subject: %s\n", p.Subject)
-	body := strings.Replace(p.Body, "\ndiff", "\n"+zeroWidthSpace+"diff", -1)
-	body = strings.Replace(body, "\n---", "\n"+zeroWidthSpace+"---", -1)
-	body = strings.Replace(body, "\n+++", "\n"+zeroWidthSpace+"+++", -1)
+	if p.Charset != "" {
+		// Declare the charset, as git format-patch does, so that git
+		// am converts the message to the destination's encoding.
+		fmt.Fprintf(ew, "MIME-Version: 1.0\nContent-Type: text/plain; charset=%s\nContent-Transfer-Encoding: 8bit\n", p.Charset)
+	}
+	body := escapeBody(p.Body)
+	if len(p.Diffs) == 0 {
+		// Like git format-patch, omit the diff separator for empty
+		// patches so that they can be applied as empty commits.
+		fmt.Fprintf(ew, "\n%s\n", body)
+		return ew.Err()
+	}
 	fmt.Fprintf(ew, "\n%s\n---\n\n\n", body)
 	for _, diff := range p.Diffs {
-		fmt.Fprintf(ew, "diff --git a/%s b/%s\n", diff.Path, diff.Path)
+		oldPath := diff.Path
+		if diff.OldPath != "" {
+			oldPath = diff.OldPath
+		}
+		fmt.Fprintf(ew, "diff --git a/%s b/%s\n", oldPath, diff.Path)
 		ew.Write(diff.Meta)
 		ew.Write([]byte{'\n'})
 		ew.Write(diff.Body)
@@ -103,6 +361,241 @@ func (p Patch) Write(w io.Writer) error {
 	return ew.Err()
 }
 
+// metaPrefixes are the prefixes of valid lines in a diff's extended
+// header.
+var metaPrefixes = []string{
+	"old mode ", "new mode ", "deleted file mode ", "new file mode ",
+	"copy from ", "copy to ", "rename from ", "rename to ",
+	"similarity index ", "dissimilarity index ", "index ",
+	"--- ", "+++ ", "Binary files ",
+}
+
+// Validate checks that the patch is structurally sound: that each of
+// its diffs has a valid path and header, and that the line counts in
+// each hunk's header are consistent with the hunk's body. The
+// returned error names the offending diff.
+func (p Patch) Validate() error {
+	for i, diff := range p.Diffs {
+		if err := diff.validate(); err != nil {
+			return fmt.Errorf("patch %s: diff %d (%s): %v", p.ID.Hex()[:7], i, diff.Path, err)
+		}
+	}
+	return nil
+}
+
+func (d Diff) validate() error {
+	if err := validatePath(d.Path); err != nil {
+		return err
+	}
+	if d.OldPath != "" {
+		if err := validatePath(d.OldPath); err != nil {
+			return err
+		}
+	}
+	for meta := d.Meta; meta != nil; {
+		line := string(scanLine(&meta))
+		if line == "GIT binary patch" {
+			// The remainder of the diff is binary patch data,
+			// which is validated by git.
+			return nil
+		}
+		valid := false
+		for _, prefix := range metaPrefixes {
+			if strings.HasPrefix(line, prefix) {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return fmt.Errorf("invalid header line %q", line)
+		}
+	}
+	return validateHunks(d.Body)
+}
+
+func validatePath(path string) error {
+	switch {
+	case path == "":
+		return errors.New("empty path")
+	case strings.HasPrefix(path, "/"):
+		return fmt.Errorf("absolute path %s", path)
+	}
+	for _, elem := range strings.Split(path, "/") {
+		if elem == "" || elem == "." || elem == ".." {
+			return fmt.Errorf("invalid path %s", path)
+		}
+	}
+	return nil
+}
+
+var hunkHeaderRe = regexp.MustCompile(`^@@ -(\d+)(?:,(\d+))? \+(\d+)(?:,(\d+))? @@`)
+
+// A HunkHeader is the header line of a hunk in a diff body:
+//
+//	@@ -OldStart,OldLines +NewStart,NewLines @@Section
+type HunkHeader struct {
+	OldStart, OldLines int
+	NewStart, NewLines int
+	// Section is the remainder of the line, e.g., the enclosing
+	// function named by a diff driver, with its leading space.
+	Section string
+}
+
+// ParseHunkHeader parses the provided line of a diff body as a hunk
+// header, and tells whether it is one. Line counts omitted from the
+// header are 1.
+func ParseHunkHeader(line []byte) (HunkHeader, bool) {
+	g := hunkHeaderRe.FindSubmatch(line)
+	if g == nil {
+		return HunkHeader{}, false
+	}
+	var (
+		h    = HunkHeader{Section: string(line[len(g[0]):])}
+		nums = []*int{&h.OldStart, &h.OldLines, &h.NewStart, &h.NewLines}
+	)
+	for i, n := range nums {
+		if g[i+1] == nil {
+			*n = 1
+			continue
+		}
+		var err error
+		if *n, err = strconv.Atoi(string(g[i+1])); err != nil {
+			return HunkHeader{}, false
+		}
+	}
+	return h, true
+}
+
+// String returns the header line, with both line counts.
+func (h HunkHeader) String() string {
+	return fmt.Sprintf("@@ -%d,%d +%d,%d @@%s", h.OldStart, h.OldLines, h.NewStart, h.NewLines, h.Section)
+}
+
+// validateHunks checks that the line counts in each hunk's header
+// match the hunk's body.
+func validateHunks(body []byte) error {
+	var (
+		header     string
+		nold, nnew int
+		inHunk     bool
+	)
+	done := func() error {
+		if inHunk && (nold != 0 || nnew != 0) {
+			return fmt.Errorf("hunk %q: body is short by %d old and %d new lines", header, nold, nnew)
+		}
+		return nil
+	}
+	for body != nil {
+		line := scanLine(&body)
+		if h, ok := ParseHunkHeader(line); ok {
+			if err := done(); err != nil {
+				return err
+			}
+			header, inHunk = string(line), true
+			nold, nnew = h.OldLines, h.NewLines
+			continue
+		}
+		if !inHunk {
+			if len(line) == 0 {
+				continue
+			}
+			return fmt.Errorf("unexpected line %q outside of hunk", line)
+		}
+		if len(line) > 0 && line[0] == '\\' {
+			// "\ No newline at end of file"
+			continue
+		}
+		if nold == 0 && nnew == 0 {
+			if len(line) == 0 {
+				continue
+			}
+			if string(line) == "-- " {
+				// The remainder is the patch's signature.
+				return nil
+			}
+			return fmt.Errorf("hunk %q: unexpected line %q past end of hunk", header, line)
+		}
+		op := byte(' ')
+		if len(line) > 0 {
+			op = line[0]
+		}
+		switch op {
+		case ' ':
+			nold--
+			nnew--
+		case '-':
+			nold--
+		case '+':
+			nnew--
+		default:
+			return fmt.Errorf("hunk %q: invalid line %q", header, line)
+		}
+		if nold < 0 || nnew < 0 {
+			return fmt.Errorf("hunk %q: body has more lines than its header", header)
+		}
+	}
+	return done()
+}
+
+// countLines returns the numbers of lines added and removed by the
+// hunks in the provided diff body. Lines outside of hunks, such as a
+// patch's signature, are not counted.
+func countLines(body []byte) (insertions, deletions int) {
+	var nold, nnew int
+	for body != nil {
+		line := scanLine(&body)
+		if h, ok := ParseHunkHeader(line); ok {
+			nold, nnew = h.OldLines, h.NewLines
+			continue
+		}
+		if nold <= 0 && nnew <= 0 {
+			continue
+		}
+		op := byte(' ')
+		if len(line) > 0 {
+			op = line[0]
+		}
+		switch op {
+		case ' ':
+			nold--
+			nnew--
+		case '-':
+			nold--
+			deletions++
+		case '+':
+			nnew--
+			insertions++
+		}
+	}
+	return
+}
+
+var (
+	escapeRe   = regexp.MustCompile(`(?m)^((?:` + zeroWidthSpace + `)*(?:diff|---|\+\+\+))`)
+	unescapeRe = regexp.MustCompile(`(?m)^` + zeroWidthSpace + `((?:` + zeroWidthSpace + `)*(?:diff|---|\+\+\+))`)
+)
+
+// escapeBody escapes diff-like lines in the provided patch body, as
+// described in Patch.Write.
+func escapeBody(body string) string {
+	return escapeRe.ReplaceAllString(body, zeroWidthSpace+"$1")
+}
+
+// mboxDate returns the date of an mbox "From " line for a patch with
+// the provided time, in the asctime format of mbox separators. Patches
+// without a time are dated as by git format-patch.
+func mboxDate(t time.Time) string {
+	if t.IsZero() {
+		return mboxPlaceholderDate
+	}
+	return t.UTC().Format(time.ANSIC)
+}
+
+// unescapeBody reverses escapeBody.
+func unescapeBody(body string) string {
+	return unescapeRe.ReplaceAllString(body, "$1")
+}
+
 var oid = []byte("oid")
 
 // MaybeContainsLFSPointer uses (coarse) heuristics to determine
@@ -124,8 +617,17 @@ func (p Patch) MaybeContainsLFSPointer() bool {
 var errMalformedPatch = errors.New("malformed patch")
 var continueHeader = []byte(" ")
 
+var (
+	crlf = []byte("\r\n")
+	lf   = []byte("\n")
+)
+
 // ParsePatchHead parses a patch header from the provided buffer.
+// CRLF line endings, as in patches produced on Windows, are treated
+// as LF, as git am does, so that they do not leak into the header
+// fields or the commit message.
 func parsePatchHeader(b []byte) (Patch, error) {
+	b = bytes.ReplaceAll(b, crlf, lf)
 	from := scanLine(&b)
 	fields := bytes.Fields(from)
 	if len(fields) < 2 {
@@ -155,14 +657,52 @@ func parsePatchHeader(b []byte) (Patch, error) {
 	if p.Subject == "" {
 		return Patch{}, errors.New("patch is missing subject")
 	}
+	if ct := m.Header.Get("Content-Type"); ct != "" {
+		_, params, err := mime.ParseMediaType(ct)
+		if err != nil {
+			return Patch{}, fmt.Errorf("content-type %q: %v", ct, err)
+		}
+		p.Charset = params["charset"]
+	}
 	b, err = ioutil.ReadAll(m.Body)
 	if err != nil {
 		return Patch{}, err
 	}
-	p.Body = string(b)
+	p.Body = unescapeBody(string(b))
 	return p, nil
 }
 
+// parseDiffs parses the diffs in the provided git diff output.
+func parseDiffs(b []byte) (diffs []Diff, err error) {
+	// Only "diff --git" lines separate diffs: the lines of binary
+	// patches, for example, may begin with "diff".
+	err = foreach(b, "diff --git ", func(diff []byte) error {
+		header := scanLine(&diff)
+		path := parseDiffHeader(header)
+		if path == nil {
+			return errors.New("diff is missing header")
+		}
+		d := Diff{Path: string(path), Meta: next(&diff, "@@"), Body: diff}
+		if d.Body == nil {
+			// Diffs without hunks, such as pure renames, extend to the
+			// end of the output when they are last.
+			d.Meta = bytes.TrimRight(d.Meta, "\n")
+		}
+		for meta := d.Meta; meta != nil; {
+			line := scanLine(&meta)
+			switch {
+			case bytes.HasPrefix(line, renameFrom):
+				d.OldPath = string(line[len(renameFrom):])
+			case bytes.HasPrefix(line, renameTo):
+				d.Path = string(line[len(renameTo):])
+			}
+		}
+		diffs = append(diffs, d)
+		return nil
+	})
+	return
+}
+
 func scan(b *[]byte, prefix string) (body []byte) {
 	body = next(b, prefix)
 	if len(*b) >= len(prefix) {
@@ -228,9 +768,23 @@ func parseHeader(line []byte) (header, value []byte, ok bool) {
 	return g[1], g[2], true
 }
 
-var diffHeaderRe = regexp.MustCompile(`^diff --git a/([^ ]+)`)
+var (
+	diffHeaderRe = regexp.MustCompile(`^diff --git a/([^ ]+)`)
+	diffGitA     = []byte("diff --git a/")
+)
 
+// parseDiffHeader returns the path named by the provided "diff --git"
+// line. When the line names the same path twice, as it does unless
+// the file was renamed, the path may contain spaces; otherwise, the
+// path is taken to end at the first space, and rename headers give
+// the actual paths.
 func parseDiffHeader(line []byte) (path []byte) {
+	if rest := bytes.TrimPrefix(line, diffGitA); len(rest) < len(line) && len(rest)%2 == 1 {
+		n := (len(rest) - 3) / 2
+		if p := rest[:n]; n > 0 && string(rest[n:]) == " b/"+string(p) {
+			return p
+		}
+	}
 	g := diffHeaderRe.FindSubmatch(line)
 	if g == nil {
 		return nil
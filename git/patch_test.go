@@ -5,7 +5,9 @@ package git
 
 import (
 	"bytes"
+	"encoding/json"
 	"io/ioutil"
+	"strings"
 	"testing"
 	"time"
 )
@@ -34,6 +36,54 @@ func TestParsePatchInvalidEmail(t *testing.T) {
 	}
 }
 
+// TestParsePatchCRLF verifies that patches with CRLF line endings are
+// parsed without stray carriage returns.
+func TestParsePatchCRLF(t *testing.T) {
+	patch := parsePatchRoundTrip(t, "testdata/0001-docs-fix-typo-in-README-crlf.patch")
+	if got, want := patch.Author, "Jane Doe <jane@example.com>"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, want := patch.Subject, "[PATCH] docs: fix typo in README with a subject long enough to be folded"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, want := patch.Time.Format(time.Kitchen), "9:15AM"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if strings.Contains(patch.Body, "\r") {
+		t.Errorf("body contains carriage returns: %q", patch.Body)
+	}
+	if !strings.HasPrefix(patch.Body, "The word \"recieve\" was misspelled.\n") {
+		t.Errorf("got body %q", patch.Body)
+	}
+}
+
+func TestPatchCharset(t *testing.T) {
+	for _, charset := range []string{"", "ISO-8859-1"} {
+		patch := Patch{
+			ID:      SHA1.FromString(charset),
+			Author:  "=?ISO-8859-1?q?Ren=E9?= <you@example.com>",
+			Time:    time.Unix(0, 0),
+			Subject: "test",
+			Body:    "A na\xefve body.\n",
+			Charset: charset,
+		}
+		var buf bytes.Buffer
+		if err := patch.Write(&buf); err != nil {
+			t.Fatal(err)
+		}
+		got, err := parsePatchHeader(buf.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Charset != charset {
+			t.Errorf("got charset %q, want %q", got.Charset, charset)
+		}
+		if !strings.HasPrefix(got.Body, patch.Body) {
+			t.Errorf("got body %q, want %q", got.Body, patch.Body)
+		}
+	}
+}
+
 // parsePatchRoundTrip parses and returns the patch at path, with a round trip
 // through (Patch).Write.
 func parsePatchRoundTrip(t *testing.T, path string) Patch {
@@ -56,3 +106,392 @@ func parsePatchRoundTrip(t *testing.T, path string) Patch {
 	}
 	return patch
 }
+
+func TestParseDiffHeader(t *testing.T) {
+	for _, c := range []struct{ line, want string }{
+		{"diff --git a/file b/file", "file"},
+		{"diff --git a/dir/with space b/dir/with space", "dir/with space"},
+		{"diff --git a/ b b/ b", " b"},
+		// Renames are resolved by their rename headers.
+		{"diff --git a/old b/new", "old"},
+		{"diff --git a/old name b/new name", "old"},
+		{"not a diff", ""},
+	} {
+		if got := string(parseDiffHeader([]byte(c.line))); got != c.want {
+			t.Errorf("%q: got %q, want %q", c.line, got, c.want)
+		}
+	}
+}
+
+func TestParseHunkHeader(t *testing.T) {
+	for _, c := range []struct {
+		line string
+		want HunkHeader
+		ok   bool
+		// str is the header as formatted by String.
+		str string
+	}{
+		{"@@ -1,2 +3,4 @@", HunkHeader{1, 2, 3, 4, ""}, true, "@@ -1,2 +3,4 @@"},
+		{"@@ -1 +0,0 @@ func main() {", HunkHeader{1, 1, 0, 0, " func main() {"}, true, "@@ -1,1 +0,0 @@ func main() {"},
+		{"@@ -0,0 +1 @@", HunkHeader{0, 0, 1, 1, ""}, true, "@@ -0,0 +1,1 @@"},
+		{"@@ -1,99999999999999999999 +1 @@", HunkHeader{}, false, ""},
+		{" @@ -1 +1 @@", HunkHeader{}, false, ""},
+	} {
+		got, ok := ParseHunkHeader([]byte(c.line))
+		if got != c.want || ok != c.ok {
+			t.Errorf("%q: got %+v, %v, want %+v, %v", c.line, got, ok, c.want, c.ok)
+		}
+		if ok && got.String() != c.str {
+			t.Errorf("%q: got %q, want %q", c.line, got.String(), c.str)
+		}
+	}
+}
+
+func TestPatchValidate(t *testing.T) {
+	for _, path := range []string{
+		"testdata/0001-reflow-syntax-permit-file-and-dir-module-arguments-v.patch",
+		"testdata/0001-build-deps-bump-activesupport-from-6.0.2.1-to-6.0.3..patch",
+	} {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		diffs, err := parseDiffs(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(diffs) == 0 {
+			t.Fatalf("%s: no diffs", path)
+		}
+		if err := (Patch{ID: SHA1.FromString(path), Diffs: diffs}).Validate(); err != nil {
+			t.Errorf("%s: %v", path, err)
+		}
+	}
+
+	const meta = "index 1234567..89abcde 100644\n--- a/file\n+++ b/file"
+	for _, c := range []struct {
+		diff Diff
+		err  string
+	}{
+		{Diff{Path: "file", Meta: []byte(meta), Body: []byte("@@ -1,2 +1,2 @@\n context\n-old\n+new")}, ""},
+		{Diff{Path: "file", Meta: []byte(meta), Body: []byte("@@ -1 +1 @@\n-old\n\\ No newline at end of file\n+new\n")}, ""},
+		{Diff{Path: "file", Meta: []byte("new file mode 160000\nindex 0000000..1234567")}, ""},
+		{Diff{Path: "", Meta: []byte(meta)}, "empty path"},
+		{Diff{Path: "a/../b", Meta: []byte(meta)}, "invalid path a/../b"},
+		{Diff{Path: "file", OldPath: "/etc/passwd", Meta: []byte(meta)}, "absolute path /etc/passwd"},
+		{Diff{Path: "file", Meta: []byte("bogus header\n" + meta)}, `invalid header line "bogus header"`},
+		{Diff{Path: "file", Meta: []byte(meta), Body: []byte("@@ -1,2 +1,2 @@\n context\n-old")}, `hunk "@@ -1,2 +1,2 @@": body is short by 0 old and 1 new lines`},
+		{Diff{Path: "file", Meta: []byte(meta), Body: []byte("@@ -1,1 +1,1 @@\n-old\n+new\n+extra")}, `hunk "@@ -1,1 +1,1 @@": unexpected line "+extra" past end of hunk`},
+		{Diff{Path: "file", Meta: []byte(meta), Body: []byte("@@ -1,2 +1,2 @@\n-old\n*new")}, `hunk "@@ -1,2 +1,2 @@": invalid line "*new"`},
+		{Diff{Path: "file", Meta: []byte(meta), Body: []byte("garbage\n@@ -1 +1 @@\n-old\n+new")}, `unexpected line "garbage" outside of hunk`},
+	} {
+		err := Patch{ID: SHA1.FromString("patch"), Diffs: []Diff{c.diff}}.Validate()
+		switch {
+		case c.err == "" && err != nil:
+			t.Errorf("%+v: unexpected error %v", c.diff, err)
+		case c.err != "" && (err == nil || !strings.HasSuffix(err.Error(), ": "+c.err)):
+			t.Errorf("%+v: got error %v, want %s", c.diff, err, c.err)
+		}
+	}
+}
+
+// TestParseDiffsWithoutHunks verifies that diffs without hunks, such
+// as pure renames, are parsed without trailing blank lines, even when
+// they end the output.
+func TestParseDiffsWithoutHunks(t *testing.T) {
+	const raw = "diff --git a/old b/new\nsimilarity index 100%\nrename from old\nrename to new\n\n"
+	diffs, err := parseDiffs([]byte(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 1 {
+		t.Fatalf("got %d diffs, want 1", len(diffs))
+	}
+	if got, want := string(diffs[0].Meta), "similarity index 100%\nrename from old\nrename to new"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, want := diffs[0].OldPath+">"+diffs[0].Path, "old>new"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if err := (Patch{ID: SHA1.FromString("patch"), Diffs: diffs}).Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestParseDiffsDiffContent verifies that diffs are split only on
+// "diff --git" lines, and not on content that begins with "diff".
+func TestParseDiffsDiffContent(t *testing.T) {
+	const raw = "diff --git a/notes b/notes\n" +
+		"new file mode 100644\n" +
+		"index 0000000..1111111\n" +
+		"--- /dev/null\n" +
+		"+++ b/notes\n" +
+		"@@ -0,0 +1,2 @@\n" +
+		"+diff --git a/x b/x\n" +
+		"+diff something\n" +
+		"diff --git a/bin b/bin\n" +
+		"new file mode 100644\n" +
+		"index 0000000..2222222\n" +
+		"GIT binary patch\n" +
+		"literal 30\n" +
+		// Lines of 30 bytes begin with 'd'.
+		"diff0123456789012345678901234567890123456\n" +
+		"\n" +
+		"literal 0\n" +
+		"HcmV?d00001\n" +
+		"\n"
+	diffs, err := parseDiffs([]byte(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, diff := range diffs {
+		paths = append(paths, diff.Path)
+	}
+	if got, want := strings.Join(paths, " "), "notes bin"; got != want {
+		t.Fatalf("got diffs of %q, want %q", got, want)
+	}
+	if got, want := string(diffs[0].Body), "@@ -0,0 +1,2 @@\n+diff --git a/x b/x\n+diff something"; got != want {
+		t.Errorf("got body %q, want %q", got, want)
+	}
+	if !diffs[1].IsBinary() || !bytes.Contains(diffs[1].Meta, []byte("\ndiff0123")) {
+		t.Errorf("bad binary diff %q", diffs[1].Meta)
+	}
+}
+
+// TestPatchMboxDate verifies that the mbox "From " line is dated with
+// the patch's time, and that the date does not affect parsing.
+func TestPatchMboxDate(t *testing.T) {
+	for _, c := range []struct {
+		time time.Time
+		from string
+	}{
+		{time.Date(2019, 3, 4, 5, 6, 7, 0, time.FixedZone("", -8*3600)), "Mon Mar  4 13:06:07 2019"},
+		{time.Time{}, "Mon Sep 17 00:00:00 2001"},
+	} {
+		patch := Patch{
+			ID:      SHA1.FromString(c.from),
+			Author:  "your name <you@example.com>",
+			Time:    c.time,
+			Subject: "test",
+			Body:    "body\n",
+		}
+		var buf bytes.Buffer
+		if err := patch.Write(&buf); err != nil {
+			t.Fatal(err)
+		}
+		line := strings.SplitN(buf.String(), "\n", 2)[0]
+		if got, want := line, "From "+patch.ID.Hex()+" "+c.from; got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+		got, err := parsePatchHeader(buf.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.ID != patch.ID {
+			t.Errorf("got ID %v, want %v", got.ID, patch.ID)
+		}
+		if !c.time.IsZero() && !got.Time.Equal(c.time) {
+			t.Errorf("got time %v, want %v", got.Time, c.time)
+		}
+		if got.Subject != patch.Subject || got.Author != patch.Author {
+			t.Errorf("got %v, want %v", got, patch)
+		}
+	}
+}
+
+// TestPatchBodyEscape verifies that patch bodies containing diff-like
+// lines survive a round trip through Write and parsePatchHeader.
+func TestPatchBodyEscape(t *testing.T) {
+	for _, body := range []string{
+		"diff --git a/x b/x\n",
+		"Fix the parser.\n\ndiff --git a/file b/file\n--- a/file\n+++ b/file\n",
+		"Escaped already:\n" + zeroWidthSpace + "diff --git a/x b/x\n",
+		"Twice:\n" + zeroWidthSpace + zeroWidthSpace + "--- a/x\n",
+		"Not a diff:\n" + zeroWidthSpace + "text\n",
+	} {
+		patch := Patch{
+			ID:      SHA1.FromString(body),
+			Author:  "your name <you@example.com>",
+			Time:    time.Unix(0, 0),
+			Subject: "test",
+			Body:    body,
+		}
+		var buf bytes.Buffer
+		if err := patch.Write(&buf); err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(buf.String(), "\ndiff --git") {
+			t.Errorf("body %q: unescaped diff line in patch:\n%s", body, buf.String())
+		}
+		got, err := parsePatchHeader(buf.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := strings.TrimSpace(got.Body), strings.TrimSpace(body); got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+}
+
+func TestPatchStat(t *testing.T) {
+	patch := Patch{Diffs: []Diff{
+		{
+			Path: "file",
+			Meta: []byte("index 1234567..89abcde 100644\n--- a/file\n+++ b/file"),
+			Body: []byte("@@ -1,3 +1,3 @@\n line 1\n-line 2\n+line two\n line 3\n@@ -10 +10,2 @@\n+added\n line 10\n\\ No newline at end of file\n-- \n2.20.1\n"),
+		},
+		{
+			Path: "image.png",
+			Meta: []byte("new file mode 100644\nindex 0000000..1234567\nGIT binary patch\nliteral 3\nKcmZ?wVE_OC0RR91"),
+		},
+		{
+			Path: "new",
+			Meta: []byte("new file mode 100644\nindex 0000000..1234567\n--- /dev/null\n+++ b/new"),
+			Body: []byte("@@ -0,0 +1,2 @@\n+one\n+two\n"),
+		},
+	}}
+	got := patch.Stat()
+	want := map[string]Stat{
+		"file":      {Insertions: 2, Deletions: 1},
+		"image.png": {Binary: true},
+		"new":       {Insertions: 2},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for path, stat := range want {
+		if got[path] != stat {
+			t.Errorf("%s: got %+v, want %+v", path, got[path], stat)
+		}
+	}
+}
+
+func TestDiffIsBinary(t *testing.T) {
+	for _, c := range []struct {
+		diff Diff
+		want bool
+	}{
+		{Diff{Meta: []byte("index 1234567..89abcde 100644\n--- a/file\n+++ b/file"), Body: []byte("@@ -1 +1 @@\n-a\n+b\n")}, false},
+		{Diff{Meta: []byte("index 1234567..89abcde 100644\nGIT binary patch\nliteral 3\nKcmZ?wVE_OC0RR91")}, true},
+		{Diff{Meta: []byte("index 1234567..89abcde 100644\nBinary files a/file and b/file differ")}, true},
+		{Diff{Meta: []byte("index 1234567..89abcde 100644\n--- a/file\n+++ b/file"), Body: []byte("@@ -1 +1 @@\n-a\n+b\x00\n")}, true},
+	} {
+		if got := c.diff.IsBinary(); got != c.want {
+			t.Errorf("%q: got %v, want %v", c.diff.Meta, got, c.want)
+		}
+	}
+}
+
+func TestDiffIsNewIsDeleted(t *testing.T) {
+	for _, c := range []struct {
+		diff             Diff
+		isNew, isDeleted bool
+	}{
+		{Diff{Meta: []byte("index 1234567..89abcde 100644\n--- a/file\n+++ b/file")}, false, false},
+		{Diff{Meta: []byte("new file mode 100644\nindex 0000000..89abcde\n--- /dev/null\n+++ b/file")}, true, false},
+		{Diff{Meta: []byte("deleted file mode 100644\nindex 1234567..0000000\n--- a/file\n+++ /dev/null")}, false, true},
+		{Diff{Meta: []byte("old mode 100644\nnew mode 100755")}, false, false},
+	} {
+		if got := c.diff.IsNew(); got != c.isNew {
+			t.Errorf("%q: got IsNew %v, want %v", c.diff.Meta, got, c.isNew)
+		}
+		if got := c.diff.IsDeleted(); got != c.isDeleted {
+			t.Errorf("%q: got IsDeleted %v, want %v", c.diff.Meta, got, c.isDeleted)
+		}
+	}
+}
+
+func TestDiffSetPaths(t *testing.T) {
+	for _, c := range []struct {
+		diff          Diff
+		oldPath, path string
+		want          Diff
+	}{
+		{
+			Diff{Path: "a", Meta: []byte("index 1234567..89abcde 100644\n--- a/a\n+++ b/a")},
+			"d/a", "d/a",
+			Diff{Path: "d/a", Meta: []byte("index 1234567..89abcde 100644\n--- a/d/a\n+++ b/d/a")},
+		},
+		{
+			Diff{Path: "a", Meta: []byte("new file mode 100644\nindex 0000000..89abcde\n--- /dev/null\n+++ b/a")},
+			"d/a", "d/a",
+			Diff{Path: "d/a", Meta: []byte("new file mode 100644\nindex 0000000..89abcde\n--- /dev/null\n+++ b/d/a")},
+		},
+		{
+			Diff{Path: "a", Meta: []byte("index 1234567..89abcde 100644\n--- a/a\n+++ b/a")},
+			"a", "d/a",
+			Diff{Path: "d/a", OldPath: "a", Meta: []byte("rename from a\nrename to d/a\nindex 1234567..89abcde 100644\n--- a/a\n+++ b/d/a")},
+		},
+		{
+			Diff{Path: "b", OldPath: "a", Meta: []byte("similarity index 90%\nrename from a\nrename to b\nindex 1234567..89abcde 100644\n--- a/a\n+++ b/b")},
+			"d/b", "d/b",
+			Diff{Path: "d/b", Meta: []byte("index 1234567..89abcde 100644\n--- a/d/b\n+++ b/d/b")},
+		},
+		{
+			Diff{Path: "a", Meta: []byte("index 1234567..89abcde 100644\nGIT binary patch\nliteral 3\nKcmZ?wVE_OC0RR91")},
+			"d/a", "d/a",
+			Diff{Path: "d/a", Meta: []byte("index 1234567..89abcde 100644\nGIT binary patch\nliteral 3\nKcmZ?wVE_OC0RR91")},
+		},
+	} {
+		got := c.diff
+		got.SetPaths(c.oldPath, c.path)
+		if got.Path != c.want.Path || got.OldPath != c.want.OldPath || string(got.Meta) != string(c.want.Meta) {
+			t.Errorf("%q: SetPaths(%q, %q): got %q, %q, %q, want %q, %q, %q", c.diff.Meta, c.oldPath, c.path,
+				got.OldPath, got.Path, got.Meta, c.want.OldPath, c.want.Path, c.want.Meta)
+		}
+	}
+}
+
+func TestPatchMarshalJSON(t *testing.T) {
+	patch := Patch{
+		ID:      SHA1.FromString("commit"),
+		Author:  "=?UTF-8?q?J=C3=B6rg?= <jorg@example.com>",
+		Time:    time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		Subject: "[PATCH] Fix a bug",
+		Body:    "In detail.\n",
+		Diffs: []Diff{
+			{
+				Path: "file",
+				Meta: []byte("index 1234567..89abcde 100644\n--- a/file\n+++ b/file"),
+				Body: []byte("@@ -1 +1 @@\n-a\n+b\n"),
+			},
+			{
+				Path: "image.png",
+				Meta: []byte("index 1234567..89abcde 100644\nGIT binary patch\nliteral 3\nKcmZ?wVE_OC0RR91"),
+			},
+		},
+	}
+	b, err := json.Marshal(patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		ID, Author, Subject, Body string
+		Time                      time.Time
+		Diffs                     []struct {
+			Path, Meta, Body      string
+			Insertions, Deletions int
+			Binary                bool
+			BinaryBody            []byte
+		}
+	}
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != patch.ID.Hex() || got.Author != "Jörg <jorg@example.com>" || got.Subject != "Fix a bug" || got.Body != patch.Body || !got.Time.Equal(patch.Time) {
+		t.Errorf("got %+v", got)
+	}
+	if len(got.Diffs) != 2 {
+		t.Fatalf("got %d diffs, want 2", len(got.Diffs))
+	}
+	if d := got.Diffs[0]; d.Path != "file" || d.Body != "@@ -1 +1 @@\n-a\n+b\n" || d.Insertions != 1 || d.Deletions != 1 || d.Binary || d.BinaryBody != nil {
+		t.Errorf("got %+v", d)
+	}
+	if d := got.Diffs[1]; d.Path != "image.png" || d.Meta != "index 1234567..89abcde 100644\nGIT binary patch" || d.Body != "" || !d.Binary || string(d.BinaryBody) != "literal 3\nKcmZ?wVE_OC0RR91" {
+		t.Errorf("got %+v", d)
+	}
+	if !strings.Contains(string(b), `"binaryBody":"`) {
+		t.Errorf("binary body not base64-encoded: %s", b)
+	}
+}
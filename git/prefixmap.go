@@ -0,0 +1,129 @@
+// Copyright 2018 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// A PrefixMapping maps the source directory Src to the destination
+// directory Dst. Both are paths of directories, relative to the roots
+// of their repositories, with a trailing slash, or empty for the roots
+// themselves.
+type PrefixMapping struct {
+	Src, Dst string
+}
+
+// A PrefixMap maps the paths of files in several source directories
+// to paths in different destination directories, so that they may be
+// mirrored to a single destination. A path is mapped by the mapping
+// with the longest source directory that contains it; paths in no
+// source directory are not mapped.
+type PrefixMap []PrefixMapping
+
+// ParsePrefixMap parses a prefix map from data, which holds one
+// mapping per line, of the form "src -> dst". Blank lines and lines
+// beginning with '#' are ignored. An error is returned if a line is
+// malformed, or if two mappings have the same source or destination
+// directory, as paths could then not be mapped in both directions.
+func ParsePrefixMap(data []byte) (PrefixMap, error) {
+	var (
+		m        PrefixMap
+		src, dst = make(map[string]int), make(map[string]int)
+		scanner  = bufio.NewScanner(bytes.NewReader(data))
+	)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.Split(line, "->")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("line %d: mapping '%s' must be of form src -> dst", n, line)
+		}
+		mapping := PrefixMapping{dirPrefix(parts[0]), dirPrefix(parts[1])}
+		for _, p := range []string{mapping.Src, mapping.Dst} {
+			if p != "" {
+				if err := validatePath(strings.TrimSuffix(p, "/")); err != nil {
+					return nil, fmt.Errorf("line %d: %v", n, err)
+				}
+			}
+		}
+		if prev, ok := src[mapping.Src]; ok {
+			return nil, fmt.Errorf("line %d: source %s is already mapped on line %d", n, mapping.Src, prev)
+		}
+		if prev, ok := dst[mapping.Dst]; ok {
+			return nil, fmt.Errorf("line %d: destination %s is already mapped on line %d", n, mapping.Dst, prev)
+		}
+		src[mapping.Src], dst[mapping.Dst] = n, n
+		m = append(m, mapping)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// dirPrefix returns the directory p, with surrounding spaces removed,
+// as a prefix of the paths it contains.
+func dirPrefix(p string) string {
+	p = strings.Trim(strings.TrimSpace(p), "/")
+	if p == "" {
+		return ""
+	}
+	return p + "/"
+}
+
+// Map returns the destination path of the provided source path, and
+// whether it is mapped.
+func (m PrefixMap) Map(path string) (string, bool) {
+	i := m.match(path, func(mapping PrefixMapping) string { return mapping.Src })
+	if i < 0 {
+		return "", false
+	}
+	return m[i].Dst + strings.TrimPrefix(path, m[i].Src), true
+}
+
+// Unmap returns the source path that is mapped to the provided
+// destination path, and whether there is one.
+func (m PrefixMap) Unmap(path string) (string, bool) {
+	i := m.match(path, func(mapping PrefixMapping) string { return mapping.Dst })
+	if i < 0 {
+		return "", false
+	}
+	src := m[i].Src + strings.TrimPrefix(path, m[i].Dst)
+	// The path may also be in a longer destination directory of
+	// another mapping, in which case the source path maps elsewhere.
+	if dst, ok := m.Map(src); !ok || dst != path {
+		return "", false
+	}
+	return src, true
+}
+
+// Sources returns the source directories of the map, in the order in
+// which they were given.
+func (m PrefixMap) Sources() []string {
+	dirs := make([]string, len(m))
+	for i, mapping := range m {
+		dirs[i] = mapping.Src
+	}
+	return dirs
+}
+
+// match returns the index of the mapping whose directory, as returned
+// by dir, is the longest that contains the provided path, or -1 if
+// there is none.
+func (m PrefixMap) match(path string, dir func(PrefixMapping) string) int {
+	best := -1
+	for i, mapping := range m {
+		if d := dir(mapping); strings.HasPrefix(path, d) && (best < 0 || len(d) > len(dir(m[best]))) {
+			best = i
+		}
+	}
+	return best
+}
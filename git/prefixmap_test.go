@@ -0,0 +1,84 @@
+// Copyright 2018 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package git
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParsePrefixMap(t *testing.T) {
+	m, err := ParsePrefixMap([]byte(`
+# Tools.
+internal/tools/lint -> lint
+ internal/tools/lint/docs/ ->docs
+
+third_party/ext -> /
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := PrefixMap{
+		{"internal/tools/lint/", "lint/"},
+		{"internal/tools/lint/docs/", "docs/"},
+		{"third_party/ext/", ""},
+	}
+	if !reflect.DeepEqual(m, want) {
+		t.Errorf("got %v, want %v", m, want)
+	}
+	for _, c := range []struct {
+		data, err string
+	}{
+		{"a", "line 1: mapping 'a' must be of form src -> dst"},
+		{"a -> b -> c", "must be of form src -> dst"},
+		{"a -> ../b", "line 1: invalid path ../b"},
+		{"a -> b\n\na/ -> c", "line 3: source a/ is already mapped on line 1"},
+		{"a -> b\nc -> b/", "line 2: destination b/ is already mapped on line 1"},
+	} {
+		if _, err := ParsePrefixMap([]byte(c.data)); err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%q: got %v, want error %q", c.data, err, c.err)
+		}
+	}
+}
+
+func TestPrefixMap(t *testing.T) {
+	m := PrefixMap{
+		{"internal/lint/", "lint/"},
+		{"internal/lint/docs/", "docs/"},
+		{"ext/", ""},
+		{"internal/extra/", "lint/extra/"},
+	}
+	for _, c := range []struct {
+		src, dst string
+		ok       bool
+	}{
+		{"internal/lint/main.go", "lint/main.go", true},
+		{"internal/lint/docs/README", "docs/README", true},
+		{"ext/lib.c", "lib.c", true},
+		{"internal/extra/x", "lint/extra/x", true},
+		{"internal/other/x", "", false},
+		{"internal/lintx/x", "", false},
+	} {
+		dst, ok := m.Map(c.src)
+		if dst != c.dst || ok != c.ok {
+			t.Errorf("Map(%s): got %q, %v, want %q, %v", c.src, dst, ok, c.dst, c.ok)
+		}
+		if !ok {
+			continue
+		}
+		if src, ok := m.Unmap(dst); src != c.src || !ok {
+			t.Errorf("Unmap(%s): got %q, %v, want %q, true", dst, src, ok, c.src)
+		}
+	}
+	// The source file would be in internal/lint/docs/, which is mapped
+	// elsewhere.
+	if src, ok := m.Unmap("lint/docs/README"); ok {
+		t.Errorf("Unmap(lint/docs/README): got %q, want none", src)
+	}
+	if got, want := m.Sources(), []string{"internal/lint/", "internal/lint/docs/", "ext/", "internal/extra/"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
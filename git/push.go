@@ -0,0 +1,76 @@
+// Copyright 2018 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package git
+
+import (
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/grailbio/base/log"
+)
+
+// minPushBackoff is the delay before the first retry of a
+// rate-limited push when PushInterval is not set.
+const minPushBackoff = time.Second
+
+// pushThrottle spaces out the pushes of all repositories in the
+// process: next is the earliest time at which the next push may start.
+var pushThrottle struct {
+	sync.Mutex
+	next time.Time
+}
+
+// sleep is time.Sleep, replaced by tests.
+var sleep = time.Sleep
+
+// rateLimitRe matches the error output of git commands that were
+// rejected by the remote's rate limits, such as GitHub's "secondary
+// rate limit" errors and HTTP 429 responses. The status is matched
+// only as git reports it, so that other numbers, such as object
+// counts, do not match.
+var rateLimitRe = regexp.MustCompile(`(?i)rate[ -]limit|too many requests|\b(?:HTTP|status|error:) 429\b`)
+
+// push runs the provided git command, which pushes to a remote, once
+// the repository's PushInterval has elapsed since the start of the
+// last push in the process. The command is retried up to PushRetries
+// times, with exponential backoff, if it is rejected by the remote's
+// rate limits.
+func (r *Repo) push(arg ...string) error {
+	backoff := r.opts.PushInterval
+	if backoff < minPushBackoff {
+		backoff = minPushBackoff
+	}
+	for attempt := 0; ; attempt++ {
+		waitPush(r.opts.PushInterval)
+		_, err := r.git(nil, arg...)
+		if err == nil || attempt >= r.opts.PushRetries || !rateLimitRe.MatchString(err.Error()) {
+			return err
+		}
+		log.Printf("%s: push was rate-limited by the remote: retrying in %s", r, backoff)
+		sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// waitPush waits until the provided interval has elapsed since the
+// start of the last push in the process, and reserves the next slot.
+// Concurrent callers are given successive slots.
+func waitPush(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	pushThrottle.Lock()
+	now := time.Now()
+	start := pushThrottle.next
+	if start.Before(now) {
+		start = now
+	}
+	pushThrottle.next = start.Add(interval)
+	pushThrottle.Unlock()
+	if d := start.Sub(now); d > 0 {
+		sleep(d)
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright 2018 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package git
+
+import (
+	"log"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grailbio/testutil"
+)
+
+// stubSleep replaces sleep with a function that records the requested
+// durations, and returns them and a function that restores sleep.
+func stubSleep() (*[]time.Duration, func()) {
+	var slept []time.Duration
+	sleep = func(d time.Duration) { slept = append(slept, d) }
+	return &slept, func() { sleep = time.Sleep }
+}
+
+func TestWaitPush(t *testing.T) {
+	slept, restore := stubSleep()
+	defer restore()
+	waitPush(0)
+	waitPush(time.Hour)
+	waitPush(time.Hour)
+	waitPush(time.Hour)
+	if got := len(*slept); got != 2 {
+		t.Fatalf("got %d waits, want 2: %v", got, *slept)
+	}
+	// The second and third pushes are given successive slots.
+	for i, want := range []time.Duration{time.Hour, 2 * time.Hour} {
+		if got := (*slept)[i]; got > want || got < want-time.Minute {
+			t.Errorf("wait %d: got %s, want %s", i, got, want)
+		}
+	}
+	pushThrottle.Lock()
+	pushThrottle.next = time.Time{}
+	pushThrottle.Unlock()
+}
+
+func TestRateLimitRe(t *testing.T) {
+	for _, c := range []struct {
+		out  string
+		want bool
+	}{
+		{"remote: You have exceeded a secondary rate limit.", true},
+		{"error: RPC failed; HTTP 429 curl 22 The requested URL returned error: 429", true},
+		{"fatal: unable to access 'https://example.com/': The requested URL returned error: 429", true},
+		{"remote: Too Many Requests", true},
+		{"remote: Resolving deltas: 100% (429/429), done.", false},
+		{"fatal: pack has 429 unresolved deltas", false},
+	} {
+		if got := rateLimitRe.MatchString(c.out); got != c.want {
+			t.Errorf("%q: got %v, want %v", c.out, got, c.want)
+		}
+	}
+}
+
+func TestPushRateLimit(t *testing.T) {
+	dir, cleanup := testutil.TempDir(t, "", "")
+	if *nocleanup {
+		log.Println("directory", dir)
+	} else {
+		defer cleanup()
+	}
+	// The remote rejects a push, as rate-limited or denied, if the
+	// file named by the rejection exists; it is removed by the push.
+	shell(t, dir, `
+		git init --bare repo
+		cat > repo/hooks/pre-receive <<'EOF'
+#!/bin/sh
+if [ -e limited ]; then
+	rm limited
+	echo "remote: You have exceeded a secondary rate limit." >&2
+	exit 1
+fi
+if [ -e denied ]; then
+	rm denied
+	echo "remote: permission denied" >&2
+	exit 1
+fi
+EOF
+		chmod +x repo/hooks/pre-receive
+		git clone repo checkout
+		cd checkout
+		git config user.email you@example.com
+		git config user.name "your name"
+		echo test > file
+		git add .
+		git commit -m'first commit'
+		git push
+	`)
+	url := filepath.Join(dir, "repo")
+	repo, err := Open(url, "", "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+	shell(t, repo.Root(), `
+		echo change > file
+		git -c user.email=you@example.com -c user.name=name commit -a -m'second commit'
+	`)
+	slept, restore := stubSleep()
+	defer restore()
+
+	shell(t, url, "touch limited")
+	if err := repo.Push("origin", "master"); err == nil || !strings.Contains(err.Error(), "secondary rate limit") {
+		t.Fatalf("got %v, want rate limit error", err)
+	}
+	if len(*slept) != 0 {
+		t.Errorf("got waits %v, want none without retries", *slept)
+	}
+	repo.opts.PushRetries = 2
+	shell(t, url, "touch denied")
+	if err := repo.Push("origin", "master"); err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Fatalf("got %v, want permission error", err)
+	}
+	if len(*slept) != 0 {
+		t.Errorf("got waits %v, want none for errors other than rate limits", *slept)
+	}
+	shell(t, url, "touch limited")
+	if err := repo.Push("origin", "master"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := *slept, []time.Duration{minPushBackoff}; len(got) != 1 || got[0] != want[0] {
+		t.Errorf("got waits %v, want %v", got, want)
+	}
+}
+
+func TestVerifyPush(t *testing.T) {
+	dir, cleanup := testutil.TempDir(t, "", "")
+	if *nocleanup {
+		log.Println("directory", dir)
+	} else {
+		defer cleanup()
+	}
+	shell(t, dir, `
+		git init --bare repo
+		git clone repo checkout
+		cd checkout
+		git config user.email you@example.com
+		git config user.name "your name"
+		echo test > file
+		git add .
+		git commit -m'first commit'
+		git push
+		cd ..
+		git clone --bare repo elsewhere
+	`)
+	repo, err := OpenWithOptions(filepath.Join(dir, "repo"), "", "master", Options{VerifyPush: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+	commit := func(msg string) {
+		shell(t, repo.Root(), `
+			echo "`+msg+`" >> file
+			git -c user.email=you@example.com -c user.name=name commit -a -m"`+msg+`"
+		`)
+	}
+	commit("second commit")
+	if err := repo.Push("origin", "master"); err != nil {
+		t.Fatal(err)
+	}
+	// Pushes that go elsewhere succeed, but do not update the branch.
+	repo.Configure("remote.origin.pushurl", filepath.Join(dir, "elsewhere"))
+	commit("third commit")
+	err = repo.Push("origin", "master")
+	if err == nil || !strings.Contains(err.Error(), "not at the pushed") {
+		t.Fatalf("got %v, want verification error", err)
+	}
+	repo.opts.VerifyPush = false
+	if err := repo.Push("origin", "master"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -18,11 +18,16 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"mime"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 	"unicode"
 
 	"github.com/grailbio/base/digest"
@@ -57,223 +62,2319 @@ type Repo struct {
 	prefix string
 	lock   *flock.T
 	config map[string]string
+	opts   Options
+	// readOnly is set for repositories opened with OpenLocal.
+	readOnly bool
+	// scratch is set for repositories created by Scratch and
+	// Worktree.
+	scratch bool
+	// worktreeOf is the repository of which this one is a linked
+	// worktree, if it was created by Worktree.
+	worktreeOf *Repo
+	// sshKeyFile is the temporary file holding opts.SSHKey, if any.
+	sshKeyFile string
 }
 
+// ErrReadOnly is returned by operations that would modify a
+// repository opened with OpenLocal.
+var ErrReadOnly = errors.New("repository is read-only")
+
+// Options controls optional repository behavior.
+type Options struct {
+	// DetectRenames enables rename detection when producing patches.
+	// Renames across the repository's prefix boundary are represented
+	// as additions or deletions.
+	DetectRenames bool
+	// NoLFS disables Git LFS support: the repository's LFS objects
+	// are never pushed or smudged, and git-lfs need not be installed.
+	NoLFS bool
+	// Timeout bounds the duration of each git command issued on the
+	// repository. Commands that exceed it are killed. If zero, commands
+	// are not bounded.
+	Timeout time.Duration
+	// Config holds git configuration parameters that are passed to
+	// every git command issued on the repository, including those that
+	// clone and fetch it in Open. This is useful for parameters, such
+	// as http.proxy and http.sslCAInfo, that are needed to reach the
+	// remote. Parameters set by Configure take precedence.
+	Config map[string]string
+	// FastForward makes Open update an existing checkout by
+	// fast-forwarding it to the remote branch, instead of resetting
+	// it. Open then fails if the checkout has diverged from the
+	// remote, e.g., because it has commits that were applied but not
+	// pushed, rather than silently discarding them.
+	FastForward bool
+	// SSHKey is an SSH private key with which to authenticate to the
+	// remote. It is written to a temporary file, which is used by
+	// every git command issued on the repository, including those in
+	// Open, and which is removed when the repository is closed. This
+	// allows deploy keys to be used without provisioning ~/.ssh.
+	SSHKey string
+	// TopoOrder makes Log list commits in topological order, so that
+	// no parent is listed before all of its children, rather than in
+	// git's default order by commit date, which may interleave the
+	// commits of concurrent lines of history.
+	TopoOrder bool
+	// Context is the number of context lines with which patches are
+	// produced, in place of git's default of 3. More context helps
+	// patches apply to the intended location when the destination
+	// has changed nearby, at the cost of larger patches.
+	Context int
+	// FunctionContext makes patches include the whole function
+	// surrounding each change as context, as determined by git's
+	// function-name heuristics, in addition to Context lines.
+	FunctionContext bool
+	// PartialClone makes Open clone the repository without blobs
+	// (git clone --filter=blob:none), so that only commits and trees
+	// are downloaded up front. Blobs are fetched from the remote as
+	// they are needed, e.g., when the branch is checked out or Patch
+	// produces diffs, so that large historical blobs that are never
+	// copied are never downloaded. The remote must support partial
+	// clone. Existing checkouts are unaffected.
+	PartialClone bool
+	// SparseCheckout limits the working tree of the repository's
+	// checkout to its prefix, using git's cone-mode sparse checkout,
+	// so that files outside of the prefix are never written, and,
+	// with PartialClone, their blobs never fetched. Files in the
+	// prefix's parent directories are also checked out. Patches and
+	// LFS pointers are read from the repository's objects, so they
+	// are unaffected. Existing checkouts are made sparse, or restored
+	// to full checkouts, as the option requires. It has no effect if
+	// the prefix is empty.
+	SparseCheckout bool
+	// Whitespace is the action, one of WhitespaceModes, with which
+	// whitespace errors, such as trailing whitespace, in applied
+	// patches are handled (git am --whitespace). For example, "fix"
+	// corrects them, so that the applied content differs from the
+	// patch's. If empty, git's default, which applies patches as they
+	// are, is used.
+	Whitespace string
+	// KeepConflicts leaves the am session of a patch that fails to
+	// apply in progress, rather than aborting it, so that its
+	// conflicts may be resolved in the checkout and the session
+	// concluded with ContinueApply, SkipApply, or AbortApply. Where
+	// the three-way merge attempted by Apply fails, the conflicting
+	// files hold conflict markers.
+	KeepConflicts bool
+	// AllBranches makes Open clone all of the remote's branches,
+	// rather than only the repository's branch, and fetch them
+	// whenever it updates the checkout, so that they are available
+	// as remote-tracking branches (refs/remotes/origin/*), e.g., to
+	// Worktree and Log. By default, only the repository's branch is
+	// cloned and fetched, which is faster for large remotes.
+	AllBranches bool
+	// FetchRefspecs are additional refspecs, such as
+	// "+refs/tags/*:refs/tags/*", that Open fetches from the remote
+	// whenever it clones or updates the checkout, so that the refs
+	// they name are available without a second clone.
+	FetchRefspecs []string
+	// PushInterval is the minimum interval between the starts of
+	// successive pushes (by Push, PushRef, PushTags, and PushNotes)
+	// of all repositories in the process, so that many mirrors run
+	// by one process do not trip the secondary rate limits of a
+	// remote such as GitHub. If zero, pushes are not spaced out.
+	PushInterval time.Duration
+	// PushRetries is the number of times that a push rejected by the
+	// remote's rate limits, as recognized by its error output (e.g.,
+	// "rate limit exceeded" or HTTP 429), is retried. Retries back off
+	// exponentially, starting at PushInterval or a second, whichever
+	// is longer. Other push failures are not retried.
+	PushRetries int
+	// PrefixMap maps files from several source directories to
+	// different destination directories, in place of the single
+	// prefix of the repository, which must be empty. Log lists the
+	// commits that change the map's source directories, and Patch
+	// maps the paths of their diffs, relative to the destination
+	// prefix, dropping diffs of files that are not mapped.
+	PrefixMap PrefixMap
+	// VerifyPush makes Push confirm, after pushing, that the remote
+	// branch is at the repository's HEAD, and fail if it is not. This
+	// catches pushes that a proxy, or the remote itself, reports as
+	// successful although the branch was not updated.
+	VerifyPush bool
+}
+
+// WhitespaceModes are the valid values of Options.Whitespace.
+var WhitespaceModes = []string{"nowarn", "warn", "fix", "error", "error-all"}
+
+// errPrefixMap is returned when a repository is opened with both a
+// prefix and a prefix map.
+var errPrefixMap = errors.New("a prefix map cannot be used with a prefix")
+
 // Open returns a repo representing the provided git remote url, branch, and
-// prefix within the repository. The prefix is interpreted to provide
+// prefix within the repository. If branch is empty, the remote's
+// default branch is used. The prefix is interpreted to provide
 // a "view" into the git repository: all operations apply only to
 // this prefix. Repositories are safe for concurrent operations
-// across multiple uses on the same machine.
+// across multiple uses on the same machine. Each branch of a
+// repository is given its own checkout and lock, so that distinct
+// branches of the same repository may be operated on concurrently.
 func Open(url, prefix, branch string) (*Repo, error) {
+	return OpenWithOptions(url, prefix, branch, Options{})
+}
+
+// OpenWithOptions is like Open, but configures the repository with
+// the provided options.
+func OpenWithOptions(url, prefix, branch string, opts Options) (*Repo, error) {
+	if prefix != "" && len(opts.PrefixMap) > 0 {
+		return nil, errPrefixMap
+	}
+	if opts.SSHKey == "" {
+		return open(url, prefix, branch, opts, "")
+	}
+	keyFile, err := writeSSHKey(opts.SSHKey)
+	if err != nil {
+		return nil, err
+	}
+	r, err := open(url, prefix, branch, opts, keyFile)
+	if err != nil {
+		os.Remove(keyFile)
+		return nil, err
+	}
+	return r, nil
+}
+
+// writeSSHKey writes the provided SSH private key to a new temporary
+// file, returning its path. Like all files created by
+// ioutil.TempFile, it is readable only by its owner, as ssh requires.
+func writeSSHKey(key string) (string, error) {
+	f, err := ioutil.TempFile("", "grit-ssh-key")
+	if err != nil {
+		return "", err
+	}
+	// OpenSSH refuses keys that do not end in a newline.
+	if !strings.HasSuffix(key, "\n") {
+		key += "\n"
+	}
+	_, err = f.WriteString(key)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("write ssh key: %v", err)
+	}
+	return f.Name(), nil
+}
+
+func open(url, prefix, branch string, opts Options, sshKeyFile string) (*Repo, error) {
+	os.MkdirAll(Dir, 0700)
+	if branch == "" {
+		var err error
+		branch, err = defaultBranch(url, opts, sshKeyFile)
+		if err != nil {
+			return nil, err
+		}
+	}
 	base := filepath.Base(url)
 	base = strings.TrimSuffix(base, filepath.Ext(base))
 	h := sha256.New()
 	h.Write([]byte(url))
+	h.Write([]byte{0})
+	h.Write([]byte(branch))
 	b := h.Sum(nil)
-	os.MkdirAll(Dir, 0700)
 	path := filepath.Join(Dir, fmt.Sprintf("%s%02x%02x%02x%02x", base, b[0], b[1], b[2], b[3]))
 	_, err := os.Stat(path)
 	if err != nil && !os.IsNotExist(err) {
 		return nil, err
 	}
-	r := &Repo{url: url, root: path, prefix: prefix, branch: branch}
-	r.lock = flock.New(path + ".lock")
-	if err := r.lock.Lock(context.Background()); err != nil {
-		return nil, fmt.Errorf("lock %s: %v", path, err)
+	r := &Repo{url: url, root: path, prefix: prefix, branch: branch, opts: opts, sshKeyFile: sshKeyFile}
+	r.lock = flock.New(path + ".lock")
+	if err := r.lock.Lock(context.Background()); err != nil {
+		return nil, fmt.Errorf("lock %s: %v", path, err)
+	}
+	cloned := err != nil
+	if cloned {
+		os.MkdirAll(path, 0777)
+		args := []string{"clone"}
+		if !opts.AllBranches {
+			args = append(args, "--single-branch")
+		}
+		if opts.PartialClone {
+			args = append(args, "--filter=blob:none")
+		}
+		if r.sparse() {
+			// The branch is checked out sparsely below.
+			args = append(args, "--no-checkout")
+		}
+		if _, err := r.git(nil, append(args, r.url, r.root)...); err != nil {
+			return nil, err
+		}
+		if err := r.sparseCheckout(true); err != nil {
+			return nil, err
+		}
+	}
+	refspecs := opts.FetchRefspecs
+	if opts.AllBranches {
+		refspecs = append([]string{"+refs/heads/*:refs/remotes/origin/*"}, refspecs...)
+	}
+	if len(refspecs) > 0 {
+		if _, err := r.git(nil, append([]string{"fetch", "origin"}, refspecs...)...); err != nil {
+			return nil, err
+		}
+	}
+	// The branch is fetched last, so that it is FETCH_HEAD.
+	if _, err := r.git(nil, "fetch", "origin", branch); err != nil {
+		return nil, err
+	}
+	// Clear potentially interrupted run.
+	if !cloned {
+		if err := r.Clean(); err != nil {
+			r.lock.Unlock()
+			return nil, err
+		}
+		if err := r.sparseCheckout(false); err != nil {
+			r.lock.Unlock()
+			return nil, err
+		}
+		resumed, err := r.resume()
+		if err != nil {
+			r.lock.Unlock()
+			return nil, err
+		}
+		if resumed {
+			return r, nil
+		}
+	}
+	// A fresh clone has nothing to lose, and may have checked out
+	// the remote's default branch rather than branch.
+	if !opts.FastForward || cloned {
+		if _, err := r.git(nil, "reset", "--hard", "FETCH_HEAD"); err != nil {
+			return nil, err
+		}
+		return r, nil
+	}
+	if _, err := r.git(nil, "merge", "--ff-only", "FETCH_HEAD"); err != nil {
+		r.lock.Unlock()
+		return nil, fmt.Errorf("%s: checkout %s has diverged from branch %s: %v", url, path, branch, err)
+	}
+	return r, nil
+}
+
+// sparse tells whether the repository's checkout is limited to its
+// prefix.
+func (r *Repo) sparse() bool {
+	return r.opts.SparseCheckout && r.prefix != ""
+}
+
+// sparseCheckout limits the repository's working tree to its prefix if
+// the SparseCheckout option is set. Otherwise, unless the checkout was
+// just cloned, it restores the full working tree if it was limited.
+func (r *Repo) sparseCheckout(cloned bool) error {
+	if r.sparse() {
+		_, err := r.git(nil, "sparse-checkout", "set", "--cone", "--", strings.TrimSuffix(r.prefix, "/"))
+		return err
+	}
+	if cloned {
+		return nil
+	}
+	// git config fails if the variable is not set.
+	if out, err := r.git(nil, "config", "--bool", "core.sparseCheckout"); err != nil || string(bytes.TrimSpace(out)) != "true" {
+		return nil
+	}
+	_, err := r.git(nil, "sparse-checkout", "disable")
+	return err
+}
+
+// OpenLocal returns a read-only repo representing the existing local
+// working tree at path, limited to the provided prefix. Unlike Open,
+// OpenLocal does not make a managed copy of the repository, and so
+// the working tree must have the provided branch checked out; if
+// branch is empty, the checked-out branch is used. Operations that
+// modify the repository, such as Apply and Push, return ErrReadOnly.
+func OpenLocal(path, prefix, branch string) (*Repo, error) {
+	return OpenLocalWithOptions(path, prefix, branch, Options{})
+}
+
+// OpenLocalWithOptions is like OpenLocal, but configures the
+// repository with the provided options.
+func OpenLocalWithOptions(path, prefix, branch string, opts Options) (*Repo, error) {
+	if prefix != "" && len(opts.PrefixMap) > 0 {
+		return nil, errPrefixMap
+	}
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	r := &Repo{url: path, root: path, prefix: prefix, opts: opts, readOnly: true}
+	top, err := r.git(nil, "rev-parse", "--show-toplevel")
+	if err != nil {
+		return nil, err
+	}
+	if top := string(bytes.TrimSpace(top)); top != path {
+		return nil, fmt.Errorf("%s is not the root of a working tree (%s is)", path, top)
+	}
+	head, err := r.git(nil, "symbolic-ref", "--short", "HEAD")
+	if err != nil {
+		return nil, fmt.Errorf("%s: no branch is checked out: %v", path, err)
+	}
+	r.branch = string(bytes.TrimSpace(head))
+	if branch != "" && branch != r.branch {
+		return nil, fmt.Errorf("%s: branch %s is checked out, not %s", path, r.branch, branch)
+	}
+	return r, nil
+}
+
+// defaultBranch returns the name of the default branch of the remote
+// repository at url, as named by its HEAD.
+func defaultBranch(url string, opts Options, sshKeyFile string) (string, error) {
+	// The repository has not yet been cloned, so run git in Dir.
+	r := &Repo{url: url, root: Dir, opts: opts, sshKeyFile: sshKeyFile}
+	out, err := r.git(nil, "ls-remote", "--symref", url, "HEAD")
+	if err != nil {
+		return "", err
+	}
+	// The symbolic ref is reported as "ref: refs/heads/<branch>\tHEAD".
+	for out != nil {
+		line := scanLine(&out)
+		if !bytes.HasPrefix(line, []byte("ref: ")) {
+			continue
+		}
+		fields := bytes.Fields(line[5:])
+		if len(fields) == 2 && string(fields[1]) == "HEAD" && bytes.HasPrefix(fields[0], []byte("refs/heads/")) {
+			return string(bytes.TrimPrefix(fields[0], []byte("refs/heads/"))), nil
+		}
+	}
+	return "", fmt.Errorf("%s: cannot determine default branch", url)
+}
+
+// Prefix returns the prefix within the repository, as specified in Open.
+func (r *Repo) Prefix() string {
+	return r.prefix
+}
+
+// Branch returns the repository's branch: either the branch specified
+// in Open, or the remote's default branch.
+func (r *Repo) Branch() string {
+	return r.branch
+}
+
+// Root returns the path of the repository's local checkout.
+func (r *Repo) Root() string {
+	return r.root
+}
+
+func (r *Repo) String() string {
+	return fmt.Sprintf("%s,%s,%s", r.url, r.prefix, r.branch)
+}
+
+// Close relinquishes the repo's lock. Repo operations may not
+// be safely performed after the repository has been closed.
+// Scratch repositories are removed, as are SSH key files.
+func (r *Repo) Close() error {
+	if r.sshKeyFile != "" {
+		os.Remove(r.sshKeyFile)
+	}
+	if r.worktreeOf != nil {
+		if err := os.RemoveAll(r.root); err != nil {
+			return err
+		}
+		_, err := r.worktreeOf.git(nil, "worktree", "prune")
+		return err
+	}
+	if r.scratch {
+		return os.RemoveAll(r.root)
+	}
+	if r.lock == nil {
+		return nil
+	}
+	return r.lock.Unlock()
+}
+
+// Scratch returns a throwaway copy of the repository's current state,
+// with the same prefix, branch, options, and configuration. Changes
+// made to the scratch repository do not affect r, and it cannot be
+// pushed. The scratch repository's checkout is removed when it is
+// closed. The scratch repository shares objects with r, and so may
+// not be used after r is closed.
+func (r *Repo) Scratch() (*Repo, error) {
+	root, err := ioutil.TempDir("", "grit-scratch")
+	if err != nil {
+		return nil, err
+	}
+	s := &Repo{url: r.url, root: root, prefix: r.prefix, branch: r.branch, opts: r.opts, scratch: true}
+	for k, v := range r.config {
+		s.Configure(k, v)
+	}
+	if _, err := r.git(nil, "clone", "--quiet", "--shared", "--no-checkout", r.root, root); err != nil {
+		os.RemoveAll(root)
+		return nil, err
+	}
+	if err := s.sparseCheckout(true); err != nil {
+		os.RemoveAll(root)
+		return nil, err
+	}
+	// Check out the state of r, which may include unpushed commits.
+	head, err := r.HeadDigest()
+	if err != nil {
+		os.RemoveAll(root)
+		return nil, err
+	}
+	if _, err := s.git(nil, "checkout", "--quiet", "-B", r.branch, head.Hex()); err != nil {
+		os.RemoveAll(root)
+		return nil, err
+	}
+	return s, nil
+}
+
+// Worktree returns a linked worktree of the repository's checkout, in
+// which HEAD is detached at the tip of the named branch: if branch is
+// empty or is r's branch, at r's HEAD, which may include unpushed
+// commits, and otherwise at the remote's branch, which is fetched. The
+// worktree has the same prefix, options, and configuration as r, and
+// shares its objects, so that it is cheaper to create than a scratch
+// copy; like one, it cannot be pushed, changes made to it do not
+// affect r's checkout, and it is removed when it is closed. The
+// worktree may not be used after r is closed.
+func (r *Repo) Worktree(branch string) (*Repo, error) {
+	if r.readOnly {
+		return nil, ErrReadOnly
+	}
+	if branch == "" {
+		branch = r.branch
+	}
+	rev := "HEAD"
+	if branch != r.branch {
+		rev = "refs/remotes/origin/" + branch
+		if _, err := r.git(nil, "fetch", "origin", "+refs/heads/"+branch+":"+rev); err != nil {
+			return nil, err
+		}
+	}
+	id, err := r.RevParse(rev)
+	if err != nil {
+		return nil, err
+	}
+	root, err := ioutil.TempDir("", "grit-worktree")
+	if err != nil {
+		return nil, err
+	}
+	w := &Repo{url: r.url, root: root, prefix: r.prefix, branch: branch, opts: r.opts, scratch: true, worktreeOf: r}
+	for k, v := range r.config {
+		w.Configure(k, v)
+	}
+	if _, err := r.git(nil, "worktree", "add", "--quiet", "--detach", "--no-checkout", root, id.Hex()); err != nil {
+		os.RemoveAll(root)
+		return nil, err
+	}
+	if err := w.sparseCheckout(true); err != nil {
+		w.Close()
+		return nil, err
+	}
+	if _, err := w.git(nil, "reset", "--quiet", "--hard"); err != nil {
+		w.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// Clean restores the repository's checkout to its HEAD commit,
+// clearing the state left by an interrupted run: it aborts any git am,
+// rebase, or merge in progress, discards uncommitted changes, and
+// removes untracked files, including ignored ones such as leftover
+// .rej files. Commits that were applied but not pushed are kept. Open
+// cleans existing checkouts, so that a wedged checkout does not fail
+// later runs. Clean operates only on the managed checkout: it returns
+// ErrReadOnly for local repositories, and fails if the checkout is not
+// the root of its own working tree.
+func (r *Repo) Clean() error {
+	if r.readOnly {
+		return ErrReadOnly
+	}
+	// Otherwise git would operate on an enclosing working tree.
+	top, err := r.git(nil, "rev-parse", "--show-toplevel")
+	if err != nil {
+		return err
+	}
+	// The root may be reached through symbolic links, e.g., /var on
+	// macOS; git reports the resolved path.
+	root, err := filepath.EvalSymlinks(r.root)
+	if err != nil {
+		return err
+	}
+	if top := string(bytes.TrimSpace(top)); top != root {
+		return fmt.Errorf("%s is not the root of a working tree (%s is): not cleaning", r.root, top)
+	}
+	for _, op := range []string{"am", "rebase", "merge"} {
+		// Aborting fails unless the operation is in progress, and
+		// also if no committer identity is configured, in which case
+		// a placeholder is used; git records it only in the reflog.
+		if _, err := r.git(nil, op, "--abort"); err != nil {
+			_, _ = r.gitEnv([]string{"GIT_COMMITTER_NAME=grit", "GIT_COMMITTER_EMAIL=grit@localhost"}, nil, op, "--abort")
+		}
+	}
+	if _, err := r.git(nil, "reset", "--hard", "HEAD"); err != nil {
+		return err
+	}
+	_, err = r.git(nil, "clean", "-fdx")
+	return err
+}
+
+// journalFile returns the path of the checkout's progress journal. It
+// is kept in the git directory, so that it is not part of the working
+// tree, and is not removed by Clean.
+func (r *Repo) journalFile() string {
+	return filepath.Join(r.root, ".git", "grit-journal")
+}
+
+// WriteJournal records in the checkout's progress journal that the
+// commits up to and including the source commit named by id have been
+// applied, at the repository's current HEAD, but not yet pushed. If a
+// run is interrupted, Open resumes from the journal: it restores the
+// checkout to the recorded commit, keeping the unpushed commits,
+// instead of resetting it to the remote branch. The journal should be
+// cleared with ClearJournal once the commits have been pushed.
+func (r *Repo) WriteJournal(id string) error {
+	if r.readOnly {
+		return ErrReadOnly
+	}
+	head, err := r.HeadDigest()
+	if err != nil {
+		return err
+	}
+	// Write the journal atomically, so that an interrupted write does
+	// not leave a truncated journal behind.
+	tmp := r.journalFile() + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(head.Hex()+" "+id+"\n"), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.journalFile())
+}
+
+// Journal returns the source commit ID last recorded by WriteJournal,
+// or "" if the checkout's progress journal is empty.
+func (r *Repo) Journal() (string, error) {
+	_, id, err := r.readJournal()
+	return id, err
+}
+
+// ClearJournal clears the checkout's progress journal.
+func (r *Repo) ClearJournal() error {
+	if r.readOnly {
+		return ErrReadOnly
+	}
+	if err := os.Remove(r.journalFile()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// readJournal returns the destination commit and source commit ID
+// recorded in the checkout's progress journal, if any.
+func (r *Repo) readJournal() (head, id string, err error) {
+	b, err := ioutil.ReadFile(r.journalFile())
+	if os.IsNotExist(err) {
+		return "", "", nil
+	}
+	if err != nil {
+		return "", "", err
+	}
+	fields := strings.Fields(string(b))
+	if len(fields) != 2 {
+		return "", "", fmt.Errorf("%s: invalid journal %q", r.journalFile(), b)
+	}
+	return fields[0], fields[1], nil
+}
+
+// resume restores the checkout to the commit recorded in its progress
+// journal, if any, and tells whether it did. Commits applied after the
+// journal was last written, whose processing may not have completed,
+// are discarded. If the recorded commit does not contain the fetched
+// remote branch, FETCH_HEAD, the remote has diverged and the unpushed
+// commits could not be pushed; they are discarded, and the journal is
+// cleared.
+func (r *Repo) resume() (bool, error) {
+	head, id, err := r.readJournal()
+	if err != nil || head == "" {
+		return false, err
+	}
+	if _, err := r.git(nil, "merge-base", "--is-ancestor", "FETCH_HEAD", head); err != nil {
+		log.Printf("%s: branch %s has diverged from the commits applied by an interrupted run; discarding them", r.url, r.branch)
+		return false, r.ClearJournal()
+	}
+	if _, err := r.git(nil, "reset", "--hard", head); err != nil {
+		return false, err
+	}
+	log.Printf("%s: resuming interrupted run: commits up to source commit %s were applied but not pushed", r.url, id)
+	return true, nil
+}
+
+// Linearize linearizes the repository's history.
+func (r *Repo) Linearize() error {
+	if r.readOnly {
+		return ErrReadOnly
+	}
+	_, err := r.git(nil, "filter-branch", "-f", "--parent-filter", `cut -f 2,3 -d " "`)
+	return err
+}
+
+// Branches returns the names of the branches in the repository's
+// remote that match the provided glob pattern, as interpreted by
+// path.Match.
+func (r *Repo) Branches(pattern string) ([]string, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("invalid branch pattern %s: %v", pattern, err)
+	}
+	out, err := r.git(nil, "ls-remote", "--heads", "origin")
+	if err != nil {
+		return nil, err
+	}
+	var branches []string
+	for out != nil {
+		fields := bytes.Fields(scanLine(&out))
+		if len(fields) != 2 {
+			continue
+		}
+		name := strings.TrimPrefix(string(fields[1]), "refs/heads/")
+		if ok, _ := path.Match(pattern, name); ok {
+			branches = append(branches, name)
+		}
+	}
+	return branches, nil
+}
+
+// HeadDigest returns the digest of the repository's HEAD commit.
+func (r *Repo) HeadDigest() (digest.Digest, error) {
+	return r.RevParse("HEAD")
+}
+
+// RevParse returns the digest of the commit named by rev, which may be
+// any revision that git rev-parse accepts: e.g., a hash, a branch, a
+// tag, which is peeled to the commit it refers to, or an expression
+// such as "HEAD^". An *UnknownRevisionError is returned if rev does
+// not name a commit in the repository.
+func (r *Repo) RevParse(rev string) (digest.Digest, error) {
+	out, err := r.git(nil, "rev-parse", "--verify", "--quiet", "--end-of-options", rev+"^{commit}")
+	if err != nil {
+		// With --quiet, git exits with status 1 only if rev is not
+		// a valid commit, though it may still print warnings, e.g.,
+		// about ambiguous refnames.
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+			return digest.Digest{}, &UnknownRevisionError{Rev: rev}
+		}
+		return digest.Digest{}, err
+	}
+	return SHA1.Parse(string(bytes.TrimSpace(out)))
+}
+
+// UnknownRevisionError is returned by RevParse when a revision does
+// not name a commit in the repository.
+type UnknownRevisionError struct {
+	// Rev is the revision that could not be resolved.
+	Rev string
+}
+
+func (e *UnknownRevisionError) Error() string {
+	return fmt.Sprintf("unknown revision %s", e.Rev)
+}
+
+// SignatureStatus returns the status of the GPG signature of the
+// commit named by rev, as given by git's "%G?" log format: 'G' for a
+// good signature, 'U' for a good signature from a key of unknown
+// validity, 'N' for no signature, and 'B', 'X', 'Y', 'R', or 'E' for a
+// bad signature, an expired signature, a signature by an expired or
+// revoked key, or one that cannot be checked, e.g., because the key is
+// missing. As with git verify-commit, signatures are checked against
+// the keyring of the user running git.
+func (r *Repo) SignatureStatus(rev string) (byte, error) {
+	out, err := r.git(nil, "log", "-1", "--format=%G?", rev)
+	if err != nil {
+		return 0, err
+	}
+	out = bytes.TrimSpace(out)
+	if len(out) != 1 {
+		return 0, fmt.Errorf("%s: unexpected signature status %q", rev, out)
+	}
+	return out[0], nil
+}
+
+// Signature returns the signature of the commit named by rev, as
+// armored in the commit's gpgsig header, and its signer, as reported
+// by git: the signer's name and email, if the signing key is in the
+// keyring of the user running git, or otherwise the key's ID. The
+// signature is nil if the commit is unsigned.
+func (r *Repo) Signature(rev string) (signer string, sig []byte, err error) {
+	obj, err := r.git(nil, "cat-file", "commit", rev)
+	if err != nil {
+		return "", nil, err
+	}
+	var b bytes.Buffer
+	for inSig := false; obj != nil; {
+		line := scanLine(&obj)
+		if len(line) == 0 {
+			// The headers end with a blank line.
+			break
+		}
+		switch {
+		case bytes.HasPrefix(line, []byte("gpgsig ")):
+			inSig = true
+			line = line[len("gpgsig "):]
+		case inSig && line[0] == ' ':
+			// Continuation lines are indented by a space.
+			line = line[1:]
+		default:
+			inSig = false
+			continue
+		}
+		b.Write(line)
+		b.WriteByte('\n')
+	}
+	if b.Len() == 0 {
+		return "", nil, nil
+	}
+	out, err := r.git(nil, "log", "-1", "--format=%GS%n%GK", rev)
+	if err != nil {
+		return "", nil, err
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			signer = line
+			break
+		}
+	}
+	return signer, b.Bytes(), nil
+}
+
+// Contains tells whether the commit named by rev is in the history
+// of the repository's HEAD. It returns false if the repository does
+// not have the commit at all, e.g., because the remote's history was
+// rewritten before the repository was cloned.
+func (r *Repo) Contains(rev string) (bool, error) {
+	if _, err := r.git(nil, "cat-file", "-e", rev+"^{commit}"); err != nil {
+		return false, nil
+	}
+	// The commit is in HEAD's history if no commits are reachable
+	// from it but not from HEAD.
+	out, err := r.git(nil, "rev-list", "-1", rev, "^HEAD")
+	if err != nil {
+		return false, err
+	}
+	return len(bytes.TrimSpace(out)) == 0, nil
+}
+
+// MergeBase returns the best common ancestor of the commits named by
+// a and b. An error is returned if the commits have no common
+// ancestor.
+func (r *Repo) MergeBase(a, b string) (digest.Digest, error) {
+	out, err := r.git(nil, "merge-base", a, b)
+	if err != nil {
+		return digest.Digest{}, err
+	}
+	return SHA1.Parse(string(bytes.TrimSpace(out)))
+}
+
+// A Tag is a git tag.
+type Tag struct {
+	// Name is the tag's name, without the refs/tags/ prefix.
+	Name string
+	// Commit is the commit to which the tag refers.
+	Commit digest.Digest
+	// Message is the annotated tag's message; it is empty for
+	// lightweight tags.
+	Message string
+}
+
+// Tags returns the repository's tags that refer to commits. Tags are
+// fetched by Open only if they refer to commits on the repository's
+// branch.
+func (r *Repo) Tags() ([]Tag, error) {
+	// Records are terminated by a NUL and a newline, since tag
+	// messages may span multiple lines.
+	out, err := r.git(nil, "for-each-ref",
+		"--format=%(refname:strip=2)%00%(objecttype)%00%(objectname)%00%(*objecttype)%00%(*objectname)%00%(contents)%00",
+		"refs/tags")
+	if err != nil {
+		return nil, err
+	}
+	var tags []Tag
+	for _, record := range bytes.Split(out, []byte("\x00\n")) {
+		if len(record) == 0 {
+			continue
+		}
+		fields := strings.SplitN(string(record), "\x00", 6)
+		if len(fields) != 6 {
+			return nil, fmt.Errorf("invalid tag record %q", record)
+		}
+		tag := Tag{Name: fields[0]}
+		id := fields[2]
+		switch {
+		case fields[1] == "commit":
+		case fields[1] == "tag" && fields[3] == "commit":
+			id = fields[4]
+			tag.Message = fields[5]
+		default:
+			log.Debug.Printf("%s: tag %s does not refer to a commit: skipping", r, tag.Name)
+			continue
+		}
+		if tag.Commit, err = SHA1.Parse(id); err != nil {
+			return nil, fmt.Errorf("tag %s: invalid commit %s: %v", tag.Name, id, err)
+		}
+		tags = append(tags, tag)
+	}
+	return tags, nil
+}
+
+// FetchTags fetches all of the tags in the repository's remote, and
+// the commits to which they refer, replacing local tags of the same
+// names, e.g., tags that were moved in the remote, and removing local
+// tags that the remote no longer has. Since repositories opened by
+// OpenLocal are read in place, FetchTags leaves their tags as is.
+func (r *Repo) FetchTags() error {
+	if r.readOnly {
+		return nil
+	}
+	_, err := r.git(nil, "fetch", "--prune", "--no-tags", "origin", "+refs/tags/*:refs/tags/*")
+	return err
+}
+
+// TagState fetches from the repository's remote the tag state recorded
+// in ref by SetTagState, and returns it: the source commits from which
+// tags were mirrored, by tag name. The state is empty if the remote
+// has no ref.
+func (r *Repo) TagState(ref string) (map[string]digest.Digest, error) {
+	out, err := r.fetchState(ref)
+	if err != nil {
+		return nil, err
+	}
+	state := make(map[string]digest.Digest)
+	for out != nil {
+		fields := strings.Fields(string(scanLine(&out)))
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s: invalid tag state %q", ref, strings.Join(fields, " "))
+		}
+		id, err := SHA1.Parse(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s: tag %s: invalid commit %s: %v", ref, fields[0], fields[1], err)
+		}
+		state[fields[0]] = id
+	}
+	return state, nil
+}
+
+// SetTagState records the provided tag state, as returned by TagState,
+// in ref. The state is recorded in the message of a commit with an
+// empty tree, whose parent is the previously recorded state, so that
+// the ref is updated by fast-forwarding it. The ref is pushed by
+// PushRef.
+func (r *Repo) SetTagState(ref string, state map[string]digest.Digest) error {
+	names := make([]string, 0, len(state))
+	for name := range state {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b bytes.Buffer
+	b.WriteString("grit tag state\n\n")
+	for _, name := range names {
+		fmt.Fprintf(&b, "%s %s\n", name, state[name].Hex())
+	}
+	return r.setState(ref, b.Bytes())
+}
+
+// SkippedCommits fetches from the repository's remote the hashes of
+// the commits recorded in ref by SetSkippedCommits, and returns them.
+// The set is empty if the remote has no ref.
+func (r *Repo) SkippedCommits(ref string) (map[string]bool, error) {
+	out, err := r.fetchState(ref)
+	if err != nil {
+		return nil, err
+	}
+	skipped := make(map[string]bool)
+	for out != nil {
+		if id := string(bytes.TrimSpace(scanLine(&out))); id != "" {
+			skipped[id] = true
+		}
+	}
+	return skipped, nil
+}
+
+// SetSkippedCommits records the hashes of the provided commits in ref,
+// as SetTagState records tag state. The ref is pushed by PushRef.
+func (r *Repo) SetSkippedCommits(ref string, skipped map[string]bool) error {
+	ids := make([]string, 0, len(skipped))
+	for id := range skipped {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	var b bytes.Buffer
+	b.WriteString("grit skipped commits\n\n")
+	for _, id := range ids {
+		fmt.Fprintf(&b, "%s\n", id)
+	}
+	return r.setState(ref, b.Bytes())
+}
+
+// fetchState fetches ref, in which state is recorded by setState,
+// from the repository's remote, and returns the body of the message
+// that records the state, or nil if the remote has no ref.
+func (r *Repo) fetchState(ref string) ([]byte, error) {
+	if r.readOnly {
+		return nil, ErrReadOnly
+	}
+	if _, err := r.git(nil, "fetch", "origin", "+"+ref+":"+ref); err != nil {
+		if !strings.Contains(err.Error(), "couldn't find remote ref") {
+			return nil, err
+		}
+		// Discard any state that was recorded but not pushed.
+		if _, err := r.git(nil, "update-ref", "-d", ref); err != nil {
+			return nil, err
+		}
+		return nil, nil
+	}
+	return r.git(nil, "log", "-1", "--format=%b", ref)
+}
+
+// setState records the state described by the provided message in ref:
+// it commits the message with an empty tree, on top of the previously
+// recorded state, so that the ref is updated by fast-forwarding it.
+func (r *Repo) setState(ref string, msg []byte) error {
+	if r.readOnly {
+		return ErrReadOnly
+	}
+	tree, err := r.git(nil, "mktree")
+	if err != nil {
+		return err
+	}
+	args := []string{"commit-tree", "-F", "-", string(bytes.TrimSpace(tree))}
+	if _, err := r.RevParse(ref); err == nil {
+		args = append(args, "-p", ref)
+	}
+	out, err := r.git(msg, args...)
+	if err != nil {
+		return err
+	}
+	_, err = r.git(nil, "update-ref", ref, string(bytes.TrimSpace(out)))
+	return err
+}
+
+// PushRef pushes ref to the provided remote. The push fails unless it
+// fast-forwards the remote's ref.
+func (r *Repo) PushRef(remote, ref string) error {
+	if r.readOnly {
+		return ErrReadOnly
+	}
+	if r.scratch {
+		return errors.New("scratch repositories cannot be pushed")
+	}
+	return r.push("push", remote, ref+":"+ref)
+}
+
+// RemoteTags returns the names of the tags in the repository's remote.
+func (r *Repo) RemoteTags() (map[string]bool, error) {
+	out, err := r.git(nil, "ls-remote", "--tags", "--refs", "origin")
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool)
+	for out != nil {
+		fields := bytes.Fields(scanLine(&out))
+		if len(fields) == 2 {
+			names[strings.TrimPrefix(string(fields[1]), "refs/tags/")] = true
+		}
+	}
+	return names, nil
+}
+
+// CreateTag creates a tag with the provided name, referring to the
+// provided commit, replacing any existing local tag of the same name.
+// If message is nonempty, an annotated tag is created.
+func (r *Repo) CreateTag(name string, id digest.Digest, message string) error {
+	if r.readOnly {
+		return ErrReadOnly
+	}
+	if message == "" {
+		_, err := r.git(nil, "tag", "-f", name, id.Hex())
+		return err
+	}
+	_, err := r.git([]byte(message), "tag", "-f", "-a", "-F", "-", name, id.Hex())
+	return err
+}
+
+// PushTags pushes the named tags to the provided remote. Tags named
+// in force replace those of the same names in the remote.
+func (r *Repo) PushTags(remote string, names []string, force map[string]bool) error {
+	if r.readOnly {
+		return ErrReadOnly
+	}
+	if r.scratch {
+		return errors.New("scratch repositories cannot be pushed")
+	}
+	args := []string{"push", remote}
+	for _, name := range names {
+		if force[name] {
+			args = append(args, "+refs/tags/"+name)
+		} else {
+			args = append(args, "refs/tags/"+name)
+		}
+	}
+	return r.push(args...)
+}
+
+// Configure sets the configuration parameter named by key to
+// the value value. Properties configured this way overrides the
+// Git's defaults (e.g., sourced through a user's .gitconfig) for
+// repo Git invocations.
+func (r *Repo) Configure(key, value string) {
+	if r.config == nil {
+		r.config = make(map[string]string)
+	}
+	r.config[key] = value
+}
+
+// Committer returns the identity, "name <email>", as which commits are
+// made in the repository, as determined by its configuration and the
+// environment. It returns an error if git cannot determine a committer
+// identity, e.g., because user.email is not configured.
+func (r *Repo) Committer() (string, error) {
+	out, err := r.git(nil, "var", "GIT_COMMITTER_IDENT")
+	if err != nil {
+		return "", err
+	}
+	// The identity is followed by a timestamp.
+	ident := string(bytes.TrimSpace(out))
+	if i := strings.LastIndex(ident, ">"); i >= 0 {
+		ident = ident[:i+1]
+	}
+	return ident, nil
+}
+
+// Log returns a set of commit objects representing the "git log" operation
+// with the provided arguments. Commits are read in git's "fuller" format,
+// so that both author and committer information is available. If the
+// repository's TopoOrder option is set, commits are listed in
+// topological order. Otherwise, they are listed newest first by commit
+// date, and commits with equal dates are ordered as by orderTies, so
+// that the order does not depend on how git breaks the ties. Commit
+// messages and identities are converted to UTF-8 from the encodings
+// declared by the commits' encoding headers, regardless of git's
+// i18n.logOutputEncoding.
+func (r *Repo) Log(args ...string) (commits []*Commit, err error) {
+	var paths []string
+	if len(r.opts.PrefixMap) > 0 {
+		paths = r.opts.PrefixMap.Sources()
+	} else if r.prefix != "" {
+		paths = []string{r.prefix}
+	}
+	return r.log(paths, args...)
+}
+
+// Commit returns the commit named by rev, whether or not it changes
+// the repository's prefix.
+func (r *Repo) Commit(rev string) (*Commit, error) {
+	id, err := r.RevParse(rev)
+	if err != nil {
+		return nil, err
+	}
+	commits, err := r.log(nil, "-1", "--no-walk", id.Hex())
+	if err != nil {
+		return nil, err
+	}
+	if len(commits) != 1 {
+		return nil, fmt.Errorf("log %s: got %d commits, want 1", rev, len(commits))
+	}
+	return commits[0], nil
+}
+
+// log is like Log, but limits the listed commits to those that change
+// the provided paths, if any, rather than the repository's prefix.
+func (r *Repo) log(paths []string, args ...string) (commits []*Commit, err error) {
+	if r.opts.TopoOrder {
+		args = append([]string{"--topo-order"}, args...)
+	} else {
+		defer func() {
+			if err == nil {
+				orderTies(commits)
+			}
+		}()
+	}
+	args = append([]string{"log", "--pretty=fuller", "--parents", "--encoding=UTF-8"}, args...)
+	if len(paths) > 0 {
+		args = append(append(args, "--"), paths...)
+	}
+	out, err := r.git(nil, args...)
+	if err != nil {
+		if strings.Contains(err.Error(), "path not in the working tree") {
+			// Allow missing destination directory.
+			return nil, nil
+		}
+		return nil, err
+	}
+	err = foreach(out, "commit", func(commit []byte) error {
+		c := &Commit{repo: r}
+		headers := scan(&commit, "\n")
+		// The commit line lists the commit's parents after its digest.
+		ids := bytes.Fields(bytes.TrimPrefix(scanLine(&headers), []byte("commit ")))
+		if len(ids) == 0 {
+			return errors.New("missing commit digest")
+		}
+		var err error
+		c.Digest, err = SHA1.Parse(string(ids[0]))
+		if err != nil {
+			return fmt.Errorf("invalid commit digest %s: %v", ids[0], err)
+		}
+		for _, id := range ids[1:] {
+			parent, err := SHA1.Parse(string(id))
+			if err != nil {
+				return fmt.Errorf("commit %s: invalid parent digest %s: %v", c.Digest.Short(), id, err)
+			}
+			c.Parents = append(c.Parents, parent)
+		}
+		for headers != nil {
+			line := scanLine(&headers)
+			keyval := strings.SplitN(string(line), ":", 2)
+			key, val := keyval[0], keyval[1]
+			val = strings.TrimLeftFunc(val, unicode.IsSpace)
+			c.Headers = append(c.Headers, Header{key, val})
+		}
+		commit = bytes.TrimPrefix(commit, []byte("    "))
+		c.Body = string(bytes.Replace(commit, []byte("\n    "), []byte("\n"), -1))
+		commits = append(commits, c)
+		return nil
+	})
+	return
+}
+
+// orderTies reorders each run of commits with equal commit dates in
+// the provided list, which is ordered newest first, so that children
+// precede their parents and commits are otherwise ordered by digest.
+// The order is thus determined by the commits alone. Runs are
+// ordered by parents among the run only: with --no-merges, for
+// example, a commit's ancestry through an omitted merge is ignored.
+func orderTies(commits []*Commit) {
+	for i := 0; i < len(commits); {
+		date, err := commits[i].CommitDate()
+		j := i + 1
+		for err == nil && j < len(commits) {
+			d, err := commits[j].CommitDate()
+			if err != nil || !d.Equal(date) {
+				break
+			}
+			j++
+		}
+		if j-i > 1 {
+			orderRun(commits[i:j])
+		}
+		i = j
+	}
+}
+
+// orderRun orders the provided commits, children first, breaking ties
+// by digest.
+func orderRun(run []*Commit) {
+	// The number of children of each commit in the run that remain
+	// to be ordered.
+	children := make(map[digest.Digest]int)
+	for _, c := range run {
+		for _, p := range c.Parents {
+			children[p]++
+		}
+	}
+	pending := append([]*Commit(nil), run...)
+	for i := range run {
+		next := -1
+		for k, c := range pending {
+			if children[c.Digest] > 0 {
+				continue
+			}
+			if next < 0 || c.Digest.Hex() < pending[next].Digest.Hex() {
+				next = k
+			}
+		}
+		if next < 0 {
+			// Not possible for a commit graph; keep git's order.
+			copy(run[i:], pending)
+			return
+		}
+		c := pending[next]
+		pending = append(pending[:next], pending[next+1:]...)
+		for _, p := range c.Parents {
+			children[p]--
+		}
+		run[i] = c
+	}
+}
+
+var (
+	prefixA    = []byte("--- a/")
+	prefixB    = []byte("+++ b/")
+	renameFrom = []byte("rename from ")
+	renameTo   = []byte("rename to ")
+)
+
+// Patch returns a patch representing the commit named by the provided ID.  Arg
+// dstPrefix is the prefix of the destination repository. If dstPrefix!="", it
+// it is prepended to the pathnames in the patch. Only diffs within the
+// repository's prefix are included: a file moved into the prefix is
+// represented as an addition, and one moved out of it as a deletion,
+// whether or not renames are detected. With a prefix map, only diffs
+// of mapped files are included, and their paths are mapped, relative
+// to dstPrefix; files moved into or out of the mapped directories are
+// likewise represented as additions or deletions.
+func (r *Repo) Patch(id digest.Digest, dstPrefix string) (Patch, error) {
+	// To minimize the amount of parsing we have to do here, first get the
+	// diffs only, and then extract the rest of the message which can be
+	// passed directly as a regular email.
+	renames := "--no-renames"
+	if r.opts.DetectRenames {
+		renames = "--find-renames"
+	}
+	rawdiffs, err := r.formatPatch(id, renames, "--format=") // diff content only
+	if err != nil {
+		return Patch{}, err
+	}
+	raw, err := r.formatPatch(id, renames)
+	if err != nil {
+		return Patch{}, err
+	}
+	raw = bytes.TrimSuffix(raw, rawdiffs)
+	patch, err := parsePatchHeader(raw)
+	if err != nil {
+		return Patch{}, fmt.Errorf("parse patch %v: %v", id, err)
+	}
+
+	patch.Diffs, err = parseDiffs(rawdiffs)
+	if err != nil {
+		return Patch{}, err
+	}
+	var diffs []Diff
+	for _, diff := range patch.Diffs {
+		_, inPrefix := r.dstPath(diff.Path, dstPrefix)
+		if _, oldInPrefix := r.dstPath(diff.OldPath, dstPrefix); diff.OldPath != "" && oldInPrefix != inPrefix {
+			// The file was moved across the prefix boundary: within
+			// the prefix, this is either an addition or a deletion.
+			path := diff.Path
+			if !inPrefix {
+				path = diff.OldPath
+			}
+			log.Debug.Printf("splitting rename %s -> %s across prefix %s", diff.OldPath, diff.Path, r.prefix)
+			split, err := r.pathDiffs(id, path)
+			if err != nil {
+				return Patch{}, err
+			}
+			for _, diff := range split {
+				diffs = append(diffs, r.fixDiff(diff, dstPrefix))
+			}
+			continue
+		}
+		if !inPrefix {
+			log.Debug.Printf("dropping diff with path %s not in prefix %s", diff.Path, r.prefix)
+			continue
+		}
+		diffs = append(diffs, r.fixDiff(diff, dstPrefix))
+	}
+	patch.Diffs = diffs
+	return patch, nil
+}
+
+// SplitRename returns the rename diff, as produced by Patch for the
+// commit named by id, as a deletion of the old path followed by an
+// addition of the new path.
+func (r *Repo) SplitRename(id digest.Digest, dstPrefix string, diff Diff) ([]Diff, error) {
+	srcPath := func(path string) string {
+		return r.prefix + r.SourcePath(path, dstPrefix)
+	}
+	diffs, err := r.pathDiffs(id, srcPath(diff.OldPath), srcPath(diff.Path))
+	if err != nil {
+		return nil, err
+	}
+	for i := range diffs {
+		diffs[i] = r.fixDiff(diffs[i], dstPrefix)
+	}
+	return diffs, nil
+}
+
+// pathDiffs returns the diffs, without rename detection, for the
+// provided paths in the commit named by id.
+func (r *Repo) pathDiffs(id digest.Digest, paths ...string) ([]Diff, error) {
+	raw, err := r.formatPatch(id, append([]string{"--no-renames", "--format=", "--"}, paths...)...)
+	if err != nil {
+		return nil, err
+	}
+	return parseDiffs(raw)
+}
+
+func (r *Repo) formatPatch(id digest.Digest, args ...string) ([]byte, error) {
+	if r.opts.FunctionContext {
+		args = append([]string{"--function-context"}, args...)
+	}
+	if r.opts.Context > 0 {
+		args = append([]string{fmt.Sprintf("--unified=%d", r.opts.Context)}, args...)
+	}
+	args = append([]string{
+		// Paths with non-ASCII characters are otherwise quoted,
+		// which the parsing and rewriting of diffs does not handle.
+		"-c", "core.quotePath=false",
+		"format-patch",
+		"--always", // to support empty commits
+		"--no-stat", "--stdout",
+		"--no-signature", // so that diffs may be concatenated
+		// Messages are converted to UTF-8 from the encodings declared
+		// by commits, as in Log, and the patch declares its charset.
+		"--encoding=UTF-8",
+		// Diffs produced by textconv filters and external diff
+		// drivers cannot be applied; binary files are instead
+		// copied as binary patches, which format-patch implies.
+		"--no-textconv", "--no-ext-diff",
+		"-1", id.Hex(),
+	}, args...)
+	return r.git(nil, args...)
+}
+
+// dstPath returns the destination path, relative to dstPrefix, of
+// the file at the provided source path, and whether the file is
+// within the repository's prefix or, with a prefix map, is mapped.
+func (r *Repo) dstPath(path, dstPrefix string) (string, bool) {
+	if len(r.opts.PrefixMap) > 0 {
+		mapped, ok := r.opts.PrefixMap.Map(path)
+		return dstPrefix + mapped, ok
+	}
+	if !strings.HasPrefix(path, r.prefix) {
+		return "", false
+	}
+	return dstPrefix + strings.TrimPrefix(path, r.prefix), true
+}
+
+// SourcePath returns the path, relative to the repository's prefix, of
+// the file that Patch places at the provided destination path, given
+// the destination prefix. Without a prefix map, this is the path
+// relative to dstPrefix. Paths that no source file is mapped to are
+// returned unchanged.
+func (r *Repo) SourcePath(path, dstPrefix string) string {
+	path = strings.TrimPrefix(path, dstPrefix)
+	if len(r.opts.PrefixMap) == 0 {
+		return path
+	}
+	if src, ok := r.opts.PrefixMap.Unmap(path); ok {
+		return src
+	}
+	return path
+}
+
+// fixDiff rewrites the paths in the provided diff, which must be
+// within the repository's prefix, or mapped by its prefix map, to be
+// relative to dstPrefix.
+func (r *Repo) fixDiff(diff Diff, dstPrefix string) Diff {
+	fixPath := func(path string) string {
+		path, _ = r.dstPath(path, dstPrefix)
+		return path
+	}
+	diff.Path = fixPath(diff.Path)
+	if diff.OldPath != "" {
+		diff.OldPath = fixPath(diff.OldPath)
+	}
+	// Also rewrite any --- or +++ meta lines that begin with a/ or b/,
+	// as well as rename headers, since they are also paths. The rest of
+	// meta is opaque to us.
+	meta := diff.Meta
+	diff.Meta = nil
+	for meta != nil {
+		line := scanLine(&meta)
+		var prefix []byte
+		for _, p := range [][]byte{prefixA, prefixB, renameFrom, renameTo} {
+			if bytes.HasPrefix(line, p) {
+				prefix = p
+				break
+			}
+		}
+		if prefix != nil {
+			diff.Meta = append(diff.Meta, prefix...)
+			diff.Meta = append(diff.Meta, fixPath(string(line[len(prefix):]))...)
+		} else {
+			diff.Meta = append(diff.Meta, line...)
+		}
+		diff.Meta = append(diff.Meta, '\n')
+	}
+	diff.Meta = bytes.TrimSuffix(diff.Meta, []byte{'\n'})
+	return diff
+}
+
+// Files returns the paths of the files in the repository's working
+// tree, relative to the repository's prefix.
+func (r *Repo) Files() ([]string, error) {
+	args := []string{"ls-files", "-z"}
+	if r.prefix != "" {
+		args = append(args, "--", r.prefix)
+	}
+	out, err := r.git(nil, args...)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, path := range bytes.Split(out, []byte{0}) {
+		if len(path) == 0 {
+			continue
+		}
+		paths = append(paths, strings.TrimPrefix(string(path), r.prefix))
+	}
+	return paths, nil
+}
+
+// Show returns the contents of the file at path, relative to the
+// repository's prefix, as of the commit named by ref. Contents are
+// returned as stored in the repository, i.e., as with "git show
+// ref:path"; no filters or text conversions are applied.
+func (r *Repo) Show(ref, path string) ([]byte, error) {
+	if err := validatePath(path); err != nil {
+		return nil, err
+	}
+	out, err := r.git(nil, "cat-file", "blob", ref+":"+r.prefix+path)
+	if err != nil {
+		return nil, fmt.Errorf("show %s:%s: %v", ref, path, err)
+	}
+	return out, nil
+}
+
+// ShowBlob returns the contents of the blob named by id, which may be
+// abbreviated, as stored in the repository.
+func (r *Repo) ShowBlob(id string) ([]byte, error) {
+	out, err := r.git(nil, "cat-file", "blob", id)
+	if err != nil {
+		return nil, fmt.Errorf("show blob %s: %v", id, err)
+	}
+	return out, nil
+}
+
+// ShowSmudged is like Show, but if the file is an LFS pointer, it
+// returns the contents of its object, as smudged by "git lfs smudge",
+// which fetches the object from the remote if needed. Unlike "git
+// cat-file --filters", this does not require git-lfs to be configured
+// as a filter in the repository. An error is returned if the object
+// cannot be smudged. With the NoLFS option, ShowSmudged is the same as
+// Show.
+func (r *Repo) ShowSmudged(ref, path string) ([]byte, error) {
+	p, err := r.Show(ref, path)
+	if err != nil || r.opts.NoLFS || !IsLFSPointer(p) {
+		return p, err
+	}
+	var out bytes.Buffer
+	if err := r.gitIO(bytes.NewReader(p), &out, "lfs", "smudge", "--", r.prefix+path); err != nil {
+		return nil, fmt.Errorf("smudge %s:%s: %v", ref, path, err)
+	}
+	// E.g., with GIT_LFS_SKIP_SMUDGE set in the environment.
+	if IsLFSPointer(out.Bytes()) {
+		return nil, fmt.Errorf("smudge %s:%s: git-lfs returned the pointer rather than its object", ref, path)
+	}
+	return out.Bytes(), nil
+}
+
+// BlobSize returns the size, in bytes, of the file at path, relative
+// to the repository's prefix, as of the commit named by ref. The size
+// is that of the blob stored in the repository, as reported by "git
+// cat-file -s ref:path".
+func (r *Repo) BlobSize(ref, path string) (int64, error) {
+	if err := validatePath(path); err != nil {
+		return 0, err
+	}
+	out, err := r.git(nil, "cat-file", "-s", ref+":"+r.prefix+path)
+	if err != nil {
+		return 0, fmt.Errorf("size %s:%s: %v", ref, path, err)
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+}
+
+// ExportIgnored returns the subset of the provided paths that have
+// the export-ignore attribute set, as determined by the .gitattributes
+// files in the repository's working tree. Paths are relative to the
+// repository's prefix.
+func (r *Repo) ExportIgnored(paths []string) (map[string]bool, error) {
+	ignored := make(map[string]bool)
+	if len(paths) == 0 {
+		return ignored, nil
+	}
+	var in bytes.Buffer
+	for _, path := range paths {
+		in.WriteString(r.prefix + path)
+		in.WriteByte(0)
+	}
+	out, err := r.git(in.Bytes(), "check-attr", "-z", "--stdin", "export-ignore")
+	if err != nil {
+		return nil, err
+	}
+	// Output is a sequence of "<path>\0<attribute>\0<info>\0" records.
+	fields := bytes.Split(out, []byte{0})
+	for i := 0; i+2 < len(fields); i += 3 {
+		if string(fields[i+2]) == "set" {
+			ignored[strings.TrimPrefix(string(fields[i]), r.prefix)] = true
+		}
+	}
+	return ignored, nil
+}
+
+// Diff returns the differences between the repository's tree and
+// the tree that would result from copying the files in the source
+// repository's tree, at their respective HEADs. Both trees are limited
+// to their repositories' prefixes. The provided filter is called with
+// the destination path of each file; it returns whether the file should
+// be included and, optionally, a function to rewrite its contents.
+// Files in the repository that are not included by the filter are
+// also ignored. The returned diffs describe the changes from the
+// expected tree to the repository's. Since Diff writes the source's
+// objects to the repository, the repository may not be read-only.
+func (r *Repo) Diff(src *Repo, filter func(path string) (keep bool, rewrite func([]byte) []byte)) ([]Diff, error) {
+	if r.readOnly {
+		return nil, ErrReadOnly
+	}
+	args := []string{"ls-tree", "-r", "-z", "HEAD"}
+	if src.prefix != "" {
+		args = append(args, "--", src.prefix)
+	}
+	out, err := src.git(nil, args...)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		index   bytes.Buffer
+		objects []string
+		paths   = make(map[string]string)
+	)
+	for _, entry := range bytes.Split(out, []byte{0}) {
+		if len(entry) == 0 {
+			continue
+		}
+		// Entries are of the form "<mode> <type> <object>\t<path>".
+		tab := bytes.IndexByte(entry, '\t')
+		if tab < 0 {
+			return nil, fmt.Errorf("malformed git ls-tree output %q", entry)
+		}
+		fields := strings.Fields(string(entry[:tab]))
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("malformed git ls-tree output %q", entry)
+		}
+		mode, typ, object := fields[0], fields[1], fields[2]
+		path := r.prefix + strings.TrimPrefix(string(entry[tab+1:]), src.prefix)
+		keep, rewrite := filter(path)
+		if !keep {
+			continue
+		}
+		if typ == "blob" {
+			if rewrite != nil {
+				content, err := src.git(nil, "cat-file", "blob", object)
+				if err != nil {
+					return nil, err
+				}
+				id, err := r.git(rewrite(content), "hash-object", "-w", "--stdin")
+				if err != nil {
+					return nil, err
+				}
+				object = string(bytes.TrimSpace(id))
+			} else {
+				objects = append(objects, object)
+				paths[object] = path
+			}
+		}
+		fmt.Fprintf(&index, "%s %s\t%s\n", mode, object, path)
+	}
+	// Copy the objects that are not already present in the repository,
+	// so that their contents can be diffed.
+	if len(objects) > 0 {
+		out, err := r.git([]byte(strings.Join(objects, "\n")+"\n"), "cat-file", "--batch-check")
+		if err != nil {
+			return nil, err
+		}
+		for out != nil {
+			line := scanLine(&out)
+			if !bytes.HasSuffix(line, []byte(" missing")) {
+				continue
+			}
+			object := string(bytes.TrimSuffix(line, []byte(" missing")))
+			content, err := src.git(nil, "cat-file", "blob", object)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", paths[object], err)
+			}
+			if _, err := r.git(content, "hash-object", "-w", "--stdin"); err != nil {
+				return nil, err
+			}
+		}
+	}
+	indexPath := r.path(".git", "grit-diff-index")
+	defer os.Remove(indexPath)
+	env := []string{"GIT_INDEX_FILE=" + indexPath}
+	if _, err := r.gitEnv(env, index.Bytes(), "update-index", "--index-info"); err != nil {
+		return nil, err
+	}
+	tree, err := r.gitEnv(env, nil, "write-tree")
+	if err != nil {
+		return nil, err
+	}
+	args = []string{"diff", "--no-renames", string(bytes.TrimSpace(tree)), "HEAD"}
+	if r.prefix != "" {
+		args = append(args, "--", r.prefix)
+	}
+	out, err = r.git(nil, args...)
+	if err != nil {
+		return nil, err
+	}
+	all, err := parseDiffs(out)
+	if err != nil {
+		return nil, err
+	}
+	var diffs []Diff
+	for _, diff := range all {
+		if keep, _ := filter(diff.Path); keep {
+			diffs = append(diffs, diff)
+		}
+	}
+	return diffs, nil
+}
+
+// Apply applies a patch to the repository. Patches without diffs
+// are ignored. The patch is first validated (see Patch.Validate), and
+// its paths must be within the repository's prefix. If the patch does
+// not apply cleanly, Apply retries with a three-way merge; if this
+// also fails, the application is aborted, unless the KeepConflicts
+// option is set, and an *ApplyError is returned.
+func (r *Repo) Apply(patch Patch) error {
+	if len(patch.Diffs) == 0 {
+		return nil
+	}
+	return r.apply(patch)
+}
+
+// ApplyAllowEmpty applies a patch to the repository. Unlike Apply,
+// patches without diffs are recorded as empty commits.
+func (r *Repo) ApplyAllowEmpty(patch Patch) error {
+	return r.apply(patch, "--empty=keep")
+}
+
+// ApplyWithCallback applies a patch to the repository, as Apply does,
+// and then calls fn with the ID of the source commit from which the
+// patch was derived and the repository's new HEAD: the commit that
+// records it. Fn is not called for patches without diffs, which are
+// ignored.
+func (r *Repo) ApplyWithCallback(patch Patch, fn func(src, dstHead digest.Digest)) error {
+	if len(patch.Diffs) == 0 {
+		return nil
+	}
+	if err := r.apply(patch); err != nil {
+		return err
+	}
+	head, err := r.HeadDigest()
+	if err != nil {
+		return err
+	}
+	fn(patch.ID, head)
+	return nil
+}
+
+// ApplyAll applies a sequence of patches to the repository, as if
+// by calling Apply on each in turn, but using a single git am
+// invocation when they all apply cleanly. Otherwise, the patches are
+// applied one at a time, so that three-way merges are attempted as in
+// Apply, and the returned error names the position of the patch that
+// could not be applied; the patches before it remain applied.
+func (r *Repo) ApplyAll(patches []Patch) error {
+	return r.ApplyAllWithCallback(patches, nil)
+}
+
+// ApplyAllWithCallback is like ApplyAll, but calls fn, if it is not
+// nil, for each patch that is applied, in order, as ApplyWithCallback
+// does. When the patches are applied in a batch, fn is called once the
+// whole batch is committed.
+func (r *Repo) ApplyAllWithCallback(patches []Patch, fn func(src, dstHead digest.Digest)) error {
+	if r.readOnly {
+		return ErrReadOnly
+	}
+	var (
+		b       bytes.Buffer
+		batched int
+		escaped bool
+	)
+	for _, patch := range patches {
+		if len(patch.Diffs) == 0 {
+			continue
+		}
+		if err := r.checkApply(patch); err != nil {
+			return err
+		}
+		if err := patch.Write(&b); err != nil {
+			return fmt.Errorf("patch write: %v", err)
+		}
+		batched++
+		// Escaped messages are restored by amending each commit
+		// as it is applied.
+		escaped = escaped || escapeBody(patch.Body) != patch.Body
+	}
+	if batched == 0 {
+		return nil
+	}
+	if !escaped {
+		log.Debug.Printf("applying %d patches", batched)
+		_, err := r.git(b.Bytes(), r.amArgs()...)
+		if err == nil {
+			return r.batchApplied(patches, batched, fn)
+		}
+		log.Debug.Printf("%s: batch apply failed: applying patches one at a time: %v", r, err)
+		r.abortApply()
+	}
+	if fn == nil {
+		fn = func(src, dstHead digest.Digest) {}
+	}
+	for i, patch := range patches {
+		if err := r.ApplyWithCallback(patch, fn); err != nil {
+			return &BatchError{Index: i, N: len(patches), Err: err}
+		}
+	}
+	return nil
+}
+
+// batchApplied calls fn, if it is not nil, for each of the provided
+// patches that has diffs, with the commit that records it: one of the
+// n commits at the repository's HEAD.
+func (r *Repo) batchApplied(patches []Patch, n int, fn func(src, dstHead digest.Digest)) error {
+	if fn == nil {
+		return nil
+	}
+	out, err := r.git(nil, "rev-list", "--reverse", "-n", strconv.Itoa(n), "HEAD")
+	if err != nil {
+		return err
+	}
+	commits := strings.Fields(string(out))
+	if len(commits) != n {
+		return fmt.Errorf("applied %d patches, but found %d commits", n, len(commits))
+	}
+	for _, patch := range patches {
+		if len(patch.Diffs) == 0 {
+			continue
+		}
+		head, err := SHA1.Parse(commits[0])
+		if err != nil {
+			return err
+		}
+		commits = commits[1:]
+		fn(patch.ID, head)
+	}
+	return nil
+}
+
+// BatchError is returned by ApplyAll when a patch in the sequence
+// cannot be applied.
+type BatchError struct {
+	// Index is the position of the patch that could not be applied.
+	Index int
+	// N is the number of patches in the sequence.
+	N int
+	// Err is the error returned by Apply for the patch, e.g., an
+	// *ApplyError.
+	Err error
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("patch %d of %d: %v", e.Index+1, e.N, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *BatchError) Unwrap() error {
+	return e.Err
+}
+
+// checkApply returns an error if the patch is not valid, or if its
+// paths are outside of the repository's prefix.
+func (r *Repo) checkApply(patch Patch) error {
+	if err := patch.Validate(); err != nil {
+		return err
+	}
+	for _, diff := range patch.Diffs {
+		for _, path := range []string{diff.Path, diff.OldPath} {
+			if path != "" && !strings.HasPrefix(path, r.prefix) {
+				return fmt.Errorf("patch %s: path %s is outside of prefix %s", patch.ID.Hex()[:7], path, r.prefix)
+			}
+		}
+	}
+	return nil
+}
+
+// amArgs returns the git am command with which patches are applied
+// to the repository.
+func (r *Repo) amArgs() []string {
+	args := []string{"am", "--keep-non-patch", "--keep-cr"}
+	if r.opts.Whitespace != "" {
+		args = append(args, "--whitespace="+r.opts.Whitespace)
+	}
+	return args
+}
+
+func (r *Repo) apply(patch Patch, args ...string) error {
+	if r.readOnly {
+		return ErrReadOnly
+	}
+	if err := r.checkApply(patch); err != nil {
+		return err
+	}
+	var b bytes.Buffer
+	if err := patch.Write(&b); err != nil {
+		return fmt.Errorf("patch write: %v", err)
+	}
+	log.Debug.Printf("applying patch %s", patch.ID.Hex()[:7])
+	args = append(r.amArgs(), args...)
+	_, err := r.git(b.Bytes(), args...)
+	if err == nil {
+		return r.unescapeMessage(patch)
+	}
+	paths := conflictPaths(err.Error())
+	if len(paths) == 0 {
+		return err
+	}
+	// The patch's context may not match the repository's, but the
+	// patch may still apply cleanly with a three-way merge, using the
+	// blobs named by the diffs' index lines.
+	r.abortApply()
+	if _, err3 := r.git(b.Bytes(), append(args, "--3way")...); err3 == nil {
+		log.Printf("%s: applied patch %s using a three-way merge", r, patch.ID.Hex()[:7])
+		return r.unescapeMessage(patch)
+	}
+	// Don't leave the checkout in the middle of an am session, unless
+	// it is to be resolved.
+	if !r.opts.KeepConflicts {
+		r.abortApply()
+	}
+	e := &ApplyError{ID: patch.ID, Paths: paths, Err: err}
+	for _, diff := range patch.Diffs {
+		for _, path := range paths {
+			if diff.Path == path {
+				e.Diffs = append(e.Diffs, diff)
+				break
+			}
+		}
+	}
+	return e
+}
+
+// unescapeMessage restores the message of a commit created by
+// applying the provided patch if its body had to be escaped (see
+// Patch.Write), so that escaping does not leak into the repository.
+func (r *Repo) unescapeMessage(patch Patch) error {
+	if escapeBody(patch.Body) == patch.Body {
+		return nil
+	}
+	return r.amendMessage(patch)
+}
+
+// abortApply aborts an in-progress am session, if any.
+func (r *Repo) abortApply() {
+	if err := r.AbortApply(); err != nil {
+		log.Error.Printf("%s: %v", r, err)
+	}
+}
+
+// ContinueApply concludes the am session left in progress by a patch
+// that failed to apply with the KeepConflicts option, committing the
+// patch with its conflicts resolved. The resolution must be staged,
+// e.g., with git add, as for git am --continue; if it is not, an error
+// is returned and the session remains in progress.
+func (r *Repo) ContinueApply(patch Patch) error {
+	if r.readOnly {
+		return ErrReadOnly
+	}
+	if _, err := r.git(nil, "am", "--continue"); err != nil {
+		return fmt.Errorf("am --continue: %v", err)
+	}
+	return r.unescapeMessage(patch)
+}
+
+// SkipApply concludes the am session left in progress by a patch that
+// failed to apply with the KeepConflicts option, without committing
+// the patch. Changes made to resolve its conflicts are discarded.
+func (r *Repo) SkipApply() error {
+	if r.readOnly {
+		return ErrReadOnly
+	}
+	if _, err := r.git(nil, "am", "--skip"); err != nil {
+		return fmt.Errorf("am --skip: %v", err)
+	}
+	return nil
+}
+
+// AbortApply aborts the am session left in progress by a patch that
+// failed to apply, restoring the checkout to the commit at which the
+// session started.
+func (r *Repo) AbortApply() error {
+	if r.readOnly {
+		return ErrReadOnly
+	}
+	if _, err := r.git(nil, "am", "--abort"); err != nil {
+		return fmt.Errorf("am --abort: %v", err)
+	}
+	return nil
+}
+
+// ApplyError is returned by Apply when a patch does not apply
+// cleanly to the repository.
+type ApplyError struct {
+	// ID is the commit ID from which the rejected patch was derived.
+	ID digest.Digest
+	// Paths holds the paths of the files that could not be patched.
+	Paths []string
+	// Diffs holds the rejected diffs.
+	Diffs []Diff
+	// Err is the underlying error returned by git.
+	Err error
+}
+
+func (e *ApplyError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "patch %s does not apply: conflicting paths: %s",
+		e.ID.Hex()[:7], strings.Join(e.Paths, ", "))
+	for _, diff := range e.Diffs {
+		fmt.Fprintf(&b, "\nrejected diff for %s:\n%s\n%s", diff.Path, diff.Meta, diff.Body)
+	}
+	fmt.Fprintf(&b, "\n%v", e.Err)
+	return b.String()
+}
+
+var conflictRe = regexp.MustCompile(`(?m)^error: (?:patch failed: (.+):[0-9]+|(.+): (?:patch does not apply|does not exist in index|already exists in (?:index|working directory)))$`)
+
+// conflictPaths returns the paths reported by git am as not
+// applying cleanly in the provided error output.
+func conflictPaths(out string) (paths []string) {
+	seen := make(map[string]bool)
+	for _, g := range conflictRe.FindAllStringSubmatch(out, -1) {
+		path := g[1]
+		if path == "" {
+			path = g[2]
+		}
+		if !seen[path] {
+			seen[path] = true
+			paths = append(paths, path)
+		}
+	}
+	return
+}
+
+// Revert commits the reverse of the commit named by id, as by git
+// revert, with git's default message, which names the reverted commit.
+// If the reverse does not apply cleanly, e.g., because later commits
+// changed the same lines, the revert is aborted, leaving the
+// repository as it was, and the error names the conflicting paths.
+func (r *Repo) Revert(id digest.Digest) error {
+	if r.readOnly {
+		return ErrReadOnly
+	}
+	if _, err := r.git(nil, "revert", "--no-edit", id.Hex()); err != nil {
+		_, _ = r.git(nil, "revert", "--abort")
+		return err
+	}
+	return nil
+}
+
+// Remove commits the deletion of the files at the provided paths,
+// which are relative to the repository's prefix, with the provided
+// commit message.
+func (r *Repo) Remove(paths []string, message string) error {
+	if r.readOnly {
+		return ErrReadOnly
+	}
+	var pathspec bytes.Buffer
+	for _, path := range paths {
+		if err := validatePath(path); err != nil {
+			return err
+		}
+		pathspec.WriteString(":(literal)" + r.prefix + path)
+		pathspec.WriteByte(0)
+	}
+	if _, err := r.git(pathspec.Bytes(), "rm", "--quiet", "--pathspec-from-file=-", "--pathspec-file-nul"); err != nil {
+		return err
+	}
+	_, err := r.git([]byte(message), "commit", "--no-verify", "--file=-")
+	return err
+}
+
+// Squash squashes the last n commits in the repository into a single
+// commit. The squashed commit retains the author and author time of
+// the last commit, and takes its message from the provided patch's
+// subject and body.
+func (r *Repo) Squash(n int, patch Patch) error {
+	if r.readOnly {
+		return ErrReadOnly
+	}
+	head, err := r.HeadDigest()
+	if err != nil {
+		return err
+	}
+	if _, err := r.git(nil, "reset", "--soft", fmt.Sprintf("HEAD~%d", n)); err != nil {
+		return err
+	}
+	if _, err := r.git(nil, "commit", "--allow-empty", "--no-verify", "--reuse-message="+head.Hex()); err != nil {
+		return err
 	}
+	return r.amendMessage(patch)
+}
+
+// amendMessage replaces the message of the HEAD commit with the
+// provided patch's subject and body.
+func (r *Repo) amendMessage(patch Patch) error {
+	subject, err := new(mime.WordDecoder).DecodeHeader(patch.Subject)
 	if err != nil {
-		os.MkdirAll(path, 0777)
-		if _, err := r.git(nil, "clone", "--single-branch", r.url, r.root); err != nil {
-			return nil, err
-		}
+		return fmt.Errorf("decode subject %q: %v", patch.Subject, err)
 	}
-	if _, err := r.git(nil, "fetch", "origin", branch); err != nil {
-		return nil, err
+	msg := strings.TrimPrefix(subject, "[PATCH] ") + "\n\n" + patch.Body
+	_, err = r.git([]byte(msg), "commit", "--amend", "--allow-empty", "--no-verify", "--file=-")
+	return err
+}
+
+// Push pushes the current state of the repository to the provided
+// branch on the provided remote. LFS objects are pushed first, but
+// only if the repository's prefix contains LFS pointers; Push does
+// not require git-lfs to be installed when it does not, and fails
+// without pushing when it does and git-lfs is not installed. The
+// branch is not pushed if the objects of LFS pointers changed by the
+// pushed commits are missing, or if git-lfs fails to push all of them,
+// so that the remote never refers to objects it does not have. With
+// the VerifyPush option, Push fails if the remote branch is not at
+// HEAD once the push has completed.
+func (r *Repo) Push(remote, remoteBranch string) error {
+	if r.readOnly {
+		return ErrReadOnly
 	}
-	if _, err := r.git(nil, "reset", "--hard", "FETCH_HEAD"); err != nil {
-		return nil, err
+	if r.scratch {
+		return errors.New("scratch repositories cannot be pushed")
 	}
-	// Clear potentially interrupted run.
-	_, _ = r.git(nil, "am", "--abort")
-	return r, nil
+	if err := r.pushLFS(remote, remoteBranch); err != nil {
+		return err
+	}
+	if err := r.push("push", remote, "HEAD:"+remoteBranch); err != nil {
+		return err
+	}
+	if !r.opts.VerifyPush {
+		return nil
+	}
+	return r.verifyPush(remote, remoteBranch)
 }
 
-// Prefix returns the prefix within the repository, as specified in Open.
-func (r *Repo) Prefix() string {
-	return r.prefix
+// verifyPush returns an error unless the provided branch of the
+// provided remote is at the repository's HEAD.
+func (r *Repo) verifyPush(remote, remoteBranch string) error {
+	head, err := r.HeadDigest()
+	if err != nil {
+		return err
+	}
+	out, err := r.git(nil, "ls-remote", remote, "refs/heads/"+remoteBranch)
+	if err != nil {
+		return fmt.Errorf("verify push: %v", err)
+	}
+	fields := bytes.Fields(out)
+	if len(fields) == 0 {
+		return fmt.Errorf("verify push: %s has no branch %s after pushing %s", remote, remoteBranch, head.Short())
+	}
+	if got := string(fields[0]); got != head.Hex() {
+		return fmt.Errorf("verify push: %s branch %s is at %.8s, not at the pushed %s", remote, remoteBranch, got, head.Short())
+	}
+	return nil
 }
 
-func (r *Repo) String() string {
-	return fmt.Sprintf("%s,%s,%s", r.url, r.prefix, r.branch)
+// DefaultNotesRef is the ref in which git notes are stored by default.
+const DefaultNotesRef = "refs/notes/commits"
+
+// FetchNotes fetches the git notes in notesRef from the repository's
+// remote, replacing any local notes. Notes are not fetched by Open.
+// Since repositories opened by OpenLocal are read in place,
+// FetchNotes leaves their notes as is.
+func (r *Repo) FetchNotes(notesRef string) error {
+	if r.readOnly {
+		return nil
+	}
+	_, err := r.git(nil, "fetch", "origin", "+"+notesRef+":"+notesRef)
+	if err != nil && strings.Contains(err.Error(), "couldn't find remote ref") {
+		// The remote has no notes.
+		return nil
+	}
+	return err
 }
 
-// Close relinquishes the repo's lock. Repo operations may not
-// be safely performed after the repository has been closed.
-func (r *Repo) Close() error {
-	return r.lock.Unlock()
+// Notes returns the git note in notesRef attached to the commit named
+// by rev, or an empty string if the commit has no note.
+func (r *Repo) Notes(notesRef, rev string) (string, error) {
+	out, err := r.git(nil, "log", "-1", "--notes="+notesRef, "--format=%N", rev)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
 }
 
-// Linearize linearizes the repository's history.
-func (r *Repo) Linearize() error {
-	_, err := r.git(nil, "filter-branch", "-f", "--parent-filter", `cut -f 2,3 -d " "`)
+// AddNote attaches the provided note to the HEAD commit in notesRef,
+// replacing any existing note.
+func (r *Repo) AddNote(notesRef, note string) error {
+	if r.readOnly {
+		return ErrReadOnly
+	}
+	_, err := r.git([]byte(note), "notes", "--ref="+notesRef, "add", "-f", "-F", "-", "HEAD")
 	return err
 }
 
-// Configure sets the configuration parameter named by key to
-// the value value. Properties configured this way overrides the
-// Git's defaults (e.g., sourced through a user's .gitconfig) for
-// repo Git invocations.
-func (r *Repo) Configure(key, value string) {
-	if r.config == nil {
-		r.config = make(map[string]string)
+// PushNotes pushes the repository's git notes in notesRef to the
+// provided remote. Notes should first be fetched with FetchNotes, so
+// that the push does not overwrite notes that were added to the remote
+// separately.
+func (r *Repo) PushNotes(remote, notesRef string) error {
+	if r.readOnly {
+		return ErrReadOnly
 	}
-	r.config[key] = value
+	if r.scratch {
+		return errors.New("scratch repositories cannot be pushed")
+	}
+	return r.push("push", remote, notesRef+":"+notesRef)
 }
 
-// Log returns a set of commit objects representing the "git log" operation
-// with the provided arguments.
-func (r *Repo) Log(args ...string) (commits []*Commit, err error) {
-	args = append([]string{"log"}, args...)
-	if r.prefix != "" {
-		args = append(args, r.prefix)
+func (r *Repo) pushLFS(remote, remoteBranch string) error {
+	if r.opts.NoLFS {
+		return nil
 	}
-	out, err := r.git(nil, args...)
-	if err != nil {
-		if strings.Contains(err.Error(), "path not in the working tree") {
-			// Allow missing destination directory.
-			return nil, nil
+	if _, err := exec.LookPath("git-lfs"); err != nil {
+		// Pointers are found without git-lfs, which is needed only
+		// to push their objects.
+		files, err := r.Files()
+		if err != nil {
+			return err
 		}
-		return nil, err
-	}
-	err = foreach(out, "commit", func(commit []byte) error {
-		c := &Commit{repo: r}
-		headers := scan(&commit, "\n")
-		digest := scanLine(&headers)
-		digest = bytes.TrimPrefix(digest, []byte("commit "))
-		var err error
-		c.Digest, err = SHA1.Parse(string(digest))
+		paths := make(map[string]bool, len(files))
+		for _, file := range files {
+			paths[r.prefix+file] = true
+		}
+		pointers, err := r.ListLFSPointersForPaths(paths)
 		if err != nil {
-			return fmt.Errorf("invalid commit digest %v: %v", digest, err)
+			return err
 		}
-		for headers != nil {
-			line := scanLine(&headers)
-			keyval := strings.SplitN(string(line), ":", 2)
-			key, val := keyval[0], keyval[1]
-			val = strings.TrimLeftFunc(val, unicode.IsSpace)
-			c.Headers = append(c.Headers, Header{key, val})
+		if len(pointers) == 0 {
+			log.Debug.Printf("%s: git-lfs is not installed, and there are no LFS pointers: not pushing LFS objects", r)
+			return nil
 		}
-		commit = bytes.TrimPrefix(commit, []byte("    "))
-		c.Body = string(bytes.Replace(commit, []byte("\n    "), []byte("\n"), -1))
-		commits = append(commits, c)
+		return fmt.Errorf("%s: git-lfs is not installed, but %s and %d other files are LFS pointers: not pushing", r, pointers[0], len(pointers)-1)
+	}
+	pointers, err := r.ListLFSPointers()
+	if err != nil {
+		return err
+	}
+	if len(pointers) == 0 {
+		log.Debug.Printf("%s: no LFS pointers: not pushing LFS objects", r)
 		return nil
-	})
-	return
+	}
+	missing, err := r.missingLFSObjects(remote, remoteBranch)
+	if err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%s: LFS objects are missing for %s: not pushing", r, strings.Join(missing, ", "))
+	}
+	// By default, git-lfs pushes whatever objects it can, warning
+	// about missing ones; the branch must not be pushed if any are.
+	if err := r.push("-c", "lfs.allowincompletepush=false", "lfs", "push", remote, remoteBranch); err != nil {
+		return fmt.Errorf("lfs push incomplete: not pushing: %v", err)
+	}
+	return nil
 }
 
-var (
-	prefixA = []byte("--- a/")
-	prefixB = []byte("+++ b/")
-)
-
-// Patch returns a patch representing the commit named by the provided ID.  Arg
-// dstPrefix is the prefix of the destination repository. If dstPrefix!="", it
-// it is prepended to the pathnames in the patch.
-func (r *Repo) Patch(id digest.Digest, dstPrefix string) (Patch, error) {
-	// To minimize the amount of parsing we have to do here, first get the
-	// diffs only, and then extract the rest of the message which can be
-	// passed directly as a regular email.
+// UnpushedPaths returns the paths, relative to the repository's root,
+// changed by the commits that would be pushed to the provided branch
+// of the provided remote. If the remote branch does not exist, or its
+// commit is unknown to the repository, all paths in HEAD are returned.
+func (r *Repo) UnpushedPaths(remote, remoteBranch string) ([]string, error) {
+	return r.unpushedPaths(remote, remoteBranch)
+}
 
-	rawdiffs, err := r.git(nil, "format-patch",
-		"--always", // to support empty commits
-		"--no-renames", "--no-stat", "--stdout",
-		"--format=", // diff content only
-		"-1", id.Hex(),
-	)
+// unpushedPaths is like UnpushedPaths, but passes the provided
+// additional arguments to git diff.
+func (r *Repo) unpushedPaths(remote, remoteBranch string, diffArgs ...string) ([]string, error) {
+	out, err := r.git(nil, "ls-remote", remote, "refs/heads/"+remoteBranch)
 	if err != nil {
-		return Patch{}, err
+		return nil, err
 	}
-	raw, err := r.git(nil, "format-patch",
-		"--always", "--no-renames", "--no-stat", "-1", id.Hex(), "--stdout")
-	if err != nil {
-		return Patch{}, err
+	args := []string{"ls-tree", "-r", "-z", "--name-only", "HEAD"}
+	if fields := bytes.Fields(out); len(fields) > 0 {
+		if _, err := r.git(nil, "cat-file", "-e", string(fields[0])+"^{commit}"); err == nil {
+			args = append(append([]string{"diff", "--name-only"}, diffArgs...), "--no-renames", "-z", string(fields[0]), "HEAD")
+		}
 	}
-	raw = bytes.TrimSuffix(raw, rawdiffs)
-	patch, err := parsePatchHeader(raw)
-	if err != nil {
-		return Patch{}, fmt.Errorf("parse patch %v: %v", id, err)
+	if out, err = r.git(nil, args...); err != nil {
+		return nil, err
 	}
-
-	err = foreach(rawdiffs, "diff", func(diff []byte) error {
-		header := scanLine(&diff)
-		path := parseDiffHeader(header)
-		if path == nil {
-			return errors.New("diff is missing header")
+	var paths []string
+	for _, path := range bytes.Split(out, []byte{0}) {
+		if len(path) > 0 {
+			paths = append(paths, string(path))
 		}
-		meta := next(&diff, "@@")
-		patch.Diffs = append(patch.Diffs, Diff{Path: string(path), Meta: meta, Body: diff})
-		return nil
-	})
+	}
+	return paths, nil
+}
+
+// missingLFSObjects returns the paths of the LFS pointers, changed by
+// the commits to be pushed to the remote branch, whose objects are
+// missing from the repository, so that they cannot be pushed.
+func (r *Repo) missingLFSObjects(remote, remoteBranch string) ([]string, error) {
+	paths, err := r.unpushedPaths(remote, remoteBranch, "--diff-filter=AMCRT")
 	if err != nil {
-		return Patch{}, err
+		return nil, err
 	}
-	fixPath := func(path string) string {
-		return dstPrefix + strings.TrimPrefix(path, r.prefix)
+	pointers, err := r.readLFSPointers("HEAD", paths)
+	if err != nil {
+		return nil, err
 	}
-
-	var diffs []Diff
-	for _, diff := range patch.Diffs {
-		if strings.HasPrefix(diff.Path, r.prefix) {
-			diff.Path = fixPath(diff.Path)
-			// Also rewrite any --- or +++ meta lines that begin with a/ or b/,
-			// since they are also paths. The rest of meta is opaque to us.
-			meta := diff.Meta
-			diff.Meta = nil
-			for meta != nil {
-				line := scanLine(&meta)
-				switch {
-				case bytes.HasPrefix(line, prefixA) || bytes.HasPrefix(line, prefixB):
-					path := []byte(fixPath(string(line[len(prefixA):])))
-					diff.Meta = append(diff.Meta, line[:len(prefixA)]...)
-					diff.Meta = append(diff.Meta, path...)
-					diff.Meta = append(diff.Meta, '\n')
-				default:
-					diff.Meta = append(diff.Meta, line...)
-					diff.Meta = append(diff.Meta, '\n')
-				}
-			}
-			diff.Meta = bytes.TrimSuffix(diff.Meta, []byte{'\n'})
-			diffs = append(diffs, diff)
-		} else {
-			log.Debug.Printf("dropping diff with path %s not in prefix %s", diff.Path, r.prefix)
+	var missing []string
+	for _, path := range paths {
+		p, ok := pointers[path]
+		if !ok {
+			continue
+		}
+		id, size, err := parseLFSPointer(p)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		oid := id.Hex()
+		info, err := os.Stat(r.path(".git", "lfs", "objects", oid[:2], oid[2:4], oid))
+		if err != nil || info.Size() != size {
+			missing = append(missing, fmt.Sprintf("%s (%s)", path, oid[:7]))
 		}
 	}
-	patch.Diffs = diffs
-	return patch, nil
+	return missing, nil
 }
 
-// Apply applies a patch to the repository.
-func (r *Repo) Apply(patch Patch) error {
-	if len(patch.Diffs) == 0 {
-		return nil
+// readLFSPointers returns the contents of those of the provided
+// paths, relative to the repository's root, that are LFS pointer files
+// in the commit named by rev, keyed by path. Paths that are not in the
+// commit are ignored.
+func (r *Repo) readLFSPointers(rev string, paths []string) (map[string][]byte, error) {
+	if len(paths) == 0 {
+		return nil, nil
 	}
-	var b bytes.Buffer
-	if err := patch.Write(&b); err != nil {
-		return fmt.Errorf("patch write: %v", err)
+	// Pointer files are small; don't read other blobs.
+	var in bytes.Buffer
+	for _, path := range paths {
+		in.WriteString(rev + ":" + path + "\n")
 	}
-	log.Debug.Printf("applying patch %s", patch.ID.Hex()[:7])
-	_, err := r.git(b.Bytes(), "am", "--keep-non-patch", "--keep-cr")
-	return err
-}
-
-// Push pushes the current state of the repository to the provided
-// branch on the provided remote.
-func (r *Repo) Push(remote, remoteBranch string) error {
-	_, err := r.git(nil, "lfs", "push", "origin", remoteBranch)
+	out, err := r.git(in.Bytes(), "cat-file", "--batch-check=%(objecttype) %(objectsize)")
 	if err != nil {
-		return err
+		return nil, err
 	}
-	_, err = r.git(nil, "push", remote, "HEAD:"+remoteBranch)
-	return err
+	pointers := make(map[string][]byte)
+	for i, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		var (
+			typ  string
+			size int
+		)
+		if _, err := fmt.Sscanf(line, "%s %d", &typ, &size); err != nil || typ != "blob" || size > lfsMaxPointerSize {
+			continue
+		}
+		p, err := r.git(nil, "cat-file", "blob", rev+":"+paths[i])
+		if err != nil {
+			return nil, err
+		}
+		if IsLFSPointer(p) {
+			pointers[paths[i]] = p
+		}
+	}
+	return pointers, nil
+}
+
+// lfsMaxPointerSize is the maximum size of an LFS pointer file.
+const lfsMaxPointerSize = 1024
+
+// lfsPointerVersion begins every LFS pointer file.
+var lfsPointerVersion = []byte("version https://git-lfs.github.com/spec/")
+
+// IsLFSPointer tells whether the provided file contents are those of
+// an LFS pointer file.
+func IsLFSPointer(content []byte) bool {
+	return len(content) <= lfsMaxPointerSize && bytes.HasPrefix(content, lfsPointerVersion)
 }
 
 // ListLFSPointers returns paths to in the repository which are LFS
@@ -303,33 +2404,53 @@ func (r *Repo) ListLFSPointers() (pointers []string, err error) {
 	return
 }
 
+// ListLFSPointersForPaths is like ListLFSPointers, but considers only
+// those of the provided paths that are within the repository's prefix.
+// The paths are relative to the repository's root, like those of the
+// patches applied to it. Only the paths' blobs in HEAD are read, so
+// that the cost scales with the number of paths rather than with the
+// size of the repository; git-lfs is not needed.
+func (r *Repo) ListLFSPointersForPaths(paths map[string]bool) ([]string, error) {
+	var list []string
+	for path := range paths {
+		if strings.HasPrefix(path, r.prefix) {
+			list = append(list, path)
+		}
+	}
+	sort.Strings(list)
+	contents, err := r.readLFSPointers("HEAD", list)
+	if err != nil {
+		return nil, err
+	}
+	var pointers []string
+	for _, path := range list {
+		if _, ok := contents[path]; ok {
+			pointers = append(pointers, strings.TrimPrefix(path, r.prefix))
+		}
+	}
+	return pointers, nil
+}
+
 // CopyLFSObject copies the object referred to by the provided pointer
-// from the given source repository.
+// from the given source repository. The copied object is verified
+// against the pointer's oid and size.
 func (r *Repo) CopyLFSObject(src *Repo, pointer string) error {
+	if r.readOnly {
+		return ErrReadOnly
+	}
 	p, err := ioutil.ReadFile(r.path(r.prefix, pointer))
+	if os.IsNotExist(err) {
+		// The pointer file is not in a sparse working tree.
+		p, err = r.git(nil, "cat-file", "blob", "HEAD:"+r.prefix+pointer)
+	}
 	if err != nil {
 		return err
 	}
-	var (
-		q    = p
-		line []byte
-		oid  string
-	)
-	for q != nil {
-		line = scanLine(&q)
-		if !bytes.HasPrefix(line, []byte("oid ")) {
-			continue
-		}
-		id, err := digest.Parse(string(line[4:]))
-		if err != nil {
-			return err
-		}
-		oid = id.Hex()
-		break
-	}
-	if oid == "" {
-		return errors.New("pointer file is missing oid")
+	id, size, err := parseLFSPointer(p)
+	if err != nil {
+		return fmt.Errorf("%s: %v", pointer, err)
 	}
+	oid := id.Hex()
 	opath := r.path(".git", "lfs", "objects", oid[:2], oid[2:4], oid)
 	// Do we already have the object?
 	if _, err := os.Stat(opath); err == nil {
@@ -343,26 +2464,92 @@ func (r *Repo) CopyLFSObject(src *Repo, pointer string) error {
 		return err
 	}
 	defer os.Remove(tmp.Name())
-	if err := src.gitIO(bytes.NewReader(p), tmp, "lfs", "smudge"); err != nil {
+	var (
+		w = digest.Digester(id.Hash()).NewWriter()
+		n countWriter
+	)
+	if err := src.gitIO(bytes.NewReader(p), io.MultiWriter(tmp, w, &n), "lfs", "smudge"); err != nil {
 		return err
 	}
 	if err := tmp.Close(); err != nil {
 		return err
 	}
+	if int64(n) != size {
+		return fmt.Errorf("%s: object %s has size %d, expected %d", pointer, oid[:7], n, size)
+	}
+	if got := w.Digest(); got != id {
+		return fmt.Errorf("%s: object %s has digest %s", pointer, id, got)
+	}
 	return os.Rename(tmp.Name(), opath)
 }
 
+// lfsDigester is the digester assumed for LFS pointer oids that do not
+// name their hash algorithm.
+var lfsDigester = digest.Digester(crypto.SHA256)
+
+// parseLFSPointer parses the oid and size of the LFS pointer file p.
+func parseLFSPointer(p []byte) (oid digest.Digest, size int64, err error) {
+	var haveSize bool
+	for p != nil {
+		line := scanLine(&p)
+		switch {
+		case bytes.HasPrefix(line, []byte("oid ")):
+			if !oid.IsZero() {
+				return digest.Digest{}, 0, errors.New("pointer file has multiple oids")
+			}
+			// Oids name their hash algorithm, as in "sha256:<hex>";
+			// unnamed oids are assumed to use lfsDigester's.
+			s := string(line[4:])
+			if strings.Contains(s, ":") {
+				oid, err = digest.Parse(s)
+			} else {
+				oid, err = lfsDigester.Parse(s)
+			}
+			if err != nil {
+				return digest.Digest{}, 0, fmt.Errorf("invalid oid %q: %v", s, err)
+			}
+		case bytes.HasPrefix(line, []byte("size ")):
+			size, err = strconv.ParseInt(string(line[5:]), 10, 64)
+			if err != nil || size < 0 {
+				return digest.Digest{}, 0, fmt.Errorf("invalid size %q", line[5:])
+			}
+			haveSize = true
+		}
+	}
+	if oid.IsZero() {
+		return digest.Digest{}, 0, errors.New("pointer file is missing oid")
+	}
+	if !haveSize {
+		return digest.Digest{}, 0, errors.New("pointer file is missing size")
+	}
+	return oid, size, nil
+}
+
+// countWriter is an io.Writer that counts the bytes written to it.
+type countWriter int64
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	*w += countWriter(len(p))
+	return len(p), nil
+}
+
 func (r *Repo) path(elems ...string) string {
 	return filepath.Join(append([]string{r.root}, elems...)...)
 }
 
 func (r *Repo) git(stdin []byte, arg ...string) ([]byte, error) {
+	return r.gitEnv(nil, stdin, arg...)
+}
+
+// gitEnv is like git, but also adds the provided variables to the
+// command's environment.
+func (r *Repo) gitEnv(env []string, stdin []byte, arg ...string) ([]byte, error) {
 	var in io.Reader
 	if stdin != nil {
 		in = bytes.NewReader(stdin)
 	}
 	var out bytes.Buffer
-	err := r.gitIO(in, &out, arg...)
+	err := r.gitIOEnv(env, in, &out, arg...)
 	return out.Bytes(), err
 }
 
@@ -372,19 +2559,57 @@ func (r *Repo) git(stdin []byte, arg ...string) ([]byte, error) {
 // error occurs during the invocation of the "git" command, its
 // standard error is included in the returned error.
 func (r *Repo) gitIO(stdin io.Reader, stdout io.Writer, arg ...string) error {
-	args := []string{"-C", r.root}
+	return r.gitIOEnv(nil, stdin, stdout, arg...)
+}
+
+// gitArgs returns the arguments with which git is invoked to run the
+// provided command on the repository: the repository's configuration
+// is passed in sorted order, so that invocations are deterministic.
+func (r *Repo) gitArgs(arg ...string) []string {
+	config := make(map[string]string)
+	for k, v := range r.opts.Config {
+		config[k] = v
+	}
 	for k, v := range r.config {
-		args = append(args, "-c")
-		args = append(args, k+"="+v)
+		config[k] = v
+	}
+	keys := make([]string, 0, len(config))
+	for k := range config {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	args := []string{"-C", r.root}
+	for _, k := range keys {
+		args = append(args, "-c", k+"="+config[k])
 	}
-	args = append(args, arg...)
-	cmd := exec.Command("git", args...)
+	return append(args, arg...)
+}
+
+func (r *Repo) gitIOEnv(env []string, stdin io.Reader, stdout io.Writer, arg ...string) error {
+	args := r.gitArgs(arg...)
+	ctx := context.Background()
+	if r.opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.opts.Timeout)
+		defer cancel()
+	}
+	cmd := exec.CommandContext(ctx, "git", args...)
 	cmd.Stdout = stdout
 	var stderr bytes.Buffer
 	cmd.Stderr = &stderr
 	cmd.Stdin = stdin
 	if len(arg) > 0 && arg[0] != "lfs" {
-		cmd.Env = append(os.Environ(), "GIT_LFS_SKIP_SMUDGE=1")
+		// LFS objects are copied and pushed by grit itself, so
+		// commands need not fetch them. The provided variables come
+		// last, so that they may override this, as the last value of
+		// a variable in cmd.Env is used.
+		env = append([]string{"GIT_LFS_SKIP_SMUDGE=1"}, env...)
+	}
+	if r.sshKeyFile != "" {
+		env = append(env, "GIT_SSH_COMMAND=ssh -i '"+r.sshKeyFile+"' -o IdentitiesOnly=yes")
+	}
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
 	}
 	log.Debug.Printf("%s: git %s", r.root, strings.Join(arg, " "))
 	if err := cmd.Run(); err != nil {
@@ -392,7 +2617,12 @@ func (r *Repo) gitIO(stdin io.Reader, stdout io.Writer, arg ...string) error {
 		if len(outerr) > 0 {
 			outerr = "\n" + outerr
 		}
-		return fmt.Errorf("%s: git %s: error: %v%s", r.root, strings.Join(arg, " "), err, outerr)
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("%s: git %s: timed out after %s%s", r.root, strings.Join(arg, " "), r.opts.Timeout, outerr)
+		}
+		// The error is wrapped so that callers may examine the
+		// command's exit status.
+		return fmt.Errorf("%s: git %s: error: %w%s", r.root, strings.Join(arg, " "), err, outerr)
 	}
 	outerr := string(stderr.Bytes())
 	if len(outerr) > 0 {
@@ -413,10 +2643,24 @@ type Commit struct {
 	Headers []Header
 	// Body is the commit message.
 	Body string
+	// Parents are the digests of the commit's parents, as listed by
+	// git log, which may simplify history to the paths of interest.
+	Parents []digest.Digest
 
 	repo *Repo
 }
 
+var sourceCommitRe = regexp.MustCompile(`grit-source-commit: ([0-9a-f]{40})`)
+
+// SourceCommits returns the full source commit hashes recorded in
+// the commit's grit-source-commit trailers, if any.
+func (c *Commit) SourceCommits() (ids []string) {
+	for _, g := range sourceCommitRe.FindAllStringSubmatch(c.Body, -1) {
+		ids = append(ids, g[1])
+	}
+	return
+}
+
 var shipitRe = regexp.MustCompile(`(?:fb)?shipit-source-id: ([a-z0-9]+)`)
 
 // ShipitID returns the shipit ID, if any.
@@ -431,6 +2675,53 @@ func (c *Commit) ShipitID() (ids []string) {
 	return
 }
 
+// IsMerge tells whether the commit has more than one parent, as listed
+// by Log.
+func (c *Commit) IsMerge() bool {
+	return len(c.Parents) > 1
+}
+
+// Header returns the value of the first header with the provided key.
+func (c *Commit) Header(key string) (string, bool) {
+	for _, h := range c.Headers {
+		if h.K == key {
+			return h.V, true
+		}
+	}
+	return "", false
+}
+
+// Author returns the commit's author, as "name <email>".
+func (c *Commit) Author() string {
+	v, _ := c.Header("Author")
+	return v
+}
+
+// logTimeLayout is the layout of dates in git log output.
+const logTimeLayout = "Mon Jan 2 15:04:05 2006 -0700"
+
+// AuthorDate returns the commit's author date.
+func (c *Commit) AuthorDate() (time.Time, error) {
+	v, ok := c.Header("AuthorDate")
+	if !ok {
+		// Log output that is not in the "fuller" format.
+		v, ok = c.Header("Date")
+	}
+	if !ok {
+		return time.Time{}, fmt.Errorf("commit %s: missing author date", c.Digest.Short())
+	}
+	return time.Parse(logTimeLayout, v)
+}
+
+// CommitDate returns the commit's committer date.
+func (c *Commit) CommitDate() (time.Time, error) {
+	v, ok := c.Header("CommitDate")
+	if !ok {
+		return time.Time{}, fmt.Errorf("commit %s: missing commit date", c.Digest.Short())
+	}
+	return time.Parse(logTimeLayout, v)
+}
+
 // String returns a "one-line" commit message.
 func (c *Commit) String() string {
 	return fmt.Sprintf("%s: %s", c.Digest.Short(), c.Title())
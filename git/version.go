@@ -0,0 +1,73 @@
+// Copyright 2018 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package git
+
+import (
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	// MinVersion is the oldest version of git that supports all of the
+	// features on which this package relies: it is the first with
+	// git am --empty, with which empty commits are applied.
+	MinVersion = "2.35.0"
+	// MinLFSVersion is the oldest version of git-lfs with which this
+	// package is known to work.
+	MinLFSVersion = "2.4.0"
+)
+
+var versionRe = regexp.MustCompile(`[0-9]+(\.[0-9]+)+`)
+
+// Version returns the version of the git installation that is used to
+// operate on repositories, e.g., "2.39.5", as reported by git --version.
+func Version() (string, error) {
+	return version("git", "--version")
+}
+
+// LFSVersion returns the version of the git-lfs installation that is
+// used to operate on LFS objects, e.g., "3.3.0", as reported by git lfs
+// version. An error is returned if git-lfs is not installed.
+func LFSVersion() (string, error) {
+	return version("git", "lfs", "version")
+}
+
+// version runs the provided command and returns the first version
+// number in its output.
+func version(name string, arg ...string) (string, error) {
+	cmd := strings.Join(append([]string{name}, arg...), " ")
+	out, err := exec.Command(name, arg...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%s: %v: %s", cmd, err, strings.TrimSpace(string(out)))
+	}
+	v := versionRe.FindString(string(out))
+	if v == "" {
+		return "", fmt.Errorf("%s: no version in output %q", cmd, strings.TrimSpace(string(out)))
+	}
+	return v, nil
+}
+
+// VersionLess tells whether version a, a dot-separated sequence of
+// numbers such as "2.39.5", precedes version b. Missing components
+// are taken to be zero, so that "2.35" and "2.35.0" are equal.
+func VersionLess(a, b string) bool {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+		if x != y {
+			return x < y
+		}
+	}
+	return false
+}
@@ -0,0 +1,35 @@
+// Copyright 2018 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package git
+
+import "testing"
+
+func TestVersionLess(t *testing.T) {
+	for _, c := range []struct {
+		a, b string
+		want bool
+	}{
+		{"2.34.1", "2.35.0", true},
+		{"2.35", "2.35.0", false},
+		{"2.35.0", "2.35", false},
+		{"2.39.5", "2.35.0", false},
+		{"2.9", "2.35", true},
+		{"10.0", "9.99.99", false},
+	} {
+		if got := VersionLess(c.a, c.b); got != c.want {
+			t.Errorf("VersionLess(%q, %q): got %v, want %v", c.a, c.b, got, c.want)
+		}
+	}
+}
+
+func TestVersion(t *testing.T) {
+	v, err := Version()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if VersionLess(v, MinVersion) {
+		t.Errorf("git %s is older than %s", v, MinVersion)
+	}
+}
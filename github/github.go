@@ -0,0 +1,111 @@
+// Copyright 2018 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// Package github implements the small subset of the GitHub API that
+// grit uses to publish releases for mirrored tags. It depends only on
+// the standard library.
+package github
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// DefaultURL is the URL of the public GitHub API.
+const DefaultURL = "https://api.github.com"
+
+// A Client issues requests to the GitHub API on behalf of the owner
+// of a token. A Client without a token does nothing.
+type Client struct {
+	// Token is the token with which requests are authorized.
+	Token string
+	// URL is the URL of the API, e.g., that of a GitHub Enterprise
+	// instance. If empty, DefaultURL is used.
+	URL string
+	// HTTPClient is used to issue requests. If nil,
+	// http.DefaultClient is used.
+	HTTPClient *http.Client
+}
+
+// A Release is a GitHub release.
+type Release struct {
+	// TagName is the name of the tag from which the release is made.
+	TagName string `json:"tag_name"`
+	// Name is the release's title.
+	Name string `json:"name,omitempty"`
+	// Body is the release's description.
+	Body string `json:"body,omitempty"`
+}
+
+// CreateRelease creates the provided release in the repository named
+// by owner and repo. It returns created=false, without error, if the
+// repository already has a release for the tag, or if the client has
+// no token.
+func (c *Client) CreateRelease(ctx context.Context, owner, repo string, release Release) (created bool, err error) {
+	if c.Token == "" {
+		return false, nil
+	}
+	b, err := json.Marshal(release)
+	if err != nil {
+		return false, err
+	}
+	url := c.URL
+	if url == "" {
+		url = DefaultURL
+	}
+	url = fmt.Sprintf("%s/repos/%s/%s/releases", strings.TrimSuffix(url, "/"), owner, repo)
+	req, err := http.NewRequest("POST", url, bytes.NewReader(b))
+	if err != nil {
+		return false, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Authorization", "Bearer "+c.Token)
+	req.Header.Set("Content-Type", "application/json")
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return false, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusCreated:
+		return true, nil
+	case resp.StatusCode == http.StatusUnprocessableEntity && alreadyExists(body):
+		return false, nil
+	default:
+		return false, fmt.Errorf("create release %s in %s/%s: %s: %s", release.TagName, owner, repo, resp.Status, bytes.TrimSpace(body))
+	}
+}
+
+// alreadyExists tells whether the provided error response reports
+// that the resource already exists.
+func alreadyExists(body []byte) bool {
+	var resp struct {
+		Errors []struct {
+			Code string `json:"code"`
+		} `json:"errors"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return false
+	}
+	for _, e := range resp.Errors {
+		if e.Code == "already_exists" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,65 @@
+// Copyright 2018 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package github
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCreateRelease(t *testing.T) {
+	releases := make(map[string]Release)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got, want := r.URL.Path, "/repos/grailbio/project/releases"; got != want {
+			t.Errorf("got path %v, want %v", got, want)
+		}
+		if got, want := r.Header.Get("Authorization"), "Bearer token"; got != want {
+			t.Errorf("got authorization %v, want %v", got, want)
+		}
+		var release Release
+		if err := json.NewDecoder(r.Body).Decode(&release); err != nil {
+			t.Error(err)
+		}
+		switch {
+		case release.TagName == "bad":
+			http.Error(w, `{"message": "Bad credentials"}`, http.StatusUnauthorized)
+		case releases[release.TagName] != (Release{}):
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			w.Write([]byte(`{"message": "Validation Failed", "errors": [{"resource": "Release", "code": "already_exists", "field": "tag_name"}]}`))
+		default:
+			releases[release.TagName] = release
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{}`))
+		}
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	client := Client{Token: "token", URL: srv.URL}
+	release := Release{TagName: "v1.0.0", Name: "v1.0.0", Body: "First release.\n"}
+	if created, err := client.CreateRelease(ctx, "grailbio", "project", release); err != nil || !created {
+		t.Fatalf("got %v, %v, want true, nil", created, err)
+	}
+	if got := releases["v1.0.0"]; got != release {
+		t.Errorf("got %+v, want %+v", got, release)
+	}
+	if created, err := client.CreateRelease(ctx, "grailbio", "project", release); err != nil || created {
+		t.Errorf("got %v, %v, want false, nil", created, err)
+	}
+	if _, err := client.CreateRelease(ctx, "grailbio", "project", Release{TagName: "bad"}); err == nil {
+		t.Error("expected error")
+	}
+	// Clients without tokens do nothing.
+	client.Token = ""
+	if created, err := client.CreateRelease(ctx, "grailbio", "project", Release{TagName: "v2.0.0"}); err != nil || created {
+		t.Errorf("got %v, %v, want false, nil", created, err)
+	}
+	if _, ok := releases["v2.0.0"]; ok {
+		t.Error("release created without a token")
+	}
+}
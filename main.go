@@ -8,7 +8,12 @@
 //
 // Usage:
 //
-// 	grit [-push] [-dump] [-linearize] src dst rules...
+// 	grit [-push] [-dump] [-linearize] [-keep-empty] [-export-ignore] [-renames] src dst rules...
+// 	grit -branches=pattern [-push] src dst rules...
+// 	grit -verify src dst rules...
+// 	grit -check src dst rules...
+// 	grit -reconcile [-push] src dst rules...
+// 	grit -revert=source-id [-push] dst
 //
 // "grit -push src dst rules..." copies commits from the repository
 // src to the repository dst, applying the the given rules and, if
@@ -20,10 +25,35 @@
 // 	url,prefix
 // 	url,prefix,branch
 //
-// The default prefix is "" and the default branch is "master". When a
+// The default prefix is "" and the default branch is the remote
+// repository's default branch (as named by its HEAD). When a
 // prefix is specified, Grit considers constructs a view of the repository
 // limited to the given prefix path. Changes outside of this prefix are
-// discarded.
+// discarded. The destination's prefix need not exist: the initial sync
+// creates it.
+//
+// Grit refuses to copy commits within a single repository, as named by
+// different spellings of its URL, e.g., with and without a ".git"
+// suffix, or as an SSH or local path: this is usually a
+// misconfiguration. The flag -force permits it when the source and
+// destination are different branches, or disjoint prefixes of the same
+// branch. A branch is never mirrored to an overlapping prefix of
+// itself, since copied commits would be copied again by the next run.
+//
+// The source, destination, and rules may instead be given by the
+// environment variables GRIT_SRC, GRIT_DST, and GRIT_RULES, which is
+// convenient for declarative deployments. GRIT_RULES contains one rule
+// per line, in the format of the -rules file. Arguments take precedence
+// over the environment: for example, GRIT_RULES is ignored if rules are
+// given as arguments.
+//
+// Exit status
+//
+// Grit exits with status 0 if it copied commits (or mirrored tags), and
+// with status 3 if there was nothing to do because the destination was
+// already up to date, so that schedulers can skip downstream steps. It
+// exits with status 1 on errors and with status 2 on usage errors. With
+// -verify, grit exits with status 0 if the destination is in sync.
 //
 // Linearization
 //
@@ -35,6 +65,580 @@
 // histories are not linear (e.g., when accepting patches from
 // GitHub).
 //
+// Source commits are copied oldest first, in the reverse of the order
+// in which git log lists them: by default, by commit date. Commits
+// with equal commit dates, as are common after a rebase, are copied
+// parents first and otherwise in an order determined by their hashes,
+// so that repeated syncs of the same source produce the same
+// destination history. If the source history is not linear, commits
+// on concurrent lines of history are then interleaved, and a commit
+// whose committer clock was skewed may be copied before its parent, so
+// that its patch fails to apply.
+// If the flag -topo-order is provided, commits are instead copied in
+// topological order, so that parents are always copied before their
+// children, and each line of history is copied without interleaving.
+//
+// Statistics
+//
+// If the flag -stats is provided, grit writes a JSON summary of each
+// sync to the given file, so that it can be exported as metrics. The
+// summary is an array with an entry for each synced branch, reporting
+// the number of commits applied, and the number of source commits that
+// were skipped as empty, stripped, or had their messages stripped. The
+// stats are written even if a sync fails, with an entry that reports
+// its error. Programs that embed grit may instead call mirror.Sync, in
+// package github.com/grailbio/grit/mirror, which returns the summary.
+//
+// If the flag -summary is provided, grit logs a summary of each copied
+// commit's changes, in the format of git diff --stat. The summary is
+// computed after rules are applied, and so reflects the changes made
+// to the destination.
+//
+// Logging
+//
+// Grit logs the progress of each sync at the default level, info, and
+// the commits it applies, skips, or filters at debug level (-log=debug).
+// Warnings and errors are logged at error level. Each sync ends with a
+// summary line reporting the numbers of commits applied and skipped, as
+// -stats does. If the flag -quiet is provided, only warnings, errors,
+// and the summaries are logged; -quiet cannot be combined with -log.
+//
+// Timeouts
+//
+// If the flag -timeout is provided, each git command that grit runs,
+// such as a fetch or a push, is killed if it does not complete within
+// the given duration, and grit exits with an error naming the command.
+//
+// Push throttling
+//
+// Remotes such as GitHub reject pushes that exceed their rate limits,
+// which is likely when many mirrors are run together. If the flag
+// -push-interval is provided, pushes to the destination, including
+// those of tags and notes, start at least the given duration apart,
+// including across the branches synchronized with -branches and
+// -parallel. If the flag -push-retries is provided, a push that the
+// remote rejects as rate-limited, as recognized by its error output
+// (e.g., "rate limit" or HTTP 429), is retried up to that many times,
+// with exponential backoff starting at -push-interval or a second,
+// whichever is longer. Other push failures are not retried.
+//
+// Some proxies, and misconfigured remotes, report pushes as successful
+// although the remote branch was not updated; the next run then copies
+// the same commits again. If the flag -verify-push is provided, grit
+// confirms after each push that the destination branch is at the
+// pushed commit, and exits with an error if it is not.
+//
+// Versions
+//
+// Grit logs the versions of git and git-lfs when it starts, and warns if
+// they are older than the oldest versions that support the features on
+// which grit relies, such as git am --empty, since differing versions
+// across machines can cause subtle failures to apply commits. "grit
+// -version" logs the versions and exits.
+//
+// Git configuration
+//
+// The flag -config passes comma-separated key=value pairs as
+// configuration parameters to every git command that grit runs,
+// including those that clone, fetch, and push repositories. For
+// example, "-config=http.proxy=http://proxy:3128,http.sslCAInfo=/etc/ca.pem"
+// configures an HTTP proxy and a custom CA bundle.
+//
+// Commits are applied to the destination as the committer given by its
+// user.name and user.email configuration. The flags -committer-name and
+// -committer-email set these for the destination, as would
+// "-config=user.name=...,user.email=...". Unless patches are only
+// dumped or the destination is only verified, grit exits with an error
+// at startup if no committer identity is configured, by these flags or
+// otherwise.
+//
+// If the environment variable GRIT_SRC_SSH_KEY or GRIT_DST_SSH_KEY is
+// set, it holds an SSH private key, such as a deploy key, with which
+// grit authenticates to the source or destination remote, respectively.
+// The key is written to a temporary file for the duration of the run,
+// so that ~/.ssh need not be provisioned, as in stateless CI runners.
+//
+// Grit keeps a checkout of each repository in /var/tmp/grit, which it
+// resets to the remote branch at the start of each run. If the flag
+// -ff-only is provided, the destination's checkout is instead
+// fast-forwarded, and grit fails if it has diverged from the remote,
+// e.g., because commits applied by an earlier run were not pushed.
+// Before either, the checkout is cleaned: any git am, rebase, or merge
+// left in progress by an interrupted run is aborted, and uncommitted
+// changes and untracked files are discarded. "grit -clean src dst"
+// cleans the checkouts of src and dst in this way, and exits without
+// copying commits.
+//
+// With -push, grit records its progress in a journal in the
+// destination's checkout as it applies commits, and clears it once
+// they are pushed. If a run is interrupted before pushing, e.g., by a
+// signal or by running out of memory, the next run resumes from the
+// journal: rather than resetting the checkout, it keeps the commits
+// that were applied, copies only the commits that remain, and pushes
+// them all, even if no commits remain to be copied. If the remote
+// branch has changed in the meantime, the applied commits are
+// discarded and copied anew, as they are if a -pre-push command (see
+// below) vetoes the push. Runs with -no-trailer or -notes, which keep
+// state in notes, are not journaled.
+//
+// If the flag -partial-clone is provided, the source's checkout is
+// created as a partial clone, without blobs: only commits and trees are
+// downloaded when it is cloned, and blobs are fetched as they are
+// needed, e.g., to produce the diffs of the commits that are copied.
+// This speeds up the first run considerably for sources whose history
+// holds many large files outside of the copied prefix. The source's
+// remote must support partial clone, and the flag has no effect on
+// existing checkouts.
+//
+// If the flag -sparse-checkout is provided, the working trees of the
+// source's and destination's checkouts are limited to their prefixes,
+// along with the files in the prefixes' parent directories, using
+// git's sparse checkout, so that resetting checkouts and applying
+// patches need not write files outside of the prefixes. Combined with
+// -partial-clone, the blobs of such files in the source are never
+// fetched. Existing checkouts are made sparse, and are restored when
+// the flag is no longer provided. The flag has no effect on a
+// repository without a prefix.
+//
+// Git LFS
+//
+// Grit copies the Git LFS objects referred to by copied LFS pointers,
+// and pushes them along with the destination branch. LFS objects are
+// pushed only if the destination contains LFS pointers, so git-lfs
+// need not be installed to mirror repositories that do not use LFS;
+// grit refuses to push a destination that does, if git-lfs is not
+// installed. If the flag -no-lfs is provided, LFS pointers are copied
+// as regular files and LFS objects are neither copied nor pushed.
+//
+// Pre-push validation
+//
+// If the flag -pre-push is provided, the given shell command is run in
+// the destination repository's checkout after all commits have been
+// applied, but before they are pushed. If the command fails, grit exits
+// without pushing. The command is also run before pushing the commit
+// made by -revert or -reconcile. Its environment includes:
+//
+//	GRIT_CHANGED_PATHS  sorted, newline-separated list of paths changed by the copied commits,
+//	                    including those applied by an interrupted run that is resumed
+//	GRIT_NCOMMIT        the number of copied commits
+//	GRIT_DST_BRANCH     the destination branch
+//	GRIT_DST_PREFIX     the destination prefix
+//
+// Re-seeding
+//
+// Grit finds the last synchronized source commit by searching the
+// destination's history for source IDs. If the flag -force-initial is
+// provided, this search is skipped, and grit performs an initial sync,
+// copying every source commit as if the destination had never been
+// synchronized. Commits that were already copied are copied again, so
+// this is useful only when the destination's history is corrupted, or
+// when the source history has been rewritten. If the flag -since is
+// also provided, only the source commits after the given commit are
+// copied.
+//
+// If the source branch has been force-pushed so that the last
+// synchronized source commit is no longer in its history, grit exits
+// with an error rather than silently copying nothing. The error names
+// the last commit that the old and new histories have in common, if
+// any, so that the destination can be re-seeded with -force-initial
+// and -since.
+//
+// Destination commits with source IDs that no longer apply under the
+// current rules, for example because a new strip rule excludes all of
+// the files they touched, are skipped by the search. To keep the
+// search from walking the destination's entire history, at most
+// -search-limit such commits (1000 by default) are examined; if none
+// of them applies, grit exits with an error rather than performing an
+// initial sync. A limit of 0 removes the bound.
+//
+// If the flag -merge-base is provided, grit instead copies the source
+// commits after the merge base of the last synchronized source commit
+// and the source branch's head. When the source history has diverged,
+// this copies the commits after the last commit common to both
+// histories, including rewritten versions of commits that were
+// already copied, which may then fail to apply. Since the range is not
+// limited to descendants of the last synchronized commit, it also
+// includes commits on branches that were merged after forking from an
+// earlier commit.
+//
+// Limiting commits
+//
+// If the flag -max-commits is provided, at most the given number of
+// (destination) commits are copied, oldest first, and pushed. This
+// allows a large backlog of commits to be copied over several runs,
+// each of which resumes from the commits copied by the previous one.
+//
+// Filtering by author
+//
+// If the flag -author-allow is provided, only source commits whose
+// author (as "name <email>") matches the given regular expression are
+// copied; if the flag -author-deny is provided, source commits whose
+// author matches it are not copied. Other commits are skipped, and
+// logged, so that they may be reviewed and copied by other means.
+// Filtering does not affect how grit finds the last synchronized
+// commit: a skipped commit that precedes a copied one is not
+// reconsidered by later syncs, even if the filters change.
+//
+// Signed commits
+//
+// If the flag -require-signed is provided, only source commits with a
+// good GPG signature are copied. Signatures are checked as by git
+// verify-commit, against the keyring of the user running grit (or the
+// one in GNUPGHOME); git's gpg.minTrustLevel configuration, which may
+// be passed with -config, determines which keys are trusted. Unsigned
+// and badly signed commits are skipped and reported as errors, along
+// with their number. Like author filters, this does not affect how
+// grit finds the last synchronized commit.
+//
+// A signature cannot be carried across the rewriting of a commit, but
+// if the flag -signature-trailers is provided, the signature of each
+// signed source commit is recorded, for provenance, in the destination
+// commit's message by informational trailers: grit-original-signer,
+// which names the signer (or the signing key, if it is not in the
+// keyring), and grit-original-signature, which holds the armored
+// signature, base64-encoded. The signature remains checkable against
+// the source commit.
+//
+// Local sources
+//
+// If the flag -local-source is provided, the source is named by the
+// path of an existing local working tree, which grit reads directly
+// instead of cloning it. The working tree must have the source branch
+// checked out (if the branch is omitted from the spec, the checked-out
+// branch is used), and is never modified. A local source cannot be
+// linearized, nor can it be used with -branches.
+//
+// Prefix maps
+//
+// Several source directories may be mirrored to different directories
+// of a single destination in one run. The flag -prefix-map names a
+// file that maps each source directory to a destination directory,
+// relative to the destination's prefix, one per line:
+//
+// 	# Comments and blank lines are ignored.
+// 	internal/tools/lint -> lint
+// 	internal/tools/lint/docs -> docs
+// 	third_party/ext -> vendor/ext
+//
+// Each source file is mapped by the longest source directory that
+// contains it; changes to files in none of them are dropped, as are
+// changes outside of the prefix without a map. A source commit that
+// changes several mapped directories is copied as a single destination
+// commit. No two lines may map the same source, or to the same
+// destination, directory. A prefix map cannot be used with a source
+// prefix, or with -verify.
+//
+// Multiple branches
+//
+// If the flag -branches is provided, each source branch matching the
+// given glob pattern (e.g., "release/*") is mirrored to the destination
+// branch of the same name; the branches given in the repository specs
+// are then used only to open the repositories. Each branch is synced
+// independently, tracking its own last synchronized commit. Source
+// branches that do not exist in the destination are skipped: they must
+// be created in the destination before they can be mirrored.
+//
+// If the flag -parallel=n is also provided, up to n branches are synced
+// concurrently. Each branch has its own checkouts and locks, so that
+// concurrent syncs do not interfere, and their statistics are reported
+// in branch order. Whether or not branches are synced concurrently, a
+// branch whose sync fails does not stop the others: each failure is
+// reported with its branch, and grit exits with an error once all
+// branches are done. Log messages of concurrent syncs are interleaved.
+// Patches cannot be dumped in parallel.
+//
+// Renames
+//
+// By default, file renames are copied as a deletion of the old path
+// and an addition of the new path. If the flag -renames is provided,
+// renames are detected and copied as renames, preserving file history
+// in the destination repository. Renames across the source prefix
+// boundary, or between a stripped and a non-stripped path, are still
+// copied as a deletion or an addition.
+//
+// Patch context
+//
+// Patches are produced with git's default of 3 lines of context. When
+// unrelated changes in the destination leave a hunk's context
+// ambiguous, more context helps it apply at the intended location. The
+// flag -context=n produces patches with n lines of context, and the
+// flag -function-context includes the whole function surrounding each
+// change, as determined by git's function-name heuristics (see
+// gitattributes(5)). Both make patches larger, and a hunk with more
+// context also conflicts with more of the destination's changes.
+//
+// Diff drivers configured for the source, by git configuration and
+// gitattributes(5), are not used to produce patches: textconv filters
+// and external diff commands, as may be set up for notebooks or
+// serialized protocol buffers, produce diffs that are meaningful to
+// people but cannot be applied. Files that git treats as binary,
+// including those with the -diff attribute or a diff driver marked as
+// binary, are copied exactly, as binary patches.
+//
+// Patches are applied to the destination as they are, including any
+// whitespace errors, such as trailing whitespace, that they contain.
+// Destinations whose linters reject such errors may use the flag
+// -whitespace=fix to correct them as patches are applied; -whitespace
+// accepts each of the actions of git am --whitespace (see
+// git-apply(1)), and -whitespace=error instead fails the run on a
+// patch with whitespace errors. Fixed content differs from the
+// source, so that -verify reports the fixed files.
+//
+// Submodules
+//
+// Changes to submodules are copied as changes to their gitlinks: the
+// destination records the same submodule commits as the source, along
+// with any changes to .gitmodules, but grit never fetches submodule
+// contents. Rewrite and normalization rules do not apply to gitlinks.
+// If the flag -skip-submodules is provided, gitlink and .gitmodules
+// changes are instead stripped, with a warning.
+//
+// Large binary files
+//
+// Binary files that are not tracked by Git LFS are copied like any
+// other. To keep large ones out of the destination, provide the flag
+// -max-blob-size=n: changes that add or modify a binary file larger
+// than n bytes, as stored in the source, are stripped, with a warning
+// naming the file and its size. So that the stripped file's later
+// changes also apply, a change is stripped if the file is larger than
+// n bytes either before or after it; in particular, deletions of such
+// files are stripped too. Since the stripped files remain in the
+// source, -verify reports them.
+//
+// Debugging rules
+//
+// Grit logs the rules in effect, including those read from the -rules
+// file and GRIT_RULES, when it starts synchronizing. They are logged
+// as they would be given on the command line, quoted for the shell, so
+// that a run can be reproduced from its log.
+//
+// When logging at debug level (-log=debug), grit logs each file that
+// is stripped, message-stripped, or rewritten by a rule. If the flag
+// -verbose-diff=n is also provided, the affected diff contents,
+// truncated to n bytes, are logged too; rewritten diffs are logged
+// both before and after rewriting.
+//
+// Linting rules
+//
+// "grit -lint rules..." checks the given rules, together with those in
+// the -rules file (or GRIT_RULES, if no rules are given as arguments),
+// without accessing any repository. Each rule that fails to parse is
+// reported along with the error. Rewrite and redact rules whose
+// replacements refer to capture groups that their regexps do not
+// define are reported as warnings: such references expand to the
+// empty string. A common instance is "$1x", which refers to a group
+// named "1x" rather than to group 1 followed by "x"; write "${1}x"
+// instead. grit exits with a non-zero status if any problem is found.
+//
+// Dumping patches
+//
+// "grit -dump src dst rules..." writes the patches that would be
+// applied to the destination to stdout instead of applying them. The
+// patches are written as an mbox, in the format of git format-patch,
+// so that they may be applied with git am; unlike git format-patch,
+// grit dates each patch's "From " line with its commit time, in UTC,
+// for mbox parsers that reject git's fixed date. If the flag
+// -dump-file is provided, the mbox is written to the named file
+// instead; -dump-file implies -dump.
+//
+// "grit -dump=json src dst rules..." instead writes each patch as a
+// JSON object, on a line of its own, for tools that do not parse the
+// git patch format. Each object has the patch's id, author, time,
+// subject, and body, and its diffs, each with its path, oldPath (for
+// renames), meta (the diff's extended header), insertions, deletions,
+// and binary fields. The body of a text diff is given by its body
+// field; that of a binary diff is base64-encoded in its binaryBody
+// field.
+//
+// Verification
+//
+// "grit -verify src dst rules..." checks that the destination
+// repository is in sync with the source repository: it compares the
+// destination's tree against the tree that would result from copying
+// the source's tree under the given rules. If the trees differ, the
+// residual diffs are written to stdout and grit exits with a non-zero
+// status. Note that changes excluded by strip-commit rules cannot be
+// accounted for, and are reported as differences.
+//
+// Checking
+//
+// "grit -check src dst rules..." checks that the commits that would be
+// copied apply cleanly to the destination, without pushing them. The
+// commits are applied to a linked worktree (see git-worktree(1)) of the
+// destination's checkout, which shares its objects, and which is
+// removed afterwards. If a commit fails to apply, the
+// conflicting paths and the rejected diffs are written to stdout, and
+// grit exits with a non-zero status. This is useful to catch conflicts
+// before a scheduled sync does.
+//
+// Resolving conflicts
+//
+// "grit -interactive -push src dst rules..." copies commits as usual,
+// but when a commit fails to apply, grit does not fail: it leaves the
+// git am session in the destination's checkout in progress, writes
+// the commit, its source commits, the conflicting paths, and the
+// rejected diffs to stderr, and prompts on stdin for how to proceed.
+// Where a three-way merge was possible, the conflicting files hold
+// conflict markers. To continue, resolve the conflicts in the checkout,
+// whose path grit prints, stage the result with git add, and answer
+// "c": the commit is applied as resolved, and grit copies the remaining
+// commits. Answer "s" to skip the commit, discarding any changes made
+// to it, or "a" to abort, which leaves the destination as it was; grit
+// also aborts if stdin ends. A failed run does not leave its am
+// session behind to be resolved later: after a scheduled sync fails on
+// a conflict, running grit with -interactive and the same arguments
+// copies the remaining commits, stopping at the conflict. With -push,
+// the source commits that were skipped are recorded in the
+// destination's refs/grit/skipped, and later runs, interactive or not,
+// do not copy them. The flag -interactive cannot be used with -dump,
+// -verify, -check, -reconcile, or -branches.
+//
+// Reverting
+//
+// "grit -revert=source-id -push dst" backs a mirrored commit out of the
+// destination: it finds the destination commit that records the given
+// source commit, which is named by a hash of at least 7 digits, and
+// commits its reverse, as by git revert, and pushes it. Without -push,
+// the revert is committed only to grit's checkout, as with other
+// modes. Grit fails if no commit, or more than one, records the source
+// commit; if the commit squashes several source commits, which would
+// all be reverted; if the commit was already reverted; and if its
+// reverse does not apply cleanly. The revert's message does not record
+// the source commit, so later syncs do not copy it again.
+//
+// Reconciling
+//
+// Rules apply only to the commits that grit copies: adding a strip rule
+// does not remove the files it matches that earlier syncs copied to
+// the destination. "grit -reconcile -push src dst rules..." commits the
+// deletion of the destination files that the rules, and -export-ignore
+// if it is provided, would now strip, and pushes it, so that the
+// destination converges to what the current rules produce. The
+// deletion's message lists the rules that strip the files, and does
+// not record a source commit, so later syncs are unaffected. Without
+// -push, the deletion is committed only to grit's checkout. Grit exits
+// with status 3 if no destination file is stripped.
+//
+// Squashing
+//
+// If the flag -squash-window is provided, runs of consecutive source
+// commits by the same author, each within the given duration of the
+// first commit in the run, are squashed into a single destination
+// commit. The squashed commit's message concatenates the messages of
+// its source commits, and it records the source ID of each.
+//
+// If the flag -squash-run is provided, all of the source commits that
+// a run copies, after rules are applied, are squashed into a single
+// destination commit, which represents their net change. Its message
+// lists the source commits by ID and subject, and records the source ID
+// of each, so that subsequent runs continue from the last of them. It
+// keeps the author of the last source commit, and credits the authors
+// of the others in Co-authored-by trailers. With -max-commits, at most
+// that many source commits are squashed by each run.
+//
+// Source commits
+//
+// Source commits are recorded in the destination commit messages by
+// their abbreviated IDs, in fbshipit-source-id trailers. If the flag
+// -source-commits is provided, their full hashes are also recorded,
+// in grit-source-commit trailers; subsequent syncs then use the full
+// hashes to find the last synchronized commit.
+//
+// Co-authored-by trailers in source commit messages are moved to the
+// end of the destination commit's message, alongside the source IDs,
+// so that they remain recognizable as trailers. A squashed commit
+// carries the trailers of each of its source commits, and credits
+// the authors of its source commits other than its own in
+// Co-authored-by trailers.
+//
+// If the flag -no-trailer is provided, the source IDs are not added to
+// destination commit messages. They are instead recorded in git notes
+// in the destination's refs/notes/grit, which are pushed along with its
+// branch, and from which subsequent syncs find the last synchronized
+// commit. The flag must then be provided on every sync. Since the
+// destination's commits carry no trailers, they are not recognized as
+// copies if the destination is in turn synchronized back to the source.
+//
+// Message templates
+//
+// If the flag -message-template is provided, destination commit
+// messages are rendered from the named file, which contains a Go
+// text/template. The template's first line is the message's subject,
+// and the remainder its body. Trailers are appended to the rendered
+// message as usual. The template may refer to the following fields:
+//
+// 	.Subject        the source commit's subject
+// 	.Body           the source commit's message body, without its subject
+// 	.Author         the source commit's author, as "name <email>"
+// 	.Date           the source commit's author date, a time.Time
+// 	.SourceID       the abbreviated ID of the source commit
+// 	.SourceCommit   the full ID of the source commit
+//
+// For example, the template
+//
+// 	{{.Subject}}
+//
+// 	{{.Body}}
+//
+// 	Mirrored from the internal repository (commit {{.SourceID}}).
+//
+// preserves the source message and adds a disclaimer. For squashed
+// commits, the fields describe the combined message and the newest
+// source commit.
+//
+// Notes
+//
+// If the flag -notes is provided, the git notes (in refs/notes/commits)
+// attached to source commits are attached to the corresponding
+// destination commits, and the destination's notes are pushed along
+// with its branch. A squashed commit carries the notes of each of its
+// source commits. Source commits without notes are copied as usual.
+//
+// Case-insensitive filesystems
+//
+// If the flag -case-insensitive is provided, grit fails before
+// applying any commits if a copied commit would add a path that differs
+// only in case from another path in the destination, as such paths
+// collide when the destination is checked out on a case-insensitive
+// filesystem, such as those commonly used by macOS. The error names
+// the offending commit and paths.
+//
+// Tags
+//
+// If the flag -tags is provided, each source tag that refers to a
+// copied commit, and that the destination does not yet have, is
+// created in the destination, referring to the destination commit
+// that records the source commit's ID, and pushed. Annotated tags keep
+// their messages. Tags on commits that were not copied, e.g., because
+// they were stripped, are not mirrored.
+//
+// The source commit of each mirrored tag is recorded in the commit
+// message of the destination ref refs/grit/tags, so that each run
+// pushes only newly created tags and detects tags that were moved in
+// the source since they were mirrored. Moved tags are left as is, and
+// reported, unless the flag -force-tags is also provided, in which
+// case they are moved in the destination and force-pushed. Tags that
+// already exist in the destination when they are first seen are
+// recorded as they are in the source.
+//
+// If the flag -github-releases=owner/repo is also provided, grit
+// creates a GitHub release in the given repository for each mirrored
+// tag, with the tag's message as the release's description. Releases
+// are created using the token in the environment variable GITHUB_TOKEN;
+// without a token, no releases are created. The API endpoint may be
+// set by the environment variable GITHUB_API_URL, e.g., for GitHub
+// Enterprise.
+//
+// Empty commits
+//
+// By default, patches that end up with no diffs are skipped. If the
+// flag -keep-empty is provided, source commits that are themselves
+// empty (for example, release markers) are instead copied as empty
+// commits. Commits that become empty only because of rules or prefix
+// filtering are still skipped. Note that when the source repository
+// has a prefix, empty commits are never selected, since they do not
+// touch the prefix.
+//
 // Rules
 //
 // Grit can apply a set of rewrite rules to source commits before
@@ -49,11 +653,23 @@
 //    Strips commit messages when all files with changes match the given
 //    regular expression. This rule can be used to push internal cross-repo
 //    maintenance changes that do not need a context in the external world. For
-//    example, go.mod and go.sum files.
+//    example, go.mod and go.sum files. If the flag -keep-trailers is
+//    provided, the trailers of stripped messages, such as Signed-off-by,
+//    are kept, so that sign-offs survive stripping: they are moved to
+//    the end of the destination commit's message, as are Co-authored-by
+//    trailers (see "Source commits").
 //
 //  strip-commit:hash
 //    Strip the commit named by the given hash. This is useful for excluding
-//    troublesome commits that you know are safe to ignore.
+//    troublesome commits that you know are safe to ignore. Longer lists of
+//    commits may be kept in a file given by the flag -strip-commits-file,
+//    which lists one hash per line; blank lines and lines beginning with
+//    "#" are ignored. Each hash is validated as for strip-commit rules.
+//
+//  strip-message-commit:regexp
+//    Strip commits whose messages match the given regular expression. This is
+//    useful for excluding classes of commits, for example automated ones,
+//    regardless of their hashes.
 //
 //  rewrite:regexp:/old_re/new_re/
 //    For each file whose path matches regexp, regexp-replace each line in the
@@ -67,6 +683,72 @@
 //
 //  rewrite:go.mod$:!replace .* => .*!!
 //
+//  rewrite:regexp:+:/old_re/new_re/
+//  rewrite:regexp:-:/old_re/new_re/
+//    Like rewrite, but replaces only in the lines added ("+") or removed
+//    ("-") by each diff, leaving context lines as is. Since the
+//    destination's content is unaffected by the rewriting of removed
+//    lines, grit -verify applies only rewrite rules for added lines and
+//    for all lines.
+//
+//  add-header:regexp:file
+//    Prepends the contents of the given file to each newly added file whose
+//    path matches regexp, unless the added file already begins with it.
+//    Headers are never added to existing files, but subsequent changes to
+//    files that were given a header are adjusted for it. Since grit -verify
+//    cannot tell when a file was added, it expects every matching file to
+//    begin with the header.
+//
+//  redact:/secret_re/replacement/
+//    Replaces matches of secret_re in the content of every diff with
+//    replacement, e.g., "redact:/tok_[0-9a-f]{32}/***REDACTED***/". As with
+//    rewrite, the first character determines the separator. Diff metadata,
+//    such as file names, is left as is.
+//
+//  route:regexp:/content_re/dir/
+//    Places each file whose path matches regexp, and whose content has a
+//    line matching content_re, in the directory dir of the destination,
+//    keeping its base name; the first matching line determines the
+//    directory. Dir is relative to the destination's prefix, and may refer
+//    to content_re's capture groups, e.g.,
+//    "route:\.proto$:!^// grit-dir: (\S+)!$1!". A new file is routed by its
+//    added lines, and a changed file by its content in the source before
+//    and after the change, so that changing the matching line moves the
+//    file. Files stored in Git LFS are routed by the contents of their
+//    objects, not of their pointers, unless -no-lfs is provided. As with
+//    rewrite, the first character determines the separator.
+//
+//  trim-trailing-space:regexp
+//    Strips trailing whitespace, including carriage returns, from each line
+//    in files matching the given regular expression.
+//
+//  normalize-eol:regexp
+//    Converts CRLF line endings to LF in files matching the given regular
+//    expression.
+//
+// Normalization and redaction apply to all lines in a diff, including
+// context and removed lines, since these refer to content that was
+// itself normalized or redacted when it was copied.
+//
+// Path rules match the paths of files in the destination: the source's
+// prefix is first replaced by the destination's. Strip rules then match
+// each file's path before it is routed, and rewrite, add-header,
+// normalization, and redaction rules match its routed path. Routing
+// matches the source content, before it is rewritten. Grit fails if two
+// files of a commit are routed to the same path; -case-insensitive
+// checks routed paths. Grit -verify does not account for route rules,
+// and reports routed files as differing.
+//
+// If the flag -export-ignore is provided, files that have the
+// export-ignore attribute set in the source repository's .gitattributes
+// files (as used by git archive) are stripped, in addition to those
+// matched by strip rules.
+//
+// Rules may also be read from a file named by the -rules flag. The file
+// contains one rule per line; blank lines and lines beginning with "#"
+// are ignored. Rules from the file are combined with any rules given
+// as arguments.
+//
 // One way sync
 //
 // Copy commits from the "project/" directory in repository
@@ -106,417 +788,790 @@
 package main
 
 import (
-	"bytes"
+	"bufio"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strings"
+	"text/template"
 
 	"github.com/grailbio/base/log"
 	"github.com/grailbio/grit/git"
+	"github.com/grailbio/grit/github"
+	"github.com/grailbio/grit/mirror"
+	"github.com/grailbio/grit/rules"
 )
 
+// exitNothingToDo is the exit status used when grit copied no
+// commits and mirrored no tags.
+const exitNothingToDo = 3
+
 func usage() {
 	fmt.Fprintln(os.Stderr, `usage:
 	grit src dst rules...
 	grit -push src dst rules...
-	grit -dump src dst rules`)
+	grit -dump src dst rules
+	grit -check src dst rules
+	grit -lint rules...
+	grit -clean src dst
+	grit -revert=source-id [-push] dst
+	grit -reconcile [-push] src dst rules...
+	grit -version`)
 	flag.PrintDefaults()
 	os.Exit(2)
 }
 
+var (
+	dump         = dumpFlag("dump", "dump patches to stdout instead of applying them to the destination repository; -dump=json dumps them as JSON")
+	dumpFile     = flag.String("dump-file", "", "dump patches to this mbox file instead of stdout; implies -dump")
+	push         = flag.Bool("push", false, "push applied changes to the destination repository's remote")
+	configs      = flag.String("config", "", "comma-separated key-value pairs that should be passed to git")
+	commitName   = flag.String("committer-name", "", "name of the committer of commits applied to the destination (user.name)")
+	commitEmail  = flag.String("committer-email", "", "email of the committer of commits applied to the destination (user.email)")
+	linearize    = flag.Bool("linearize", false, "linearize source repository history before copying commits")
+	verify       = flag.Bool("verify", false, "verify that the destination is in sync with the source instead of copying commits")
+	check        = flag.Bool("check", false, "check that commits apply cleanly to a worktree of the destination, without pushing them")
+	keepEmpty    = flag.Bool("keep-empty", false, "copy empty source commits as empty commits instead of skipping them")
+	exportIgnore = flag.Bool("export-ignore", false, "strip files with the export-ignore attribute in the source repository")
+	squashAll    = flag.Bool("squash-run", false, "squash all of the source commits copied by each run into a single commit")
+	squashWindow = flag.Duration("squash-window", 0, "squash consecutive source commits by the same author within this window into a single commit")
+	renames      = flag.Bool("renames", false, "detect renames in source commits and copy them as renames")
+	rulesFile    = flag.String("rules", "", "file containing rules, one per line, in addition to those given as arguments")
+	stripFile    = flag.String("strip-commits-file", "", "file listing hashes of commits to strip, one per line, as if given by strip-commit rules")
+	maxCommits   = flag.Int("max-commits", 0, "if positive, the maximum number of commits to copy in a single run")
+	verboseDiff  = flag.Int("verbose-diff", 0, "when logging at debug level, log up to this many bytes of each stripped or rewritten diff")
+	skipSubmods  = flag.Bool("skip-submodules", false, "strip changes to submodule gitlinks and .gitmodules files")
+	maxBlobSize  = flag.Int64("max-blob-size", 0, "if positive, strip changes that add or modify binary files larger than this many bytes")
+	pushInterval = flag.Duration("push-interval", 0, "if positive, the minimum interval between the starts of successive pushes to the destination")
+	pushRetries  = flag.Int("push-retries", 0, "the number of times to retry, with exponential backoff, pushes rejected by the destination's rate limits")
+	verifyPush   = flag.Bool("verify-push", false, "after pushing, fail unless the destination branch is at the pushed commit")
+	timeout      = flag.Duration("timeout", 0, "if positive, the maximum duration of each git command; commands that exceed it are killed")
+	localSource  = flag.Bool("local-source", false, "read the source directly from an existing local working tree instead of cloning it")
+	forceInitial = flag.Bool("force-initial", false, "ignore previously synchronized commits and perform an initial sync")
+	since        = flag.String("since", "", "with -force-initial, copy only the source commits after this one")
+	stats        = flag.String("stats", "", "file to which to write a JSON summary of each sync, e.g., for exporting metrics")
+	fullIDs      = flag.Bool("source-commits", false, "record full source commit hashes in grit-source-commit trailers")
+	noLFS        = flag.Bool("no-lfs", false, "do not copy or push Git LFS objects")
+	prePush      = flag.String("pre-push", "", "shell command to run in the destination checkout before pushing; a failure aborts the push")
+	branches     = flag.String("branches", "", "mirror each source branch matching this glob pattern to the same-named destination branch")
+	parallel     = flag.Int("parallel", 1, "with -branches, the maximum number of branches to sync concurrently")
+	copyNotes    = flag.Bool("notes", false, "copy git notes from source commits to destination commits, and push them")
+	caseCheck    = flag.Bool("case-insensitive", false, "fail if copied commits would add paths that differ only in case from others, as they collide on case-insensitive filesystems")
+	mirrorTags   = flag.Bool("tags", false, "mirror source tags that refer to copied commits to the destination")
+	releases     = flag.String("github-releases", "", "with -tags, create a release for each mirrored tag in this GitHub owner/repo, using GITHUB_TOKEN")
+	forceTags    = flag.Bool("force-tags", false, "with -tags, update destination tags whose source tags were moved since they were mirrored")
+	force        = flag.Bool("force", false, "copy commits between different branches, or disjoint prefixes, of the same repository")
+	summary      = flag.Bool("summary", false, "log a diffstat of each copied commit, after rules are applied")
+	mergeBase    = flag.Bool("merge-base", false, "copy the source commits after the merge base of the last synchronized commit and the source head")
+	authorAllow  = flag.String("author-allow", "", "copy only source commits whose author matches this regexp")
+	authorDeny   = flag.String("author-deny", "", "do not copy source commits whose author matches this regexp")
+	ffOnly       = flag.Bool("ff-only", false, "fast-forward the destination checkout instead of resetting it, failing if it has diverged from the remote")
+	noTrailer    = flag.Bool("no-trailer", false, "record source commits in the destination's refs/notes/grit instead of in commit message trailers")
+	msgTemplate  = flag.String("message-template", "", "file containing a Go text/template from which to render destination commit messages")
+	topoOrder    = flag.Bool("topo-order", false, "copy source commits in topological order rather than by commit date")
+	partialClone = flag.Bool("partial-clone", false, "clone the source repository without blobs, fetching them as they are needed")
+	sparse       = flag.Bool("sparse-checkout", false, "limit the working trees of the source and destination checkouts to their prefixes")
+	searchLimit  = flag.Int("search-limit", 1000, "the maximum number of destination commits with source IDs to examine when searching for the last synchronized commit; 0 means no limit")
+	signedOnly   = flag.Bool("require-signed", false, "copy only source commits with good GPG signatures, skipping and reporting the others")
+	keepTrailers = flag.Bool("keep-trailers", false, "keep the trailers, such as Signed-off-by, of commit messages stripped by strip-message rules")
+	sigTrailers  = flag.Bool("signature-trailers", false, "record the signers and signatures of signed source commits in trailers")
+	contextLines = flag.Int("context", 0, "if positive, produce patches with this many lines of context instead of 3")
+	funcContext  = flag.Bool("function-context", false, "produce patches with the whole surrounding function as context")
+	whitespace   = flag.String("whitespace", "", "handle whitespace errors in applied patches with this git am --whitespace action: nowarn, warn, fix, error, or error-all")
+	clean        = flag.Bool("clean", false, "clean the checkouts of the source and destination, e.g., after an interrupted run, and exit")
+	lint         = flag.Bool("lint", false, "check the rules given as arguments, with -rules, or in GRIT_RULES, and exit")
+	showVersion  = flag.Bool("version", false, "log the versions of git and git-lfs and exit")
+	revert       = flag.String("revert", "", "revert the destination commit copied from this source commit, instead of copying commits")
+	reconcile    = flag.Bool("reconcile", false, "commit the deletion of destination files that the rules would now strip, instead of copying commits")
+	interactive  = flag.Bool("interactive", false, "when a commit fails to apply, prompt to continue after resolving its conflicts in the destination's checkout, to skip it, or to abort")
+	mapFile      = flag.String("prefix-map", "", "file mapping source directories to destination directories, one \"src -> dst\" per line, in place of the source prefix")
+	quiet        = flag.Bool("quiet", false, "log only warnings, errors, and a summary of each sync")
+)
+
 func main() {
 	log.SetPrefix("")
 	log.AddFlags()
-	dump := flag.Bool("dump", false, "dump patches to stdout instead of applying them to the destination repository")
-	push := flag.Bool("push", false, "push applied changes to the destination repository's remote")
-	configs := flag.String("config", "", "comma-separated key-value pairs that should be passed to git")
-	linearize := flag.Bool("linearize", false, "linearize source repository history before copying commits")
 	flag.Usage = usage
 	flag.Parse()
-	if flag.NArg() < 2 {
+	if *quiet {
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name == "log" {
+				log.Fatal("-quiet cannot be used with -log")
+			}
+		})
+		log.SetLevel(log.Error)
+	}
+	// Arguments take precedence over the environment.
+	args := flag.Args()
+	if *lint {
+		ruleArgs := args
+		if len(ruleArgs) == 0 {
+			if env := os.Getenv("GRIT_RULES"); env != "" {
+				ruleArgs = scanRules(strings.NewReader(env), "GRIT_RULES")
+			}
+		}
+		if *rulesFile != "" {
+			ruleArgs = append(readRules(*rulesFile), ruleArgs...)
+		}
+		if *stripFile != "" {
+			ruleArgs = append(ruleArgs, stripCommitRules(*stripFile)...)
+		}
+		if len(ruleArgs) == 0 {
+			flag.Usage()
+		}
+		if n := lintRules(ruleArgs); n > 0 {
+			log.Error.Printf("%d problems in %d rules", n, len(ruleArgs))
+			os.Exit(1)
+		}
+		log.Printf("%d rules OK", len(ruleArgs))
+		return
+	}
+	checkVersions()
+	if *showVersion {
+		return
+	}
+	if *revert != "" {
+		dstSpec := os.Getenv("GRIT_DST")
+		if len(args) > 0 {
+			dstSpec = args[0]
+		}
+		if dstSpec == "" || len(args) > 1 {
+			flag.Usage()
+		}
+		dstURL, dstPrefix, dstBranch := parseSpec(dstSpec)
+		if err := mirror.Revert(syncOptions(), *revert, dstURL, dstPrefix, dstBranch); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	srcSpec, dstSpec := os.Getenv("GRIT_SRC"), os.Getenv("GRIT_DST")
+	if len(args) > 0 {
+		srcSpec = args[0]
+	}
+	if len(args) > 1 {
+		dstSpec = args[1]
+	}
+	if srcSpec == "" || dstSpec == "" {
 		flag.Usage()
 	}
-	if *push && *dump {
+	var ruleArgs []string
+	if len(args) > 2 {
+		ruleArgs = args[2:]
+	} else if env := os.Getenv("GRIT_RULES"); env != "" {
+		ruleArgs = scanRules(strings.NewReader(env), "GRIT_RULES")
+	}
+	if *dumpFile != "" && *dump == "" {
+		*dump = "mbox"
+	}
+	dumping := *dump != ""
+	if *push && dumping || *verify && (*push || dumping) || *check && (*push || dumping || *verify) {
 		flag.Usage()
 	}
-	srcURL, srcPrefix, srcBranch := parseSpec(flag.Arg(0))
-	dstURL, dstPrefix, dstBranch := parseSpec(flag.Arg(1))
-	if srcURL == dstURL {
-		log.Error.Printf("source and destination cannot be the same")
+	if *reconcile && (dumping || *verify || *check || *branches != "") {
 		flag.Usage()
 	}
+	if *interactive && (dumping || *verify || *check || *reconcile || *branches != "") {
+		flag.Usage()
+	}
+	srcURL, srcPrefix, srcBranch := parseSpec(srcSpec)
+	dstURL, dstPrefix, dstBranch := parseSpec(dstSpec)
+	checkSelfMirror(srcSpec, dstSpec)
 
-	var rules rules
-	for _, rule := range flag.Args()[2:] {
-		parts := strings.SplitN(rule, ":", 2)
-		if len(parts) != 2 {
-			log.Fatalf("invalid rule %s", rule)
+	if *clean {
+		if !*localSource {
+			cleanCheckout(srcURL, srcPrefix, srcBranch, "GRIT_SRC_SSH_KEY")
 		}
-		switch parts[0] {
-		case "strip":
-			r, err := regexp.Compile(parts[1])
-			if err != nil {
-				log.Fatalf("invalid regexp %s: %s", parts[1], err)
-			}
-			rules.strip = append(rules.strip, r)
-		case "strip-message":
-			r, err := regexp.Compile(parts[1])
-			if err != nil {
-				log.Fatalf("invalid regexp %s: %s", parts[1], err)
-			}
-			rules.stripMessagePaths = append(rules.stripMessagePaths, r)
-		case "strip-commit":
-			hash := parts[1]
-			if len(hash) < 7 {
-				log.Fatalf("invalid commit prefix %s: must have at least 7 digits", parts[1])
-			}
-			for _, d := range hash {
-				if (d < '0' || d > '9') && (d < 'a' || d > 'f') && (d < 'A' || d > 'F') {
-					log.Fatalf("invalid commit prefix %s: invalid hex digit %c", hash, d)
-				}
+		cleanCheckout(dstURL, dstPrefix, dstBranch, "GRIT_DST_SSH_KEY")
+		return
+	}
+
+	var rules rules.Rules
+	if *rulesFile != "" {
+		for _, rule := range readRules(*rulesFile) {
+			if err := rules.Parse(rule); err != nil {
+				log.Fatal(err)
 			}
-			rules.stripCommits = append(rules.stripCommits, hash)
-		case "rewrite":
-			rules.rewrite = append(rules.rewrite, parseRewriteRule(parts[1]))
-			if len(parts) != 2 {
-				log.Fatalf("invalid rule %s", rule)
+		}
+	}
+	for _, rule := range ruleArgs {
+		if err := rules.Parse(rule); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *stripFile != "" {
+		for _, rule := range stripCommitRules(*stripFile) {
+			if err := rules.Parse(rule); err != nil {
+				log.Fatalf("%s: %v", *stripFile, err)
 			}
-		default:
-			log.Fatalf("invalid rule type %s", parts[0])
 		}
 	}
+	rules.AuthorAllow = compileFlag("author-allow", *authorAllow)
+	rules.AuthorDeny = compileFlag("author-deny", *authorDeny)
 
-	log.Printf("synchronizing repo:%s prefix:%s branch:%s -> repo:%s prefix:%s branch:%s",
-		srcURL, srcPrefix, srcBranch, dstURL, dstPrefix, dstBranch)
-	open := func(url, prefix, branch string) *git.Repo {
-		r, err := git.Open(url, prefix, branch)
+	opts := syncOptions()
+	if *msgTemplate != "" {
+		b, err := ioutil.ReadFile(*msgTemplate)
 		if err != nil {
-			log.Fatalf("open %s: %v", url, err)
+			log.Fatal(err)
 		}
-		for _, kv := range strings.Split(*configs, ",") {
-			if kv == "" {
-				continue
-			}
-			parts := strings.SplitN(kv, "=", 2)
-			if len(parts) != 2 {
-				log.Fatalf("bad config %s", kv)
-			}
-			r.Configure(parts[0], parts[1])
-		}
-		return r
-	}
-	// Open repositories in URL order so that we don't deadlock across
-	// multiple repositories.
-	var src, dst *git.Repo
-	if srcURL < dstURL {
-		src = open(srcURL, srcPrefix, srcBranch)
-		dst = open(dstURL, dstPrefix, dstBranch)
-	} else {
-		dst = open(dstURL, dstPrefix, dstBranch)
-		src = open(srcURL, srcPrefix, srcBranch)
-	}
-	defer src.Close()
-	defer dst.Close()
-
-	if *linearize {
-		if err := src.Linearize(); err != nil {
-			log.Fatalf("linearize %s: %v", src, err)
-		}
-	}
-
-	// Last synchronized commit that applies, if any. We apply the
-	// rewrite rules here, so that we skip commits that may be tagged
-	// with shipit IDs, but wouldn't actually come from the source
-	// repository. This can happen if a repository is the destination
-	// for multiple repositories, and commits sourced from one repo can
-	// touch those in another. A common source of this is Bazel BUILD
-	// files and go.{mod,sum} files that may be modified independently
-	// in the source and destination repositories.
-	var lastCommit *git.Commit
-	for head := "HEAD"; ; {
-		last, err := dst.Log("-1", "--grep", `^\s*\(fb\)\?shipit-source-id: [a-z0-9]\+$`, head)
+		opts.MessageTemplate, err = template.New(filepath.Base(*msgTemplate)).Option("missingkey=error").Parse(string(b))
 		if err != nil {
-			log.Fatalf("log %s: %v", dst, err)
-		}
-		if len(last) == 0 {
-			break
+			log.Fatalf("-message-template: %v", err)
 		}
-		applies, err := rules.isCommitApplicable(last[0], dst)
+	}
+	if *mapFile != "" {
+		b, err := ioutil.ReadFile(*mapFile)
 		if err != nil {
-			log.Fatalf("isCommitApplicable %s: %v", last[0], err)
+			log.Fatal(err)
+		}
+		if opts.PrefixMap, err = git.ParsePrefixMap(b); err != nil {
+			log.Fatalf("-prefix-map: %s: %v", *mapFile, err)
+		}
+		if srcPrefix != "" {
+			log.Fatal("-prefix-map cannot be used with a source prefix")
 		}
-		if applies {
-			lastCommit = last[0]
-			break
+		if *verify {
+			log.Fatal("-prefix-map cannot be used with -verify")
 		}
-		log.Printf("commit %s is not applicable to %s: skipping", last[0], dst)
-		head = last[0].Digest.Hex() + "^"
 	}
-	var commits []*git.Commit
-	if lastCommit == nil {
-		log.Printf("performing initial sync")
-		var err error
-		commits, err = src.Log("--no-merges")
-		if err != nil {
-			log.Fatalf("log %s: %v", src, err)
-		}
-	} else {
-		log.Printf("synchronizing: last diff: %v, source: %v", lastCommit.Digest, lastCommit.ShipitID())
-		ids := lastCommit.ShipitID()
-		if len(ids) == 0 {
-			log.Fatalf("no fbshipit-source-id found in commit: %+v", lastCommit)
-		}
-		// When a commit is a squash of multiple commits, they are sorted in
-		// ascending chronological order. So the last ID is the one we should sync
-		// from.
-		newestID := ids[len(ids)-1]
-		var err error
-		commits, err = src.Log(newestID+".."+srcBranch, "--ancestry-path", "--no-merges")
-		if err != nil {
-			log.Fatalf("log %s: %v", src, err)
+	if *squashAll && *squashWindow > 0 {
+		log.Fatal("-squash-run cannot be used with -squash-window")
+	}
+	if *since != "" && !*forceInitial {
+		log.Fatal("-since can only be used with -force-initial")
+	}
+	if *releases != "" {
+		if !*mirrorTags {
+			log.Fatal("-github-releases can only be used with -tags")
 		}
+		parseGitHubRepo(*releases)
 	}
-
-	// Filter out commits which are themselves copies, so that
-	// we can properly support multi-way syncing.
-	// We also filter out commits that match any stripped commits.
-	raw := commits
-	commits = nil
-commitsLoop:
-	for _, commit := range raw {
-		if len(commit.ShipitID()) > 0 {
-			continue
+	if *forceTags && !*mirrorTags {
+		log.Fatal("-force-tags can only be used with -tags")
+	}
+	if *branches != "" && *localSource {
+		log.Fatal("-branches cannot be used with -local-source")
+	}
+	validWhitespace := *whitespace == ""
+	for _, mode := range git.WhitespaceModes {
+		validWhitespace = validWhitespace || mode == *whitespace
+	}
+	if !validWhitespace {
+		log.Fatalf("-whitespace: invalid action %s: must be one of %s", *whitespace, strings.Join(git.WhitespaceModes, ", "))
+	}
+	if *parallel < 1 {
+		log.Fatal("-parallel must be at least 1")
+	}
+	if *parallel > 1 && dumping {
+		log.Fatal("-parallel cannot be used with -dump")
+	}
+	if *reconcile {
+		deleted, err := mirror.Reconcile(opts, rules, srcURL, srcPrefix, srcBranch, dstURL, dstPrefix, dstBranch)
+		if err != nil {
+			log.Fatal(err)
 		}
-		if rules.isStripped(commit) {
-			log.Debug.Printf("commit %s: stripped by strip-commit rule", commit.Digest)
-			continue commitsLoop
+		if !deleted {
+			os.Exit(exitNothingToDo)
 		}
-		commits = append(commits, commit)
+		return
 	}
-
-	log.Printf("%d commits to copy", len(commits))
-	var ncommit int
-	for i := len(commits) - 1; i >= 0; i-- {
-		c := commits[i]
-		patch, err := src.Patch(c.Digest, dst.Prefix())
+	// Failed syncs are recorded with their results, so that they are
+	// included in the stats.
+	var results []mirror.Result
+	record := func(res mirror.Result, err error) {
 		if err != nil {
-			log.Fatalf("%s: patch %s: %v", src, c.Digest.Hex()[:7], err)
-		}
-		if patch.Body != "" {
-			patch.Body += "\n\n"
-		}
-		shipitTag := fmt.Sprintf("fbshipit-source-id: %s", patch.ID.Hex()[:7])
-		patch.Body += shipitTag
-		// Apply filepath specific rules.
-		// Prefixes are already rewritten by the repo.
-		var diffs []git.Diff
-		stripMessage := true
-	diffloop:
-		for _, diff := range patch.Diffs {
-			if match, re := rules.isPathStripped(diff.Path); match {
-				log.Debug.Printf("file %s matches rule %s: stripping", diff.Path, re)
-				continue diffloop
+			log.Error.Print(err)
+			res.Error = err.Error()
+		}
+		results = append(results, res)
+	}
+	defer func() {
+		var failed bool
+		for _, res := range results {
+			if res.Error != "" {
+				failed = true
+			} else if !*verify {
+				logSummary(res)
 			}
-			if match, re := rules.isMessagePathStripped(diff.Path); match {
-				log.Debug.Printf("file %s matches rule %s for stripping commit messages", diff.Path, re)
-			} else {
-				stripMessage = false
+		}
+		writeStats(results)
+		if failed {
+			os.Exit(1)
+		}
+		if !*verify && !changed(results) {
+			os.Exit(exitNothingToDo)
+		}
+	}()
+	if *dumpFile != "" {
+		f, err := os.Create(*dumpFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer func() {
+			if err := f.Close(); err != nil {
+				log.Fatalf("%s: %v", *dumpFile, err)
 			}
-			rules.rewriteDiff(&diff)
-			diffs = append(diffs, diff)
+		}()
+		dumpOut = f
+	}
+	if *branches == "" {
+		record(mirror.Sync(opts, rules, srcURL, srcPrefix, srcBranch, dstURL, dstPrefix, dstBranch))
+		return
+	}
+	// The repositories are opened only to list their branches; they
+	// are reopened by each branch's sync.
+	listBranches := func(url, prefix, branch, keyVar string) []string {
+		r, err := openRepo(url, prefix, branch, keyVar)
+		if err != nil {
+			log.Fatal(err)
 		}
-		if len(diffs) == 0 {
-			log.Printf("skipping empty patch %s", patch.ID.Hex()[:7])
+		defer r.Close()
+		names, err := r.Branches(*branches)
+		if err != nil {
+			log.Fatalf("%s: branches: %v", r, err)
+		}
+		return names
+	}
+	srcBranches := listBranches(srcURL, srcPrefix, srcBranch, "GRIT_SRC_SSH_KEY")
+	dstBranches := make(map[string]bool)
+	for _, branch := range listBranches(dstURL, dstPrefix, dstBranch, "GRIT_DST_SSH_KEY") {
+		dstBranches[branch] = true
+	}
+	log.Printf("%d source branches match %s", len(srcBranches), *branches)
+	var mirrored []string
+	for _, branch := range srcBranches {
+		if !dstBranches[branch] {
+			log.Error.Printf("destination %s has no branch %s: skipping; create it to mirror the branch", dstURL, branch)
 			continue
 		}
-		ncommit++
-		patch.Diffs = diffs
-		if stripMessage {
-			patch.Subject = "Stripped commit"
-			patch.Body = "Commit message stripped.\n\n" + shipitTag
+		mirrored = append(mirrored, branch)
+	}
+	pairs := make([]mirror.Pair, len(mirrored))
+	for i, branch := range mirrored {
+		pairs[i] = mirror.Pair{
+			Options:   opts,
+			Rules:     rules,
+			SrcURL:    srcURL,
+			SrcPrefix: srcPrefix,
+			SrcBranch: branch,
+			DstURL:    dstURL,
+			DstPrefix: dstPrefix,
+			DstBranch: branch,
 		}
-		if *dump {
-			if err := patch.Write(os.Stdout); err != nil {
-				log.Fatal(err)
-			}
-		} else {
-			log.Printf("applying %s", c)
-			if err := dst.Apply(patch); err != nil {
-				log.Fatalf("%s: apply %s: %s", dst, patch, err)
-			}
-			if !patch.MaybeContainsLFSPointer() {
-				log.Debug.Printf("%s: patch contains no LFS pointers", patch)
-				continue
-			}
-			// Copy any LFS objects that were touched by this change.
-			// Doing it this way allows us to download only LFS objects
-			// that actually need to be transferred.
-			paths := patch.Paths()
-			ptrs, err := dst.ListLFSPointers()
-			if err != nil {
-				log.Fatal(err)
-			}
-			for _, ptr := range ptrs {
-				if !paths[ptr] {
-					continue
-				}
-				if err := dst.CopyLFSObject(src, ptr); err != nil {
-					log.Fatalf("copying LFS object %s: %v", ptr, err)
-				}
-			}
+	}
+	branchResults, errs := mirror.SyncAll(pairs, *parallel)
+	var failed []string
+	for i, branch := range mirrored {
+		err := errs[i]
+		if err != nil {
+			err = fmt.Errorf("branch %s: %v", branch, err)
+			failed = append(failed, branch)
 		}
+		record(branchResults[i], err)
 	}
-
-	if !*push {
-		return
+	if len(failed) > 0 {
+		log.Error.Printf("%d of %d branches failed to sync: %s", len(failed), len(mirrored), strings.Join(failed, ", "))
 	}
-	if ncommit == 0 {
-		log.Print("nothing to do")
+}
+
+// checkSelfMirror fails unless the source and destination, given by
+// the provided specs, are different repositories or, with -force,
+// different branches or disjoint prefixes of the same repository.
+func checkSelfMirror(srcSpec, dstSpec string) {
+	srcURL, srcPrefix, srcBranch := parseSpec(srcSpec)
+	dstURL, dstPrefix, dstBranch := parseSpec(dstSpec)
+	if repoKey(srcURL) != repoKey(dstURL) {
 		return
 	}
-	log.Printf("pushing changes to %s %s", dstURL, dstBranch)
-	if err := dst.Push("origin", dstBranch); err != nil {
-		log.Fatalf("%s: push origin %s: %v", dst, dstBranch, err)
+	// Each branch is mirrored to itself with -branches. An unnamed
+	// branch is the remote's default branch, which may be the other.
+	sameBranch := *branches != "" || srcBranch == dstBranch || srcBranch == "" || dstBranch == ""
+	switch {
+	case sameBranch && (strings.HasPrefix(srcPrefix, dstPrefix) || strings.HasPrefix(dstPrefix, srcPrefix)):
+		log.Fatalf("source %s and destination %s are the same branch of a repository, with overlapping prefixes: "+
+			"commits copied to the destination would be copied again", srcSpec, dstSpec)
+	case srcURL == dstURL && (*branches != "" || srcBranch == dstBranch):
+		// Their checkouts would be the same, and locked twice.
+		log.Fatalf("source %s and destination %s are the same branch of a repository", srcSpec, dstSpec)
+	case !*force:
+		log.Fatalf("source %s and destination %s are the same repository: "+
+			"use -force to copy commits between its branches or prefixes", srcSpec, dstSpec)
 	}
 }
 
-func parseSpec(spec string) (url, prefix, branch string) {
-	parts := strings.Split(spec, ",")
-	switch len(parts) {
-	case 1:
-		return parts[0], "", "master"
-	case 2:
-		return parts[0], parts[1], "master"
-	case 3:
-		return parts[0], parts[1], parts[2]
+// repoKey returns a canonical form of the provided repository URL, so
+// that different spellings of the same repository's URL, e.g., with and
+// without a ".git" suffix, as an scp-like SSH address, or as a relative
+// path, have the same key.
+func repoKey(u string) string {
+	parsed, err := url.Parse(u)
+	if err == nil && parsed.Scheme == "file" {
+		u, parsed = parsed.Path, nil
+	}
+	switch i := strings.Index(u, ":"); {
+	case err == nil && parsed != nil && parsed.Scheme != "" && parsed.Host != "":
+		u = strings.ToLower(parsed.Hostname()) + "/" + strings.TrimPrefix(parsed.Path, "/")
+	case i > 0 && !strings.Contains(u[:i], "/"):
+		// An scp-like address, [user@]host:path.
+		host := u[:i]
+		if j := strings.LastIndex(host, "@"); j >= 0 {
+			host = host[j+1:]
+		}
+		u = strings.ToLower(host) + "/" + strings.TrimPrefix(u[i+1:], "/")
 	default:
-		log.Fatalf("invalid spec %s", spec)
+		if abs, err := filepath.Abs(u); err == nil {
+			u = abs
+		}
+		if path, err := filepath.EvalSymlinks(u); err == nil {
+			u = path
+		}
 	}
-	panic("not reached")
+	u = strings.TrimSuffix(u, "/")
+	return strings.TrimSuffix(strings.TrimSuffix(u, ".git"), "/")
 }
 
-type rewriteRule struct {
-	pathRe *regexp.Regexp // matched against the pathname
-	oldRe  *regexp.Regexp // matched against each line in the file
-	new    []byte         // replacement
+// compileFlag compiles the regular expression given by the named flag,
+// returning nil if it is empty.
+func compileFlag(name, expr string) *regexp.Regexp {
+	if expr == "" {
+		return nil
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		log.Fatalf("-%s: invalid regexp %s: %s", name, expr, err)
+	}
+	return re
 }
 
-func parseRewriteRule(rule string) (r rewriteRule) {
-	parts := strings.SplitN(rule, ":", 2)
-	if len(parts) != 2 {
-		log.Fatalf("invalid rewrite rule %s", rule)
+// writeStats writes the provided results as JSON to the file named
+// by the -stats flag, if any.
+func writeStats(results []mirror.Result) {
+	if *stats == "" {
+		return
+	}
+	b, err := json.MarshalIndent(results, "", "\t")
+	if err != nil {
+		log.Fatal(err)
 	}
-	var err error
-	if r.pathRe, err = regexp.Compile(parts[0]); err != nil {
-		log.Fatalf("rewrite: invalid path regexp %s: %s", parts[0], err)
+	if err := ioutil.WriteFile(*stats, append(b, '\n'), 0644); err != nil {
+		log.Fatalf("stats: %v", err)
 	}
-	if len(parts[1]) < 3 {
-		log.Fatalf("rewrite: rule '%s' must be of form rewrite:pathre:/from_re/to_re/", rule)
+}
+
+// changed tells whether any of the provided syncs copied commits,
+// mirrored tags, or pushed commits applied by an interrupted run.
+func changed(results []mirror.Result) bool {
+	for _, res := range results {
+		if res.Applied > 0 || res.Tags > 0 || res.Pushed {
+			return true
+		}
 	}
-	sep := parts[1][0:1]
-	parts = strings.Split(parts[1][1:], sep)
-	if len(parts) != 3 || parts[2] != "" {
-		log.Fatalf("rewrite: rule '%s' must be of form rewrite:pathre:/from_re/to_re/", rule)
+	return false
+}
+
+// logSummary logs the outcome of a sync. The summary is kept with
+// -quiet, which otherwise logs only warnings and errors.
+func logSummary(res mirror.Result) {
+	level := log.Info
+	if *quiet {
+		level = log.Error
 	}
-	if r.oldRe, err = regexp.Compile(parts[0]); err != nil {
-		log.Fatalf("rewrite: invalid 'from' regexp %s: %s", parts[0], err)
+	pushed := ""
+	if res.Pushed {
+		pushed = ", pushed"
 	}
-	r.new = []byte(parts[1])
-	return r
+	level.Printf("%s -> %s: applied %d commits, skipped %d (%d empty, %d stripped, %d filtered, %d unsigned), mirrored %d tags%s",
+		res.Src, res.Dst, res.Applied, res.Empty+res.Stripped+res.Filtered+res.Unsigned,
+		res.Empty, res.Stripped, res.Filtered, res.Unsigned, res.Tags, pushed)
 }
 
-func (r *rewriteRule) rewrite(diff []byte) []byte {
-	result := bytes.Buffer{}
-	for _, line := range bytes.Split(diff, []byte("\n")) {
-		line = r.oldRe.ReplaceAll(line, r.new)
-		result.Write(line)
-		result.WriteByte('\n')
+// parseGitHubRepo parses the provided "owner/repo" GitHub repository
+// name.
+func parseGitHubRepo(name string) (owner, repo string) {
+	parts := strings.Split(name, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		log.Fatalf("invalid GitHub repository %s: must be of form owner/repo", name)
 	}
-	return result.Bytes()
+	return parts[0], parts[1]
 }
 
-type rules struct {
-	strip             []*regexp.Regexp
-	stripMessagePaths []*regexp.Regexp
-	// We store strip prefixes as strings since digesters refuse
-	// to parse odd-length hex strings and git typically gives out
-	// a prefix with 7 digits.
-	stripCommits []string
-	rewrite      []rewriteRule
+var (
+	// dumpOut is the file to which -dump writes patches.
+	dumpOut io.Writer = os.Stdout
+	// ndump is the number of patches written to dumpOut.
+	ndump int
+)
+
+// A dumpFormat is the value of the -dump flag: the format, "mbox" or
+// "json", in which patches are dumped, or "" if they are not. Like a
+// boolean flag, -dump may be given without a value, selecting mbox.
+type dumpFormat string
+
+// dumpFlag defines a dumpFormat flag with the provided name and usage.
+func dumpFlag(name, usage string) *dumpFormat {
+	f := new(dumpFormat)
+	flag.Var(f, name, usage)
+	return f
 }
 
-// isStripped returns whether this commit matches the strip rules of
-// the rule set r.
-func (r rules) isStripped(c *git.Commit) bool {
-	for _, stripped := range r.stripCommits {
-		if strings.HasPrefix(c.Digest.Hex(), stripped) {
-			return true
-		}
+func (f *dumpFormat) String() string {
+	if f == nil {
+		return ""
 	}
-	return false
+	return string(*f)
 }
 
-// isPathStripped returns whether the provided path is stripped by the
-// ruleset's strip path rules.
-func (r rules) isPathStripped(path string) (bool, *regexp.Regexp) {
-	for _, re := range r.strip {
-		if re.MatchString(path) {
-			return true, re
-		}
+func (f *dumpFormat) Set(value string) error {
+	switch value {
+	case "true", "mbox":
+		*f = "mbox"
+	case "false":
+		*f = ""
+	case "json":
+		*f = "json"
+	default:
+		return fmt.Errorf("unknown format %q: must be mbox or json", value)
 	}
-	return false, nil
+	return nil
 }
 
-// isMessagePathStripped returns whether the provided path is stripped
-// by the ruleset's message strip rules.
-func (r rules) isMessagePathStripped(path string) (bool, *regexp.Regexp) {
-	for _, re := range r.stripMessagePaths {
-		if re.MatchString(path) {
-			return true, re
+func (f *dumpFormat) IsBoolFlag() bool { return true }
+
+// dumpPatch writes the provided patch to dumpOut: as the next message
+// of an mbox, or with -dump=json, as the next line of JSON.
+func dumpPatch(patch git.Patch) error {
+	if *dump == "json" {
+		return json.NewEncoder(dumpOut).Encode(patch)
+	}
+	// Messages are separated by blank lines.
+	if ndump > 0 {
+		if _, err := io.WriteString(dumpOut, "\n"); err != nil {
+			return err
 		}
 	}
-	return false, nil
+	if err := patch.Write(dumpOut); err != nil {
+		return err
+	}
+	ndump++
+	return nil
+}
+
+// checkVersions logs the versions of git and, unless -no-lfs is
+// provided, git-lfs, and warns if they are older than those that grit
+// requires, which helps diagnose failures that are specific to an
+// environment.
+func checkVersions() {
+	v, err := git.Version()
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("git version %s", v)
+	if git.VersionLess(v, git.MinVersion) {
+		log.Error.Printf("warning: git %s is older than %s, the oldest version that grit supports; commits may fail to apply", v, git.MinVersion)
+	}
+	if *noLFS {
+		return
+	}
+	v, err = git.LFSVersion()
+	if err != nil {
+		log.Error.Printf("warning: git-lfs is unavailable; repositories with LFS objects cannot be synchronized without -no-lfs: %v", err)
+		return
+	}
+	log.Printf("git-lfs version %s", v)
+	if git.VersionLess(v, git.MinLFSVersion) {
+		log.Error.Printf("warning: git-lfs %s is older than %s, the oldest version that grit is known to work with", v, git.MinLFSVersion)
+	}
+}
+
+// syncOptions returns the options, given by flags and the environment,
+// with which repositories are synchronized, reverted, and reconciled.
+func syncOptions() mirror.Options {
+	opts := mirror.Options{
+		Push:              *push,
+		Verify:            *verify,
+		Check:             *check,
+		Interactive:       *interactive,
+		Config:            gitConfig(),
+		CommitterName:     *commitName,
+		CommitterEmail:    *commitEmail,
+		SrcSSHKey:         os.Getenv("GRIT_SRC_SSH_KEY"),
+		DstSSHKey:         os.Getenv("GRIT_DST_SSH_KEY"),
+		Timeout:           *timeout,
+		PushInterval:      *pushInterval,
+		PushRetries:       *pushRetries,
+		VerifyPush:        *verifyPush,
+		PrePush:           *prePush,
+		LocalSource:       *localSource,
+		PartialClone:      *partialClone,
+		SparseCheckout:    *sparse,
+		FastForward:       *ffOnly,
+		NoLFS:             *noLFS,
+		Linearize:         *linearize,
+		TopoOrder:         *topoOrder,
+		ForceInitial:      *forceInitial,
+		Since:             *since,
+		MergeBase:         *mergeBase,
+		SearchLimit:       *searchLimit,
+		MaxCommits:        *maxCommits,
+		RequireSigned:     *signedOnly,
+		DetectRenames:     *renames,
+		Context:           *contextLines,
+		FunctionContext:   *funcContext,
+		Whitespace:        *whitespace,
+		KeepEmpty:         *keepEmpty,
+		ExportIgnore:      *exportIgnore,
+		SkipSubmodules:    *skipSubmods,
+		MaxBlobSize:       *maxBlobSize,
+		CaseInsensitive:   *caseCheck,
+		SquashRun:         *squashAll,
+		SquashWindow:      *squashWindow,
+		NoTrailer:         *noTrailer,
+		SourceCommits:     *fullIDs,
+		KeepTrailers:      *keepTrailers,
+		SignatureTrailers: *sigTrailers,
+		Notes:             *copyNotes,
+		Tags:              *mirrorTags,
+		ForceTags:         *forceTags,
+		GitHub:            github.Client{Token: os.Getenv("GITHUB_TOKEN"), URL: os.Getenv("GITHUB_API_URL")},
+		Summary:           *summary,
+		VerboseDiff:       *verboseDiff,
+	}
+	if *dump != "" {
+		opts.Dump = dumpPatch
+	}
+	if *releases != "" {
+		opts.ReleaseOwner, opts.ReleaseRepo = parseGitHubRepo(*releases)
+	}
+	return opts
+}
+
+// openRepo opens the repository named by url, prefix, and branch,
+// authenticated by the SSH key in the environment variable keyVar, and
+// configured by the -config, -timeout, and -sparse-checkout flags.
+func openRepo(url, prefix, branch, keyVar string) (*git.Repo, error) {
+	r, err := git.OpenWithOptions(url, prefix, branch, git.Options{
+		SSHKey:         os.Getenv(keyVar),
+		SparseCheckout: *sparse,
+		Timeout:        *timeout,
+		Config:         gitConfig(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %v", url, err)
+	}
+	return r, nil
+}
+
+// cleanCheckout cleans grit's checkout of the repository named by url,
+// prefix, and branch, as requested by -clean.
+func cleanCheckout(url, prefix, branch, keyVar string) {
+	r, err := openRepo(url, prefix, branch, keyVar)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer r.Close()
+	if err := r.Clean(); err != nil {
+		log.Fatalf("%s: clean: %v", r, err)
+	}
+	log.Printf("%s: cleaned checkout %s", r, r.Root())
 }
 
-// rewriteDiff applies the rulesets rewrite rules to the provided diff.
-func (r rules) rewriteDiff(diff *git.Diff) {
-	for _, r := range r.rewrite {
-		if r.pathRe.MatchString(diff.Path) {
-			diff.Body = r.rewrite(diff.Body)
+// gitConfig returns the git configuration given by the -config flag.
+// It is passed to every git command, including those that clone and
+// fetch repositories, so that it may configure, e.g., proxies.
+func gitConfig() map[string]string {
+	config := make(map[string]string)
+	for _, kv := range strings.Split(*configs, ",") {
+		if kv == "" {
+			continue
 		}
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			log.Fatalf("bad config %s", kv)
+		}
+		config[parts[0]] = parts[1]
 	}
+	return config
 }
 
-// isCommitApplicable returns whether the provided commit is non-empty
-// in the provided repository and prefix.
-func (r rules) isCommitApplicable(c *git.Commit, src *git.Repo) (bool, error) {
-	if r.isStripped(c) {
-		return false, nil
+func parseSpec(spec string) (url, prefix, branch string) {
+	parts := strings.Split(spec, ",")
+	switch len(parts) {
+	case 1:
+		return parts[0], "", ""
+	case 2:
+		return parts[0], parts[1], ""
+	case 3:
+		return parts[0], parts[1], parts[2]
+	default:
+		log.Fatalf("invalid spec %s", spec)
 	}
-	patch, err := src.Patch(c.Digest, "")
+	panic("not reached")
+}
+
+// readRules reads rules from the file at path, one per line. Blank
+// lines and lines beginning with "#" are ignored.
+func readRules(path string) []string {
+	f, err := os.Open(path)
 	if err != nil {
-		return false, err
+		log.Fatalf("rules: %v", err)
 	}
-	var ndiff int
-	for _, diff := range patch.Diffs {
-		if match, _ := r.isPathStripped(diff.Path); match {
+	defer f.Close()
+	return scanRules(f, path)
+}
+
+// scanRules reads rules from r, like readRules. Errors are reported
+// with the provided name.
+func scanRules(r io.Reader, name string) []string {
+	var rules []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
 			continue
 		}
-		ndiff++
+		rules = append(rules, line)
+	}
+	if err := scanner.Err(); err != nil {
+		log.Fatalf("rules %s: %v", name, err)
 	}
-	return ndiff > 0, nil
+	return rules
 }
 
-/*
-func isApplicableCommit(c *git.Commit, stripCommits []string) bool {
-	for _, stripped := range stripCommits {
-			if strings.HasPrefix(c.Digest.Hex(), stripped) {
-				return false
-			}
+// stripCommitRules returns strip-commit rules for the hashes listed,
+// one per line, in the file at path, as given by -strip-commits-file.
+// Blank lines and lines beginning with "#" are ignored.
+func stripCommitRules(path string) []string {
+	var stripped []string
+	for _, hash := range readRules(path) {
+		stripped = append(stripped, "strip-commit:"+hash)
 	}
-	patch, err :=
+	return stripped
+}
 
+// lintRules parses each of the provided rules, logging those that are
+// invalid, as well as rewrite and redact rules whose replacements
+// refer to capture groups that their regexps do not define; these
+// expand to the empty string, which is rarely what was intended. It
+// returns the number of problems found.
+func lintRules(ruleArgs []string) int {
+	var n int
+	for _, rule := range ruleArgs {
+		var r rules.Rules
+		if err := r.Parse(rule); err != nil {
+			log.Error.Printf("rule %q: %v", rule, err)
+			n++
+			continue
+		}
+		for _, warning := range r.Warnings() {
+			log.Error.Printf("rule %q: warning: %s", rule, warning)
+			n++
+		}
+	}
+	return n
 }
-*/
@@ -5,12 +5,19 @@
 package main_test
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"log"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/grailbio/testutil"
@@ -73,67 +80,2555 @@ func TestGrit(t *testing.T) {
 	a.Compare(t, b)
 
 	// Pushing the other way should now be a no-op.
+	g.RunNoop(t, nil, "-push", repoA, repoB)
+	b.Git(t, "pull")
+	a.Compare(t, b)
+}
+
+// TestGritRules ensures that rules are applied universally across
+// grit actions.
+func TestGritRules(t *testing.T) {
+	dir, cleanup := temp(t)
+	defer cleanup()
+	var g grit
+	g.Build(t)
+
+	var (
+		repoHome   = filepath.Join(dir, "home")
+		repoRemote = filepath.Join(dir, "remote")
+	)
+
+	run(t, "git", "init", "--bare", repoHome)
+	run(t, "git", "init", "--bare", repoRemote)
+
+	home := repo(filepath.Join(dir, "home_checkout"))
+	remote := repo(filepath.Join(dir, "remote_checkout"))
+
+	home.Clone(t, filepath.Join(dir, "home"))
+	remote.Clone(t, filepath.Join(dir, "remote"))
+
+	for _, r := range []repo{home, remote} {
+		r.Git(t, "commit", "--allow-empty", "-m", "initial commit")
+		r.Git(t, "push")
+	}
+
+	remote.WriteFile(t, "file1", "content1")
+	remote.Git(t, "add", ".")
+	remote.Git(t, "commit", "-a", "-m", "commit 1 to remote")
+	remote.Git(t, "push")
+	g.Run(t, "-push", repoRemote, repoHome+",remote/")
+
+	home.Git(t, "pull")
+
+	// Now synthesize a change to the home repo that touches the remote/
+	// directory but is excluded from the sync rules. We fabricate a
+	// source ID to emulate that it has been pushed from a different
+	// remote repository.
+
+	home.WriteFile(t, "remote/BUILD", "excluded content")
+	home.WriteFile(t, "test.txt", "out of scope content")
+	home.Git(t, "add", ".")
+	home.Git(t, "commit", "-a", "-m", "commit 1 to local\n\nfbshipit-source-id: bb96450\n")
+	home.Git(t, "push")
+
+	remote.WriteFile(t, "file2", "content2")
+	remote.Git(t, "add", ".")
+	remote.Git(t, "commit", "-a", "-m", "commit 1 2 remote")
+	remote.Git(t, "push")
+
+	g.Run(t, "-push", repoRemote, repoHome+",remote/", "strip:^BUILD$")
+
+	home.Git(t, "pull")
+
+	repo(filepath.Join(string(home), "remote")).Compare(t, remote, "BUILD")
+}
+
+// TestGritNewPrefix ensures that the source can be synchronized into
+// a destination prefix that does not yet exist.
+func TestGritNewPrefix(t *testing.T) {
+	dir, cleanup := temp(t)
+	defer cleanup()
+	g, a, b, repoA, repoB := setup(t, dir)
+
+	a.WriteFile(t, "file1", "content 1\n")
+	a.WriteFile(t, "dir/file2", "content 2\n")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-a", "-m", "first commit")
+	a.Git(t, "mv", "dir/file2", "dir/renamed2")
+	a.Git(t, "commit", "-m", "second commit")
+	a.Git(t, "push")
+
+	dst := repoB + ",vendor/thirdparty/"
+	if out, err := g.RunError(t, "-verify", repoA, dst); err == nil {
+		t.Errorf("expected -verify of missing prefix to fail:\n%s", out)
+	}
+	g.Run(t, "-check", "-renames", repoA, dst)
+	g.Run(t, "-push", "-renames", repoA, dst)
+	g.Run(t, "-verify", repoA, dst)
+	b.Git(t, "pull")
+	a.Compare(t, repo(filepath.Join(string(b), "vendor/thirdparty")))
+	if got, want := b.Output(t, "log", "--format=%s"), "second commit\nfirst commit\ninitial commit\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	a.WriteFile(t, "file1", "content 1 modified\n")
+	a.Git(t, "commit", "-a", "-m", "third commit")
+	a.Git(t, "push")
+	g.Run(t, "-push", repoA, dst)
+	b.Git(t, "pull")
+	a.Compare(t, repo(filepath.Join(string(b), "vendor/thirdparty")))
+}
+
+// TestGritSparseCheckout ensures that commits are copied between
+// prefixes of sparse checkouts.
+func TestGritSparseCheckout(t *testing.T) {
+	dir, cleanup := temp(t)
+	defer cleanup()
+	g, a, b, repoA, repoB := setup(t, dir)
+
+	a.WriteFile(t, "project/file1", "content 1\n")
+	a.WriteFile(t, "internal/file2", "content 2\n")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-a", "-m", "first commit")
+	a.WriteFile(t, "project/file1", "content 1 modified\n")
+	a.Git(t, "commit", "-a", "-m", "second commit")
+	a.Git(t, "push")
+
+	src, dst := repoA+",project/", repoB+",vendor/project/"
+	g.Run(t, "-push", "-sparse-checkout", src, dst)
+	g.Run(t, "-verify", "-sparse-checkout", src, dst)
+	g.RunNoop(t, nil, "-push", "-sparse-checkout", src, dst)
+	b.Git(t, "pull")
+	if got, want := b.Output(t, "show", "HEAD:vendor/project/file1"), "content 1 modified\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// TestGritSelfMirror ensures that commits are copied within a
+// repository only with -force, and never to an overlapping prefix.
+func TestGritSelfMirror(t *testing.T) {
+	dir, cleanup := temp(t)
+	defer cleanup()
+	g, a, _, repoA, _ := setup(t, dir)
+
+	a.WriteFile(t, "a/file1", "content 1\n")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-a", "-m", "first commit")
+	a.Git(t, "push")
+
+	for _, c := range []struct {
+		args []string
+		err  string
+	}{
+		{[]string{repoA, repoA}, "overlapping prefixes"},
+		{[]string{"-force", repoA + ".git,a/", "file://" + repoA + ",a/b/"}, "overlapping prefixes"},
+		{[]string{"-force", repoA + ",a/", repoA + ",b/"}, "are the same branch of a repository"},
+		{[]string{"file://" + repoA + ",a/", repoA + "/,b/"}, "use -force"},
+	} {
+		out, err := g.RunError(t, append([]string{"-push"}, c.args...)...)
+		if err == nil || !strings.Contains(out, c.err) {
+			t.Errorf("%v: got %v, want error %q:\n%s", c.args, err, c.err, out)
+		}
+	}
+
+	src, dst := "file://"+repoA+",a/", repoA+",b/"
+	g.Run(t, "-push", "-force", src, dst)
+	g.RunNoop(t, nil, "-push", "-force", src, dst)
+	a.Git(t, "pull")
+	if got, want := a.Output(t, "show", "HEAD:b/file1"), "content 1\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// TestGritRulesFile ensures that rules read from a file are applied.
+func TestGritRulesFile(t *testing.T) {
+	dir, cleanup := temp(t)
+	defer cleanup()
+	var g grit
+	g.Build(t)
+
+	var (
+		repoA = filepath.Join(dir, "arepo")
+		repoB = filepath.Join(dir, "brepo")
+	)
+
+	run(t, "git", "init", "--bare", repoA)
+	run(t, "git", "init", "--bare", repoB)
+
+	a := repo(filepath.Join(dir, "a"))
+	b := repo(filepath.Join(dir, "b"))
+	a.Clone(t, repoA)
+	b.Clone(t, repoB)
+
+	b.Git(t, "commit", "--allow-empty", "-m", "initial commit")
+	b.Git(t, "push")
+
+	a.WriteFile(t, "file1", "content 1")
+	a.WriteFile(t, "BUILD", "build content")
+	a.WriteFile(t, "internal/file2", "content 2")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-a", "-m", "first commit")
+	a.Git(t, "push")
+
+	rules := filepath.Join(dir, "rules")
+	if err := ioutil.WriteFile(rules, []byte("# Internal files.\nstrip:^BUILD$\n\n  strip:^internal/\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	g.Run(t, "-push", "-rules="+rules, repoA, repoB)
+	b.Git(t, "pull")
+	a.Compare(t, b, "BUILD", "internal")
+	b.NotExist(t, "BUILD")
+	b.NotExist(t, "internal")
+}
+
+// TestGritPrefixMap ensures that -prefix-map copies only the mapped
+// source directories, to their destination paths, with rules applied
+// to the mapped paths, and that it cannot be used with a source prefix.
+func TestGritPrefixMap(t *testing.T) {
+	dir, cleanup := temp(t)
+	defer cleanup()
+	g, a, b, repoA, repoB := setup(t, dir)
+
+	a.WriteFile(t, "tools/lint/main.go", "main 1")
+	a.WriteFile(t, "libs/ext/lib.c", "lib 1")
+	a.WriteFile(t, "libs/ext/lib_test.c", "test 1")
+	a.WriteFile(t, "internal/file", "internal 1")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-a", "-m", "first commit")
+	a.WriteFile(t, "internal/file", "internal 2")
+	a.Git(t, "commit", "-a", "-m", "internal commit")
+	a.WriteFile(t, "tools/lint/main.go", "main 2")
+	a.WriteFile(t, "libs/ext/lib.c", "lib 2")
+	a.WriteFile(t, "internal/file", "internal 3")
+	a.Git(t, "commit", "-a", "-m", "mixed commit")
+	a.Git(t, "push")
+
+	prefixMap := filepath.Join(dir, "prefix-map")
+	if err := ioutil.WriteFile(prefixMap, []byte("tools/lint -> lint\nlibs/ext -> ext\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := g.RunError(t, "-prefix-map="+prefixMap, repoA+",tools/", repoB); err == nil || !strings.Contains(out, "cannot be used with a source prefix") {
+		t.Errorf("got %v, want error for source prefix:\n%s", err, out)
+	}
+	// Rules apply to the mapped paths.
+	g.Run(t, "-push", "-prefix-map="+prefixMap, repoA, repoB, "strip:_test\\.c$")
+	b.Git(t, "pull")
+	if got, want := b.Output(t, "ls-files"), "ext/lib.c\nlint/main.go\n"; got != want {
+		t.Errorf("got files %q, want %q", got, want)
+	}
+	if got, want := b.Output(t, "log", "--format=%s"), "mixed commit\nfirst commit\ninitial commit\n"; got != want {
+		t.Errorf("got commits %q, want %q", got, want)
+	}
+	for path, want := range map[string]string{"lint/main.go": "main 2", "ext/lib.c": "lib 2"} {
+		if got := b.Output(t, "show", "HEAD:"+path); got != want {
+			t.Errorf("%s: got %q, want %q", path, got, want)
+		}
+	}
+	g.RunNoop(t, nil, "-push", "-prefix-map="+prefixMap, repoA, repoB, "strip:_test\\.c$")
+}
+
+// TestGritEnv ensures that the source, destination, and rules may be
+// given by the environment, and that arguments take precedence.
+func TestGritEnv(t *testing.T) {
+	dir, cleanup := temp(t)
+	defer cleanup()
+	g, a, b, repoA, repoB := setup(t, dir)
+
+	a.WriteFile(t, "file1", "content 1")
+	a.WriteFile(t, "BUILD", "build content")
+	a.WriteFile(t, "internal/file2", "content 2")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-a", "-m", "first commit")
+	a.Git(t, "push")
+
+	g.RunEnv(t, []string{
+		"GRIT_SRC=" + repoA,
+		"GRIT_DST=" + filepath.Join(dir, "nonexistent"),
+		"GRIT_RULES=# Internal files.\nstrip:^BUILD$\n\nstrip:^internal/\n",
+	}, "-push", repoA, repoB)
+	b.Git(t, "pull")
+	a.Compare(t, b, "BUILD", "internal")
+	b.NotExist(t, "BUILD")
+	b.NotExist(t, "internal")
+
+	a.WriteFile(t, "extra/BUILD", "build content 2")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-a", "-m", "second commit")
+	a.Git(t, "push")
+	// Rules given as arguments take precedence.
+	g.RunEnv(t, []string{"GRIT_SRC=" + repoA, "GRIT_DST=" + repoB, "GRIT_RULES=strip:BUILD$"}, "-push", repoA, repoB, "strip:^internal/")
+	b.Git(t, "pull")
+	if got, want := b.Output(t, "show", "HEAD:extra/BUILD"), "build content 2"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	g.RunEnv(t, []string{"GRIT_SRC=" + repoA, "GRIT_DST=" + repoB, "GRIT_RULES=strip:^BUILD$\nstrip:^internal/"}, "-verify")
+}
+
+// TestGritRewriteModes ensures that rewrite rules may be limited to
+// added or removed lines, leaving context lines as is.
+func TestGritRewriteModes(t *testing.T) {
+	dir, cleanup := temp(t)
+	defer cleanup()
+	g, a, b, repoA, repoB := setup(t, dir)
+
+	// This commit is copied before the rules are introduced.
+	a.WriteFile(t, "hosts", "internal one\nline 2\n")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-a", "-m", "first commit")
+	a.Git(t, "push")
+	g.Run(t, "-push", repoA, repoB)
+
+	a.WriteFile(t, "hosts", "internal one\nline 2\ninternal two\n")
+	a.Git(t, "commit", "-a", "-m", "second commit")
+	a.WriteFile(t, "hosts", "internal one\nline 2\n")
+	a.Git(t, "commit", "-a", "-m", "third commit")
+	a.WriteFile(t, "hosts", "internal one\nline 2\ninternal three\n")
+	a.Git(t, "commit", "-a", "-m", "fourth commit")
+	a.Git(t, "push")
+	rules := []string{"rewrite:^hosts$:+:/internal/external/", "rewrite:^hosts$:-:!internal!external!"}
+	g.Run(t, append([]string{"-push", repoA, repoB}, rules...)...)
+	b.Git(t, "pull")
+	if got, want := b.Output(t, "show", "HEAD:hosts"), "internal one\nline 2\nexternal three\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// TestGritStripMessageCommit ensures that commits are stripped
+// by the strip-message-commit rule.
+func TestGritStripMessageCommit(t *testing.T) {
+	dir, cleanup := temp(t)
+	defer cleanup()
+	g, a, b, repoA, repoB := setup(t, dir)
+
+	a.WriteFile(t, "file1", "content 1")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-a", "-m", "first commit")
+	a.WriteFile(t, "file2", "content 2")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-a", "-m", "[auto] generated commit")
+	a.Git(t, "push")
+
+	g.Run(t, "-push", repoA, repoB, `strip-message-commit:^\[auto\] `)
+	b.Git(t, "pull")
+	a.Compare(t, b, "file2")
+	b.NotExist(t, "file2")
+}
+
+// TestGritStripCommitsFile ensures that commits listed in the
+// -strip-commits-file are stripped, and that invalid hashes are
+// rejected.
+func TestGritStripCommitsFile(t *testing.T) {
+	dir, cleanup := temp(t)
+	defer cleanup()
+	g, a, b, repoA, repoB := setup(t, dir)
+
+	a.WriteFile(t, "file1", "content 1")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-a", "-m", "first commit")
+	a.WriteFile(t, "file2", "content 2")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-a", "-m", "bad commit")
+	a.WriteFile(t, "file3", "content 3")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-a", "-m", "third commit")
+	a.Git(t, "push")
+	bad := strings.TrimSpace(a.Output(t, "rev-parse", "--short=10", "HEAD~"))
+
+	list := filepath.Join(dir, "strip")
+	if err := ioutil.WriteFile(list, []byte("# Known bad commits.\nzzzzzzz\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out, err := g.RunError(t, "-strip-commits-file="+list, "-push", repoA, repoB)
+	if err == nil {
+		t.Fatalf("expected error for invalid hash\n%s", out)
+	}
+	if want := "invalid hex digit z"; !strings.Contains(out, want) {
+		t.Errorf("got %q, want %q", out, want)
+	}
+
+	if err := ioutil.WriteFile(list, []byte("# Known bad commits.\n\n"+bad+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	g.Run(t, "-strip-commits-file="+list, "-push", repoA, repoB)
+	b.Git(t, "pull")
+	a.Compare(t, b, "file2")
+	b.NotExist(t, "file2")
+	if got, want := b.Output(t, "log", "--format=%s"), "third commit\nfirst commit\ninitial commit\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// TestGritKeepEmpty ensures that empty commits are copied with
+// -keep-empty, and only once.
+func TestGritKeepEmpty(t *testing.T) {
+	dir, cleanup := temp(t)
+	defer cleanup()
+	g, a, b, repoA, repoB := setup(t, dir)
+
+	a.WriteFile(t, "file1", "content 1")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-a", "-m", "first commit")
+	a.Git(t, "commit", "--allow-empty", "-m", "release marker")
+	a.Git(t, "push")
+
+	g.Run(t, "-push", "-keep-empty", repoA, repoB)
+	g.RunNoop(t, nil, "-push", "-keep-empty", repoA, repoB)
+	b.Git(t, "pull")
+	a.Compare(t, b)
+	if got, want := b.Output(t, "log", "--format=%s"), "release marker\nfirst commit\ninitial commit\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// TestGritVerify ensures that -verify detects drift between the
+// source and destination repositories.
+func TestGritVerify(t *testing.T) {
+	dir, cleanup := temp(t)
+	defer cleanup()
+	g, a, b, repoA, repoB := setup(t, dir)
+
+	a.WriteFile(t, "file1", "content 1")
+	a.WriteFile(t, "BUILD", "build content")
+	a.WriteFile(t, "go.mod", "module example.com/a\nreplace x => ../x\n")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-a", "-m", "first commit")
+	a.Git(t, "push")
+
+	rules := []string{"strip:^BUILD$", "rewrite:go.mod$:/replace .* => .*//"}
+	g.Run(t, append([]string{"-push", repoA, repoB}, rules...)...)
+	g.Run(t, append([]string{"-verify", repoA, repoB}, rules...)...)
+
+	b.Git(t, "pull")
+	b.WriteFile(t, "file1", "drifted content")
+	b.Git(t, "commit", "-a", "-m", "drift")
+	b.Git(t, "push")
+	out, err := g.RunError(t, append([]string{"-verify", repoA, repoB}, rules...)...)
+	if err == nil {
+		t.Fatal("expected verification to fail")
+	}
+	if !strings.Contains(out, "+drifted content") {
+		t.Errorf("expected drift in output:\n%s", out)
+	}
+	// The rules themselves are logged, but the files they govern
+	// must not appear in the diff.
+	if strings.Contains(out, "a/go.mod") || strings.Contains(out, "a/BUILD") {
+		t.Errorf("unexpected rule-governed files in output:\n%s", out)
+	}
+}
+
+// TestGritExportIgnore ensures that files with the export-ignore
+// attribute are stripped with -export-ignore.
+func TestGritExportIgnore(t *testing.T) {
+	dir, cleanup := temp(t)
+	defer cleanup()
+	g, a, b, repoA, repoB := setup(t, dir)
+
+	a.WriteFile(t, ".gitattributes", "internal/** export-ignore\n*.secret export-ignore\n")
+	a.WriteFile(t, "file1", "content 1")
+	a.WriteFile(t, "internal/file2", "content 2")
+	a.WriteFile(t, "file3.secret", "content 3")
+	a.WriteFile(t, "BUILD", "build content")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-a", "-m", "first commit")
+	a.Git(t, "push")
+
+	g.Run(t, "-push", "-export-ignore", repoA, repoB, "strip:^BUILD$")
+	g.Run(t, "-verify", "-export-ignore", repoA, repoB, "strip:^BUILD$")
+	b.Git(t, "pull")
+	a.Compare(t, b, "internal", "file3.secret", "BUILD")
+	b.NotExist(t, "internal")
+	b.NotExist(t, "file3.secret")
+	b.NotExist(t, "BUILD")
+}
+
+// TestGritSquashRun ensures that -squash-run squashes all pending
+// commits into one, which lists them and credits their authors, that
+// it respects -max-commits, and that it cannot be combined with
+// -squash-window.
+func TestGritSquashRun(t *testing.T) {
+	dir, cleanup := temp(t)
+	defer cleanup()
+	g, a, b, repoA, repoB := setup(t, dir)
+
+	a.WriteFile(t, "file1", "content 1")
+	a.WriteFile(t, "file2", "content 2")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-a", "-m", "first commit", "--author=Other Author <other@example.com>")
+	a.WriteFile(t, "file1", "content 1 modified")
+	a.Git(t, "rm", "file2")
+	a.Git(t, "commit", "-a", "-m", "second commit", "-m", "with body")
+	a.WriteFile(t, "file2", "content 2 restored")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-a", "-m", "third commit", "--author=Other Author <other@example.com>")
+	a.Git(t, "push")
+	ids := strings.Fields(a.Output(t, "log", "--reverse", "--format=%h", "--abbrev=7"))
+
+	if out, err := g.RunError(t, "-squash-run", "-squash-window=1h", repoA, repoB); err == nil || !strings.Contains(out, "cannot be used with -squash-window") {
+		t.Errorf("got %v, want error for -squash-window:\n%s", err, out)
+	}
+	g.Run(t, "-push", "-squash-run", repoA, repoB)
+	b.Git(t, "pull")
+	a.Compare(t, b)
+	if got, want := b.Output(t, "log", "--format=%s (%an)"), "Squashed 3 source commits (Other Author)\ninitial commit (your name)\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	want := "Squashes the following source commits:\n\n" +
+		ids[0] + " first commit\n" + ids[1] + " second commit\n" + ids[2] + " third commit\n\n" +
+		"Co-authored-by: your name <you@example.com>\n"
+	body := b.Output(t, "log", "-1", "--format=%b")
+	if !strings.HasPrefix(body, want) {
+		t.Errorf("got body %q, want prefix %q", body, want)
+	}
+	if got, want := strings.Count(body, "fbshipit-source-id: "), 3; got != want {
+		t.Errorf("got %v source IDs, want %v:\n%s", got, want, body)
+	}
+
+	// At most -max-commits source commits are squashed; a single
+	// commit is copied as it is.
+	for i := 3; i <= 5; i++ {
+		a.WriteFile(t, "file3", fmt.Sprintf("content %d", i))
+		a.Git(t, "add", ".")
+		a.Git(t, "commit", "-a", "-m", fmt.Sprintf("commit %d", i))
+	}
+	a.Git(t, "push")
+	g.Run(t, "-push", "-squash-run", "-max-commits=2", repoA, repoB)
+	g.Run(t, "-push", "-squash-run", "-max-commits=2", repoA, repoB)
+	g.RunNoop(t, nil, "-push", "-squash-run", repoA, repoB)
+	b.Git(t, "pull")
+	a.Compare(t, b)
+	if got, want := b.Output(t, "log", "-2", "--format=%s"), "commit 5\nSquashed 2 source commits\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// TestGritSquash ensures that consecutive commits are squashed with
+// -squash-window.
+func TestGritSquash(t *testing.T) {
+	dir, cleanup := temp(t)
+	defer cleanup()
+	g, a, b, repoA, repoB := setup(t, dir)
+
+	a.WriteFile(t, "file1", "content 1")
+	a.WriteFile(t, "file2", "content 2")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-a", "-m", "first commit")
+	a.WriteFile(t, "file1", "content 1 modified")
+	a.Git(t, "rm", "file2")
+	a.Git(t, "commit", "-a", "-m", "second commit", "-m", "with body")
+	a.WriteFile(t, "file1", "content 1 modified again")
+	a.Git(t, "commit", "-a", "-m", "third commit")
+	a.Git(t, "push")
+
+	g.Run(t, "-push", "-squash-window=1h", repoA, repoB)
+	b.Git(t, "pull")
+	a.Compare(t, b)
+	if got, want := b.Output(t, "log", "--format=%s"), "first commit\ninitial commit\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	body := b.Output(t, "log", "-1", "--format=%b")
+	if !strings.Contains(body, "second commit\n\nwith body\n\nthird commit") {
+		t.Errorf("messages not concatenated:\n%s", body)
+	}
+	if got, want := strings.Count(body, "fbshipit-source-id: "), 3; got != want {
+		t.Errorf("got %v source IDs, want %v:\n%s", got, want, body)
+	}
+
+	if strings.Contains(body, "Co-authored-by") {
+		t.Errorf("unexpected co-authors:\n%s", body)
+	}
+
+	// A subsequent sync is a no-op.
+	a.WriteFile(t, "file3", "content 3")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-a", "-m", "fourth commit")
+	a.Git(t, "push")
+	g.Run(t, "-push", "-squash-window=1h", repoA, repoB)
+	b.Git(t, "pull")
+	a.Compare(t, b)
+	if got, want := b.Output(t, "log", "--format=%s"), "fourth commit\nfirst commit\ninitial commit\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// TestGritRenames ensures that renames are copied as renames with
+// -renames, and that renames from stripped paths are copied as
+// additions.
+func TestGritRenames(t *testing.T) {
+	dir, cleanup := temp(t)
+	defer cleanup()
+	g, a, b, repoA, repoB := setup(t, dir)
+
+	a.WriteFile(t, "file1", "content 1\n")
+	a.WriteFile(t, "internal/file2", "content 2\n")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-a", "-m", "first commit")
+	a.Git(t, "mv", "file1", "file1.renamed")
+	a.Git(t, "mv", "internal/file2", "file2")
+	a.Git(t, "commit", "-a", "-m", "second commit")
+	a.Git(t, "push")
+
+	g.Run(t, "-push", "-renames", repoA, repoB, "strip:^internal/")
+	b.Git(t, "pull")
+	a.Compare(t, b, "internal")
+	if got, want := b.Output(t, "show", "-M", "--name-status", "--format=", "HEAD"), "R100\tfile1\tfile1.renamed\nA\tfile2\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// TestGritCaseInsensitive ensures that -case-insensitive reports paths
+// that differ only in case, but permits changing the case of a path.
+func TestGritCaseInsensitive(t *testing.T) {
+	dir, cleanup := temp(t)
+	defer cleanup()
+	g, a, b, repoA, repoB := setup(t, dir)
+
+	a.WriteFile(t, "README", "content 1")
+	a.WriteFile(t, "Doc.txt", "content 2")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-a", "-m", "first commit")
+	a.Git(t, "mv", "Doc.txt", "doc.txt")
+	a.Git(t, "commit", "-a", "-m", "rename doc")
+	a.Git(t, "push")
+	g.Run(t, "-push", "-case-insensitive", repoA, repoB)
+
+	a.WriteFile(t, "readme", "content 3")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-a", "-m", "add readme")
+	a.Git(t, "push")
+	out, err := g.RunError(t, "-push", "-case-insensitive", repoA, repoB)
+	if err == nil {
+		t.Fatalf("expected case collision to fail:\n%s", out)
+	}
+	if !strings.Contains(out, "adds readme, which differs only in case from README") {
+		t.Errorf("collision not reported:\n%s", out)
+	}
+	b.Git(t, "pull")
+	b.NotExist(t, "readme")
+	if got, want := b.Output(t, "ls-files"), "README\ndoc.txt\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// TestGritBranches ensures that -branches mirrors each matching
+// branch to the same-named destination branch.
+func TestGritBranches(t *testing.T) {
+	dir, cleanup := temp(t)
+	defer cleanup()
+	g, a, b, repoA, repoB := setup(t, dir)
+
+	a.WriteFile(t, "file1", "content 1")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-a", "-m", "first commit")
+	a.Git(t, "push")
+	g.Run(t, "-push", repoA, repoB)
+	b.Git(t, "pull")
+
+	b.Git(t, "push", "origin", "HEAD:release/1")
+	for _, branch := range []string{"release/1", "release/2"} {
+		a.Git(t, "checkout", "-b", branch, "master")
+		a.WriteFile(t, "file1", "content on "+branch)
+		a.Git(t, "commit", "-a", "-m", "commit on "+branch)
+		a.Git(t, "push", "origin", branch)
+	}
+
+	g.Run(t, "-push", "-branches=release/*", repoA, repoB)
+	a.Git(t, "checkout", "release/1")
+	b.Git(t, "fetch")
+	b.Git(t, "checkout", "release/1")
+	a.Compare(t, b)
+	if got, want := b.Output(t, "ls-remote", "--heads", "origin", "release/2"), ""; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// TestGritWhitespace ensures that -whitespace=fix corrects whitespace
+// errors in applied patches.
+func TestGritWhitespace(t *testing.T) {
+	dir, cleanup := temp(t)
+	defer cleanup()
+	g, a, b, repoA, repoB := setup(t, dir)
+
+	a.WriteFile(t, "file1", "line 1 \nline 2\t\n")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-a", "-m", "first commit")
+	a.Git(t, "push")
+	if out, err := g.RunError(t, "-whitespace=tidy", "-push", repoA, repoB); err == nil {
+		t.Errorf("-whitespace=tidy succeeded: %s", out)
+	}
+	g.Run(t, "-whitespace=fix", "-push", repoA, repoB)
+	b.Git(t, "pull")
+	got, err := ioutil.ReadFile(filepath.Join(string(b), "file1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "line 1\nline 2\n"; string(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// TestGritBranchesParallel ensures that branches synced concurrently
+// with -parallel are each mirrored as they would be one at a time, and
+// that a branch whose sync fails does not stop the others.
+func TestGritBranchesParallel(t *testing.T) {
+	dir, cleanup := temp(t)
+	defer cleanup()
+	g, a, b, repoA, repoB := setup(t, dir)
+
+	a.WriteFile(t, "file1", "content 1")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-a", "-m", "first commit")
+	a.Git(t, "push")
+	g.Run(t, "-push", repoA, repoB)
+	b.Git(t, "pull")
+
+	branches := []string{"release/1", "release/2", "release/3", "release/4"}
+	for _, branch := range branches {
+		b.Git(t, "push", "origin", "HEAD:"+branch)
+		a.Git(t, "checkout", "-b", branch, "master")
+		a.WriteFile(t, "file1", "content on "+branch)
+		a.Git(t, "commit", "-a", "-m", "commit on "+branch)
+		a.Git(t, "push", "origin", branch)
+	}
+
+	g.Run(t, "-push", "-parallel=3", "-branches=release/*", repoA, repoB)
+	b.Git(t, "fetch")
+	for _, branch := range branches {
+		a.Git(t, "checkout", branch)
+		b.Git(t, "checkout", branch)
+		b.Git(t, "reset", "--hard", "origin/"+branch)
+		a.Compare(t, b)
+	}
+	g.RunNoop(t, nil, "-push", "-parallel=3", "-branches=release/*", repoA, repoB)
+
+	for _, branch := range branches {
+		a.Git(t, "checkout", branch)
+		a.WriteFile(t, "file2", "content on "+branch)
+		a.Git(t, "add", ".")
+		a.Git(t, "commit", "-a", "-m", "second commit on "+branch)
+		a.Git(t, "push", "origin", branch)
+	}
+	veto := `-pre-push=test "$GRIT_DST_BRANCH" != release/2`
+	out, err := g.RunError(t, "-push", "-parallel=3", "-branches=release/*", veto, repoA, repoB)
+	if err == nil {
+		t.Fatalf("expected sync of release/2 to fail:\n%s", out)
+	}
+	if !strings.Contains(out, "branch release/2: pre-push command") || !strings.Contains(out, "1 of 4 branches failed to sync: release/2") {
+		t.Errorf("failure not reported by branch:\n%s", out)
+	}
+	b.Git(t, "fetch")
+	for _, branch := range branches {
+		a.Git(t, "checkout", branch)
+		b.Git(t, "checkout", branch)
+		b.Git(t, "reset", "--hard", "origin/"+branch)
+		if branch == "release/2" {
+			b.NotExist(t, "file2")
+		} else {
+			a.Compare(t, b)
+		}
+	}
+
+	if out, err := g.RunError(t, "-dump", "-parallel=2", "-branches=release/*", repoA, repoB); err == nil {
+		t.Errorf("-parallel with -dump succeeded: %s", out)
+	}
+}
+
+// TestGritNormalize ensures that normalization rules strip trailing
+// whitespace and carriage returns, including in subsequent changes.
+func TestGritNormalize(t *testing.T) {
+	dir, cleanup := temp(t)
+	defer cleanup()
+	g, a, b, repoA, repoB := setup(t, dir)
+
+	a.WriteFile(t, "file.txt", "line 1  \r\nline 2\t\r\n")
+	a.WriteFile(t, "file.bat", "line 1  \r\nline 2\r\n")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-a", "-m", "first commit")
+	a.WriteFile(t, "file.txt", "line 1  \r\nline 2 modified \r\n")
+	a.WriteFile(t, "file.bat", "line 1  \r\nline 2 modified\r\n")
+	a.Git(t, "commit", "-a", "-m", "second commit")
+	a.Git(t, "push")
+
+	rules := []string{`trim-trailing-space:\.txt$`, `normalize-eol:\.bat$`}
+	g.Run(t, append([]string{"-push", repoA, repoB}, rules...)...)
+	g.Run(t, append([]string{"-verify", repoA, repoB}, rules...)...)
+	b.Git(t, "pull")
+	for path, want := range map[string]string{
+		"file.txt": "line 1\nline 2 modified\n",
+		"file.bat": "line 1  \nline 2 modified\n",
+	} {
+		got, err := ioutil.ReadFile(filepath.Join(string(b), path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("%s: got %q, want %q", path, got, want)
+		}
+	}
+}
+
+// TestGritBinaryRules ensures that rules do not modify binary files,
+// even when their path regexps match them.
+func TestGritBinaryRules(t *testing.T) {
+	dir, cleanup := temp(t)
+	defer cleanup()
+	g, a, b, repoA, repoB := setup(t, dir)
+
+	binary := "internal\x00data  \r\n"
+	a.WriteFile(t, "file.txt", "internal text  \r\n")
+	a.WriteFile(t, "data.bin", binary)
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-a", "-m", "first commit")
+	binary += "more internal\x00data\r\n"
+	a.WriteFile(t, "data.bin", binary)
+	a.Git(t, "commit", "-a", "-m", "second commit")
+	a.Git(t, "push")
+
+	rules := []string{"rewrite:.*:/internal/external/", "trim-trailing-space:.*", "redact:/data/***/"}
+	g.Run(t, append([]string{"-push", repoA, repoB}, rules...)...)
+	g.Run(t, append([]string{"-verify", repoA, repoB}, rules...)...)
+	b.Git(t, "pull")
+	for path, want := range map[string]string{
+		"file.txt": "external text\n",
+		"data.bin": binary,
+	} {
+		got, err := ioutil.ReadFile(filepath.Join(string(b), path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("%s: got %q, want %q", path, got, want)
+		}
+	}
+}
+
+// TestGritRedact ensures that redact rules replace secrets in diffs,
+// including in context and removed lines, so that subsequent changes
+// apply, and that the destination verifies against them.
+func TestGritRedact(t *testing.T) {
+	dir, cleanup := temp(t)
+	defer cleanup()
+	g, a, b, repoA, repoB := setup(t, dir)
+
+	a.WriteFile(t, "fixture.txt", "user=test\ntoken=tok_0123456789abcdef\n")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-a", "-m", "add fixture")
+	a.WriteFile(t, "fixture.txt", "user=test\ntoken=tok_0123456789abcdef\nother=tok_fedcba9876543210 tok_0000000000000000\n")
+	a.Git(t, "commit", "-a", "-m", "add more tokens")
+	a.WriteFile(t, "fixture.txt", "user=test\nother=tok_fedcba9876543210 tok_0000000000000000\n")
+	a.Git(t, "commit", "-a", "-m", "remove token")
+	a.Git(t, "push")
+
+	rule := "redact:/tok_[0-9a-f]{16}/***REDACTED***/"
+	g.Run(t, "-push", repoA, repoB, rule)
+	g.Run(t, "-verify", repoA, repoB, rule)
+	b.Git(t, "pull")
+	got, err := ioutil.ReadFile(filepath.Join(string(b), "fixture.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "user=test\nother=***REDACTED*** ***REDACTED***\n"; string(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if log := b.Output(t, "log", "-p"); strings.Contains(log, "tok_") {
+		t.Errorf("secret leaked to destination history:\n%s", log)
+	}
+}
+
+// TestGritMaxCommits ensures that -max-commits limits the number of
+// commits copied in a single run.
+func TestGritMaxCommits(t *testing.T) {
+	dir, cleanup := temp(t)
+	defer cleanup()
+	g, a, b, repoA, repoB := setup(t, dir)
+
+	for i := 1; i <= 3; i++ {
+		a.WriteFile(t, "file1", fmt.Sprintf("content %d", i))
+		a.Git(t, "add", ".")
+		a.Git(t, "commit", "-a", "-m", fmt.Sprintf("commit %d", i))
+	}
+	a.Git(t, "push")
+
+	g.Run(t, "-push", "-max-commits=2", repoA, repoB)
+	b.Git(t, "pull")
+	if got, want := b.Output(t, "log", "--format=%s"), "commit 2\ncommit 1\ninitial commit\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	g.Run(t, "-push", "-max-commits=2", repoA, repoB)
+	b.Git(t, "pull")
+	a.Compare(t, b)
+	if got, want := b.Output(t, "log", "--format=%s"), "commit 3\ncommit 2\ncommit 1\ninitial commit\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// TestGritAuthorFilter ensures that commits are filtered by author,
+// and that filtered commits do not disturb later syncs.
+func TestGritAuthorFilter(t *testing.T) {
+	dir, cleanup := temp(t)
+	defer cleanup()
+	g, a, b, repoA, repoB := setup(t, dir)
+
+	commit := func(author, file, content string) {
+		a.WriteFile(t, file, content)
+		a.Git(t, "add", ".")
+		a.Git(t, "commit", "-m", author+" "+file, "--author", author+" <"+author+"@example.com>")
+	}
+	commit("alice", "file1", "content 1")
+	commit("bob", "internal", "content 2")
+	commit("alice", "file1", "content 3")
+	a.Git(t, "push")
+
+	g.Run(t, "-push", "-author-allow=^alice ", repoA, repoB)
+	b.Git(t, "pull")
+	if got, want := b.Output(t, "log", "--format=%s"), "alice file1\nalice file1\ninitial commit\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	b.NotExist(t, "internal")
+
+	// A trailing filtered commit leaves nothing to do.
+	commit("bob", "internal", "content 4")
+	a.Git(t, "push")
+	g.RunNoop(t, nil, "-push", "-author-deny=<bob@", repoA, repoB)
+
+	commit("carol", "file2", "content 5")
+	a.Git(t, "push")
+	g.Run(t, "-push", "-author-deny=<bob@", repoA, repoB)
+	b.Git(t, "pull")
+	if got, want := b.Output(t, "log", "-1", "--format=%s %an"), "carol file2 carol\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	b.NotExist(t, "internal")
+	if got, want := b.Output(t, "rev-list", "--count", "HEAD"), "4\n"; got != want {
+		t.Errorf("got %q commits, want %q", got, want)
+	}
+}
+
+// TestGritRequireSigned ensures that -require-signed copies only
+// commits with good signatures.
+func TestGritRequireSigned(t *testing.T) {
+	if _, err := exec.LookPath("gpg"); err != nil {
+		t.Skip("gpg not installed")
+	}
+	dir, cleanup := temp(t)
+	defer cleanup()
+	g, a, b, repoA, repoB := setup(t, dir)
+
+	gnupg := filepath.Join(dir, "gnupg")
+	if err := os.Mkdir(gnupg, 0700); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("GNUPGHOME", os.Getenv("GNUPGHOME"))
+	os.Setenv("GNUPGHOME", gnupg)
+	defer exec.Command("gpgconf", "--kill", "gpg-agent").Run()
+	run(t, "gpg", "--batch", "--passphrase", "", "--quick-gen-key", "signer <signer@example.com>", "ed25519", "sign", "never")
+
+	a.WriteFile(t, "file1", "content 1")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-Ssigner@example.com", "-m", "signed commit")
+	a.WriteFile(t, "file2", "content 2")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-m", "unsigned commit")
+	a.WriteFile(t, "file1", "content 3")
+	a.Git(t, "commit", "-a", "-Ssigner@example.com", "-m", "another signed commit")
+	a.Git(t, "push")
+
+	out, err := g.RunError(t, "-push", "-require-signed", repoA, repoB)
+	if err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+	if !strings.Contains(out, "not signed: skipping") || !strings.Contains(out, "skipped 1 commits without a good signature") {
+		t.Errorf("unsigned commit not reported:\n%s", out)
+	}
+	b.Git(t, "pull")
+	if got, want := b.Output(t, "log", "--format=%s"), "another signed commit\nsigned commit\ninitial commit\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	b.NotExist(t, "file2")
+}
+
+// TestGritSignatureTrailers ensures that -signature-trailers records
+// the signers and signatures of signed source commits.
+func TestGritSignatureTrailers(t *testing.T) {
+	if _, err := exec.LookPath("gpg"); err != nil {
+		t.Skip("gpg not installed")
+	}
+	dir, cleanup := temp(t)
+	defer cleanup()
+	g, a, b, repoA, repoB := setup(t, dir)
+
+	gnupg := filepath.Join(dir, "gnupg")
+	if err := os.Mkdir(gnupg, 0700); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("GNUPGHOME", os.Getenv("GNUPGHOME"))
+	os.Setenv("GNUPGHOME", gnupg)
+	defer exec.Command("gpgconf", "--kill", "gpg-agent").Run()
+	run(t, "gpg", "--batch", "--passphrase", "", "--quick-gen-key", "signer <signer@example.com>", "ed25519", "sign", "never")
+
+	a.WriteFile(t, "file1", "content 1")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-Ssigner@example.com", "-m", "signed commit")
+	a.WriteFile(t, "file2", "content 2")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-m", "unsigned commit")
+	a.Git(t, "push")
+
+	g.Run(t, "-push", "-signature-trailers", repoA, repoB)
+	g.RunNoop(t, nil, "-push", "-signature-trailers", repoA, repoB)
+	b.Git(t, "pull")
+	a.Compare(t, b)
+	if got := b.Output(t, "log", "-1", "--format=%b"); strings.Contains(got, "grit-original-") {
+		t.Errorf("unsigned commit has signature trailers:\n%s", got)
+	}
+	body := b.Output(t, "log", "-1", "--skip=1", "--format=%b")
+	if want := "grit-original-signer: signer <signer@example.com>\n"; !strings.Contains(body, want) {
+		t.Errorf("got %q, want %q", body, want)
+	}
+	const prefix = "grit-original-signature: "
+	var sig string
+	for _, line := range strings.Split(body, "\n") {
+		if strings.HasPrefix(line, prefix) {
+			sig = strings.TrimPrefix(line, prefix)
+		}
+	}
+	armored, err := base64.StdEncoding.DecodeString(sig)
+	if err != nil {
+		t.Fatalf("%q: %v", sig, err)
+	}
+	if !strings.HasPrefix(string(armored), "-----BEGIN PGP SIGNATURE-----\n") || !strings.HasSuffix(string(armored), "-----END PGP SIGNATURE-----\n") {
+		t.Errorf("got signature %q", armored)
+	}
+}
+
+// TestGritCoAuthors ensures that Co-authored-by trailers are moved to
+// the end of the destination message, and combined when squashing,
+// with a trailer for each author of the squashed commits other than
+// the squashed commit's.
+func TestGritCoAuthors(t *testing.T) {
+	dir, cleanup := temp(t)
+	defer cleanup()
+	g, a, b, repoA, repoB := setup(t, dir)
+
+	a.WriteFile(t, "file1", "content 1")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-a", "-m", "first commit", "-m", "Co-authored-by: Alice <alice@example.com>")
+	a.WriteFile(t, "file1", "content 1 modified")
+	a.Git(t, "commit", "-a", "-m", "second commit", "-m", "with body",
+		"-m", "Co-authored-by: Bob <bob@example.com>\nco-authored-by: Alice <alice@example.com>\nCo-authored-by: your name <you@example.com>")
+	a.Git(t, "push")
+
+	g.Run(t, "-push", "-squash-window=1h", repoA, repoB)
+	b.Git(t, "pull")
+	a.Compare(t, b)
+	got := b.Output(t, "log", "-1", "--format=%b")
+	want := `second commit
+
+with body
+
+Co-authored-by: Alice <alice@example.com>
+Co-authored-by: Bob <bob@example.com>
+`
+	if !strings.HasPrefix(got, want) {
+		t.Errorf("got body %q, want prefix %q", got, want)
+	}
+	if got, want := b.Output(t, "log", "-1", "--format=%(trailers:key=Co-authored-by,valueonly)"), "Alice <alice@example.com>\nBob <bob@example.com>\n\n"; got != want {
+		t.Errorf("got co-author trailers %q, want %q", got, want)
+	}
+
+	a.WriteFile(t, "file2", "content 2")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-a", "-m", "third commit", "--author=Carol <carol@example.com>",
+		"-m", "Co-authored-by: Dave <dave@example.com>")
+	a.WriteFile(t, "file2", "content 2 modified")
+	a.Git(t, "commit", "-a", "-m", "fourth commit", "--author=Carol <carol@example.com>")
+	a.WriteFile(t, "file1", "content 1 modified again")
+	a.Git(t, "commit", "-a", "-m", "fifth commit")
+	a.Git(t, "push")
+	g.Run(t, "-push", "-squash-run", repoA, repoB)
+	b.Git(t, "pull")
+	a.Compare(t, b)
+	if got, want := b.Output(t, "log", "-1", "--format=%an <%ae>"), "your name <you@example.com>\n"; got != want {
+		t.Errorf("got author %q, want %q", got, want)
+	}
+	if got, want := b.Output(t, "log", "-1", "--format=%(trailers:key=Co-authored-by)"), "Co-authored-by: Carol <carol@example.com>\nCo-authored-by: Dave <dave@example.com>\n\n"; got != want {
+		t.Errorf("got co-author trailers %q, want %q", got, want)
+	}
+}
+
+// TestGritKeepTrailers ensures that -keep-trailers keeps the trailers
+// of commit messages stripped by strip-message rules.
+func TestGritKeepTrailers(t *testing.T) {
+	dir, cleanup := temp(t)
+	defer cleanup()
+	g, a, b, repoA, repoB := setup(t, dir)
+
+	a.WriteFile(t, "go.mod", "module example.com/m")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-a", "-m", "internal: bump deps", "-m", "See go/internal-link.",
+		"-m", "Signed-off-by: your name <you@example.com>\nCo-authored-by: Alice <alice@example.com>")
+	a.WriteFile(t, "go.mod", "module example.com/m\n\ngo 1.13")
+	a.Git(t, "commit", "-a", "-m", "internal: set go version", "-m", "Not a trailer: at the end")
+	a.Git(t, "push")
+
+	g.Run(t, "-push", "-keep-trailers", repoA, repoB, "strip-message:^go.mod$")
+	b.Git(t, "pull")
+	a.Compare(t, b)
+	got := b.Output(t, "log", "-1", "--format=%B", "HEAD~")
+	want := `Stripped commit
+
+Commit message stripped.
+
+Signed-off-by: your name <you@example.com>
+Co-authored-by: Alice <alice@example.com>
+fbshipit-source-id: `
+	if !strings.HasPrefix(got, want) {
+		t.Errorf("got message %q, want prefix %q", got, want)
+	}
+	got = b.Output(t, "log", "-1", "--format=%B")
+	want = "Stripped commit\n\nCommit message stripped.\n\nfbshipit-source-id: "
+	if !strings.HasPrefix(got, want) {
+		t.Errorf("got message %q, want prefix %q", got, want)
+	}
+}
+
+// TestGritSourceCommits ensures that -source-commits records full
+// source hashes, and that they are used by subsequent syncs.
+func TestGritSourceCommits(t *testing.T) {
+	dir, cleanup := temp(t)
+	defer cleanup()
+	g, a, b, repoA, repoB := setup(t, dir)
+
+	a.WriteFile(t, "file1", "content 1")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-a", "-m", "first commit")
+	a.Git(t, "push")
+	g.Run(t, "-push", "-source-commits", repoA, repoB)
+	b.Git(t, "pull")
+	id := strings.TrimSpace(a.Output(t, "rev-parse", "HEAD"))
+	want := fmt.Sprintf("fbshipit-source-id: %s\ngrit-source-commit: %s\n\n", id[:7], id)
+	if got := b.Output(t, "log", "-1", "--format=%b"); !strings.HasSuffix(got, want) {
+		t.Errorf("got body %q, want suffix %q", got, want)
+	}
+
+	a.WriteFile(t, "file2", "content 2")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-a", "-m", "second commit")
+	a.Git(t, "push")
+	g.Run(t, "-push", "-source-commits", repoA, repoB)
+	b.Git(t, "pull")
+	a.Compare(t, b)
+	if got, want := b.Output(t, "log", "--format=%s"), "second commit\nfirst commit\ninitial commit\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// TestGritNotes ensures that git notes are copied to the destination
+// with -notes, and that commits without notes are copied as usual.
+func TestGritNotes(t *testing.T) {
+	dir, cleanup := temp(t)
+	defer cleanup()
+	g, a, b, repoA, repoB := setup(t, dir)
+
+	a.WriteFile(t, "file1", "content 1")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-a", "-m", "first commit")
+	a.Git(t, "push")
+	g.Run(t, "-push", "-notes", repoA, repoB)
+
+	a.WriteFile(t, "file1", "content 2")
+	a.Git(t, "commit", "-a", "-m", "second commit")
+	a.Git(t, "notes", "add", "-m", "Reviewed-at: https://review.example.com/2", "HEAD")
+	a.WriteFile(t, "file1", "content 3")
+	a.Git(t, "commit", "-a", "-m", "third commit")
+	a.Git(t, "push", "origin", "master", "refs/notes/commits")
+	g.Run(t, "-push", "-notes", repoA, repoB)
+
+	b.Git(t, "pull")
+	b.Git(t, "fetch", "origin", "refs/notes/commits:refs/notes/commits")
+	if got, want := b.Output(t, "log", "--format=%s:%N"), "third commit:\nsecond commit:Reviewed-at: https://review.example.com/2\n\nfirst commit:\ninitial commit:\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// TestGritTopoOrder ensures that -topo-order copies parents before
+// their children, even if committer dates are skewed.
+func TestGritTopoOrder(t *testing.T) {
+	dir, cleanup := temp(t)
+	defer cleanup()
+	g, a, b, repoA, repoB := setup(t, dir)
+
+	commit := func(date, msg string) {
+		cmd := exec.Command("git", "-C", string(a), "commit", "-a", "-m", msg)
+		cmd.Env = append(os.Environ(), "GIT_COMMITTER_DATE="+date, "GIT_AUTHOR_DATE="+date)
+		runCommand(t, cmd)
+	}
+	a.WriteFile(t, "file1", "content 1\n")
+	a.Git(t, "add", ".")
+	commit("2020-01-01T10:00:00", "base commit")
+	a.Git(t, "checkout", "-b", "topic")
+	// The topic commit's clock is skewed, so that it predates its
+	// parent, and git log lists it after the parent by default.
+	a.WriteFile(t, "file1", "content 1 modified\n")
+	commit("2020-01-01T05:00:00", "topic commit")
+	a.Git(t, "checkout", "master")
+	a.WriteFile(t, "file2", "content 2\n")
+	a.Git(t, "add", ".")
+	commit("2020-01-01T20:00:00", "master commit")
+	a.Git(t, "merge", "--no-ff", "-m", "merge topic", "topic")
+	a.Git(t, "push", "origin", "master")
+
+	g.Run(t, "-push", "-topo-order", repoA, repoB)
+	b.Git(t, "pull")
+	a.Compare(t, b)
+	if got, want := b.Output(t, "log", "--format=%s"), "topic commit\nmaster commit\nbase commit\ninitial commit\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// TestGritDumpFile ensures that -dump-file writes an mbox that git am
+// applies to reproduce the copied commits.
+func TestGritDumpFile(t *testing.T) {
+	dir, cleanup := temp(t)
+	defer cleanup()
+	g, a, b, repoA, repoB := setup(t, dir)
+
+	a.WriteFile(t, "file1", "content 1\n")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-a", "-m", "first commit")
+	a.WriteFile(t, "file2", "content 2\n")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-a", "-m", "second commit", "-m", "From the team.")
+	a.WriteFile(t, "file1", "content 1 modified\n")
+	a.Git(t, "commit", "-a", "-m", "third commit")
+	a.Git(t, "push")
+
+	mbox := filepath.Join(dir, "patches.mbox")
+	g.Run(t, "-dump-file="+mbox, repoA, repoB)
+	if got, want := b.Output(t, "rev-list", "--count", "origin/master"), "1\n"; got != want {
+		t.Errorf("destination was modified: got %q commits, want %q", got, want)
+	}
+
+	c := repo(filepath.Join(dir, "c"))
+	run(t, "git", "init", string(c))
+	c.Git(t, "config", "user.email", "you@example.com")
+	c.Git(t, "config", "user.name", "your name")
+	c.Git(t, "am", mbox)
+	a.Compare(t, c)
+	if got, want := c.Output(t, "log", "--format=%s"), "third commit\nsecond commit\nfirst commit\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, want := c.Output(t, "log", "-1", "--skip=1", "--format=%b"), "From the team.\n\nfbshipit-source-id: "; !strings.HasPrefix(got, want) {
+		t.Errorf("got %q, want prefix %q", got, want)
+	}
+}
+
+// TestGritDumpJSON ensures that -dump=json writes one JSON object
+// per patch, with binary diff bodies base64-encoded.
+func TestGritDumpJSON(t *testing.T) {
+	dir, cleanup := temp(t)
+	defer cleanup()
+	g, a, b, repoA, repoB := setup(t, dir)
+
+	a.WriteFile(t, "file1", "content 1\n")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-a", "-m", "first commit")
+	a.WriteFile(t, "image", "\x00\x01\x02")
+	a.WriteFile(t, "file1", "content 1 modified\n")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-a", "-m", "second commit", "-m", "With an image.")
+	a.Git(t, "push")
+
+	out := filepath.Join(dir, "patches.json")
+	g.Run(t, "-dump=json", "-dump-file="+out, repoA, repoB)
+	if got, want := b.Output(t, "rev-list", "--count", "origin/master"), "1\n"; got != want {
+		t.Errorf("destination was modified: got %q commits, want %q", got, want)
+	}
+	data, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want 2:\n%s", len(lines), data)
+	}
+	type patch struct {
+		Subject, Body string
+		Diffs         []struct {
+			Path, Body            string
+			Insertions, Deletions int
+			Binary                bool
+			BinaryBody            []byte
+		}
+	}
+	var patches []patch
+	for _, line := range lines {
+		var patch patch
+		if err := json.Unmarshal([]byte(line), &patch); err != nil {
+			t.Fatalf("%s: %v", line, err)
+		}
+		patches = append(patches, patch)
+	}
+	if got, want := patches[0].Subject, "first commit"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	second := patches[1]
+	if got, want := second.Subject, "second commit"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if !strings.HasPrefix(second.Body, "With an image.\n") || !strings.Contains(second.Body, "fbshipit-source-id: ") {
+		t.Errorf("got %q", second.Body)
+	}
+	if len(second.Diffs) != 2 {
+		t.Fatalf("got %+v, want 2 diffs", second.Diffs)
+	}
+	if d := second.Diffs[0]; d.Path != "file1" || d.Binary || d.Insertions != 1 || d.Deletions != 1 || !strings.Contains(d.Body, "+content 1 modified") {
+		t.Errorf("got %+v", d)
+	}
+	if d := second.Diffs[1]; d.Path != "image" || !d.Binary || d.Body != "" || !strings.HasPrefix(string(d.BinaryBody), "literal 3\n") {
+		t.Errorf("got %+v", d)
+	}
+}
+
+// TestGritVersion ensures that -version logs the version of git
+// without accessing any repository.
+func TestGritVersion(t *testing.T) {
+	var g grit
+	g.Build(t)
+	out, err := g.RunError(t, "-version")
+	if err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+	if want := "git version "; !strings.Contains(out, want) {
+		t.Errorf("got %q, want %q", out, want)
+	}
+}
+
+// TestGritLint ensures that -lint reports invalid rules and
+// references to undefined capture groups, and accepts valid rules.
+func TestGritLint(t *testing.T) {
+	dir, cleanup := temp(t)
+	defer cleanup()
+	var g grit
+	g.Build(t)
+
+	rulesFile := filepath.Join(dir, "rules")
+	if err := ioutil.WriteFile(rulesFile, []byte("# valid\nstrip:^internal/\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out, err := g.RunError(t, "-lint", "-rules="+rulesFile, "rewrite:.*:/(foo)(?P<x>bar)/${1}$x$2$$/", "redact:/secret/xxx/")
+	if err != nil {
+		t.Fatalf("valid rules: %v\n%s", err, out)
+	}
+
+	out, err = g.RunError(t, "-lint", "-rules="+rulesFile,
+		"strip:(",
+		"bogus:foo",
+		"rewrite:.*:/(foo)/$1x/",
+		"redact:/secret/${name}/",
+	)
+	if err == nil {
+		t.Fatalf("invalid rules: expected error\n%s", out)
+	}
+	for _, want := range []string{
+		`rule "strip:(": invalid regexp (`,
+		`rule "bogus:foo": invalid rule type bogus`,
+		`rule "rewrite:.*:/(foo)/$1x/": warning: 'to' refers to $1x`,
+		`rule "redact:/secret/${name}/": warning: replacement refers to ${name}`,
+		"4 problems in 5 rules",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output does not contain %q:\n%s", want, out)
+		}
+	}
+}
+
+// TestGritClean ensures that -clean cleans the checkouts without
+// copying commits, keeping those that were applied but not pushed.
+func TestGritClean(t *testing.T) {
+	dir, cleanup := temp(t)
+	defer cleanup()
+	g, a, b, repoA, repoB := setup(t, dir)
+
+	a.WriteFile(t, "file1", "content 1")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-a", "-m", "first commit")
+	a.Git(t, "push")
+	g.Run(t, "-ff-only", repoA, repoB)
+	out, err := g.RunError(t, "-clean", repoA, repoB)
+	if err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+	if got, want := strings.Count(out, "cleaned checkout"), 2; got != want {
+		t.Errorf("got %d cleaned checkouts, want %d:\n%s", got, want, out)
+	}
+	b.Git(t, "fetch")
+	if got, want := b.Output(t, "rev-list", "--count", "origin/master"), "1\n"; got != want {
+		t.Errorf("destination was modified: got %q commits, want %q", got, want)
+	}
+	// The commit applied by the first run is pushed by the next.
+	g.Run(t, "-push", "-ff-only", repoA, repoB)
+	b.Git(t, "pull")
+	if got, want := b.Output(t, "log", "--format=%s"), "first commit\ninitial commit\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// TestGritCommitter ensures that grit fails at startup without a
+// committer identity, unless it only verifies, and that -committer-name
+// and -committer-email provide one.
+func TestGritCommitter(t *testing.T) {
+	dir, cleanup := temp(t)
+	defer cleanup()
+	g, a, b, repoA, repoB := setup(t, dir)
+
+	a.WriteFile(t, "file1", "content 1")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-a", "-m", "first commit")
+	a.Git(t, "push")
+
+	// Keep any global or system configuration out of the way.
+	env := append(os.Environ(), "HOME="+dir, "XDG_CONFIG_HOME="+dir, "GIT_CONFIG_NOSYSTEM=1")
+	cmd := exec.Command(string(g), "-push", repoA, repoB)
+	cmd.Env = env
+	out, err := cmd.CombinedOutput()
+	if err == nil {
+		t.Fatalf("expected error\n%s", out)
+	}
+	if want := "no committer identity configured"; !strings.Contains(string(out), want) {
+		t.Errorf("got %q, want %q", out, want)
+	}
+	cmd = exec.Command(string(g), "-verify", repoA, repoB)
+	cmd.Env = env
+	out, _ = cmd.CombinedOutput()
+	if want := "no committer identity configured"; strings.Contains(string(out), want) {
+		t.Errorf("-verify: got %q, want no committer error", out)
+	}
+	cmd = exec.Command(string(g), "-committer-name=sync bot", "-committer-email=bot@example.com", "-push", repoA, repoB)
+	cmd.Env = env
+	runCommand(t, cmd)
+	b.Git(t, "pull")
+	if got, want := b.Output(t, "log", "-1", "--format=%s: %cn <%ce>"), "first commit: sync bot <bot@example.com>\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// TestGritNoTrailer ensures that -no-trailer records source commits
+// in notes instead of trailers, and that syncs resume from them.
+func TestGritNoTrailer(t *testing.T) {
+	dir, cleanup := temp(t)
+	defer cleanup()
+	g, a, b, repoA, repoB := setup(t, dir)
+
+	a.WriteFile(t, "file1", "content 1")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-a", "-m", "first commit")
+	a.Git(t, "push")
+	g.Run(t, "-push", "-no-trailer", "-source-commits", repoA, repoB)
+
+	a.WriteFile(t, "file1", "content 2")
+	a.Git(t, "commit", "-a", "-m", "second commit")
+	a.Git(t, "push")
+	g.Run(t, "-push", "-no-trailer", "-source-commits", repoA, repoB)
+	g.RunNoop(t, nil, "-push", "-no-trailer", "-source-commits", repoA, repoB)
+
+	b.Git(t, "pull")
+	a.Compare(t, b)
+	if got, want := b.Output(t, "log", "-2", "--format=%B"), "second commit\n\nfirst commit\n\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	b.Git(t, "fetch", "origin", "refs/notes/grit:refs/notes/grit")
+	want := fmt.Sprintf("fbshipit-source-id: %s\ngrit-source-commit: %s\n\n", a.Output(t, "rev-parse", "--short=7", "HEAD")[:7], strings.TrimSpace(a.Output(t, "rev-parse", "HEAD")))
+	if got := b.Output(t, "log", "-1", "--notes=grit", "--format=%N"); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// TestGritMessageTemplate ensures that -message-template renders
+// destination commit messages, to which trailers are appended.
+func TestGritMessageTemplate(t *testing.T) {
+	dir, cleanup := temp(t)
+	defer cleanup()
+	g, a, b, repoA, repoB := setup(t, dir)
+
+	tmpl := filepath.Join(dir, "message.tmpl")
+	if err := ioutil.WriteFile(tmpl, []byte("mirror: {{.Subject}}\n\n{{.Body}}\n\nAuthor: {{.Author}}\nMirrored from internal repo.\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	a.WriteFile(t, "file1", "content 1")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-a", "-m", "first commit – ünïcode", "-m", "with body")
+	a.Git(t, "push")
+	g.Run(t, "-push", "-message-template="+tmpl, repoA, repoB)
+	b.Git(t, "pull")
+	a.Compare(t, b)
+	want := fmt.Sprintf("mirror: first commit – ünïcode\n\nwith body\n\nAuthor: your name <you@example.com>\nMirrored from internal repo.\n\nfbshipit-source-id: %s\n\n", a.Output(t, "rev-parse", "--short=7", "HEAD")[:7])
+	if got := b.Output(t, "log", "-1", "--format=%B"); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	if err := ioutil.WriteFile(tmpl, []byte("{{.Missing}}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	a.WriteFile(t, "file1", "content 2")
+	a.Git(t, "commit", "-a", "-m", "second commit")
+	a.Git(t, "push")
+	if out, err := g.RunError(t, "-message-template="+tmpl, repoA, repoB); err == nil {
+		t.Errorf("expected error for invalid template field\n%s", out)
+	}
+}
+
+// TestGritTags ensures that -tags mirrors tags that refer to copied
+// commits, and that -github-releases creates releases for them.
+func TestGritTags(t *testing.T) {
+	dir, cleanup := temp(t)
+	defer cleanup()
+	g, a, b, repoA, repoB := setup(t, dir)
+	var (
+		mu       sync.Mutex
+		releases []string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var release struct {
+			TagName string `json:"tag_name"`
+			Body    string `json:"body"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&release); err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		releases = append(releases, r.URL.Path+" "+release.TagName+": "+release.Body)
+		mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+
+	a.WriteFile(t, "file1", "content 1")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-a", "-m", "first commit")
+	a.Git(t, "tag", "-a", "-m", "Release 1.", "v1")
+	a.WriteFile(t, "BUILD", "build content")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-a", "-m", "stripped commit")
+	a.Git(t, "tag", "v2")
+	a.WriteFile(t, "file1", "content 3")
+	a.Git(t, "commit", "-a", "-m", "third commit")
+	a.Git(t, "tag", "v3")
+	a.Git(t, "push", "--follow-tags", "origin", "master", "v2", "v3")
+
+	// Malformed repositories are rejected before anything is pushed.
+	remote := b.Output(t, "ls-remote", "origin")
+	if out, err := g.RunError(t, "-push", "-tags", "-github-releases=project", repoA, repoB, "strip:^BUILD$"); err == nil {
+		t.Errorf("expected malformed -github-releases to fail:\n%s", out)
+	}
+	if got := b.Output(t, "ls-remote", "origin"); got != remote {
+		t.Errorf("destination was modified: got %q, want %q", got, remote)
+	}
+
+	env := []string{"GITHUB_TOKEN=token", "GITHUB_API_URL=" + srv.URL}
+	args := []string{"-push", "-tags", "-github-releases=grailbio/project", repoA, repoB, "strip:^BUILD$"}
+	g.RunEnv(t, env, args...)
+	g.RunNoop(t, env, args...)
+	b.Git(t, "pull", "--tags")
+	if got, want := b.Output(t, "tag", "-l", "--format=%(refname:strip=2) %(subject) %(*subject)"), "v1 Release 1. first commit\nv3 third commit \n"; got != want {
+		t.Errorf("got tags %q, want %q", got, want)
+	}
+	want := []string{
+		"/repos/grailbio/project/releases v1: Release 1.\n",
+		"/repos/grailbio/project/releases v3: ",
+	}
+	if len(releases) != len(want) {
+		t.Fatalf("got releases %q, want %q", releases, want)
+	}
+	for i := range want {
+		if releases[i] != want[i] {
+			t.Errorf("got release %q, want %q", releases[i], want[i])
+		}
+	}
+}
+
+// TestGritTagsMoved ensures that tags moved in the source are updated
+// in the destination only with -force-tags.
+func TestGritTagsMoved(t *testing.T) {
+	dir, cleanup := temp(t)
+	defer cleanup()
+	g, a, b, repoA, repoB := setup(t, dir)
+
+	a.WriteFile(t, "file1", "content 1")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-a", "-m", "first commit")
+	a.Git(t, "tag", "v1")
+	a.WriteFile(t, "file1", "content 2")
+	a.Git(t, "commit", "-a", "-m", "second commit")
+	a.Git(t, "push", "origin", "master", "v1")
+	g.Run(t, "-push", "-tags", repoA, repoB)
+	tagSubject := func() string {
+		b.Git(t, "fetch", "--force", "origin", "+refs/tags/*:refs/tags/*")
+		return b.Output(t, "log", "-1", "--format=%s", "v1")
+	}
+	if got, want := tagSubject(), "first commit\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	a.Git(t, "tag", "-f", "v1")
+	a.Git(t, "push", "-f", "origin", "v1")
+	g.RunNoop(t, nil, "-push", "-tags", repoA, repoB)
+	if got, want := tagSubject(), "first commit\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	g.Run(t, "-push", "-tags", "-force-tags", repoA, repoB)
+	g.RunNoop(t, nil, "-push", "-tags", "-force-tags", repoA, repoB)
+	if got, want := tagSubject(), "second commit\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// TestGritLocalSource ensures that commits can be copied from a local
+// working tree.
+func TestGritLocalSource(t *testing.T) {
+	dir, cleanup := temp(t)
+	defer cleanup()
+	g, a, b, _, repoB := setup(t, dir)
+
+	a.WriteFile(t, "file1", "content 1")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-a", "-m", "first commit")
+	// Uncommitted changes are not copied.
+	a.WriteFile(t, "file1", "content 1 modified")
+
+	g.Run(t, "-push", "-local-source", string(a), repoB)
+	b.Git(t, "pull")
+	if got, want := b.Output(t, "show", "HEAD:file1"), "content 1"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, want := a.Output(t, "status", "--porcelain"), " M file1\n"; got != want {
+		t.Errorf("source was modified: got status %q, want %q", got, want)
+	}
+	if out, err := g.RunError(t, "-push", "-local-source", string(a)+",,nosuchbranch", repoB); err == nil {
+		t.Errorf("expected error for branch that is not checked out:\n%s", out)
+	}
+}
+
+// TestGritAddHeader ensures that add-header rules prepend headers to
+// new files only, and that later changes to files that carried the
+// header in the source are not shifted.
+func TestGritAddHeader(t *testing.T) {
+	dir, cleanup := temp(t)
+	defer cleanup()
+	g, a, b, repoA, repoB := setup(t, dir)
+	const header = "// Copyright\n// License\n"
+	headerFile := filepath.Join(dir, "header")
+	if err := ioutil.WriteFile(headerFile, []byte(header), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	a.WriteFile(t, "file.go", "package a\n")
+	a.WriteFile(t, "empty.go", "")
+	// The repeated lines would let a misplaced hunk apply.
+	licensed := func(mid, end string) string {
+		x := strings.Repeat("x\n", 5)
+		return header + "package a\n" + x + mid + x + end + x + x
+	}
+	a.WriteFile(t, "licensed.go", licensed("", ""))
+	a.WriteFile(t, "README", "readme\n")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-a", "-m", "first commit")
+	a.WriteFile(t, "file.go", "package a\n\nfunc f() {}\n")
+	a.WriteFile(t, "licensed.go", licensed("", "y\n"))
+	a.Git(t, "commit", "-a", "-m", "second commit")
+	a.Git(t, "push")
+
+	rule := `add-header:\.go$:` + headerFile
+	g.Run(t, "-push", repoA, repoB, rule)
+	g.Run(t, "-verify", repoA, repoB, rule)
+	b.Git(t, "pull")
+	for path, want := range map[string]string{
+		"file.go":     header + "package a\n\nfunc f() {}\n",
+		"empty.go":    header,
+		"licensed.go": licensed("", "y\n"),
+		"README":      "readme\n",
+	} {
+		got, err := ioutil.ReadFile(filepath.Join(string(b), path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("%s: got %q, want %q", path, got, want)
+		}
+	}
+
+	// Subsequent modifications and deletions account for the header.
+	a.WriteFile(t, "file.go", "package b\n\nfunc f() {}\n")
+	a.WriteFile(t, "licensed.go", licensed("z\n", "y\n"))
+	a.Git(t, "rm", "empty.go")
+	a.Git(t, "commit", "-a", "-m", "third commit")
+	a.Git(t, "push")
+	g.Run(t, "-push", repoA, repoB, rule)
+	g.Run(t, "-verify", repoA, repoB, rule)
+	b.Git(t, "pull")
+	b.NotExist(t, "empty.go")
+	if got, want := b.Output(t, "show", "HEAD:file.go"), header+"package b\n\nfunc f() {}\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, want := b.Output(t, "show", "HEAD:licensed.go"), licensed("z\n", "y\n"); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// TestGritRoute ensures that route rules place files by their
+// contents, following them as they change.
+func TestGritRoute(t *testing.T) {
+	dir, cleanup := temp(t)
+	defer cleanup()
+	g, a, b, repoA, repoB := setup(t, dir)
+
+	a.WriteFile(t, "src/api.proto", "// grit-dir: api\nmessage A {}\n")
+	a.WriteFile(t, "src/plain.proto", "message P {}\n")
+	a.WriteFile(t, "src/notes.txt", "// grit-dir: api\n")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-a", "-m", "first commit")
+	a.WriteFile(t, "src/api.proto", "// grit-dir: api\nmessage A {\n  int32 x = 1;\n}\n")
+	a.Git(t, "commit", "-a", "-m", "second commit")
+	a.Git(t, "push")
+
+	rule := `route:\.proto$:!^// grit-dir: (\S+)!protos/$1!`
+	g.Run(t, "-push", repoA, repoB, rule)
+	b.Git(t, "pull")
+	for path, want := range map[string]string{
+		"protos/api/api.proto": "// grit-dir: api\nmessage A {\n  int32 x = 1;\n}\n",
+		"src/plain.proto":      "message P {}\n",
+		"src/notes.txt":        "// grit-dir: api\n",
+	} {
+		if got := b.Output(t, "show", "HEAD:"+path); got != want {
+			t.Errorf("%s: got %q, want %q", path, got, want)
+		}
+	}
+	b.NotExist(t, "src/api.proto")
+
+	// Changing the matching line moves the file, and deleting it
+	// deletes the routed file.
+	a.WriteFile(t, "src/api.proto", "// grit-dir: v2\nmessage A {\n  int32 x = 1;\n}\n")
+	a.Git(t, "commit", "-a", "-m", "third commit")
+	a.Git(t, "push")
+	g.Run(t, "-push", repoA, repoB, rule)
+	b.Git(t, "pull")
+	b.NotExist(t, "protos/api/api.proto")
+	if got, want := b.Output(t, "show", "HEAD:protos/v2/api.proto"), "// grit-dir: v2\nmessage A {\n  int32 x = 1;\n}\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	a.Git(t, "rm", "-q", "src/api.proto")
+	a.Git(t, "commit", "-m", "fourth commit")
+	a.Git(t, "push")
+	g.Run(t, "-push", repoA, repoB, rule)
+	b.Git(t, "pull")
+	b.NotExist(t, "protos/v2/api.proto")
+
+	// Files routed to the same path collide.
+	a.WriteFile(t, "x/dup.proto", "// grit-dir: api\n")
+	a.WriteFile(t, "y/dup.proto", "// grit-dir: api\n")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-m", "fifth commit")
+	a.Git(t, "push")
+	if out, err := g.RunError(t, "-push", repoA, repoB, rule); err == nil || !strings.Contains(out, "both routed to protos/api/dup.proto") {
+		t.Errorf("expected collision error, got %v:\n%s", err, out)
+	}
+}
+
+// TestGritStats ensures that -stats reports the outcome of a sync,
+// including one that fails.
+func TestGritStats(t *testing.T) {
+	dir, cleanup := temp(t)
+	defer cleanup()
+	g, a, _, repoA, repoB := setup(t, dir)
+
+	a.WriteFile(t, "file1", "content 1")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-a", "-m", "first commit")
+	a.WriteFile(t, "BUILD", "build")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-a", "-m", "build commit")
+	a.WriteFile(t, "go.mod", "module a")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-a", "-m", "internal go.mod commit")
+	a.WriteFile(t, "file1", "content 1 modified")
+	a.Git(t, "commit", "-a", "-m", "automated commit")
+	a.Git(t, "push")
+
+	stats := filepath.Join(dir, "stats.json")
+	g.Run(t, "-push", "-stats="+stats, repoA, repoB,
+		"strip:^BUILD$", "strip-message:^go.mod$", "strip-message-commit:^automated")
+	b, err := ioutil.ReadFile(stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var results []struct {
+		Src, Dst                                  string
+		Applied, Empty, Stripped, MessageStripped int
+		Pushed                                    bool
+		Error                                     string
+	}
+	if err := json.Unmarshal(b, &results); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(results), 1; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	r := results[0]
+	if r.Applied != 2 || r.Empty != 1 || r.Stripped != 1 || r.MessageStripped != 1 || !r.Pushed {
+		t.Errorf("unexpected stats %+v", r)
+	}
+	if got, want := r.Src, repoA+",,master"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if r.Error != "" {
+		t.Errorf("unexpected error %q", r.Error)
+	}
+
+	a.WriteFile(t, "file2", "content 2")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-a", "-m", "second commit")
+	a.Git(t, "push")
+	if out, err := g.RunError(t, "-push", "-pre-push=false", "-stats="+stats, repoA, repoB,
+		"strip:^BUILD$", "strip-message:^go.mod$", "strip-message-commit:^automated"); err == nil {
+		t.Fatalf("expected pre-push command to fail:\n%s", out)
+	}
+	if b, err = ioutil.ReadFile(stats); err != nil {
+		t.Fatal(err)
+	}
+	results = nil
+	if err := json.Unmarshal(b, &results); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(results), 1; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	r = results[0]
+	if r.Applied != 1 || r.Pushed || !strings.Contains(r.Error, "pre-push command") {
+		t.Errorf("unexpected stats %+v", r)
+	}
+}
+
+// TestGritSummary ensures that -summary logs a diffstat of each copied
+// commit, after rules are applied.
+func TestGritSummary(t *testing.T) {
+	dir, cleanup := temp(t)
+	defer cleanup()
+	g, a, _, repoA, repoB := setup(t, dir)
+
+	a.WriteFile(t, "file1", "line 1\nline 2\n")
+	a.WriteFile(t, "BUILD", "build content\n")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-a", "-m", "first commit")
+	a.WriteFile(t, "file1", "line 1\nline 2 modified\nline 3\n")
+	a.WriteFile(t, "directory/file2", "content 2\n")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-a", "-m", "second commit")
+	a.Git(t, "push")
+	out, err := g.RunError(t, "-push", "-summary", repoA, repoB, "strip:^BUILD$")
+	if err != nil {
+		t.Fatalf("%v:\n%s", err, out)
+	}
+	for _, want := range []string{
+		" file1 | 2 ++\n 1 file changed, 2 insertions(+)\n",
+		" directory/file2 | 1 +\n file1           | 3 ++-\n 2 files changed, 3 insertions(+), 1 deletion(-)\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing summary %q in output:\n%s", want, out)
+		}
+	}
+}
+
+// TestGritForceInitial ensures that -force-initial ignores previously
+// synchronized commits, and that -since bounds the sync.
+func TestGritForceInitial(t *testing.T) {
+	dir, cleanup := temp(t)
+	defer cleanup()
+	g, a, b, repoA, repoB := setup(t, dir)
+
+	a.WriteFile(t, "file1", "content 1")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-a", "-m", "first commit")
+	a.Git(t, "push")
+	g.Run(t, "-push", repoA, repoB)
+	since := strings.TrimSpace(a.Output(t, "rev-parse", "HEAD"))
+
+	// Rewrite the source's history.
+	a.WriteFile(t, "file1", "content 1 rewritten")
+	a.Git(t, "commit", "-a", "--amend", "-m", "first commit rewritten")
+	a.WriteFile(t, "file2", "content 2")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-a", "-m", "second commit")
+	a.Git(t, "push", "-f")
+
+	if out, err := g.RunError(t, "-push", "-since="+since, repoA, repoB); err == nil {
+		t.Errorf("expected -since without -force-initial to fail:\n%s", out)
+	}
+	out, err := g.RunError(t, "-push", "-force-initial", "-since=nonexistent", repoA, repoB)
+	if err == nil || !strings.Contains(out, "unknown revision nonexistent") {
+		t.Errorf("expected -since with an unknown revision to fail:\n%s", out)
+	}
+	rewritten := strings.TrimSpace(a.Output(t, "rev-parse", "HEAD^"))
+	g.Run(t, "-push", "-force-initial", "-since="+rewritten, repoA, repoB)
+	b.Git(t, "pull")
+	if got, want := b.Output(t, "log", "--format=%s"), "second commit\nfirst commit\ninitial commit\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, want := b.Output(t, "show", "HEAD:file1"), "content 1"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// TestGritForcePushed ensures that grit fails, suggesting how to
+// re-seed the destination, when the last synchronized source commit
+// was removed from the source's history by a force push.
+func TestGritForcePushed(t *testing.T) {
+	dir, cleanup := temp(t)
+	defer cleanup()
+	g, a, b, repoA, repoB := setup(t, dir)
+
+	a.WriteFile(t, "file1", "content 1")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-a", "-m", "first commit")
+	a.WriteFile(t, "file1", "content 2")
+	a.Git(t, "commit", "-a", "-m", "second commit")
+	a.Git(t, "push")
+	g.Run(t, "-push", repoA, repoB)
+	base := strings.TrimSpace(a.Output(t, "rev-parse", "HEAD^"))
+
+	a.Git(t, "reset", "--hard", base)
+	a.WriteFile(t, "file2", "content 2 rewritten")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-m", "second commit rewritten")
+	a.Git(t, "push", "-f")
+	out, err := g.RunError(t, "-push", repoA, repoB)
+	if err == nil {
+		t.Fatalf("expected sync of force-pushed source to fail:\n%s", out)
+	}
+	if !strings.Contains(out, "force-pushed") || !strings.Contains(out, "-since="+base) {
+		t.Errorf("force push not reported:\n%s", out)
+	}
+	g.Run(t, "-push", "-force-initial", "-since="+base, repoA, repoB)
+	b.Git(t, "pull")
+	if got, want := b.Output(t, "log", "--format=%s"), "second commit rewritten\nsecond commit\nfirst commit\ninitial commit\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// TestGritSearchLimit ensures that the search for the last
+// synchronized commit examines at most -search-limit commits.
+func TestGritSearchLimit(t *testing.T) {
+	dir, cleanup := temp(t)
+	defer cleanup()
+	g, a, b, repoA, repoB := setup(t, dir)
+
+	a.WriteFile(t, "file1", "content 1")
+	a.WriteFile(t, "file2", "content 2")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-a", "-m", "first commit")
+	for i := 0; i < 2; i++ {
+		a.WriteFile(t, "file2", fmt.Sprintf("content 2 modified %d", i))
+		a.Git(t, "commit", "-a", "-m", fmt.Sprintf("file2 commit %d", i))
+	}
+	a.Git(t, "push")
+	g.Run(t, "-push", repoA, repoB)
+
+	// The file2 commits no longer apply under the new rule.
+	out, err := g.RunError(t, "-push", "-search-limit=2", repoA, repoB, "strip:^file2$")
+	if err == nil {
+		t.Fatalf("expected search to fail:\n%s", out)
+	}
+	if !strings.Contains(out, "no applicable synchronized commit found among the last 2") {
+		t.Errorf("search limit not reported:\n%s", out)
+	}
+	g.RunNoop(t, nil, "-push", "-search-limit=3", repoA, repoB, "strip:^file2$")
+	b.Git(t, "pull")
+	if got, want := b.Output(t, "rev-list", "--count", "HEAD"), "4\n"; got != want {
+		t.Errorf("got %q commits, want %q", got, want)
+	}
+}
+
+// TestGritMergeBase ensures that, with -merge-base, grit copies the
+// commits after the merge base of the last synchronized commit and the
+// source head, including after a force push.
+func TestGritMergeBase(t *testing.T) {
+	dir, cleanup := temp(t)
+	defer cleanup()
+	g, a, b, repoA, repoB := setup(t, dir)
+
+	a.WriteFile(t, "file1", "content 1")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-a", "-m", "first commit")
+	a.WriteFile(t, "file1", "content 2")
+	a.Git(t, "commit", "-a", "-m", "second commit")
+	a.Git(t, "push")
+	g.Run(t, "-push", "-merge-base", repoA, repoB)
+
+	a.WriteFile(t, "file2", "content 3")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-m", "third commit")
+	a.Git(t, "push")
+	g.Run(t, "-push", "-merge-base", repoA, repoB)
+
+	a.Git(t, "reset", "--hard", "HEAD~2")
+	a.WriteFile(t, "file3", "content 2 rewritten")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-m", "second commit rewritten")
+	a.Git(t, "push", "-f")
+	g.Run(t, "-push", "-merge-base", repoA, repoB)
+	b.Git(t, "pull")
+	if got, want := b.Output(t, "log", "--format=%s"), "second commit rewritten\nthird commit\nsecond commit\nfirst commit\ninitial commit\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// TestGritVerboseDiff ensures that -verbose-diff logs the contents of
+// stripped and rewritten diffs.
+func TestGritVerboseDiff(t *testing.T) {
+	dir, cleanup := temp(t)
+	defer cleanup()
+	g, a, _, repoA, repoB := setup(t, dir)
+
+	a.WriteFile(t, "secret", "secret content")
+	a.WriteFile(t, "go.mod", "module foo\nreplace a => b\n")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-a", "-m", "first commit")
+	a.Git(t, "push")
+
+	out, err := g.RunError(t, "-log=debug", "-verbose-diff=1000", repoA, repoB,
+		"strip:^secret$", "rewrite:go.mod$:/replace .*//")
+	if err != nil {
+		t.Fatalf("%v:\n%s", err, out)
+	}
+	for _, want := range []string{"stripped:", "+secret content", "before rewrite:", "+replace a => b", "after rewrite:"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output does not contain %q:\n%s", want, out)
+		}
+	}
+
+	out, err = g.RunError(t, "-log=debug", "-verbose-diff=5", repoA, repoB, "strip:^secret$")
+	if err != nil {
+		t.Fatalf("%v:\n%s", err, out)
+	}
+	if !strings.Contains(out, "more bytes)") || strings.Contains(out, "+secret content") {
+		t.Errorf("diff was not truncated:\n%s", out)
+	}
+}
+
+// TestGritNoLFS ensures that grit can push to destinations without
+// LFS pointers when git-lfs is not installed.
+func TestGritNoLFS(t *testing.T) {
+	dir, cleanup := temp(t)
+	defer cleanup()
+	g, a, b, repoA, repoB := setup(t, dir)
+
+	a.WriteFile(t, "file1", "content 1")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-a", "-m", "first commit")
+	a.Git(t, "push")
+
+	// Run grit with a PATH containing only git.
+	git, err := exec.LookPath("git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bin := filepath.Join(dir, "bin")
+	if err := os.Mkdir(bin, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(git, filepath.Join(bin, "git")); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(string(g), "-config=user.name=test,user.email=you@example.com", "-push", repoA, repoB)
+	cmd.Env = append(os.Environ(), "PATH="+bin)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%v:\n%s", err, out)
+	}
+	b.Git(t, "pull")
+	a.Compare(t, b)
+
+	a.WriteFile(t, "file2", "content 2")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-a", "-m", "second commit")
+	a.Git(t, "push")
+	g.Run(t, "-push", "-no-lfs", repoA, repoB)
+	b.Git(t, "pull")
+	a.Compare(t, b)
+}
+
+// TestGritPrePush ensures that a failing -pre-push command aborts
+// the push, that the next run does not push the vetoed commits as
+// they were applied, and that GRIT_CHANGED_PATHS lists each changed
+// path once.
+func TestGritPrePush(t *testing.T) {
+	dir, cleanup := temp(t)
+	defer cleanup()
+	g, a, b, repoA, repoB := setup(t, dir)
+
+	a.WriteFile(t, "file2", "content 2")
+	a.WriteFile(t, "file1", "content 1")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-a", "-m", "first commit")
+	a.WriteFile(t, "file2", "content 2 modified")
+	a.Git(t, "commit", "-a", "-m", "first commit, modified")
+	a.Git(t, "push")
+
+	check := `test ! -e forbidden && test "$GRIT_CHANGED_PATHS" = "$(git diff --name-only origin/master HEAD)"`
+	g.Run(t, "-push", "-pre-push="+check, repoA, repoB)
+	b.Git(t, "pull")
+	a.Compare(t, b)
+
+	a.WriteFile(t, "forbidden", "content")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-a", "-m", "second commit")
+	a.Git(t, "push")
+	if out, err := g.RunError(t, "-push", "-pre-push="+check, repoA, repoB); err == nil {
+		t.Fatalf("expected pre-push command to fail:\n%s", out)
+	}
+	b.Git(t, "pull")
+	b.NotExist(t, "forbidden")
+
+	// The next run copies the vetoed commit anew, rather than resuming
+	// from the journal and pushing it as it was applied.
+	ncommit := filepath.Join(dir, "ncommit")
+	out, err := g.RunError(t, "-push", "-pre-push=echo $GRIT_NCOMMIT > "+ncommit, repoA, repoB)
+	if err != nil {
+		t.Fatalf("%v:\n%s", err, out)
+	}
+	if strings.Contains(out, "resuming interrupted run") {
+		t.Errorf("vetoed commits were resumed:\n%s", out)
+	}
+	if got, err := ioutil.ReadFile(ncommit); err != nil {
+		t.Fatal(err)
+	} else if string(got) != "1\n" {
+		t.Errorf("got %q commits, want 1", got)
+	}
+	b.Git(t, "pull")
+	a.Compare(t, b)
+}
+
+// TestGritRevert ensures that -revert backs a mirrored commit out of
+// the destination, and that it is not copied again.
+func TestGritRevert(t *testing.T) {
+	dir, cleanup := temp(t)
+	defer cleanup()
+	g, a, b, repoA, repoB := setup(t, dir)
+
+	a.WriteFile(t, "file1", "content 1")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-a", "-m", "first commit")
+	a.WriteFile(t, "file2", "content 2")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-a", "-m", "second commit")
+	a.WriteFile(t, "file3", "content 3")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-a", "-m", "third commit")
+	a.Git(t, "push")
+	g.Run(t, "-push", repoA, repoB)
+	id := strings.TrimSpace(a.Output(t, "rev-parse", "HEAD~"))
+
+	if out, err := g.RunError(t, "-revert=0000000", "-push", repoB); err == nil || !strings.Contains(out, "not found") {
+		t.Errorf("got %v, want error for unknown source commit:\n%s", err, out)
+	}
+	// The revert is pushed only if -pre-push succeeds.
+	before := b.Output(t, "ls-remote", "origin")
+	if out, err := g.RunError(t, "-revert="+id[:10], "-push", "-pre-push=false", repoB); err == nil || !strings.Contains(out, "pre-push command") {
+		t.Errorf("got %v, want error for failed pre-push command:\n%s", err, out)
+	}
+	if after := b.Output(t, "ls-remote", "origin"); after != before {
+		t.Errorf("revert pushed despite failed pre-push command: got %q, want %q", after, before)
+	}
+	changed := filepath.Join(dir, "changed")
+	g.Run(t, "-revert="+id[:10], "-push", "-pre-push=echo \"$GRIT_CHANGED_PATHS\" > "+changed, repoB)
+	if got, err := ioutil.ReadFile(changed); err != nil {
+		t.Fatal(err)
+	} else if string(got) != "file2\n" {
+		t.Errorf("got GRIT_CHANGED_PATHS %q, want %q", got, "file2\n")
+	}
+	b.Git(t, "pull")
+	b.NotExist(t, "file2")
+	a.Compare(t, b, "file2")
+	if got, want := b.Output(t, "log", "-1", "--format=%s"), "Revert \"second commit\"\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if out, err := g.RunError(t, "-revert="+id, "-push", repoB); err == nil || !strings.Contains(out, "already reverted") {
+		t.Errorf("got %v, want error for reverted commit:\n%s", err, out)
+	}
+	g.RunNoop(t, nil, "-push", repoA, repoB)
+}
+
+// TestGritReconcile ensures that -reconcile deletes the destination
+// files stripped by the rules in a single commit, pushed only if
+// -pre-push succeeds, which later syncs do not mistake for a copied
+// source commit.
+func TestGritReconcile(t *testing.T) {
+	dir, cleanup := temp(t)
+	defer cleanup()
+	g, a, b, repoA, repoB := setup(t, dir)
+
+	a.WriteFile(t, "file1", "content 1")
+	a.WriteFile(t, "secret/key 1", "key 1")
+	a.WriteFile(t, "secret/key2", "key 2")
+	a.WriteFile(t, "build.log", "log")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-a", "-m", "first commit")
+	a.Git(t, "push")
 	g.Run(t, "-push", repoA, repoB)
+
+	g.RunNoop(t, nil, "-reconcile", "-push", repoA, repoB, "strip:^nothing/")
+	before := b.Output(t, "ls-remote", "origin")
+	if out, err := g.RunError(t, "-reconcile", "-push", "-pre-push=false", repoA, repoB, "strip:^secret/", "strip:\\.log$"); err == nil || !strings.Contains(out, "pre-push command") {
+		t.Errorf("got %v, want error for failed pre-push command:\n%s", err, out)
+	}
+	if after := b.Output(t, "ls-remote", "origin"); after != before {
+		t.Errorf("deletion pushed despite failed pre-push command: got %q, want %q", after, before)
+	}
+	changed := filepath.Join(dir, "changed")
+	g.Run(t, "-reconcile", "-push", "-pre-push=echo \"$GRIT_CHANGED_PATHS\" > "+changed, repoA, repoB, "strip:^secret/", "strip:\\.log$")
+	if got, err := ioutil.ReadFile(changed); err != nil {
+		t.Fatal(err)
+	} else if want := "build.log\nsecret/key 1\nsecret/key2\n"; string(got) != want {
+		t.Errorf("got GRIT_CHANGED_PATHS %q, want %q", got, want)
+	}
+	b.Git(t, "pull")
+	b.NotExist(t, "secret/key 1")
+	b.NotExist(t, "secret/key2")
+	b.NotExist(t, "build.log")
+	a.Compare(t, b, "secret", "build.log")
+	want := "Delete 3 stripped files\n\nThese files were copied before the rules that strip them were added:\n\n" +
+		"\tstrip:\\.log$ (1 file)\n\tstrip:^secret/ (2 files)\n\n"
+	if got := b.Output(t, "log", "-1", "--format=%B"); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	g.RunNoop(t, nil, "-reconcile", "-push", repoA, repoB, "strip:^secret/", "strip:\\.log$")
+	// The deletion does not record a source commit, so that later syncs
+	// still find the last synchronized commit.
+	g.RunNoop(t, nil, "-push", repoA, repoB, "strip:^secret/", "strip:\\.log$")
+	a.WriteFile(t, "file2", "content 2")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-a", "-m", "second commit")
+	a.Git(t, "push")
+	g.Run(t, "-push", repoA, repoB, "strip:^secret/", "strip:\\.log$")
+	b.Git(t, "pull")
+	a.Compare(t, b, "secret", "build.log")
+}
+
+// TestGritResume ensures that a run interrupted before pushing is
+// resumed by the next, which pushes the commits that were applied
+// without applying them again, and that the applied commits are
+// discarded if the destination has diverged in the meantime.
+func TestGritResume(t *testing.T) {
+	dir, cleanup := temp(t)
+	defer cleanup()
+	g, a, b, repoA, repoB := setup(t, dir)
+
+	a.WriteFile(t, "file1", "content 1")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-a", "-m", "first commit")
+	a.WriteFile(t, "file2", "content 2")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-a", "-m", "second commit")
+	a.Git(t, "push")
+
+	// A pre-push command that kills grit interrupts the run after the
+	// commits have been applied. (A failing one discards them.)
+	const interrupt = "-pre-push=kill -9 $PPID"
+	if out, err := g.RunError(t, "-push", interrupt, repoA, repoB); err == nil {
+		t.Fatalf("expected run to be interrupted:\n%s", out)
+	}
+	check := `test "$GRIT_CHANGED_PATHS" = "$(printf 'file1\nfile2')"`
+	out, err := g.RunError(t, "-log=debug", "-push", "-pre-push="+check, repoA, repoB)
+	if err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+	if !strings.Contains(out, "resuming interrupted run") || strings.Contains(out, "applying") {
+		t.Errorf("run was not resumed:\n%s", out)
+	}
 	b.Git(t, "pull")
 	a.Compare(t, b)
+	if got, want := b.Output(t, "log", "--format=%s"), "second commit\nfirst commit\ninitial commit\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	g.RunNoop(t, nil, "-push", repoA, repoB)
+
+	a.WriteFile(t, "file3", "content 3")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-a", "-m", "third commit")
+	a.Git(t, "push")
+	if out, err := g.RunError(t, "-push", interrupt, repoA, repoB); err == nil {
+		t.Fatalf("expected run to be interrupted:\n%s", out)
+	}
+	b.WriteFile(t, "other", "content")
+	b.Git(t, "add", ".")
+	b.Git(t, "commit", "-a", "-m", "destination commit")
+	b.Git(t, "push")
+	out, err = g.RunError(t, "-push", repoA, repoB)
+	if err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+	if !strings.Contains(out, "has diverged") {
+		t.Errorf("applied commits were not discarded:\n%s", out)
+	}
+	b.Git(t, "pull")
+	if got, want := b.Output(t, "log", "--format=%s"), "third commit\ndestination commit\nsecond commit\nfirst commit\ninitial commit\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
 }
 
-// TestGritRules ensures that rules are applied universally across
-// grit actions.
-func TestGritRules(t *testing.T) {
+// TestGritSubmodules ensures that submodule gitlinks are mirrored
+// without fetching submodule contents, and that they are stripped
+// with -skip-submodules.
+func TestGritSubmodules(t *testing.T) {
 	dir, cleanup := temp(t)
 	defer cleanup()
-	var g grit
-	g.Build(t)
+	g, a, b, repoA, repoB := setup(t, dir)
+	sub := repo(filepath.Join(dir, "sub"))
+	run(t, "git", "init", string(sub))
+	sub.Git(t, "config", "user.email", "you@example.com")
+	sub.Git(t, "config", "user.name", "your name")
+	sub.Git(t, "commit", "--allow-empty", "-m", "sub 1")
 
-	var (
-		repoHome   = filepath.Join(dir, "home")
-		repoRemote = filepath.Join(dir, "remote")
-	)
+	a.WriteFile(t, "file1", "content 1")
+	a.Git(t, "-c", "protocol.file.allow=always", "submodule", "add", string(sub), "sub")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-m", "add submodule")
+	a.Git(t, "push")
+	g.Run(t, "-push", repoA, repoB, "trim-trailing-space:.*")
+	sub.Git(t, "commit", "--allow-empty", "-m", "sub 2")
+	a.Run(t, "git", "-C", "sub", "pull")
+	a.Git(t, "commit", "-a", "-m", "update submodule")
+	a.Git(t, "push")
+	g.Run(t, "-push", repoA, repoB, "trim-trailing-space:.*")
+	g.Run(t, "-verify", repoA, repoB, "trim-trailing-space:.*")
+	b.Git(t, "pull")
+	if got, want := b.Output(t, "rev-parse", "HEAD:sub"), a.Output(t, "rev-parse", "HEAD:sub"); got != want {
+		t.Errorf("got gitlink %s, want %s", got, want)
+	}
 
-	run(t, "git", "init", "--bare", repoHome)
-	run(t, "git", "init", "--bare", repoRemote)
+	dir, cleanup = temp(t)
+	defer cleanup()
+	g, _, b, _, repoB = setup(t, dir)
+	g.Run(t, "-push", "-skip-submodules", repoA, repoB)
+	g.Run(t, "-verify", "-skip-submodules", repoA, repoB)
+	b.Git(t, "pull")
+	b.NotExist(t, ".gitmodules")
+	b.NotExist(t, "sub")
+	// The submodule update is empty once stripped.
+	if got, want := b.Output(t, "log", "--format=%s"), "add submodule\ninitial commit\n"; got != want {
+		t.Errorf("got log %q, want %q", got, want)
+	}
+}
 
-	home := repo(filepath.Join(dir, "home_checkout"))
-	remote := repo(filepath.Join(dir, "remote_checkout"))
+// TestGritMaxBlobSize ensures that changes to binary files larger
+// than -max-blob-size are stripped, along with their deletions.
+func TestGritMaxBlobSize(t *testing.T) {
+	dir, cleanup := temp(t)
+	defer cleanup()
+	g, a, b, repoA, repoB := setup(t, dir)
+	a.WriteFile(t, "small.bin", "small\x00")
+	a.WriteFile(t, "big.bin", strings.Repeat("big\x00", 100))
+	a.WriteFile(t, "big.txt", strings.Repeat("big text\n", 100))
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-m", "add files")
+	a.Git(t, "push")
+	g.Run(t, "-push", "-max-blob-size=100", repoA, repoB)
+	b.Git(t, "pull")
+	b.Compare(t, a, "big.bin")
+	b.NotExist(t, "big.bin")
 
-	home.Clone(t, filepath.Join(dir, "home"))
-	remote.Clone(t, filepath.Join(dir, "remote"))
+	a.Git(t, "rm", "big.bin")
+	a.Git(t, "commit", "-m", "remove big.bin")
+	a.Git(t, "push")
+	// The deletion is empty once stripped.
+	g.RunNoop(t, nil, "-push", "-max-blob-size=100", repoA, repoB)
+	b.Git(t, "pull")
+	if got, want := b.Output(t, "log", "--format=%s"), "add files\ninitial commit\n"; got != want {
+		t.Errorf("got log %q, want %q", got, want)
+	}
+}
 
-	for _, r := range []repo{home, remote} {
-		r.Git(t, "commit", "--allow-empty", "-m", "initial commit")
-		r.Git(t, "push")
+// TestGritQuiet ensures that -quiet logs only warnings, errors, and
+// the summary of each sync.
+func TestGritQuiet(t *testing.T) {
+	dir, cleanup := temp(t)
+	defer cleanup()
+	g, a, _, repoA, repoB := setup(t, dir)
+	a.WriteFile(t, "file1", "content 1")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-m", "first commit")
+	a.WriteFile(t, "file2", "content 2")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-m", "stripped commit")
+	a.Git(t, "push")
+	out, err := g.RunError(t, "-quiet", "-push", repoA, repoB, "strip:^file2$")
+	if err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 1 || !strings.Contains(lines[0], "applied 1 commits, skipped 1 (1 empty") || !strings.HasSuffix(lines[0], "pushed") {
+		t.Errorf("got output %q, want only a summary", out)
 	}
+	if out, err := g.RunError(t, "-quiet", "-log=debug", repoA, repoB); err == nil {
+		t.Errorf("expected -quiet with -log to fail:\n%s", out)
+	}
+}
 
-	remote.WriteFile(t, "file1", "content1")
-	remote.Git(t, "add", ".")
-	remote.Git(t, "commit", "-a", "-m", "commit 1 to remote")
-	remote.Git(t, "push")
-	g.Run(t, "-push", repoRemote, repoHome+",remote/")
+// TestGritCheck ensures that -check applies commits to a worktree of
+// the destination, reporting conflicts without modifying the
+// destination.
+func TestGritCheck(t *testing.T) {
+	dir, cleanup := temp(t)
+	defer cleanup()
+	g, a, b, repoA, repoB := setup(t, dir)
+	// Worktrees are made in TMPDIR.
+	tmp := filepath.Join(dir, "tmp")
+	if err := os.Mkdir(tmp, 0777); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("TMPDIR", os.Getenv("TMPDIR"))
+	os.Setenv("TMPDIR", tmp)
+	scratchRemoved := func() {
+		t.Helper()
+		if names, err := ioutil.ReadDir(tmp); err != nil {
+			t.Fatal(err)
+		} else if len(names) != 0 {
+			t.Errorf("worktree %s was not removed", names[0].Name())
+		}
+	}
 
-	home.Git(t, "pull")
+	a.WriteFile(t, "file1", "content 1")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-a", "-m", "first commit")
+	a.Git(t, "push")
+	g.Run(t, "-check", repoA, repoB)
+	scratchRemoved()
+	b.Git(t, "pull")
+	b.NotExist(t, "file1")
 
-	// Now synthesize a change to the home repo that touches the remote/
-	// directory but is excluded from the sync rules. We fabricate a
-	// source ID to emulate that it has been pushed from a different
-	// remote repository.
+	g.Run(t, "-push", repoA, repoB)
+	b.Git(t, "pull")
+	b.WriteFile(t, "file1", "conflicting content")
+	b.Git(t, "commit", "-a", "-m", "conflicting commit")
+	b.Git(t, "push")
+	head := b.Output(t, "rev-parse", "HEAD")
+	a.WriteFile(t, "file1", "content 2")
+	a.Git(t, "commit", "-a", "-m", "second commit")
+	a.Git(t, "push")
+	out, err := g.RunError(t, "-check", repoA, repoB)
+	if err == nil {
+		t.Fatalf("expected check to fail:\n%s", out)
+	}
+	if !strings.Contains(out, "conflict: file1") {
+		t.Errorf("conflict not reported:\n%s", out)
+	}
+	scratchRemoved()
+	b.Git(t, "pull")
+	if got := b.Output(t, "rev-parse", "HEAD"); got != head {
+		t.Errorf("destination was modified: got %s, want %s", got, head)
+	}
+}
 
-	home.WriteFile(t, "remote/BUILD", "excluded content")
-	home.WriteFile(t, "test.txt", "out of scope content")
-	home.Git(t, "add", ".")
-	home.Git(t, "commit", "-a", "-m", "commit 1 to local\n\nfbshipit-source-id: bb96450\n")
-	home.Git(t, "push")
+// TestGritInteractive ensures that -interactive prompts for how to
+// proceed with commits that fail to apply, skipping or aborting them
+// as answered.
+func TestGritInteractive(t *testing.T) {
+	dir, cleanup := temp(t)
+	defer cleanup()
+	g, a, b, repoA, repoB := setup(t, dir)
+	interactive := func(answers string) (string, error) {
+		t.Helper()
+		cmd := exec.Command(string(g), "-config=user.name=test,user.email=you@example.com", "-interactive", "-push", repoA, repoB)
+		cmd.Stdin = strings.NewReader(answers)
+		out, err := cmd.CombinedOutput()
+		return string(out), err
+	}
 
-	remote.WriteFile(t, "file2", "content2")
-	remote.Git(t, "add", ".")
-	remote.Git(t, "commit", "-a", "-m", "commit 1 2 remote")
-	remote.Git(t, "push")
+	a.WriteFile(t, "file1", "content 1")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-m", "first commit")
+	a.Git(t, "push")
+	g.Run(t, "-push", repoA, repoB)
+	b.Git(t, "pull")
+	b.WriteFile(t, "file1", "conflicting content")
+	b.Git(t, "commit", "-a", "-m", "conflicting commit")
+	b.Git(t, "push")
+	a.WriteFile(t, "file1", "content 2")
+	a.Git(t, "commit", "-a", "-m", "second commit")
+	a.WriteFile(t, "file2", "content 3")
+	a.Git(t, "add", ".")
+	a.Git(t, "commit", "-m", "third commit")
+	a.Git(t, "push")
 
-	g.Run(t, "-push", repoRemote, repoHome+",remote/", "strip:^BUILD$")
+	// The conflict is not resolved, so it cannot be continued.
+	out, err := interactive("c\ns\n")
+	if err != nil {
+		t.Fatalf("%v:\n%s", err, out)
+	}
+	if !strings.Contains(out, "conflict: file1") {
+		t.Errorf("conflict not reported:\n%s", out)
+	}
+	if !strings.Contains(out, "am --continue") {
+		t.Errorf("failed continue not reported:\n%s", out)
+	}
+	b.Git(t, "pull")
+	if got, want := strings.TrimSpace(b.Output(t, "log", "--format=%s", "-2")), "third commit\nconflicting commit"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, want := b.Output(t, "show", "HEAD:file1"), "conflicting content"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
 
-	home.Git(t, "pull")
+	// Grit aborts if the input ends without an answer.
+	head := b.Output(t, "rev-parse", "HEAD")
+	a.WriteFile(t, "file1", "content 4")
+	a.Git(t, "commit", "-a", "-m", "fourth commit")
+	a.Git(t, "push")
+	if out, err := interactive(""); err == nil {
+		t.Errorf("expected abort to fail:\n%s", out)
+	} else if !strings.Contains(out, "aborted") {
+		t.Errorf("abort not reported:\n%s", out)
+	}
+	b.Git(t, "pull")
+	if got := b.Output(t, "rev-parse", "HEAD"); got != head {
+		t.Errorf("destination was modified: got %s, want %s", got, head)
+	}
 
-	repo(filepath.Join(string(home), "remote")).Compare(t, remote, "BUILD")
+	// A skipped commit is not copied by later runs, even when it is
+	// the last one.
+	out, err = interactive("s\n")
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 3 {
+		t.Fatalf("got %v, want exit status 3:\n%s", err, out)
+	}
+	b.Git(t, "pull")
+	if got := b.Output(t, "rev-parse", "HEAD"); got != head {
+		t.Errorf("destination was modified: got %s, want %s", got, head)
+	}
+	g.RunNoop(t, nil, "-push", repoA, repoB)
+	b.Git(t, "pull")
+	if got := b.Output(t, "rev-parse", "HEAD"); got != head {
+		t.Errorf("skipped commit was copied: got %s, want %s", got, head)
+	}
+
+	if out, err := g.RunError(t, "-interactive", "-check", repoA, repoB); err == nil {
+		t.Errorf("expected -interactive with -check to fail:\n%s", out)
+	}
+}
+
+// setup creates two repositories, a and b, with bare remotes repoA
+// and repoB; b is initialized with an empty commit.
+func setup(t *testing.T, dir string) (g grit, a, b repo, repoA, repoB string) {
+	t.Helper()
+	g.Build(t)
+	repoA = filepath.Join(dir, "arepo")
+	repoB = filepath.Join(dir, "brepo")
+	run(t, "git", "init", "--bare", repoA)
+	run(t, "git", "init", "--bare", repoB)
+	a = repo(filepath.Join(dir, "a"))
+	b = repo(filepath.Join(dir, "b"))
+	a.Clone(t, repoA)
+	b.Clone(t, repoB)
+	// Grit doesn't (yet?) handle empty repos, so we initialize B with a commit.
+	b.Git(t, "commit", "--allow-empty", "-m", "initial commit")
+	b.Git(t, "push")
+	return
 }
 
 func temp(t *testing.T) (dir string, cleanup func()) {
@@ -162,6 +2657,16 @@ func (r repo) Git(t *testing.T, arg ...string) {
 	run(t, "git", append([]string{"-C", string(r)}, arg...)...)
 }
 
+func (r repo) Output(t *testing.T, arg ...string) string {
+	t.Helper()
+	cmd := exec.Command("git", append([]string{"-C", string(r)}, arg...)...)
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("git %v: %v", arg, err)
+	}
+	return string(out)
+}
+
 func (r repo) Run(t *testing.T, name string, arg ...string) {
 	t.Helper()
 	cmd := exec.Command(name, arg...)
@@ -178,6 +2683,13 @@ func (r repo) WriteFile(t *testing.T, path, content string) {
 	}
 }
 
+func (r repo) NotExist(t *testing.T, path string) {
+	t.Helper()
+	if _, err := os.Stat(filepath.Join(string(r), path)); !os.IsNotExist(err) {
+		t.Errorf("%s: %s: expected path to not exist (err=%v)", r, path, err)
+	}
+}
+
 func (r repo) Compare(t *testing.T, q repo, excludes ...string) {
 	t.Helper()
 	var args []string
@@ -202,6 +2714,38 @@ func (g grit) Run(t *testing.T, arg ...string) {
 	run(t, string(g), args...)
 }
 
+// RunEnv runs grit with the provided variables added to its
+// environment.
+func (g grit) RunEnv(t *testing.T, env []string, arg ...string) {
+	t.Helper()
+	args := append([]string{"-config=user.name=test,user.email=you@example.com"}, arg...)
+	cmd := exec.Command(string(g), args...)
+	cmd.Env = append(os.Environ(), env...)
+	runCommand(t, cmd)
+}
+
+// RunNoop runs grit with the provided variables added to its
+// environment, and fails the test unless grit exits with the status
+// indicating that it had nothing to do.
+func (g grit) RunNoop(t *testing.T, env []string, arg ...string) {
+	t.Helper()
+	args := append([]string{"-config=user.name=test,user.email=you@example.com"}, arg...)
+	cmd := exec.Command(string(g), args...)
+	cmd.Env = append(os.Environ(), env...)
+	out, err := cmd.CombinedOutput()
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 3 {
+		t.Fatalf("grit %v: got %v, want exit status 3\n%s", arg, err, out)
+	}
+}
+
+// RunError runs grit, returning its combined output and error.
+func (g grit) RunError(t *testing.T, arg ...string) (string, error) {
+	t.Helper()
+	args := append([]string{"-config=user.name=test,user.email=you@example.com"}, arg...)
+	out, err := exec.Command(string(g), args...).CombinedOutput()
+	return string(out), err
+}
+
 func run(t *testing.T, name string, arg ...string) {
 	t.Helper()
 	runCommand(t, exec.Command(name, arg...))
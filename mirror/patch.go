@@ -0,0 +1,183 @@
+// Copyright 2018 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package mirror
+
+import (
+	"fmt"
+	"mime"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/grailbio/base/log"
+	"github.com/grailbio/grit/git"
+)
+
+// A pendingPatch is a patch to be copied to the destination
+// repository, together with the (short) IDs of the source commits
+// from which it was derived. Squashed patches also retain the
+// patches from which they were combined.
+type pendingPatch struct {
+	patch git.Patch
+	// sources holds the full hashes of the source commits.
+	sources []string
+	parts   []git.Patch
+	// coAuthors holds the co-authors named by Co-authored-by
+	// trailers in the source commits' messages, which are emitted
+	// as trailers of the destination commit.
+	coAuthors []string
+	// trailers holds the trailers kept from stripped source commit
+	// messages by -keep-trailers.
+	trailers []string
+}
+
+var coAuthorRe = regexp.MustCompile(`(?im)^co-authored-by:[ \t]*(.+?)[ \t]*$`)
+
+// extractCoAuthors removes Co-authored-by trailers from the provided
+// commit message body, returning the resulting body and the
+// co-authors named by the trailers.
+func extractCoAuthors(body string) (string, []string) {
+	var coAuthors []string
+	for _, g := range coAuthorRe.FindAllStringSubmatch(body, -1) {
+		coAuthors = appendUnique(coAuthors, g[1])
+	}
+	if coAuthors == nil {
+		return body, nil
+	}
+	body = strings.TrimRight(coAuthorRe.ReplaceAllString(body, ""), " \t\n")
+	if body != "" {
+		body += "\n"
+	}
+	return body, coAuthors
+}
+
+var trailerRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9-]*:[ \t]*\S`)
+
+// messageTrailers returns the trailers, such as Signed-off-by, in the
+// provided commit message body: the lines of its last paragraph, if
+// each of them is a "key: value" trailer.
+func messageTrailers(body string) []string {
+	paragraphs := strings.Split(strings.TrimSpace(body), "\n\n")
+	lines := strings.Split(paragraphs[len(paragraphs)-1], "\n")
+	for _, line := range lines {
+		if !trailerRe.MatchString(line) {
+			return nil
+		}
+	}
+	return lines
+}
+
+// appendUnique appends to list the provided values that are not
+// already in it.
+func appendUnique(list []string, values ...string) []string {
+outer:
+	for _, v := range values {
+		for _, w := range list {
+			if v == w {
+				continue outer
+			}
+		}
+		list = append(list, v)
+	}
+	return list
+}
+
+// squash coalesces runs of consecutive patches by the same author
+// whose times are within the provided window of the first patch in
+// the run. Combined patches take the subject of the first patch in
+// the run and the author and author time of the last, and credit the
+// authors of the others as co-authors; their bodies concatenate
+// the messages of each patch, and their diffs are those of each
+// patch, in order. Since such diffs may not apply as a single patch
+// (git does not apply the deletion of a file created earlier in the
+// same patch), the combined patch's parts should be applied
+// individually and then squashed.
+func squash(patches []pendingPatch, window time.Duration) []pendingPatch {
+	var squashed []pendingPatch
+	for i := 0; i < len(patches); {
+		first := patches[i]
+		j := i + 1
+		for ; j < len(patches); j++ {
+			p := patches[j].patch
+			if p.Author != first.patch.Author || p.Time.Sub(first.patch.Time) > window {
+				break
+			}
+		}
+		if j == i+1 {
+			squashed = append(squashed, first)
+			i = j
+			continue
+		}
+		squashed = append(squashed, combine(patches[i:j]))
+		i = j
+	}
+	return squashed
+}
+
+// combine combines the provided patches into one, as described by
+// squash.
+func combine(patches []pendingPatch) pendingPatch {
+	first, last := patches[0], patches[len(patches)-1].patch
+	combined := pendingPatch{patch: first.patch}
+	combined.patch.Author = last.Author
+	combined.patch.Diffs = nil
+	combined.patch.Body = strings.TrimSpace(first.patch.Body)
+	for _, p := range patches {
+		if p.patch.ID != first.patch.ID {
+			combined.patch.ID = p.patch.ID
+			combined.patch.Time = p.patch.Time
+			msg := strings.TrimPrefix(p.patch.Subject, "[PATCH] ")
+			if body := strings.TrimSpace(p.patch.Body); body != "" {
+				msg += "\n\n" + body
+			}
+			if combined.patch.Body != "" {
+				combined.patch.Body += "\n\n"
+			}
+			combined.patch.Body += msg
+		}
+		combined.patch.Diffs = append(combined.patch.Diffs, p.patch.Diffs...)
+		combined.sources = append(combined.sources, p.sources...)
+		if p.patch.Author != last.Author {
+			combined.coAuthors = appendUnique(combined.coAuthors, decodeHeader(p.patch.Author))
+		}
+		combined.coAuthors = appendUnique(combined.coAuthors, p.coAuthors...)
+		combined.trailers = appendUnique(combined.trailers, p.trailers...)
+		combined.parts = append(combined.parts, p.patch)
+	}
+	log.Debug.Printf("squashed %d patches into %s", len(patches), combined.patch)
+	return combined
+}
+
+// squashRun combines all of the provided patches into one, as
+// requested by -squash-run. Like the commits squashed by squash, the
+// combined patch's commit keeps the author of the last patch, and
+// credits the authors of the others as co-authors. Its message lists
+// the source commits by ID and subject.
+func squashRun(patches []pendingPatch) []pendingPatch {
+	if len(patches) < 2 {
+		return patches
+	}
+	combined := combine(patches)
+	var msg strings.Builder
+	msg.WriteString("Squashes the following source commits:\n")
+	for _, p := range patches {
+		subject := strings.TrimPrefix(decodeHeader(p.patch.Subject), "[PATCH] ")
+		fmt.Fprintf(&msg, "\n%s %s", p.patch.ID.Hex()[:7], subject)
+	}
+	combined.patch.Subject = fmt.Sprintf("[PATCH] Squashed %d source commits", len(patches))
+	combined.patch.Body = msg.String()
+	return []pendingPatch{combined}
+}
+
+// decodeHeader returns the provided patch header, such as a subject or
+// author, with its RFC 2047 encoded words decoded, or as it is if it
+// cannot be decoded.
+func decodeHeader(header string) string {
+	decoded, err := new(mime.WordDecoder).DecodeHeader(header)
+	if err != nil {
+		return header
+	}
+	return decoded
+}
@@ -0,0 +1,192 @@
+// Copyright 2018 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package mirror
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/grailbio/base/log"
+	"github.com/grailbio/grit/git"
+	"github.com/grailbio/grit/rules"
+)
+
+// Revert reverts the commit in the destination, named by url, prefix,
+// and branch, that records the source commit named by id, as grit's
+// -revert flag does, and pushes the revert if the Push option is set.
+func Revert(opts Options, id, url, prefix, branch string) error {
+	if len(id) < 7 || strings.Trim(strings.ToLower(id), "0123456789abcdef") != "" {
+		return fmt.Errorf("-revert: invalid source commit %s: must be a hash of at least 7 digits", id)
+	}
+	id = strings.ToLower(id)
+	dst, err := openRepo(opts, url, prefix, branch, git.Options{SSHKey: opts.DstSSHKey, NoLFS: opts.NoLFS, SparseCheckout: opts.SparseCheckout})
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	if err := configureCommitter(opts, dst); err != nil {
+		return err
+	}
+	if opts.NoTrailer {
+		if err := dst.FetchNotes(stateNotesRef); err != nil {
+			return fmt.Errorf("%s: fetch notes: %v", dst, err)
+		}
+	}
+	commits, err := dst.Log(append(trailerArgs(opts.NoTrailer), "--grep", `^\s*\(fb\)\?shipit-source-id: [a-z0-9]\+$`)...)
+	if err != nil {
+		return fmt.Errorf("log %s: %v", dst, err)
+	}
+	var matches []*git.Commit
+	for _, c := range commits {
+		if recordsSource(c, id) {
+			matches = append(matches, c)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return fmt.Errorf("source commit %s not found in %s: no commit records it", id, dst)
+	case 1:
+	default:
+		var names []string
+		for _, c := range matches {
+			names = append(names, c.Digest.Hex()[:7])
+		}
+		return fmt.Errorf("source commit %s is ambiguous in %s: recorded by commits %s", id, dst, strings.Join(names, ", "))
+	}
+	commit := matches[0]
+	if n := len(commit.ShipitID()); n > 1 {
+		return fmt.Errorf("%s: commit %s squashes %d source commits, which would all be reverted", dst, commit, n)
+	}
+	reverts, err := dst.Log("-1", "-F", "--grep", "This reverts commit "+commit.Digest.Hex()+".")
+	if err != nil {
+		return fmt.Errorf("log %s: %v", dst, err)
+	}
+	if len(reverts) > 0 {
+		return fmt.Errorf("%s: commit %s was already reverted by %s", dst, commit, reverts[0])
+	}
+	log.Printf("reverting %s, copied from source commit %s", commit, id)
+	if err := dst.Revert(commit.Digest); err != nil {
+		return fmt.Errorf("%s: revert %s: %v", dst, commit, err)
+	}
+	if !opts.Push {
+		return nil
+	}
+	var paths []string
+	if opts.PrePush != "" {
+		if paths, err = dst.UnpushedPaths("origin", dst.Branch()); err != nil {
+			return fmt.Errorf("%s: %v", dst, err)
+		}
+	}
+	return pushHead(opts, dst, url, paths, 1)
+}
+
+// Reconcile commits the deletion of the destination files that the
+// provided rules, or the ExportIgnore option, would strip, as grit's
+// -reconcile flag does, and pushes it if the Push option is set. It
+// returns whether any file was deleted.
+func Reconcile(opts Options, rules rules.Rules, srcURL, srcPrefix, srcBranch, dstURL, dstPrefix, dstBranch string) (bool, error) {
+	dst, err := openRepo(opts, dstURL, dstPrefix, dstBranch, git.Options{SSHKey: opts.DstSSHKey, NoLFS: opts.NoLFS, SparseCheckout: opts.SparseCheckout})
+	if err != nil {
+		return false, err
+	}
+	defer dst.Close()
+	if err := configureCommitter(opts, dst); err != nil {
+		return false, err
+	}
+	files, err := dst.Files()
+	if err != nil {
+		return false, fmt.Errorf("%s: files: %v", dst, err)
+	}
+	var ignored map[string]bool
+	if opts.ExportIgnore {
+		// The source is needed only for its attributes.
+		srcOpts := git.Options{SSHKey: opts.SrcSSHKey, SparseCheckout: opts.SparseCheckout, PrefixMap: opts.PrefixMap}
+		var src *git.Repo
+		if opts.LocalSource {
+			src, err = openLocalRepo(opts, srcURL, srcPrefix, srcBranch, srcOpts)
+		} else {
+			src, err = openRepo(opts, srcURL, srcPrefix, srcBranch, srcOpts)
+		}
+		if err != nil {
+			return false, err
+		}
+		defer src.Close()
+		paths := make([]string, len(files))
+		for i, file := range files {
+			paths[i] = src.SourcePath(file, "")
+		}
+		srcIgnored, err := src.ExportIgnored(paths)
+		if err != nil {
+			return false, fmt.Errorf("%s: export-ignore: %v", src, err)
+		}
+		ignored = make(map[string]bool)
+		for i, file := range files {
+			ignored[file] = srcIgnored[paths[i]]
+		}
+	}
+	var (
+		stripped []string
+		reasons  []string
+		counts   = make(map[string]int)
+	)
+	for _, file := range files {
+		reason := "export-ignore"
+		if match, re := rules.IsPathStripped(dst.Prefix() + file); match {
+			reason = "strip:" + re.String()
+		} else if !ignored[file] {
+			continue
+		}
+		log.Debug.Printf("file %s is stripped by %s: deleting", file, reason)
+		stripped = append(stripped, file)
+		if counts[reason] == 0 {
+			reasons = append(reasons, reason)
+		}
+		counts[reason]++
+	}
+	if len(stripped) == 0 {
+		log.Printf("%s: no files are stripped by the rules", dst)
+		return false, nil
+	}
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "Delete %d stripped file%s\n\nThese files were copied before the rules that strip them were added:\n\n", len(stripped), plural(len(stripped)))
+	for _, reason := range reasons {
+		fmt.Fprintf(&msg, "\t%s (%d file%s)\n", reason, counts[reason], plural(counts[reason]))
+	}
+	log.Printf("%s: deleting %d stripped file%s", dst, len(stripped), plural(len(stripped)))
+	if err := dst.Remove(stripped, msg.String()); err != nil {
+		return false, fmt.Errorf("%s: delete stripped files: %v", dst, err)
+	}
+	if !opts.Push {
+		return true, nil
+	}
+	paths := make([]string, len(stripped))
+	for i, file := range stripped {
+		paths[i] = dst.Prefix() + file
+	}
+	if err := pushHead(opts, dst, dstURL, paths, 1); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// recordsSource tells whether the provided destination commit records
+// the source commit named by id, a hash of at least 7 digits. Full
+// source hashes are preferred to abbreviated ones, which are ambiguous.
+func recordsSource(c *git.Commit, id string) bool {
+	if full := c.SourceCommits(); len(full) > 0 {
+		for _, source := range full {
+			if strings.HasPrefix(source, id) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, short := range c.ShipitID() {
+		if strings.HasPrefix(id, short) || strings.HasPrefix(short, id) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,1412 @@
+// Copyright 2018 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// Package mirror copies commits from a source repository to a
+// destination repository, applying rules, as the grit command does. It
+// allows programs to embed grit, e.g., to mirror many repositories and
+// export the outcome of each sync as metrics. The operation of each
+// sync is configured by Options, which correspond to grit's flags; see
+// the grit command's documentation for details.
+package mirror
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"mime"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/grailbio/base/digest"
+	"github.com/grailbio/base/log"
+	"github.com/grailbio/grit/git"
+	"github.com/grailbio/grit/github"
+	"github.com/grailbio/grit/rules"
+)
+
+// Options configures Sync, Revert, and Reconcile. Each option
+// corresponds to the grit flag named in its description.
+type Options struct {
+	// Dump, if set, is called with each patch instead of applying it
+	// to the destination (-dump).
+	Dump func(git.Patch) error
+	// Push pushes applied commits to the destination's remote (-push).
+	Push bool
+	// Verify checks that the destination is in sync with the source
+	// instead of copying commits (-verify). Differing files are
+	// printed to standard output.
+	Verify bool
+	// Check checks that commits apply cleanly to a worktree of the
+	// destination, without pushing them (-check).
+	Check bool
+	// Interactive prompts the operator, on standard error and
+	// standard input, to resolve commits that fail to apply
+	// (-interactive).
+	Interactive bool
+
+	// Config holds git configuration parameters that are passed to
+	// every git command (-config).
+	Config map[string]string
+	// CommitterName and CommitterEmail configure the committer of
+	// the commits applied to the destination (-committer-name and
+	// -committer-email).
+	CommitterName, CommitterEmail string
+	// SrcSSHKey and DstSSHKey are the SSH private keys with which to
+	// authenticate to the source and destination remotes
+	// (GRIT_SRC_SSH_KEY and GRIT_DST_SSH_KEY).
+	SrcSSHKey, DstSSHKey string
+	// Timeout bounds the duration of each git command (-timeout).
+	Timeout time.Duration
+	// PushInterval, PushRetries, and VerifyPush configure pushes to
+	// the destination (-push-interval, -push-retries, and
+	// -verify-push).
+	PushInterval time.Duration
+	PushRetries  int
+	VerifyPush   bool
+	// PrePush is a shell command to run in the destination checkout
+	// before pushing (-pre-push).
+	PrePush string
+	// LocalSource reads the source from an existing local working
+	// tree instead of cloning it (-local-source).
+	LocalSource bool
+	// PartialClone clones the source without blobs (-partial-clone).
+	PartialClone bool
+	// SparseCheckout limits the working trees of the checkouts to
+	// their prefixes (-sparse-checkout).
+	SparseCheckout bool
+	// FastForward fast-forwards the destination checkout instead of
+	// resetting it (-ff-only).
+	FastForward bool
+	// NoLFS disables the copying of Git LFS objects (-no-lfs).
+	NoLFS bool
+	// PrefixMap, if set, maps source directories to destination
+	// directories in place of the source prefix (-prefix-map).
+	PrefixMap git.PrefixMap
+
+	// Linearize linearizes the source history before copying
+	// commits (-linearize).
+	Linearize bool
+	// TopoOrder copies source commits in topological order
+	// (-topo-order).
+	TopoOrder bool
+	// ForceInitial ignores previously synchronized commits and
+	// performs an initial sync (-force-initial), copying only the
+	// source commits after Since, if set (-since).
+	ForceInitial bool
+	Since        string
+	// MergeBase copies the source commits after the merge base of
+	// the last synchronized commit and the source head (-merge-base).
+	MergeBase bool
+	// SearchLimit is the maximum number of destination commits with
+	// source IDs to examine when searching for the last synchronized
+	// commit (-search-limit). If zero, there is no limit.
+	SearchLimit int
+	// MaxCommits, if positive, is the maximum number of commits to
+	// copy (-max-commits).
+	MaxCommits int
+	// RequireSigned copies only source commits with good signatures
+	// (-require-signed).
+	RequireSigned bool
+
+	// DetectRenames copies renames as such (-renames).
+	DetectRenames bool
+	// Context and FunctionContext configure the context of patches
+	// (-context and -function-context).
+	Context         int
+	FunctionContext bool
+	// Whitespace is the git am --whitespace action with which
+	// patches are applied (-whitespace).
+	Whitespace string
+	// KeepEmpty copies empty source commits (-keep-empty).
+	KeepEmpty bool
+	// ExportIgnore strips files with the export-ignore attribute
+	// (-export-ignore).
+	ExportIgnore bool
+	// SkipSubmodules strips changes to submodules
+	// (-skip-submodules).
+	SkipSubmodules bool
+	// MaxBlobSize, if positive, strips binary files larger than this
+	// many bytes (-max-blob-size).
+	MaxBlobSize int64
+	// CaseInsensitive fails if copied commits would add paths that
+	// differ only in case (-case-insensitive).
+	CaseInsensitive bool
+	// SquashRun squashes the commits copied by a sync into one
+	// (-squash-run); SquashWindow, if positive, squashes consecutive
+	// commits by the same author within it (-squash-window).
+	SquashRun    bool
+	SquashWindow time.Duration
+
+	// MessageTemplate, if set, renders destination commit messages
+	// (-message-template).
+	MessageTemplate *template.Template
+	// NoTrailer records source commits in notes instead of trailers
+	// (-no-trailer).
+	NoTrailer bool
+	// SourceCommits records full source commit hashes in trailers
+	// (-source-commits).
+	SourceCommits bool
+	// KeepTrailers keeps the trailers of stripped commit messages
+	// (-keep-trailers).
+	KeepTrailers bool
+	// SignatureTrailers records the signatures of signed source
+	// commits in trailers (-signature-trailers).
+	SignatureTrailers bool
+	// Notes copies git notes from source commits (-notes).
+	Notes bool
+
+	// Tags mirrors source tags that refer to copied commits (-tags),
+	// and ForceTags updates those that were moved (-force-tags).
+	Tags      bool
+	ForceTags bool
+	// ReleaseOwner and ReleaseRepo, if set, name the GitHub
+	// repository in which a release is created, with GitHub, for
+	// each mirrored tag (-github-releases).
+	ReleaseOwner, ReleaseRepo string
+	GitHub                    github.Client
+
+	// Summary logs a diffstat of each copied commit (-summary).
+	Summary bool
+	// VerboseDiff is the number of bytes of each stripped or
+	// rewritten diff to log at debug level (-verbose-diff).
+	VerboseDiff int
+}
+
+// stateNotesRef is the ref of the git notes in which source commits
+// are recorded with -no-trailer.
+const stateNotesRef = "refs/notes/grit"
+
+// tagStateRef is the destination ref in which the source commits of
+// mirrored tags are recorded, so that moved tags can be detected.
+const tagStateRef = "refs/grit/tags"
+
+// skipStateRef is the destination ref in which the source commits
+// skipped by the operator with -interactive are recorded, so that
+// later runs do not copy them.
+const skipStateRef = "refs/grit/skipped"
+
+// A Result summarizes the outcome of a sync, for reporting by grit's
+// -stats flag, or by callers that export it as metrics.
+type Result struct {
+	// Src and Dst name the source and destination repositories,
+	// as url,prefix,branch.
+	Src string `json:"src"`
+	Dst string `json:"dst"`
+	// Applied is the number of commits applied to the destination.
+	Applied int `json:"applied"`
+	// Empty is the number of source commits skipped because they
+	// were empty after applying rules.
+	Empty int `json:"empty"`
+	// Stripped is the number of source commits stripped by
+	// strip-commit and strip-message-commit rules, or skipped by the
+	// operator with the Interactive option in an earlier run.
+	Stripped int `json:"stripped"`
+	// MessageStripped is the number of source commits whose messages
+	// were stripped by strip-message rules.
+	MessageStripped int `json:"messageStripped"`
+	// Filtered is the number of source commits skipped by the
+	// -author-allow and -author-deny flags.
+	Filtered int `json:"filtered"`
+	// Unsigned is the number of source commits skipped by the
+	// -require-signed flag because they lack a good signature.
+	Unsigned int `json:"unsigned"`
+	// Tags is the number of source tags mirrored to the destination.
+	Tags int `json:"tags"`
+	// Pushed tells whether the applied commits were pushed.
+	Pushed bool `json:"pushed"`
+	// Error is the error that ended the sync, if it failed.
+	Error string `json:"error,omitempty"`
+}
+
+// A Pair is a source and destination branch to be synchronized by
+// SyncAll, with the given rules and options.
+type Pair struct {
+	Options                      Options
+	Rules                        rules.Rules
+	SrcURL, SrcPrefix, SrcBranch string
+	DstURL, DstPrefix, DstBranch string
+}
+
+// SyncAll synchronizes each of the provided pairs, as Sync does, with
+// its own rules and options, running up to limit of the syncs
+// concurrently. Each sync opens its own checkouts, whose locks are
+// held in URL order, so that syncs that share a repository wait for
+// each other rather than deadlock. A failed sync does not stop the
+// others. SyncAll returns the result and error of each pair's sync, in
+// the order of the pairs.
+func SyncAll(pairs []Pair, limit int) ([]Result, []error) {
+	if limit < 1 {
+		limit = 1
+	}
+	var (
+		results = make([]Result, len(pairs))
+		errs    = make([]error, len(pairs))
+		wg      sync.WaitGroup
+		tokens  = make(chan struct{}, limit)
+	)
+	for i, p := range pairs {
+		tokens <- struct{}{}
+		wg.Add(1)
+		go func(i int, p Pair) {
+			defer wg.Done()
+			results[i], errs[i] = Sync(p.Options, p.Rules, p.SrcURL, p.SrcPrefix, p.SrcBranch, p.DstURL, p.DstPrefix, p.DstBranch)
+			<-tokens
+		}(i, p)
+	}
+	wg.Wait()
+	return results, errs
+}
+
+// Sync copies commits from the source branch to the destination
+// branch with the provided rules, as configured by opts. It returns
+// the outcome of the sync, as far as it got, and the error that ended
+// it, if any.
+func Sync(opts Options, rules rules.Rules, srcURL, srcPrefix, srcBranch, dstURL, dstPrefix, dstBranch string) (res Result, err error) {
+	// Open repositories in URL order so that we don't deadlock across
+	// multiple repositories.
+	var (
+		src, dst         *git.Repo
+		srcOpts, dstOpts git.Options
+	)
+	srcOpts.DetectRenames = opts.DetectRenames
+	srcOpts.TopoOrder = opts.TopoOrder
+	srcOpts.Context = opts.Context
+	srcOpts.FunctionContext = opts.FunctionContext
+	srcOpts.PartialClone = opts.PartialClone
+	srcOpts.SSHKey = opts.SrcSSHKey
+	srcOpts.SparseCheckout = opts.SparseCheckout
+	srcOpts.PrefixMap = opts.PrefixMap
+	srcOpts.NoLFS = opts.NoLFS
+	dstOpts.SSHKey = opts.DstSSHKey
+	dstOpts.SparseCheckout = opts.SparseCheckout
+	dstOpts.NoLFS = opts.NoLFS
+	dstOpts.FastForward = opts.FastForward
+	dstOpts.Whitespace = opts.Whitespace
+	dstOpts.KeepConflicts = opts.Interactive
+	if opts.LocalSource {
+		// Local repositories are not locked.
+		if src, err = openLocalRepo(opts, srcURL, srcPrefix, srcBranch, srcOpts); err == nil {
+			dst, err = openRepo(opts, dstURL, dstPrefix, dstBranch, dstOpts)
+		}
+	} else if srcURL < dstURL {
+		if src, err = openRepo(opts, srcURL, srcPrefix, srcBranch, srcOpts); err == nil {
+			dst, err = openRepo(opts, dstURL, dstPrefix, dstBranch, dstOpts)
+		}
+	} else {
+		if dst, err = openRepo(opts, dstURL, dstPrefix, dstBranch, dstOpts); err == nil {
+			src, err = openRepo(opts, srcURL, srcPrefix, srcBranch, srcOpts)
+		}
+	}
+	if src != nil {
+		defer src.Close()
+	}
+	if dst != nil {
+		defer dst.Close()
+	}
+	if err != nil {
+		return res, err
+	}
+	if opts.Dump == nil && !opts.Verify {
+		if err := configureCommitter(opts, dst); err != nil {
+			return res, err
+		}
+	}
+	// Commits applied by an interrupted run are pushed even if there
+	// are no new commits to copy.
+	resumed, err := dst.Journal()
+	if err != nil {
+		return res, fmt.Errorf("%s: journal: %v", dst, err)
+	}
+	// Branches may have been left to default.
+	srcBranch, dstBranch = src.Branch(), dst.Branch()
+	res.Src, res.Dst = src.String(), dst.String()
+	log.Printf("synchronizing repo:%s prefix:%s branch:%s -> repo:%s prefix:%s branch:%s rules:%s",
+		srcURL, srcPrefix, srcBranch, dstURL, dstPrefix, dstBranch, rules)
+	if opts.Notes {
+		for _, r := range []*git.Repo{src, dst} {
+			if err := r.FetchNotes(git.DefaultNotesRef); err != nil {
+				return res, fmt.Errorf("%s: fetch notes: %v", r, err)
+			}
+		}
+	}
+	if opts.NoTrailer {
+		if err := dst.FetchNotes(stateNotesRef); err != nil {
+			return res, fmt.Errorf("%s: fetch notes: %v", dst, err)
+		}
+	}
+	// Source commits skipped by the operator, which are not copied.
+	var skips map[string]bool
+	if !opts.Verify {
+		if skips, err = dst.SkippedCommits(skipStateRef); err != nil {
+			return res, fmt.Errorf("%s: skipped commits: %v", dst, err)
+		}
+	}
+
+	if opts.Verify {
+		var ignored map[string]bool
+		if opts.ExportIgnore {
+			paths, err := src.Files()
+			if err != nil {
+				return res, fmt.Errorf("%s: files: %v", src, err)
+			}
+			ignored, err = src.ExportIgnored(paths)
+			if err != nil {
+				return res, fmt.Errorf("%s: export-ignore: %v", src, err)
+			}
+		}
+		diffs, err := dst.Diff(src, func(path string) (bool, func([]byte) []byte) {
+			if match, _ := rules.IsPathStripped(path); match {
+				return false, nil
+			}
+			if ignored[strings.TrimPrefix(path, dst.Prefix())] {
+				return false, nil
+			}
+			if opts.SkipSubmodules && strings.TrimPrefix(path, dst.Prefix()) == ".gitmodules" {
+				return false, nil
+			}
+			return true, rules.RewriteContent(path)
+		})
+		if err != nil {
+			return res, fmt.Errorf("%s: diff %s: %v", dst, src, err)
+		}
+		if opts.SkipSubmodules {
+			var kept []git.Diff
+			for _, diff := range diffs {
+				if !diff.IsSubmodule() {
+					kept = append(kept, diff)
+				}
+			}
+			diffs = kept
+		}
+		if len(diffs) == 0 {
+			log.Print("destination is in sync")
+			return res, nil
+		}
+		for _, diff := range diffs {
+			fmt.Printf("diff --git a/%s b/%s\n%s\n%s\n", diff.Path, diff.Path, diff.Meta, diff.Body)
+		}
+		return res, fmt.Errorf("destination has drifted: %d files differ", len(diffs))
+	}
+
+	if opts.Linearize {
+		if err := src.Linearize(); err != nil {
+			return res, fmt.Errorf("linearize %s: %v", src, err)
+		}
+	}
+
+	last, err := lastSynced(opts, rules, src, dst)
+	if err != nil {
+		return res, err
+	}
+	var commits []*git.Commit
+	if last == nil {
+		args := []string{"--no-merges"}
+		if opts.ForceInitial {
+			log.Error.Printf("-force-initial: ignoring commits previously synchronized to %s; this may duplicate them", dst)
+			if opts.Since != "" {
+				id, err := src.RevParse(opts.Since)
+				if err != nil {
+					return res, fmt.Errorf("-since: %s: %v", src, err)
+				}
+				args = append(args, id.Hex()+"..HEAD")
+			}
+		}
+		log.Printf("performing initial sync")
+		var err error
+		commits, err = src.Log(args...)
+		if err != nil {
+			return res, fmt.Errorf("log %s: %v", src, err)
+		}
+	} else {
+		log.Printf("synchronizing: last diff: %v, source: %v", last.Commit.Digest, last.Commit.ShipitID())
+		var (
+			newestID = last.SourceID
+			ok       = last.Source != nil
+			err      error
+		)
+		msg := fmt.Sprintf("last synchronized source commit %s is not in the history of %s: the source branch may have been force-pushed", newestID, src)
+		switch {
+		case opts.MergeBase:
+			var base digest.Digest
+			base, err = src.MergeBase(newestID, "HEAD")
+			if err != nil {
+				return res, fmt.Errorf("%s: merge-base %s HEAD: %v", src, newestID, err)
+			}
+			if !ok {
+				log.Error.Printf("%s; copying commits after merge base %s, which may include copied commits", msg, base.Hex()[:7])
+			}
+			commits, err = src.Log(base.Hex()+"..HEAD", "--no-merges")
+		case !ok:
+			// Otherwise, the log below is empty, and the mirror stalls.
+			if base, err := src.MergeBase(newestID, "HEAD"); err == nil {
+				return res, fmt.Errorf("%s; to resynchronize from their last common commit, run with -merge-base, or with -force-initial -since=%s", msg, base.Hex())
+			}
+			return res, fmt.Errorf("%s; to resynchronize, run with -force-initial", msg)
+		default:
+			commits, err = src.Log(newestID+"..HEAD", "--ancestry-path", "--no-merges")
+		}
+		if err != nil {
+			return res, fmt.Errorf("log %s: %v", src, err)
+		}
+	}
+
+	// Filter out commits which are themselves copies, so that
+	// we can properly support multi-way syncing.
+	// We also filter out commits that match any stripped commits.
+	raw := commits
+	commits = nil
+commitsLoop:
+	for _, commit := range raw {
+		if len(commit.ShipitID()) > 0 {
+			continue
+		}
+		if skips[commit.Digest.Hex()] {
+			log.Debug.Printf("commit %s: skipped by the operator in an earlier run", commit.Digest)
+			res.Stripped++
+			continue commitsLoop
+		}
+		if rules.IsStripped(commit) {
+			log.Debug.Printf("commit %s: stripped by strip-commit rule", commit.Digest)
+			res.Stripped++
+			continue commitsLoop
+		}
+		if match, re := rules.IsMessageStripped(commit); match {
+			log.Debug.Printf("commit %s: message matches rule %s: stripping", commit.Digest, re)
+			res.Stripped++
+			continue commitsLoop
+		}
+		if match, reason := rules.IsAuthorFiltered(commit); match {
+			log.Debug.Printf("commit %s: author %s %s: skipping", commit.Digest.Hex()[:7], commit.Author(), reason)
+			res.Filtered++
+			continue commitsLoop
+		}
+		if opts.RequireSigned {
+			status, err := src.SignatureStatus(commit.Digest.Hex())
+			if err != nil {
+				return res, fmt.Errorf("%s: %v", src, err)
+			}
+			if status != 'G' && status != 'U' {
+				log.Error.Printf("commit %s: %s: skipping", commit.Digest.Hex()[:7], signatureProblem(status))
+				res.Unsigned++
+				continue commitsLoop
+			}
+		}
+		commits = append(commits, commit)
+	}
+	if res.Unsigned > 0 {
+		log.Error.Printf("-require-signed: skipped %d commits without a good signature", res.Unsigned)
+	}
+
+	log.Printf("%d commits to copy", len(commits))
+	var patches []pendingPatch
+	headers := rules.HeaderTracker(src, dst)
+	router := rules.Router(src, dst)
+	// Commits are listed newest first (and, with -topo-order, children
+	// before their parents), so they are copied in reverse.
+	for i := len(commits) - 1; i >= 0; i-- {
+		if opts.MaxCommits > 0 && opts.SquashWindow == 0 && len(patches) == opts.MaxCommits {
+			break
+		}
+		c := commits[i]
+		patch, err := src.Patch(c.Digest, dst.Prefix())
+		if err != nil {
+			return res, fmt.Errorf("%s: patch %s: %v", src, c.Digest.Hex()[:7], err)
+		}
+		var ignored map[string]bool
+		if opts.ExportIgnore {
+			var paths []string
+			for _, diff := range patch.Diffs {
+				paths = append(paths, src.SourcePath(diff.Path, dst.Prefix()))
+				if diff.OldPath != "" {
+					paths = append(paths, src.SourcePath(diff.OldPath, dst.Prefix()))
+				}
+			}
+			ignored, err = src.ExportIgnored(paths)
+			if err != nil {
+				return res, fmt.Errorf("%s: export-ignore: %v", src, err)
+			}
+		}
+		// A rename cannot be applied if only one of its paths is
+		// stripped; split such renames into a deletion and an addition.
+		isStripped := func(path string) bool {
+			match, _ := rules.IsPathStripped(path)
+			return match || ignored[src.SourcePath(path, dst.Prefix())]
+		}
+		var split []git.Diff
+		for _, diff := range patch.Diffs {
+			if diff.OldPath == "" || isStripped(diff.OldPath) == isStripped(diff.Path) {
+				split = append(split, diff)
+				continue
+			}
+			diffs, err := src.SplitRename(c.Digest, dst.Prefix(), diff)
+			if err != nil {
+				return res, fmt.Errorf("%s: split rename %s -> %s: %v", src, diff.OldPath, diff.Path, err)
+			}
+			split = append(split, diffs...)
+		}
+		patch.Diffs = split
+		// Apply filepath specific rules.
+		// Prefixes are already rewritten by the repo.
+		var diffs []git.Diff
+		stripMessage := true
+		// Source paths of the diffs, by their destination paths:
+		// route rules may place different files at the same path.
+		routed := make(map[string]string)
+	diffloop:
+		for _, diff := range patch.Diffs {
+			if match, re := rules.IsPathStripped(diff.Path); match {
+				log.Debug.Printf("file %s matches rule %s: stripping", diff.Path, re)
+				logDiff(opts.VerboseDiff, "stripped", diff.Body)
+				continue diffloop
+			}
+			if ignored[src.SourcePath(diff.Path, dst.Prefix())] {
+				log.Debug.Printf("file %s is export-ignored: stripping", diff.Path)
+				logDiff(opts.VerboseDiff, "stripped", diff.Body)
+				continue diffloop
+			}
+			if opts.SkipSubmodules && isSubmodule(diff, dst.Prefix()) {
+				log.Error.Printf("warning: %s: stripping submodule change to %s", patch.ID.Hex()[:7], diff.Path)
+				continue diffloop
+			}
+			if opts.MaxBlobSize > 0 && diff.IsBinary() {
+				size, err := binarySize(src, dst.Prefix(), c.Digest, diff)
+				if err != nil {
+					return res, fmt.Errorf("%s: patch %s: %v", src, c.Digest.Hex()[:7], err)
+				}
+				if size > opts.MaxBlobSize {
+					log.Error.Printf("warning: %s: stripping binary file %s of %d bytes, larger than -max-blob-size=%d", patch.ID.Hex()[:7], diff.Path, size, opts.MaxBlobSize)
+					continue diffloop
+				}
+			}
+			if match, re := rules.IsMessagePathStripped(diff.Path); match {
+				log.Debug.Printf("file %s matches rule %s for stripping commit messages", diff.Path, re)
+				logDiff(opts.VerboseDiff, "message-stripped", diff.Body)
+			} else {
+				stripMessage = false
+			}
+			path := diff.Path
+			if err := router.Route(c.Digest, &diff); err != nil {
+				return res, fmt.Errorf("%s: patch %s: %v", src, c.Digest.Hex()[:7], err)
+			}
+			if other, ok := routed[diff.Path]; ok && other != path {
+				return res, fmt.Errorf("%s: patch %s: files %s and %s are both routed to %s", src, c.Digest.Hex()[:7], other, path, diff.Path)
+			}
+			routed[diff.Path] = path
+			if !diff.IsSubmodule() {
+				body := diff.Body
+				rules.RewriteDiff(&diff)
+				if err := headers.Adjust(&diff); err != nil {
+					return res, fmt.Errorf("%s: add-header %s: %v", dst, diff.Path, err)
+				}
+				if !bytes.Equal(body, diff.Body) {
+					log.Debug.Printf("file %s: rewritten", diff.Path)
+					logDiff(opts.VerboseDiff, "before rewrite", body)
+					logDiff(opts.VerboseDiff, "after rewrite", diff.Body)
+				}
+			}
+			diffs = append(diffs, diff)
+		}
+		empty := len(diffs) == 0
+		if empty && (!opts.KeepEmpty || len(patch.Diffs) > 0) {
+			log.Debug.Printf("skipping empty patch %s", patch.ID.Hex()[:7])
+			res.Empty++
+			continue
+		}
+		patch.Diffs = diffs
+		var kept []string
+		if stripMessage && !empty && opts.KeepTrailers {
+			// Co-authors are kept as such, below.
+			for _, trailer := range messageTrailers(patch.Body) {
+				if !coAuthorRe.MatchString(trailer) {
+					kept = append(kept, trailer)
+				}
+			}
+		}
+		var coAuthors []string
+		patch.Body, coAuthors = extractCoAuthors(patch.Body)
+		if stripMessage && !empty {
+			res.MessageStripped++
+			if !opts.KeepTrailers {
+				coAuthors = nil
+			}
+			patch.Subject = "Stripped commit"
+			patch.Body = "Commit message stripped."
+		}
+		patches = append(patches, pendingPatch{patch: patch, sources: []string{patch.ID.Hex()}, coAuthors: coAuthors, trailers: kept})
+	}
+	if opts.SquashWindow > 0 {
+		patches = squash(patches, opts.SquashWindow)
+	} else if opts.SquashRun {
+		patches = squashRun(patches)
+	}
+	if opts.MaxCommits > 0 && len(patches) > opts.MaxCommits {
+		log.Printf("limiting copy to %d of %d commits; the rest will be copied by subsequent runs", opts.MaxCommits, len(patches))
+		patches = patches[:opts.MaxCommits]
+	}
+
+	if opts.CaseInsensitive {
+		files, err := dst.Files()
+		if err != nil {
+			return res, fmt.Errorf("%s: files: %v", dst, err)
+		}
+		for i := range files {
+			files[i] = dst.Prefix() + files[i]
+		}
+		if err := checkCaseCollisions(files, patches); err != nil {
+			return res, err
+		}
+	}
+
+	ncommit := len(patches)
+	// Whether any notes were copied, so that they are pushed.
+	var notesCopied bool
+	if opts.Check && ncommit > 0 {
+		// Apply to a linked worktree so that the destination's
+		// checkout is left untouched.
+		scratch, err := dst.Worktree("")
+		if err != nil {
+			return res, fmt.Errorf("%s: worktree: %v", dst, err)
+		}
+		defer scratch.Close()
+		dst = scratch
+	}
+	// Patches that need no per-commit work are applied in a batch,
+	// saving a git am invocation per commit.
+	var batch []git.Patch
+	// Progress is journaled so that an interrupted run can be resumed.
+	// Notes are replaced by the remote's when the destination is
+	// opened, so runs that keep state in notes are not resumed.
+	journal := opts.Push && !opts.Notes && !opts.NoTrailer
+	batched := opts.Dump == nil && !opts.Check && !opts.Notes && !opts.NoTrailer && !opts.Interactive && ncommit > 1 && batchable(patches, opts.NoLFS)
+	// The number of commits skipped by the operator with -interactive.
+	var skipped int
+	for i, p := range patches {
+		patch := p.patch
+		if opts.MessageTemplate != nil {
+			if err := renderMessage(opts.MessageTemplate, &patch, p.sources); err != nil {
+				return res, fmt.Errorf("%s: %v", patch, err)
+			}
+		}
+		// Trailers must be in the message's last paragraph.
+		trailers := append([]string(nil), p.trailers...)
+		for _, coAuthor := range p.coAuthors {
+			if coAuthor != patch.Author {
+				trailers = append(trailers, "Co-authored-by: "+coAuthor)
+			}
+		}
+		if opts.SignatureTrailers {
+			sigs, err := signatureTrailers(src, p.sources)
+			if err != nil {
+				return res, err
+			}
+			trailers = append(trailers, sigs...)
+		}
+		sources := sourceTrailers(p.sources, opts.SourceCommits)
+		if !opts.NoTrailer {
+			trailers = append(trailers, sources...)
+		}
+		if len(trailers) > 0 {
+			if patch.Body != "" {
+				patch.Body += "\n\n"
+			}
+			patch.Body += strings.Join(trailers, "\n")
+		}
+		if opts.Summary {
+			log.Printf("%s:\n%s", patch, formatStat(patch.Stat()))
+		}
+		if opts.Dump != nil {
+			if err := opts.Dump(patch); err != nil {
+				return res, err
+			}
+		} else if batched {
+			log.Debug.Printf("applying %s", patch)
+			batch = append(batch, patch)
+		} else {
+			log.Debug.Printf("applying %s", patch)
+			parts := p.parts
+			if len(parts) == 0 {
+				parts = []git.Patch{patch}
+			}
+			var applied int
+			for _, part := range parts {
+				apply := dst.Apply
+				if len(part.Diffs) == 0 {
+					apply = dst.ApplyAllowEmpty
+				}
+				if err := apply(part); err != nil {
+					if opts.Check {
+						return res, checkFailed(i, ncommit, p, part, err)
+					}
+					if !opts.Interactive {
+						return res, fmt.Errorf("%s: apply %s: %s", dst, part, err)
+					}
+					if ok, err := resolveApply(dst, i, ncommit, p, part, err); err != nil {
+						return res, err
+					} else if !ok {
+						continue
+					}
+				}
+				applied++
+			}
+			if applied == 0 {
+				skipped++
+				for _, id := range p.sources {
+					skips[id] = true
+				}
+				continue
+			}
+			if len(p.parts) > 0 {
+				if err := dst.Squash(applied, patch); err != nil {
+					if opts.Check {
+						return res, checkFailed(i, ncommit, p, patch, err)
+					}
+					return res, fmt.Errorf("%s: squash %s: %v", dst, patch, err)
+				}
+			}
+			if opts.Notes {
+				copied, err := copyNote(src, dst, p)
+				if err != nil {
+					return res, err
+				}
+				notesCopied = notesCopied || copied
+			}
+			if opts.NoTrailer {
+				if err := dst.AddNote(stateNotesRef, strings.Join(sources, "\n")+"\n"); err != nil {
+					return res, fmt.Errorf("%s: add note: %v", dst, err)
+				}
+			}
+			if !opts.NoLFS && !opts.Check {
+				if err := copyLFSObjects(src, dst, patch); err != nil {
+					return res, err
+				}
+			}
+			if journal {
+				if err := writeJournal(dst, p.sources); err != nil {
+					return res, err
+				}
+			}
+		}
+	}
+
+	if batched {
+		if err := dst.ApplyAll(batch); err != nil {
+			return res, fmt.Errorf("%s: apply: %s", dst, err)
+		}
+		if journal {
+			if err := writeJournal(dst, patches[ncommit-1].sources); err != nil {
+				return res, err
+			}
+		}
+	}
+
+	res.Applied = ncommit - skipped
+	if opts.Check {
+		log.Printf("check: %d commits apply cleanly to %s", ncommit, dst)
+	}
+	var tags tagSync
+	if opts.Tags && opts.Dump == nil {
+		if tags, err = mirrorSourceTags(opts, src, dst); err != nil {
+			return res, err
+		}
+		res.Tags = len(tags.tags)
+	}
+	if !opts.Push {
+		return res, nil
+	}
+	if res.Applied == 0 && resumed == "" {
+		if err := publishSkips(dst, skips, skipped); err != nil {
+			return res, err
+		}
+		if len(tags.tags) > 0 || tags.stateChanged {
+			return res, publishTags(opts, dst, tags)
+		}
+		if skipped == 0 {
+			log.Print("nothing to do")
+		}
+		return res, nil
+	}
+	var paths []string
+	if resumed != "" {
+		// Include the paths changed by the commits applied by
+		// the interrupted run.
+		var err error
+		if paths, err = dst.UnpushedPaths("origin", dstBranch); err != nil {
+			return res, fmt.Errorf("%s: %v", dst, err)
+		}
+	} else {
+		for _, p := range patches {
+			for path := range p.patch.Paths() {
+				paths = append(paths, path)
+			}
+		}
+	}
+	if err := pushHead(opts, dst, dstURL, paths, res.Applied); err != nil {
+		return res, err
+	}
+	if notesCopied {
+		log.Printf("pushing notes to %s", dstURL)
+		if err := dst.PushNotes("origin", git.DefaultNotesRef); err != nil {
+			return res, fmt.Errorf("%s: push notes: %v", dst, err)
+		}
+	}
+	if opts.NoTrailer {
+		log.Printf("pushing source commits to %s %s", dstURL, stateNotesRef)
+		if err := dst.PushNotes("origin", stateNotesRef); err != nil {
+			return res, fmt.Errorf("%s: push notes: %v", dst, err)
+		}
+	}
+	if err := publishSkips(dst, skips, skipped); err != nil {
+		return res, err
+	}
+	if err := publishTags(opts, dst, tags); err != nil {
+		return res, err
+	}
+	if err := dst.ClearJournal(); err != nil {
+		return res, fmt.Errorf("%s: clear journal: %v", dst, err)
+	}
+	res.Pushed = true
+	return res, nil
+}
+
+// publishSkips records the provided source commits, of which the
+// commits of n destination patches were skipped by the operator in this
+// run, in skipStateRef, and pushes it to the destination's remote, so
+// that later runs do not copy them.
+func publishSkips(dst *git.Repo, skips map[string]bool, n int) error {
+	if n == 0 {
+		return nil
+	}
+	log.Printf("recording %d skipped commits in %s", n, skipStateRef)
+	if err := dst.SetSkippedCommits(skipStateRef, skips); err != nil {
+		return fmt.Errorf("%s: set skipped commits: %v", dst, err)
+	}
+	if err := dst.PushRef("origin", skipStateRef); err != nil {
+		return fmt.Errorf("%s: push %s: %v", dst, skipStateRef, err)
+	}
+	return nil
+}
+
+// writeJournal records in the destination's progress journal that the
+// commits up to and including the newest of the provided source
+// commits have been applied.
+func writeJournal(dst *git.Repo, sources []string) error {
+	if err := dst.WriteJournal(sources[len(sources)-1]); err != nil {
+		return fmt.Errorf("%s: write journal: %v", dst, err)
+	}
+	return nil
+}
+
+// copyLFSObjects copies from src to dst the objects of any LFS
+// pointers touched by the provided patch, which has been applied to
+// dst. Doing it this way allows us to download only LFS objects that
+// actually need to be transferred.
+func copyLFSObjects(src, dst *git.Repo, patch git.Patch) error {
+	if !patch.MaybeContainsLFSPointer() {
+		log.Debug.Printf("%s: patch contains no LFS pointers", patch)
+		return nil
+	}
+	ptrs, err := dst.ListLFSPointersForPaths(patch.Paths())
+	if err != nil {
+		return err
+	}
+	for _, ptr := range ptrs {
+		if err := dst.CopyLFSObject(src, ptr); err != nil {
+			return fmt.Errorf("copying LFS object %s: %v", ptr, err)
+		}
+	}
+	return nil
+}
+
+// checkCaseCollisions returns an error if the provided patches, applied
+// in order to a destination with the provided files, add a path that
+// differs only in case from another. Such paths collide when the
+// destination is checked out on a case-insensitive filesystem.
+// Collisions that are already present in the destination are ignored.
+func checkCaseCollisions(files []string, patches []pendingPatch) error {
+	// Paths, keyed by their lower-case forms.
+	paths := make(map[string]string)
+	for _, path := range files {
+		paths[strings.ToLower(path)] = path
+	}
+	for _, p := range patches {
+		// Remove paths first, so that, e.g., changing the case of a
+		// path by deleting and adding it is permitted.
+		for _, diff := range p.patch.Diffs {
+			switch {
+			case diff.OldPath != "":
+				delete(paths, strings.ToLower(diff.OldPath))
+			case diff.IsDeleted():
+				delete(paths, strings.ToLower(diff.Path))
+			}
+		}
+		for _, diff := range p.patch.Diffs {
+			if diff.OldPath == "" && !diff.IsNew() {
+				// Modifications and deletions do not add paths.
+				continue
+			}
+			key := strings.ToLower(diff.Path)
+			if other, ok := paths[key]; ok && other != diff.Path {
+				return fmt.Errorf("%s adds %s, which differs only in case from %s: "+
+					"such paths collide on case-insensitive filesystems; "+
+					"rename one of them in the source, or exclude one with a strip rule", p.patch, diff.Path, other)
+			}
+			paths[key] = diff.Path
+		}
+	}
+	return nil
+}
+
+// maxStatBar is the maximum width of the bars of +s and -s in
+// formatted stats.
+const maxStatBar = 50
+
+// formatStat formats the provided stats like git diff --stat.
+func formatStat(stats map[string]git.Stat) string {
+	var (
+		paths                 []string
+		width, maxLines       int
+		insertions, deletions int
+	)
+	for path, stat := range stats {
+		paths = append(paths, path)
+		if len(path) > width {
+			width = len(path)
+		}
+		if n := stat.Insertions + stat.Deletions; n > maxLines {
+			maxLines = n
+		}
+		insertions += stat.Insertions
+		deletions += stat.Deletions
+	}
+	sort.Strings(paths)
+	digits := len(strconv.Itoa(maxLines))
+	var b strings.Builder
+	for _, path := range paths {
+		stat := stats[path]
+		if stat.Binary {
+			fmt.Fprintf(&b, " %-*s | Bin\n", width, path)
+			continue
+		}
+		plus, minus := stat.Insertions, stat.Deletions
+		if maxLines > maxStatBar {
+			// Scale the bars, but keep nonzero counts visible.
+			scale := func(n int) int {
+				if n == 0 {
+					return 0
+				}
+				if n = n * maxStatBar / maxLines; n == 0 {
+					return 1
+				}
+				return n
+			}
+			plus, minus = scale(plus), scale(minus)
+		}
+		fmt.Fprintf(&b, " %-*s | %*d %s%s\n", width, path, digits, stat.Insertions+stat.Deletions,
+			strings.Repeat("+", plus), strings.Repeat("-", minus))
+	}
+	fmt.Fprintf(&b, " %d file%s changed", len(paths), plural(len(paths)))
+	if insertions > 0 {
+		fmt.Fprintf(&b, ", %d insertion%s(+)", insertions, plural(insertions))
+	}
+	if deletions > 0 {
+		fmt.Fprintf(&b, ", %d deletion%s(-)", deletions, plural(deletions))
+	}
+	return b.String()
+}
+
+func plural(n int) string {
+	if n == 1 {
+		return ""
+	}
+	return "s"
+}
+
+// renderMessage replaces the provided patch's subject and body with
+// those rendered by tmpl. The patch was copied from the provided
+// source commits.
+func renderMessage(tmpl *template.Template, patch *git.Patch, sources []string) error {
+	subject, err := new(mime.WordDecoder).DecodeHeader(patch.Subject)
+	if err != nil {
+		return fmt.Errorf("decode subject %q: %v", patch.Subject, err)
+	}
+	newest := sources[len(sources)-1]
+	data := struct {
+		Subject, Body, Author  string
+		Date                   time.Time
+		SourceID, SourceCommit string
+	}{
+		Subject:      strings.TrimPrefix(subject, "[PATCH] "),
+		Body:         strings.TrimSpace(patch.Body),
+		Author:       patch.Author,
+		Date:         patch.Time,
+		SourceID:     newest[:7],
+		SourceCommit: newest,
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return fmt.Errorf("message template: %v", err)
+	}
+	msg := strings.TrimSpace(b.String())
+	subject, body := msg, ""
+	if i := strings.IndexByte(msg, '\n'); i >= 0 {
+		subject, body = msg[:i], strings.TrimSpace(msg[i+1:])
+	}
+	if subject == "" {
+		return errors.New("message template: rendered an empty subject")
+	}
+	patch.Subject = "[PATCH] " + mime.QEncoding.Encode("utf-8", subject)
+	patch.Body = body
+	return nil
+}
+
+// sourceTrailers returns the trailers that record the provided source
+// commits, including their full hashes if full is set.
+func sourceTrailers(sources []string, full bool) []string {
+	var trailers []string
+	for _, id := range sources {
+		trailers = append(trailers, "fbshipit-source-id: "+id[:7])
+	}
+	if full {
+		for _, id := range sources {
+			trailers = append(trailers, "grit-source-commit: "+id)
+		}
+	}
+	return trailers
+}
+
+// signatureTrailers returns the trailers that record the signatures of
+// those of the provided source commits that are signed, as requested by
+// the SignatureTrailers option.
+func signatureTrailers(src *git.Repo, sources []string) ([]string, error) {
+	var trailers []string
+	for _, id := range sources {
+		signer, sig, err := src.Signature(id)
+		if err != nil {
+			return nil, fmt.Errorf("%s: signature %s: %v", src, id, err)
+		}
+		if sig == nil {
+			continue
+		}
+		trailers = append(trailers,
+			"grit-original-signer: "+signer,
+			"grit-original-signature: "+base64.StdEncoding.EncodeToString(sig))
+	}
+	return trailers, nil
+}
+
+// trailerArgs returns the arguments with which to log destination
+// commits so that their source trailers are included, and may be
+// searched with --grep. With noTrailer, source commits are recorded in
+// notes.
+func trailerArgs(noTrailer bool) []string {
+	if noTrailer {
+		return []string{"--notes=" + stateNotesRef}
+	}
+	return nil
+}
+
+// copyNote attaches the notes of the provided patch's source commits
+// to the destination's HEAD commit, which was applied from the patch.
+// It returns whether any notes were copied.
+func copyNote(src, dst *git.Repo, p pendingPatch) (bool, error) {
+	var notes []string
+	for _, id := range p.sources {
+		note, err := src.Notes(git.DefaultNotesRef, id)
+		if err != nil {
+			return false, fmt.Errorf("%s: notes %s: %v", src, id, err)
+		}
+		if note != "" {
+			notes = append(notes, note)
+		}
+	}
+	if len(notes) == 0 {
+		return false, nil
+	}
+	if err := dst.AddNote(git.DefaultNotesRef, strings.Join(notes, "\n\n")+"\n"); err != nil {
+		return false, fmt.Errorf("%s: add note: %v", dst, err)
+	}
+	return true, nil
+}
+
+// checkFailed reports the failure of the i'th of n pending patches,
+// whose part failed to apply to the -check worktree with err, and
+// returns the error that fails the check.
+func checkFailed(i, n int, p pendingPatch, part git.Patch, err error) error {
+	fmt.Printf("commit %d of %d does not apply: %s\n", i+1, n, p.patch)
+	for _, id := range p.sources {
+		fmt.Printf("source commit: %s\n", id)
+	}
+	if e, ok := err.(*git.ApplyError); ok {
+		for _, path := range e.Paths {
+			fmt.Printf("conflict: %s\n", path)
+		}
+		for _, diff := range e.Diffs {
+			fmt.Printf("diff --git a/%s b/%s\n%s\n%s\n", diff.Path, diff.Path, diff.Meta, diff.Body)
+		}
+	}
+	return fmt.Errorf("check failed: apply %s: %v", part, err)
+}
+
+// prompts reads the operator's answers to the prompts of -interactive.
+var prompts = bufio.NewReader(os.Stdin)
+
+// resolveApply lets the operator resolve the failure, with err, of the
+// provided part of the i'th of n pending patches to apply to dst, whose
+// am session is left in progress by -interactive. It returns whether the
+// part was applied once its conflicts were resolved, or skipped, and
+// an error if the operator aborts.
+func resolveApply(dst *git.Repo, i, n int, p pendingPatch, part git.Patch, err error) (bool, error) {
+	e, ok := err.(*git.ApplyError)
+	if !ok {
+		return false, fmt.Errorf("%s: apply %s: %s", dst, part, err)
+	}
+	fmt.Fprintf(os.Stderr, "commit %d of %d does not apply: %s\n", i+1, n, p.patch)
+	for _, id := range p.sources {
+		fmt.Fprintf(os.Stderr, "source commit: %s\n", id)
+	}
+	for _, path := range e.Paths {
+		fmt.Fprintf(os.Stderr, "conflict: %s\n", path)
+	}
+	for _, diff := range e.Diffs {
+		fmt.Fprintf(os.Stderr, "diff --git a/%s b/%s\n%s\n%s\n", diff.Path, diff.Path, diff.Meta, diff.Body)
+	}
+	fmt.Fprintf(os.Stderr, "resolve the conflicts in %s and stage the result with git add\n", dst.Root())
+	abort := func() error {
+		if err := dst.AbortApply(); err != nil {
+			log.Error.Printf("%s: %v", dst, err)
+		}
+		return fmt.Errorf("%s: apply %s: aborted", dst, part)
+	}
+	for {
+		fmt.Fprint(os.Stderr, "[c]ontinue, [s]kip the commit, or [a]bort? ")
+		answer, err := prompts.ReadString('\n')
+		switch strings.ToLower(strings.TrimSpace(answer)) {
+		case "c", "continue":
+			if err := dst.ContinueApply(part); err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+				continue
+			}
+			log.Printf("%s: applied %s with resolved conflicts", dst, part)
+			return true, nil
+		case "s", "skip":
+			if err := dst.SkipApply(); err != nil {
+				return false, fmt.Errorf("%s: %v", dst, err)
+			}
+			log.Printf("%s: skipped %s", dst, part)
+			return false, nil
+		case "a", "abort":
+			return false, abort()
+		}
+		if err != nil {
+			// The input ended without an answer.
+			return false, abort()
+		}
+	}
+}
+
+// signatureProblem describes the signature status, as returned by
+// git.Repo.SignatureStatus, of a commit without a good signature.
+func signatureProblem(status byte) string {
+	switch status {
+	case 'N':
+		return "not signed"
+	case 'B':
+		return "bad signature"
+	case 'X':
+		return "expired signature"
+	case 'Y':
+		return "signed by an expired key"
+	case 'R':
+		return "signed by a revoked key"
+	case 'E':
+		return "signature cannot be checked; is the key in the keyring?"
+	default:
+		return fmt.Sprintf("signature status %c", status)
+	}
+}
+
+// openRepo opens the repository named by url, prefix, and branch with
+// the provided repository options, configured by the Config, Timeout,
+// PushInterval, PushRetries, and VerifyPush options.
+func openRepo(opts Options, url, prefix, branch string, repoOpts git.Options) (*git.Repo, error) {
+	repoOpts.Timeout = opts.Timeout
+	repoOpts.Config = opts.Config
+	repoOpts.PushInterval = opts.PushInterval
+	repoOpts.PushRetries = opts.PushRetries
+	repoOpts.VerifyPush = opts.VerifyPush
+	r, err := git.OpenWithOptions(url, prefix, branch, repoOpts)
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %v", url, err)
+	}
+	return r, nil
+}
+
+// configureCommitter configures the committer identity given by the
+// CommitterName and CommitterEmail options in dst, and returns an
+// error if dst has no committer identity, so that grit does not fail
+// only later, when applying patches.
+func configureCommitter(opts Options, dst *git.Repo) error {
+	if opts.CommitterName != "" {
+		dst.Configure("user.name", opts.CommitterName)
+	}
+	if opts.CommitterEmail != "" {
+		dst.Configure("user.email", opts.CommitterEmail)
+	}
+	if _, err := dst.Committer(); err != nil {
+		return fmt.Errorf("%s: no committer identity configured; provide -committer-name and -committer-email, or user.name and user.email with -config", dst)
+	}
+	return nil
+}
+
+// pushHead pushes the destination's HEAD, which adds ncommit commits
+// changing the provided paths, to its branch. The PrePush command, if
+// any, is run first; if it fails, nothing is pushed.
+func pushHead(opts Options, dst *git.Repo, url string, paths []string, ncommit int) error {
+	if opts.PrePush != "" {
+		// Paths changed by several commits are listed once.
+		sort.Strings(paths)
+		var uniq []string
+		for i, path := range paths {
+			if i == 0 || path != paths[i-1] {
+				uniq = append(uniq, path)
+			}
+		}
+		paths = uniq
+		log.Printf("running pre-push command %q", opts.PrePush)
+		cmd := exec.Command("sh", "-c", opts.PrePush)
+		cmd.Dir = dst.Root()
+		cmd.Stdout = os.Stderr
+		cmd.Stderr = os.Stderr
+		cmd.Env = append(os.Environ(),
+			"GRIT_CHANGED_PATHS="+strings.Join(paths, "\n"),
+			fmt.Sprintf("GRIT_NCOMMIT=%d", ncommit),
+			"GRIT_DST_BRANCH="+dst.Branch(),
+			"GRIT_DST_PREFIX="+dst.Prefix(),
+		)
+		if err := cmd.Run(); err != nil {
+			// The vetoed commits must not be pushed by a run that
+			// resumes from the journal; the next run copies them anew.
+			if err := dst.ClearJournal(); err != nil {
+				log.Error.Printf("%s: clear journal: %v", dst, err)
+			}
+			return fmt.Errorf("pre-push command %q failed: %v: not pushing", opts.PrePush, err)
+		}
+	}
+	head, err := dst.HeadDigest()
+	if err != nil {
+		return fmt.Errorf("%s: head: %v", dst, err)
+	}
+	log.Printf("pushing %s to %s %s", head.Hex(), url, dst.Branch())
+	if err := dst.Push("origin", dst.Branch()); err != nil {
+		return fmt.Errorf("%s: push origin %s: %v", dst, dst.Branch(), err)
+	}
+	return nil
+}
+
+// lastSynced returns the last synchronization of dst from src, as
+// found by r.LastSynced with the search configured by opts, or nil if
+// there was none or ForceInitial is set.
+func lastSynced(opts Options, r rules.Rules, src, dst *git.Repo) (*rules.Sync, error) {
+	if opts.ForceInitial {
+		return nil, nil
+	}
+	last, err := r.LastSynced(src, dst, rules.SearchOptions{
+		LogArgs:   trailerArgs(opts.NoTrailer),
+		KeepEmpty: opts.KeepEmpty,
+		Limit:     opts.SearchLimit,
+	})
+	if _, ok := err.(*rules.SearchLimitError); ok {
+		return nil, fmt.Errorf("%v; raise -search-limit, or re-seed with -force-initial", err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: last synchronized commit: %v", dst, err)
+	}
+	return last, nil
+}
+
+// openLocalRepo opens the existing working tree at path as a
+// read-only repository with the provided repository options,
+// configured by the Config and Timeout options.
+func openLocalRepo(opts Options, path, prefix, branch string, repoOpts git.Options) (*git.Repo, error) {
+	repoOpts.Timeout = opts.Timeout
+	repoOpts.Config = opts.Config
+	r, err := git.OpenLocalWithOptions(path, prefix, branch, repoOpts)
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %v", path, err)
+	}
+	return r, nil
+}
+
+// batchable tells whether the provided patches can be applied by a
+// single git am invocation: they must be neither squashed nor empty,
+// and they must not require LFS objects to be copied, unless noLFS is
+// set.
+func batchable(patches []pendingPatch, noLFS bool) bool {
+	for _, p := range patches {
+		if len(p.parts) > 0 || len(p.patch.Diffs) == 0 {
+			return false
+		}
+		if !noLFS && p.patch.MaybeContainsLFSPointer() {
+			return false
+		}
+	}
+	return true
+}
+
+// logDiff logs, at debug level, the provided diff body, truncated to
+// limit bytes, as given by the VerboseDiff option.
+func logDiff(limit int, what string, body []byte) {
+	if limit <= 0 || !log.At(log.Debug) {
+		return
+	}
+	var more string
+	if len(body) > limit {
+		more = fmt.Sprintf("\n... (%d more bytes)", len(body)-limit)
+		body = body[:limit]
+	}
+	log.Debug.Printf("%s:\n%s%s", what, body, more)
+}
+
+// isSubmodule tells whether the diff changes a submodule gitlink or
+// the .gitmodules file at the root of the given prefix.
+func isSubmodule(diff git.Diff, prefix string) bool {
+	return diff.IsSubmodule() || strings.TrimPrefix(diff.Path, prefix) == ".gitmodules"
+}
+
+// binarySize returns the size of the binary file changed by the
+// provided diff of the source commit id: the larger of its sizes
+// before and after the commit. Diff paths are relative to the
+// destination prefix.
+func binarySize(src *git.Repo, prefix string, id digest.Digest, diff git.Diff) (int64, error) {
+	var size int64
+	if !diff.IsDeleted() {
+		n, err := src.BlobSize(id.Hex(), src.SourcePath(diff.Path, prefix))
+		if err != nil {
+			return 0, err
+		}
+		size = n
+	}
+	if !diff.IsNew() {
+		oldPath := diff.Path
+		if diff.OldPath != "" {
+			oldPath = diff.OldPath
+		}
+		n, err := src.BlobSize(id.Hex()+"^", src.SourcePath(oldPath, prefix))
+		if err != nil {
+			return 0, err
+		}
+		if n > size {
+			size = n
+		}
+	}
+	return size, nil
+}
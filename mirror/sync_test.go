@@ -0,0 +1,139 @@
+// Copyright 2018 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package mirror_test
+
+import (
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/grailbio/grit/mirror"
+	"github.com/grailbio/grit/rules"
+	"github.com/grailbio/testutil"
+)
+
+// TestSync ensures that Sync, called as a library, copies and pushes
+// commits as configured by its options, and reports the outcome in its
+// result rather than only in logs.
+func TestSync(t *testing.T) {
+	dir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	shell(t, dir, `
+		git init --bare src
+		git init --bare dst
+		git clone src a
+		git clone dst b
+		cd a
+		git config user.email you@example.com
+		git config user.name "your name"
+		echo one > file1
+		git add .
+		git commit -m'first commit'
+		mkdir secret
+		echo key > secret/key
+		git add .
+		git commit -m'secret commit'
+		echo two > file2
+		git add .
+		git commit -m'second commit'
+		git push
+		cd ../b
+		git config user.email you@example.com
+		git config user.name "your name"
+		git commit --allow-empty -m'initial commit'
+		git push
+	`)
+	var r rules.Rules
+	if err := r.Parse("strip:^secret/"); err != nil {
+		t.Fatal(err)
+	}
+	opts := mirror.Options{
+		Push:   true,
+		Config: map[string]string{"user.name": "test", "user.email": "you@example.com"},
+	}
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	res, err := mirror.Sync(opts, r, src, "", "", dst, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := res, (mirror.Result{Src: src + ",,master", Dst: dst + ",,master", Applied: 2, Empty: 1, Pushed: true}); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	out, err := exec.Command("git", "-C", filepath.Join(dir, "b"), "pull", "-q").CombinedOutput()
+	if err != nil {
+		t.Fatalf("pull: %v\n%s", err, out)
+	}
+	out, err = exec.Command("git", "-C", filepath.Join(dir, "b"), "log", "--format=%s").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(out), "second commit\nfirst commit\ninitial commit\n"; got != want {
+		t.Errorf("got log %q, want %q", got, want)
+	}
+
+	res, err = mirror.Sync(opts, r, src, "", "", dst, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Applied != 0 || res.Pushed {
+		t.Errorf("got %+v, want nothing applied or pushed", res)
+	}
+}
+
+// TestSyncAll ensures that SyncAll syncs each pair with its own
+// options.
+func TestSyncAll(t *testing.T) {
+	dir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	shell(t, dir, `
+		git init --bare src
+		git clone src a
+		cd a
+		git config user.email you@example.com
+		git config user.name "your name"
+		echo one > file1
+		git add .
+		git commit -m'first commit'
+		git push
+		cd ..
+		for dst in dst1 dst2; do
+			git init --bare $dst
+			git clone $dst $dst-checkout
+			git -C $dst-checkout -c user.name=test -c user.email=you@example.com commit --allow-empty -m'initial commit'
+			git -C $dst-checkout push
+		done
+	`)
+	config := map[string]string{"user.name": "test", "user.email": "you@example.com"}
+	src := filepath.Join(dir, "src")
+	pairs := []mirror.Pair{
+		{Options: mirror.Options{Push: true, Config: config}, SrcURL: src, DstURL: filepath.Join(dir, "dst1")},
+		{Options: mirror.Options{Config: config}, SrcURL: src, DstURL: filepath.Join(dir, "dst2")},
+	}
+	results, errs := mirror.SyncAll(pairs, 2)
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("pair %d: %v", i, err)
+		}
+	}
+	for i, want := range []bool{true, false} {
+		if got := results[i]; got.Applied != 1 || got.Pushed != want {
+			t.Errorf("pair %d: got %+v, want 1 commit applied, pushed=%v", i, got, want)
+		}
+	}
+}
+
+func shell(t *testing.T, dir, script string) {
+	t.Helper()
+	cmd := exec.Command("bash", "-e", "-x")
+	cmd.Dir = dir
+	cmd.Stdin = strings.NewReader(script)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("script failed: %v\n%s", err, stderr.String())
+	}
+	t.Log(stderr.String())
+}
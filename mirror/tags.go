@@ -0,0 +1,162 @@
+// Copyright 2018 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package mirror
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/grailbio/base/digest"
+	"github.com/grailbio/base/log"
+	"github.com/grailbio/grit/git"
+	"github.com/grailbio/grit/github"
+)
+
+// A tagSync is the outcome of mirrorSourceTags.
+type tagSync struct {
+	// tags are the tags created in the destination.
+	tags []git.Tag
+	// moved holds the names of the created tags that replace
+	// existing destination tags.
+	moved map[string]bool
+	// state is the updated tag state, to be recorded in tagStateRef.
+	state map[string]digest.Digest
+	// stateChanged tells whether state differs from the recorded one.
+	stateChanged bool
+}
+
+// mirrorSourceTags creates, in the destination, the source's tags that
+// refer to copied commits and that are not yet in the destination's
+// remote, and, if ForceTags is set, those that were moved in the
+// source since they were mirrored, as recorded in tagStateRef. Each
+// tag refers to the destination commit that records its source commit.
+func mirrorSourceTags(opts Options, src, dst *git.Repo) (ts tagSync, err error) {
+	if err := src.FetchTags(); err != nil {
+		return ts, fmt.Errorf("%s: fetch tags: %v", src, err)
+	}
+	srcTags, err := src.Tags()
+	if err != nil {
+		return ts, fmt.Errorf("%s: tags: %v", src, err)
+	}
+	existing, err := dst.RemoteTags()
+	if err != nil {
+		return ts, fmt.Errorf("%s: remote tags: %v", dst, err)
+	}
+	ts.state, err = dst.TagState(tagStateRef)
+	if err != nil {
+		return ts, fmt.Errorf("%s: tag state: %v", dst, err)
+	}
+	ts.moved = make(map[string]bool)
+	var pending []git.Tag
+	for _, tag := range srcTags {
+		recorded, ok := ts.state[tag.Name]
+		switch {
+		case !existing[tag.Name]:
+			pending = append(pending, tag)
+		case !ok:
+			// The tag was created before its state was recorded,
+			// or by someone else: record it as it is, so that
+			// subsequent moves are detected.
+			ts.state[tag.Name] = tag.Commit
+			ts.stateChanged = true
+		case recorded == tag.Commit:
+		case !opts.ForceTags:
+			log.Error.Printf("warning: tag %s was moved in the source from %s to %s: not updating it without -force-tags",
+				tag.Name, recorded.Hex()[:7], tag.Commit.Hex()[:7])
+		default:
+			pending = append(pending, tag)
+			ts.moved[tag.Name] = true
+		}
+	}
+	if len(pending) == 0 {
+		return ts, nil
+	}
+	commits, err := dst.Log(append(trailerArgs(opts.NoTrailer), "--grep", `shipit-source-id: `)...)
+	if err != nil {
+		return ts, fmt.Errorf("%s: log: %v", dst, err)
+	}
+	// Map source IDs, both abbreviated and full, to the destination
+	// commits that record them.
+	copied := make(map[string]digest.Digest)
+	for _, c := range commits {
+		for _, id := range append(c.ShipitID(), c.SourceCommits()...) {
+			if _, ok := copied[id]; !ok {
+				copied[id] = c.Digest
+			}
+		}
+	}
+	for _, tag := range pending {
+		hex := tag.Commit.Hex()
+		id, ok := copied[hex]
+		if !ok {
+			id, ok = copied[hex[:7]]
+		}
+		if !ok {
+			log.Debug.Printf("tag %s: commit %s was not copied: skipping", tag.Name, hex[:7])
+			continue
+		}
+		if ts.moved[tag.Name] {
+			log.Printf("moving tag %s to %s", tag.Name, id.Hex()[:7])
+		} else {
+			log.Printf("tagging %s as %s", id.Hex()[:7], tag.Name)
+		}
+		if err := dst.CreateTag(tag.Name, id, tag.Message); err != nil {
+			return ts, fmt.Errorf("%s: tag %s: %v", dst, tag.Name, err)
+		}
+		ts.state[tag.Name] = tag.Commit
+		ts.stateChanged = true
+		tag.Commit = id
+		ts.tags = append(ts.tags, tag)
+	}
+	return ts, nil
+}
+
+// publishTags pushes the provided tags, as mirrored by
+// mirrorSourceTags, to the destination's remote, records their state
+// in tagStateRef and, if configured by the ReleaseOwner and ReleaseRepo
+// options, creates a GitHub release for each.
+func publishTags(opts Options, dst *git.Repo, ts tagSync) error {
+	tags := ts.tags
+	if len(tags) > 0 {
+		names := make([]string, len(tags))
+		for i, tag := range tags {
+			names[i] = tag.Name
+		}
+		log.Printf("pushing tags %s", strings.Join(names, ", "))
+		if err := dst.PushTags("origin", names, ts.moved); err != nil {
+			return fmt.Errorf("%s: push tags: %v", dst, err)
+		}
+	}
+	if ts.stateChanged {
+		if err := dst.SetTagState(tagStateRef, ts.state); err != nil {
+			return fmt.Errorf("%s: set tag state: %v", dst, err)
+		}
+		if err := dst.PushRef("origin", tagStateRef); err != nil {
+			return fmt.Errorf("%s: push %s: %v", dst, tagStateRef, err)
+		}
+	}
+	if len(tags) == 0 || opts.ReleaseRepo == "" {
+		return nil
+	}
+	releases := opts.ReleaseOwner + "/" + opts.ReleaseRepo
+	if opts.GitHub.Token == "" {
+		log.Error.Printf("no GitHub token: not creating releases in %s", releases)
+		return nil
+	}
+	for _, tag := range tags {
+		release := github.Release{TagName: tag.Name, Name: tag.Name, Body: tag.Message}
+		created, err := opts.GitHub.CreateRelease(context.Background(), opts.ReleaseOwner, opts.ReleaseRepo, release)
+		if err != nil {
+			return err
+		}
+		if created {
+			log.Printf("created release %s in %s", tag.Name, releases)
+		} else {
+			log.Printf("release %s already exists in %s", tag.Name, releases)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,263 @@
+// Copyright 2018 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package rules
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/grailbio/grit/git"
+)
+
+// A headerRule prepends a header to the contents of new files whose
+// paths match pathRe.
+type headerRule struct {
+	pathRe *regexp.Regexp
+	// lines holds the header's lines, without line terminators.
+	lines [][]byte
+}
+
+func parseHeaderRule(rule string) (h headerRule, err error) {
+	parts := strings.SplitN(rule, ":", 2)
+	if len(parts) != 2 {
+		return h, fmt.Errorf("add-header: rule '%s' must be of form add-header:pathre:file", rule)
+	}
+	if h.pathRe, err = regexp.Compile(parts[0]); err != nil {
+		return h, fmt.Errorf("add-header: invalid path regexp %s: %s", parts[0], err)
+	}
+	header, err := ioutil.ReadFile(parts[1])
+	if err != nil {
+		return h, fmt.Errorf("add-header: %v", err)
+	}
+	if len(header) == 0 {
+		return h, fmt.Errorf("add-header: header file %s is empty", parts[1])
+	}
+	h.lines = bytes.Split(bytes.TrimSuffix(header, []byte("\n")), []byte("\n"))
+	return h, nil
+}
+
+// headerText returns the header as it appears in the lines of a diff
+// with the provided operation, '+' or '-', or, if op is 0, in a file.
+func (h headerRule) headerText(op byte) []byte {
+	var b bytes.Buffer
+	for _, line := range h.lines {
+		if op != 0 {
+			b.WriteByte(op)
+		}
+		b.Write(line)
+		b.WriteByte('\n')
+	}
+	return b.Bytes()
+}
+
+// HeaderTracker returns a tracker that applies the add-header rules
+// in r to diffs of commits in the source repository src that are
+// applied to the destination repository dst.
+func (r Rules) HeaderTracker(src, dst *git.Repo) *HeaderTracker {
+	return &HeaderTracker{
+		rules:   r.headers,
+		src:     src,
+		dst:     dst,
+		has:     make(map[headerKey]bool),
+		renamed: make(map[headerKey]headerKey),
+	}
+}
+
+// A headerKey identifies a destination file and a header rule.
+type headerKey struct {
+	path string
+	rule int
+}
+
+// A HeaderTracker applies add-header rules to diffs. Since the header
+// is added only to new files, the destination files differ from the
+// source files by the header; HeaderTracker tracks which destination
+// files begin with a header, so that subsequent diffs modifying or
+// deleting them can be adjusted accordingly.
+type HeaderTracker struct {
+	rules    []headerRule
+	src, dst *git.Repo
+	// has tells whether a destination file begins with a header that
+	// a rule added, rather than one that the source file has. Files
+	// that are not present are looked up in the destination's working
+	// tree, which holds the state before any patches have been
+	// applied (see lookup).
+	has map[headerKey]bool
+	// renamed maps files that were renamed without changes before
+	// they were looked up to the files from which they were renamed.
+	renamed map[headerKey]headerKey
+}
+
+// Adjust applies the tracker's rules to the provided diff, which is
+// applied to the destination after the diffs previously adjusted.
+func (t *HeaderTracker) Adjust(diff *git.Diff) error {
+	if diff.IsBinary() {
+		return nil
+	}
+	for i, h := range t.rules {
+		if !h.pathRe.MatchString(diff.Path) && !(diff.OldPath != "" && h.pathRe.MatchString(diff.OldPath)) {
+			continue
+		}
+		key := headerKey{diff.Path, i}
+		oldBlob, _, changed := diff.Blobs()
+		switch {
+		case diff.IsNew():
+			t.has[key] = h.add(diff)
+		case diff.IsDeleted():
+			has, err := t.lookup(key, oldBlob)
+			if err != nil {
+				return err
+			}
+			if has {
+				h.remove(diff)
+			}
+			t.has[key] = false
+		default:
+			from := key
+			if diff.OldPath != "" {
+				from.path = diff.OldPath
+			}
+			if !changed {
+				// The diff has no hunks to shift, nor a source blob
+				// with which to look up the file; the renamed file is
+				// looked up once it changes.
+				if has, ok := t.has[from]; ok {
+					t.has[key] = has
+				} else if from != key {
+					t.renamed[key] = from
+				}
+				continue
+			}
+			has, err := t.lookup(from, oldBlob)
+			if err != nil {
+				return err
+			}
+			if has {
+				shiftHunks(diff, len(h.lines))
+			}
+			if diff.OldPath != "" {
+				t.has[from] = false
+				t.has[key] = has
+			}
+		}
+	}
+	return nil
+}
+
+// lookup tells whether the destination file identified by key begins
+// with a header that the rule added, given the ID of the blob of the
+// corresponding source file, as it was before the diff being adjusted.
+// Files that the tracker has not seen were copied by earlier runs: the
+// rule added the header if the destination file begins with it, but
+// the source file does not.
+func (t *HeaderTracker) lookup(key headerKey, srcBlob string) (bool, error) {
+	origin := key
+	for {
+		if has, ok := t.has[origin]; ok {
+			t.has[key] = has
+			return has, nil
+		}
+		from, ok := t.renamed[origin]
+		if !ok {
+			break
+		}
+		origin = from
+	}
+	content, err := ioutil.ReadFile(filepath.Join(t.dst.Root(), origin.path))
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	header := t.rules[key.rule].headerText(0)
+	has := bytes.HasPrefix(content, header)
+	if has {
+		src, err := t.src.ShowBlob(srcBlob)
+		if err != nil {
+			return false, err
+		}
+		has = !bytes.HasPrefix(src, header)
+	}
+	t.has[key] = has
+	return has, nil
+}
+
+// add prepends the header to the file added by the provided diff,
+// unless the file already begins with it, and tells whether it did.
+func (h headerRule) add(diff *git.Diff) bool {
+	if len(bytes.TrimSpace(diff.Body)) == 0 {
+		// Empty files have no hunk, nor file names in the header.
+		if !bytes.Contains(diff.Meta, []byte("\n+++ ")) {
+			diff.Meta = append(append([]byte{}, diff.Meta...), "\n--- /dev/null\n+++ b/"+diff.Path...)
+		}
+		diff.Body = bytes.TrimSuffix(append([]byte(fmt.Sprintf("@@ -0,0 +1,%d @@\n", len(h.lines))), h.headerText('+')...), []byte("\n"))
+		return true
+	}
+	return h.prepend(diff, '+')
+}
+
+// remove removes the header from the file deleted by the provided
+// diff, by adding it to the deleted lines.
+func (h headerRule) remove(diff *git.Diff) {
+	if len(bytes.TrimSpace(diff.Body)) == 0 {
+		// The file was empty but for the header.
+		if !bytes.Contains(diff.Meta, []byte("\n+++ ")) {
+			diff.Meta = append(append([]byte{}, diff.Meta...), "\n--- a/"+diff.Path+"\n+++ /dev/null"...)
+		}
+		diff.Body = bytes.TrimSuffix(append([]byte(fmt.Sprintf("@@ -1,%d +0,0 @@\n", len(h.lines))), h.headerText('-')...), []byte("\n"))
+		return
+	}
+	h.prepend(diff, '-')
+}
+
+// prepend prepends the header to the single hunk of the provided diff,
+// which adds (op '+') or removes (op '-') a whole file, and tells
+// whether it did. The hunk is left unchanged if it already begins with
+// the header.
+func (h headerRule) prepend(diff *git.Diff, op byte) bool {
+	line, body := diff.Body, []byte(nil)
+	if i := bytes.IndexByte(line, '\n'); i >= 0 {
+		line, body = line[:i], line[i+1:]
+	}
+	hunk, ok := git.ParseHunkHeader(line)
+	if !ok {
+		return false
+	}
+	header := h.headerText(op)
+	if bytes.HasPrefix(append(body[:len(body):len(body)], '\n'), header) {
+		return false
+	}
+	if op == '+' {
+		hunk.NewLines += len(h.lines)
+	} else {
+		hunk.OldLines += len(h.lines)
+	}
+	var b bytes.Buffer
+	b.WriteString(hunk.String())
+	b.WriteByte('\n')
+	b.Write(header)
+	b.Write(body)
+	diff.Body = b.Bytes()
+	return true
+}
+
+// shiftHunks shifts the line numbers of the provided diff's hunks
+// by n lines.
+func shiftHunks(diff *git.Diff, n int) {
+	lines := bytes.Split(diff.Body, []byte("\n"))
+	for i, line := range lines {
+		if hunk, ok := git.ParseHunkHeader(line); ok {
+			hunk.OldStart += n
+			hunk.NewStart += n
+			lines[i] = []byte(hunk.String())
+		}
+	}
+	diff.Body = bytes.Join(lines, []byte("\n"))
+}
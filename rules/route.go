@@ -0,0 +1,185 @@
+// Copyright 2018 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package rules
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/grailbio/base/digest"
+	"github.com/grailbio/base/log"
+	"github.com/grailbio/grit/git"
+)
+
+// A routeRule places files whose paths match pathRe, and whose
+// contents have a line matching contentRe, in the destination
+// directory dir, expanded with contentRe's capture groups.
+type routeRule struct {
+	pathRe    *regexp.Regexp
+	contentRe *regexp.Regexp
+	dir       []byte
+}
+
+func parseRouteRule(rule string) (r routeRule, err error) {
+	parts := strings.SplitN(rule, ":", 2)
+	if len(parts) != 2 || len(parts[1]) < 3 {
+		return r, fmt.Errorf("route: rule '%s' must be of form route:pathre:/content_re/dir/", rule)
+	}
+	if r.pathRe, err = regexp.Compile(parts[0]); err != nil {
+		return r, fmt.Errorf("route: invalid path regexp %s: %s", parts[0], err)
+	}
+	sep := parts[1][0:1]
+	parts = strings.Split(parts[1][1:], sep)
+	if len(parts) != 3 || parts[2] != "" {
+		return r, fmt.Errorf("route: rule '%s' must be of form route:pathre:/content_re/dir/", rule)
+	}
+	if r.contentRe, err = regexp.Compile(parts[0]); err != nil {
+		return r, fmt.Errorf("route: invalid content regexp %s: %s", parts[0], err)
+	}
+	r.dir = []byte(parts[1])
+	return r, nil
+}
+
+// dirFor returns the directory, relative to the destination's prefix,
+// to which the file with the provided content lines is routed, and
+// whether the rule routes it at all. The first matching line
+// determines the directory.
+func (r routeRule) dirFor(lines [][]byte) (string, bool, error) {
+	for _, line := range lines {
+		m := r.contentRe.FindSubmatchIndex(line)
+		if m == nil {
+			continue
+		}
+		dir := path.Clean(string(r.contentRe.Expand(nil, r.dir, line, m)))
+		if path.IsAbs(dir) || dir == ".." || strings.HasPrefix(dir, "../") {
+			return "", false, fmt.Errorf("route: directory %s, from line %q, is outside of the destination", dir, line)
+		}
+		return dir, true, nil
+	}
+	return "", false, nil
+}
+
+// Router returns a router that applies the route rules in r to diffs
+// of commits in the source repository src that are copied to the
+// destination repository dst.
+func (r Rules) Router(src, dst *git.Repo) *Router {
+	return &Router{rules: r.route, src: src, dst: dst}
+}
+
+// A Router applies route rules to diffs, placing each file in the
+// destination directory determined by its contents rather than by its
+// path. A file is routed by its contents on either side of a diff:
+// the added lines of a new file, and otherwise the file as it is in
+// the source before and after the commit. A diff that changes the
+// directory to which its file is routed thus moves the file.
+type Router struct {
+	rules    []routeRule
+	src, dst *git.Repo
+}
+
+// Route applies the router's rules to the provided diff, from the
+// source commit named by id, whose paths have been rewritten to be
+// relative to the destination's prefix.
+func (t *Router) Route(id digest.Digest, diff *git.Diff) error {
+	if len(t.rules) == 0 || diff.IsSubmodule() {
+		return nil
+	}
+	if diff.IsBinary() {
+		log.Debug.Printf("%s: not routing binary diff", diff.Path)
+		return nil
+	}
+	var (
+		oldPath = diff.Path
+		added   = diff.IsNew()
+		deleted = diff.IsDeleted()
+	)
+	if diff.OldPath != "" {
+		oldPath = diff.OldPath
+	}
+	routedOld, routedNew := oldPath, diff.Path
+	var err error
+	if !deleted {
+		routedNew, err = t.route(diff.Path, func() ([][]byte, error) {
+			if !added {
+				return t.lines(id.Hex(), diff.Path)
+			}
+			// The diff's single hunk holds the new file's contents,
+			// unless the file is stored in LFS, in which case it
+			// holds the file's pointer.
+			var lines [][]byte
+			for _, line := range bytes.Split(diff.Body, []byte("\n")) {
+				if len(line) > 0 && line[0] == '+' {
+					lines = append(lines, line[1:])
+				}
+			}
+			if git.IsLFSPointer(bytes.Join(lines, []byte("\n"))) {
+				return t.lines(id.Hex(), diff.Path)
+			}
+			return lines, nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if !added {
+		routedOld, err = t.route(oldPath, func() ([][]byte, error) {
+			return t.lines(id.Hex()+"^", oldPath)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	switch {
+	case added:
+		routedOld = routedNew
+	case deleted:
+		routedNew = routedOld
+	}
+	if routedOld != oldPath || routedNew != diff.Path {
+		log.Debug.Printf("file %s: routed to %s", diff.Path, routedNew)
+		diff.SetPaths(routedOld, routedNew)
+	}
+	return nil
+}
+
+// route returns the destination path of the file at the provided path,
+// whose content lines are returned by content. The path is unchanged
+// if no rule routes the file.
+func (t *Router) route(p string, content func() ([][]byte, error)) (string, error) {
+	var lines [][]byte
+	for _, r := range t.rules {
+		if !r.pathRe.MatchString(p) {
+			continue
+		}
+		if lines == nil {
+			var err error
+			if lines, err = content(); err != nil {
+				return "", err
+			}
+		}
+		dir, ok, err := r.dirFor(lines)
+		if err != nil {
+			return "", fmt.Errorf("%s: %v", p, err)
+		}
+		if ok {
+			return t.dst.Prefix() + path.Join(dir, path.Base(p)), nil
+		}
+	}
+	return p, nil
+}
+
+// lines returns the lines of the source file at the provided
+// destination path, as of the provided revision. The contents of LFS
+// files are read from their objects.
+func (t *Router) lines(rev, p string) ([][]byte, error) {
+	content, err := t.src.ShowSmudged(rev, t.src.SourcePath(p, t.dst.Prefix()))
+	if err != nil {
+		return nil, err
+	}
+	return bytes.Split(content, []byte("\n")), nil
+}
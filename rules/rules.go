@@ -0,0 +1,504 @@
+// Copyright 2018 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// Package rules implements grit's rules, which determine which source
+// commits and files are copied to the destination, and how their
+// contents are rewritten. Rules are parsed from strings of the form
+// "kind:param"; see the grit command's documentation for the kinds of
+// rules and their parameters.
+package rules
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/grailbio/base/log"
+	"github.com/grailbio/grit/git"
+)
+
+type redactRule struct {
+	re          *regexp.Regexp // matched against each line in the diff
+	replacement []byte
+}
+
+func parseRedactRule(rule string) (r redactRule, err error) {
+	if len(rule) < 3 {
+		return r, fmt.Errorf("redact: rule '%s' must be of form redact:/secret_re/replacement/", rule)
+	}
+	sep := rule[0:1]
+	parts := strings.Split(rule[1:], sep)
+	if len(parts) != 3 || parts[2] != "" {
+		return r, fmt.Errorf("redact: rule '%s' must be of form redact:/secret_re/replacement/", rule)
+	}
+	if r.re, err = regexp.Compile(parts[0]); err != nil {
+		return r, fmt.Errorf("redact: invalid regexp %s: %s", parts[0], err)
+	}
+	r.replacement = []byte(parts[1])
+	return r, nil
+}
+
+type rewriteRule struct {
+	pathRe *regexp.Regexp // matched against the pathname
+	oldRe  *regexp.Regexp // matched against each line in the file
+	new    []byte         // replacement
+	// mode is '+' or '-' if only added or removed lines,
+	// respectively, are rewritten; and 0 if all lines are.
+	mode byte
+}
+
+func parseRewriteRule(rule string) (r rewriteRule, err error) {
+	parts := strings.SplitN(rule, ":", 2)
+	if len(parts) != 2 {
+		return r, fmt.Errorf("invalid rewrite rule %s", rule)
+	}
+	if r.pathRe, err = regexp.Compile(parts[0]); err != nil {
+		return r, fmt.Errorf("rewrite: invalid path regexp %s: %s", parts[0], err)
+	}
+	if strings.HasPrefix(parts[1], "+:") || strings.HasPrefix(parts[1], "-:") {
+		r.mode = parts[1][0]
+		parts[1] = parts[1][2:]
+	}
+	if len(parts[1]) < 3 {
+		return r, fmt.Errorf("rewrite: rule '%s' must be of form rewrite:pathre:[+:|-:]/from_re/to_re/", rule)
+	}
+	sep := parts[1][0:1]
+	parts = strings.Split(parts[1][1:], sep)
+	if len(parts) != 3 || parts[2] != "" {
+		return r, fmt.Errorf("rewrite: rule '%s' must be of form rewrite:pathre:[+:|-:]/from_re/to_re/", rule)
+	}
+	if r.oldRe, err = regexp.Compile(parts[0]); err != nil {
+		return r, fmt.Errorf("rewrite: invalid 'from' regexp %s: %s", parts[0], err)
+	}
+	r.new = []byte(parts[1])
+	return r, nil
+}
+
+func (r *rewriteRule) rewrite(diff []byte) []byte {
+	result := bytes.Buffer{}
+	for _, line := range bytes.Split(diff, []byte("\n")) {
+		switch {
+		case r.mode == 0:
+			line = r.oldRe.ReplaceAll(line, r.new)
+		case len(line) > 0 && line[0] == r.mode:
+			line = append(line[:1:1], r.oldRe.ReplaceAll(line[1:], r.new)...)
+		}
+		result.Write(line)
+		result.WriteByte('\n')
+	}
+	return result.Bytes()
+}
+
+// A normalizeRule normalizes the line endings of files whose paths
+// match pathRe.
+type normalizeRule struct {
+	pathRe *regexp.Regexp
+	// trimSpace indicates that all trailing whitespace is stripped;
+	// otherwise only carriage returns are.
+	trimSpace bool
+}
+
+// normalize normalizes the ending of the provided line.
+func (n normalizeRule) normalize(line []byte) []byte {
+	if n.trimSpace {
+		return bytes.TrimRight(line, " \t\r\f\v")
+	}
+	return bytes.TrimSuffix(line, []byte{'\r'})
+}
+
+// Rules is a set of rules that determine which source commits and
+// files are copied, and how their contents are rewritten. The zero
+// value is an empty rule set, which copies everything as is.
+type Rules struct {
+	strip             []*regexp.Regexp
+	stripMessagePaths []*regexp.Regexp
+	// We store strip prefixes as strings since digesters refuse
+	// to parse odd-length hex strings and git typically gives out
+	// a prefix with 7 digits.
+	stripCommits        []string
+	stripCommitMessages []*regexp.Regexp
+	rewrite             []rewriteRule
+	normalize           []normalizeRule
+	headers             []headerRule
+	redact              []redactRule
+	route               []routeRule
+	// rules holds the rules as parsed, in order.
+	rules []string
+	// AuthorAllow and AuthorDeny, if set, filter commits by their
+	// authors; see IsAuthorFiltered. They are given by flags rather
+	// than rules. They are not applied by IsCommitApplicable: a
+	// previously copied commit remains the last synchronized one
+	// even if its author is filtered out by later syncs.
+	AuthorAllow, AuthorDeny *regexp.Regexp
+}
+
+// Parse parses the rule "kind:param" and adds it to the rule set r.
+// An error is returned if the rule is malformed.
+func (r *Rules) Parse(rule string) error {
+	parts := strings.SplitN(rule, ":", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("invalid rule %s", rule)
+	}
+	switch parts[0] {
+	case "strip":
+		re, err := regexp.Compile(parts[1])
+		if err != nil {
+			return fmt.Errorf("invalid regexp %s: %s", parts[1], err)
+		}
+		r.strip = append(r.strip, re)
+	case "strip-message":
+		re, err := regexp.Compile(parts[1])
+		if err != nil {
+			return fmt.Errorf("invalid regexp %s: %s", parts[1], err)
+		}
+		r.stripMessagePaths = append(r.stripMessagePaths, re)
+	case "strip-commit":
+		hash := parts[1]
+		if len(hash) < 7 {
+			return fmt.Errorf("invalid commit prefix %s: must have at least 7 digits", parts[1])
+		}
+		for _, d := range hash {
+			if (d < '0' || d > '9') && (d < 'a' || d > 'f') && (d < 'A' || d > 'F') {
+				return fmt.Errorf("invalid commit prefix %s: invalid hex digit %c", hash, d)
+			}
+		}
+		r.stripCommits = append(r.stripCommits, hash)
+	case "strip-message-commit":
+		re, err := regexp.Compile(parts[1])
+		if err != nil {
+			return fmt.Errorf("invalid regexp %s: %s", parts[1], err)
+		}
+		r.stripCommitMessages = append(r.stripCommitMessages, re)
+	case "trim-trailing-space", "normalize-eol":
+		re, err := regexp.Compile(parts[1])
+		if err != nil {
+			return fmt.Errorf("invalid regexp %s: %s", parts[1], err)
+		}
+		r.normalize = append(r.normalize, normalizeRule{re, parts[0] == "trim-trailing-space"})
+	case "add-header":
+		h, err := parseHeaderRule(parts[1])
+		if err != nil {
+			return err
+		}
+		r.headers = append(r.headers, h)
+	case "redact":
+		rd, err := parseRedactRule(parts[1])
+		if err != nil {
+			return err
+		}
+		r.redact = append(r.redact, rd)
+	case "rewrite":
+		rw, err := parseRewriteRule(parts[1])
+		if err != nil {
+			return err
+		}
+		r.rewrite = append(r.rewrite, rw)
+	case "route":
+		rt, err := parseRouteRule(parts[1])
+		if err != nil {
+			return err
+		}
+		r.route = append(r.route, rt)
+	default:
+		return fmt.Errorf("invalid rule type %s", parts[0])
+	}
+	r.rules = append(r.rules, rule)
+	return nil
+}
+
+// Strings returns the rules in the set, in the "kind:param" form and
+// the order in which they were parsed, so that parsing them again
+// reproduces the set. AuthorAllow and AuthorDeny are not included.
+func (r Rules) Strings() []string {
+	return append([]string(nil), r.rules...)
+}
+
+// String returns the rules in the set as they would be given to the
+// grit command: in "kind:param" form, separated by spaces, and quoted
+// for the shell where needed.
+func (r Rules) String() string {
+	quoted := make([]string, len(r.rules))
+	for i, rule := range r.rules {
+		quoted[i] = shellQuote(rule)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// shellQuote quotes s for the shell, unless it consists only of
+// characters that the shell treats literally.
+func shellQuote(s string) string {
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_-+=/.,:@%") == "" {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// IsStripped returns whether this commit matches the strip rules of
+// the rule set r.
+func (r Rules) IsStripped(c *git.Commit) bool {
+	for _, stripped := range r.stripCommits {
+		if strings.HasPrefix(c.Digest.Hex(), stripped) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsMessageStripped returns whether the commit's message matches
+// the ruleset's message-based commit strip rules.
+func (r Rules) IsMessageStripped(c *git.Commit) (bool, *regexp.Regexp) {
+	for _, re := range r.stripCommitMessages {
+		if re.MatchString(c.Body) {
+			return true, re
+		}
+	}
+	return false, nil
+}
+
+// IsAuthorFiltered returns whether the commit's author is excluded
+// by the ruleset's author filters, and if so, why.
+func (r Rules) IsAuthorFiltered(c *git.Commit) (bool, string) {
+	author := c.Author()
+	if r.AuthorAllow != nil && !r.AuthorAllow.MatchString(author) {
+		return true, "does not match -author-allow"
+	}
+	if r.AuthorDeny != nil && r.AuthorDeny.MatchString(author) {
+		return true, "matches -author-deny"
+	}
+	return false, ""
+}
+
+// IsPathStripped returns whether the provided path is stripped by the
+// ruleset's strip path rules.
+func (r Rules) IsPathStripped(path string) (bool, *regexp.Regexp) {
+	for _, re := range r.strip {
+		if re.MatchString(path) {
+			return true, re
+		}
+	}
+	return false, nil
+}
+
+// IsMessagePathStripped returns whether the provided path is stripped
+// by the ruleset's message strip rules.
+func (r Rules) IsMessagePathStripped(path string) (bool, *regexp.Regexp) {
+	for _, re := range r.stripMessagePaths {
+		if re.MatchString(path) {
+			return true, re
+		}
+	}
+	return false, nil
+}
+
+// RewriteDiff applies the ruleset's rewrite, normalization, and
+// redaction rules to the provided diff.
+func (r Rules) RewriteDiff(diff *git.Diff) {
+	if diff.IsBinary() {
+		// Rules operate on lines of text, and would corrupt binary
+		// patch data.
+		if len(r.rewrite) > 0 || len(r.normalize) > 0 || len(r.redact) > 0 {
+			log.Debug.Printf("%s: not applying rules to binary diff", diff.Path)
+		}
+		return
+	}
+	for _, r := range r.rewrite {
+		if r.pathRe.MatchString(diff.Path) {
+			diff.Body = r.rewrite(diff.Body)
+		}
+	}
+	for _, n := range r.normalize {
+		if !n.pathRe.MatchString(diff.Path) {
+			continue
+		}
+		// Context and removed lines are normalized too, since they
+		// refer to content that was normalized in the destination.
+		lines := bytes.Split(diff.Body, []byte("\n"))
+		for i, line := range lines {
+			if len(line) > 0 && (line[0] == '+' || line[0] == '-' || line[0] == ' ') {
+				lines[i] = append(line[:1:1], n.normalize(line[1:])...)
+			}
+		}
+		diff.Body = bytes.Join(lines, []byte("\n"))
+	}
+	if len(r.redact) > 0 {
+		// Like normalization, redaction applies to context and
+		// removed lines too. It replaces text within lines, so the
+		// hunks' line counts are unaffected.
+		lines := bytes.Split(diff.Body, []byte("\n"))
+		for i, line := range lines {
+			if len(line) == 0 || (line[0] != '+' && line[0] != '-' && line[0] != ' ') {
+				continue
+			}
+			for _, rd := range r.redact {
+				line = append(line[:1:1], rd.re.ReplaceAll(line[1:], rd.replacement)...)
+			}
+			lines[i] = line
+		}
+		diff.Body = bytes.Join(lines, []byte("\n"))
+	}
+}
+
+// RewriteContent returns a function that applies the ruleset's
+// rewrite and normalization rules to the contents of the file at the
+// provided path, or nil if no such rules apply to the path.
+func (r Rules) RewriteContent(path string) func([]byte) []byte {
+	var (
+		rewrites   []rewriteRule
+		normalizes []normalizeRule
+		headers    []headerRule
+	)
+	for _, rw := range r.rewrite {
+		// Removed lines are not in the destination's content.
+		if rw.mode != '-' && rw.pathRe.MatchString(path) {
+			rewrites = append(rewrites, rw)
+		}
+	}
+	for _, n := range r.normalize {
+		if n.pathRe.MatchString(path) {
+			normalizes = append(normalizes, n)
+		}
+	}
+	for _, h := range r.headers {
+		if h.pathRe.MatchString(path) {
+			headers = append(headers, h)
+		}
+	}
+	if len(rewrites) == 0 && len(normalizes) == 0 && len(headers) == 0 && len(r.redact) == 0 {
+		return nil
+	}
+	return func(content []byte) []byte {
+		if bytes.IndexByte(content, 0) >= 0 {
+			// Binary content is copied as is; see RewriteDiff.
+			return content
+		}
+		lines := bytes.Split(content, []byte("\n"))
+		for i := range lines {
+			for _, rw := range rewrites {
+				lines[i] = rw.oldRe.ReplaceAll(lines[i], rw.new)
+			}
+			for _, n := range normalizes {
+				lines[i] = n.normalize(lines[i])
+			}
+			for _, rd := range r.redact {
+				lines[i] = rd.re.ReplaceAll(lines[i], rd.replacement)
+			}
+		}
+		content = bytes.Join(lines, []byte("\n"))
+		for _, h := range headers {
+			// We cannot tell whether the file was added since the
+			// rule was introduced, so assume that it should have
+			// the header.
+			header := append(bytes.Join(h.lines, []byte("\n")), '\n')
+			if !bytes.HasPrefix(content, header) {
+				content = append(header, content...)
+			}
+		}
+		return content
+	}
+}
+
+// IsCommitApplicable returns whether the provided commit is non-empty
+// in the provided repository and prefix. If keepEmpty is true, commits
+// that are themselves empty are also considered applicable.
+func (r Rules) IsCommitApplicable(c *git.Commit, src *git.Repo, keepEmpty bool) (bool, error) {
+	if r.IsStripped(c) {
+		return false, nil
+	}
+	if match, _ := r.IsMessageStripped(c); match {
+		return false, nil
+	}
+	patch, err := src.Patch(c.Digest, "")
+	if err != nil {
+		return false, err
+	}
+	if keepEmpty && len(patch.Diffs) == 0 {
+		return true, nil
+	}
+	var ndiff int
+	for _, diff := range patch.Diffs {
+		if match, _ := r.IsPathStripped(diff.Path); match {
+			continue
+		}
+		ndiff++
+	}
+	return ndiff > 0, nil
+}
+
+// Warnings returns a description of each suspicious rule in r: those
+// that are valid, but probably do not do what was intended. Currently
+// these are rewrite and redact rules whose replacements refer to
+// capture groups that their regexps do not define; such references
+// expand to the empty string.
+func (r Rules) Warnings() []string {
+	var warnings []string
+	for _, rw := range r.rewrite {
+		for _, group := range undefinedGroups(rw.oldRe, rw.new) {
+			warnings = append(warnings, fmt.Sprintf("'to' refers to %s, which 'from' does not define", group))
+		}
+	}
+	for _, rd := range r.redact {
+		for _, group := range undefinedGroups(rd.re, rd.replacement) {
+			warnings = append(warnings, fmt.Sprintf("replacement refers to %s, which the regexp does not define", group))
+		}
+	}
+	return warnings
+}
+
+// undefinedGroups returns the references in the replacement template,
+// as interpreted by regexp.Expand, to capture groups that re does not
+// define. Note that Expand takes the longest possible name, so that
+// "$1x" refers to the group named "1x" and not to group 1.
+func undefinedGroups(re *regexp.Regexp, template []byte) []string {
+	defined := make(map[string]bool)
+	for i, name := range re.SubexpNames() {
+		defined[strconv.Itoa(i)] = true
+		if name != "" {
+			defined[name] = true
+		}
+	}
+	var undefined []string
+	for i := 0; i < len(template); i++ {
+		if template[i] != '$' || i+1 == len(template) {
+			continue
+		}
+		i++
+		if template[i] == '$' {
+			continue
+		}
+		var name, ref string
+		if template[i] == '{' {
+			end := bytes.IndexByte(template[i:], '}')
+			if end < 0 {
+				continue
+			}
+			name = string(template[i+1 : i+end])
+			ref = "${" + name + "}"
+			i += end
+		} else {
+			j := i
+			for j < len(template) && isGroupNameByte(template[j]) {
+				j++
+			}
+			name = string(template[i:j])
+			ref = "$" + name
+			i = j - 1
+		}
+		if name == "" {
+			continue
+		}
+		if n, err := strconv.Atoi(name); err == nil {
+			name = strconv.Itoa(n)
+		}
+		if !defined[name] {
+			undefined = append(undefined, ref)
+		}
+	}
+	return undefined
+}
+
+func isGroupNameByte(c byte) bool {
+	return c == '_' || '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
@@ -0,0 +1,418 @@
+// Copyright 2018 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package rules
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/grailbio/grit/git"
+)
+
+func parse(t *testing.T, rules ...string) Rules {
+	t.Helper()
+	var r Rules
+	for _, rule := range rules {
+		if err := r.Parse(rule); err != nil {
+			t.Fatalf("%s: %v", rule, err)
+		}
+	}
+	return r
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, c := range []struct {
+		rule, err string
+	}{
+		{"strip", "invalid rule strip"},
+		{"bogus:foo", "invalid rule type bogus"},
+		{"strip:(", "invalid regexp ("},
+		{"strip-message:[", "invalid regexp ["},
+		{"strip-message-commit:(", "invalid regexp ("},
+		{"normalize-eol:(", "invalid regexp ("},
+		{"strip-commit:abc", "must have at least 7 digits"},
+		{"strip-commit:abcdefg", "invalid hex digit g"},
+		{"redact:/x/", "must be of form redact:/secret_re/replacement/"},
+		{"redact:/(/x/", "redact: invalid regexp ("},
+		{"rewrite:.*", "invalid rewrite rule .*"},
+		{"rewrite:(:/a/b/", "rewrite: invalid path regexp ("},
+		{"rewrite:.*:/a/b", "must be of form rewrite:pathre:[+:|-:]/from_re/to_re/"},
+		{"rewrite:.*:/(/b/", "rewrite: invalid 'from' regexp ("},
+		{"add-header:.*", "must be of form add-header:pathre:file"},
+		{"route:.*", "must be of form route:pathre:/content_re/dir/"},
+		{"route:(:/a/b/", "route: invalid path regexp ("},
+		{"route:.*:/(/b/", "route: invalid content regexp ("},
+		{"add-header:.*:/nonexistent/header", "add-header: open /nonexistent/header"},
+	} {
+		var r Rules
+		err := r.Parse(c.rule)
+		if err == nil {
+			t.Errorf("%s: expected error", c.rule)
+			continue
+		}
+		if !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s: got %v, want %q", c.rule, err, c.err)
+		}
+	}
+}
+
+func TestStripCommits(t *testing.T) {
+	commit := &git.Commit{
+		Digest:  git.SHA1.FromString("commit"),
+		Headers: []git.Header{{K: "Author", V: "alice <alice@example.com>"}},
+		Body:    "Fix a bug\n\nInternal-only: yes\n",
+	}
+	other := &git.Commit{
+		Digest:  git.SHA1.FromString("other"),
+		Headers: []git.Header{{K: "Author", V: "bob <bob@example.com>"}},
+		Body:    "Add a feature\n",
+	}
+	r := parse(t, "strip-commit:"+commit.Digest.Hex()[:7], "strip-message-commit:(?m)^Internal-only:")
+	if !r.IsStripped(commit) || r.IsStripped(other) {
+		t.Errorf("strip-commit: got %v, %v", r.IsStripped(commit), r.IsStripped(other))
+	}
+	if match, re := r.IsMessageStripped(commit); !match || re.String() != "(?m)^Internal-only:" {
+		t.Errorf("strip-message-commit: got %v, %v", match, re)
+	}
+	if match, _ := r.IsMessageStripped(other); match {
+		t.Error("strip-message-commit: other commit stripped")
+	}
+
+	r.AuthorAllow = regexp.MustCompile("@example.com>$")
+	r.AuthorDeny = regexp.MustCompile("^bob ")
+	if match, _ := r.IsAuthorFiltered(commit); match {
+		t.Error("author filtered")
+	}
+	if match, reason := r.IsAuthorFiltered(other); !match || reason != "matches -author-deny" {
+		t.Errorf("got %v, %q", match, reason)
+	}
+	r.AuthorAllow = regexp.MustCompile("^carol ")
+	if match, reason := r.IsAuthorFiltered(commit); !match || reason != "does not match -author-allow" {
+		t.Errorf("got %v, %q", match, reason)
+	}
+}
+
+func TestStripPaths(t *testing.T) {
+	r := parse(t, "strip:^internal/", "strip-message:^secret/")
+	if match, re := r.IsPathStripped("internal/file"); !match || re.String() != "^internal/" {
+		t.Errorf("got %v, %v", match, re)
+	}
+	if match, _ := r.IsPathStripped("public/internal/file"); match {
+		t.Error("public path stripped")
+	}
+	if match, _ := r.IsMessagePathStripped("secret/file"); !match {
+		t.Error("message path not stripped")
+	}
+	if match, _ := r.IsMessagePathStripped("internal/file"); match {
+		t.Error("strip rule applied as strip-message rule")
+	}
+}
+
+func TestRewriteDiff(t *testing.T) {
+	const body = "@@ -1,3 +1,3 @@\n internal.example.com \r\n-old internal\n+new internal \t"
+	for _, c := range []struct {
+		rules []string
+		path  string
+		want  string
+	}{
+		{
+			[]string{"rewrite:\\.go$:/internal/public/"},
+			"file.go",
+			"@@ -1,3 +1,3 @@\n public.example.com \r\n-old public\n+new public \t\n",
+		},
+		{
+			[]string{"rewrite:\\.go$:/internal/public/"},
+			"file.txt",
+			body,
+		},
+		{
+			[]string{"rewrite:.*:+:/internal/public/"},
+			"file.go",
+			"@@ -1,3 +1,3 @@\n internal.example.com \r\n-old internal\n+new public \t\n",
+		},
+		{
+			[]string{"rewrite:.*:-:/(old) internal/${1} public/"},
+			"file.go",
+			"@@ -1,3 +1,3 @@\n internal.example.com \r\n-old public\n+new internal \t\n",
+		},
+		{
+			[]string{"normalize-eol:.*"},
+			"file.go",
+			"@@ -1,3 +1,3 @@\n internal.example.com \n-old internal\n+new internal \t",
+		},
+		{
+			[]string{"trim-trailing-space:.*"},
+			"file.go",
+			"@@ -1,3 +1,3 @@\n internal.example.com\n-old internal\n+new internal",
+		},
+		{
+			[]string{"redact:|[a-z]+\\.example\\.com|REDACTED|"},
+			"file.go",
+			"@@ -1,3 +1,3 @@\n REDACTED \r\n-old internal\n+new internal \t",
+		},
+	} {
+		r := parse(t, c.rules...)
+		diff := git.Diff{Path: c.path, Body: []byte(body)}
+		r.RewriteDiff(&diff)
+		if got := string(diff.Body); got != c.want {
+			t.Errorf("%v %s: got %q, want %q", c.rules, c.path, got, c.want)
+		}
+	}
+
+	// Binary diffs are left as is.
+	r := parse(t, "rewrite:.*:/internal/public/")
+	diff := git.Diff{Path: "file", Meta: []byte("index 1..2\nGIT binary patch"), Body: []byte("literal internal")}
+	r.RewriteDiff(&diff)
+	if got, want := string(diff.Body), "literal internal"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestRewriteContent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	header := filepath.Join(dir, "header")
+	if err := ioutil.WriteFile(header, []byte("// Copyright\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r := parse(t,
+		"rewrite:\\.go$:/internal/public/",
+		"rewrite:\\.go$:-:/old/new/",
+		"trim-trailing-space:\\.go$",
+		"add-header:\\.go$:"+header,
+	)
+	if r.RewriteContent("file.txt") != nil {
+		t.Error("rules applied to file.txt")
+	}
+	rewrite := r.RewriteContent("file.go")
+	if rewrite == nil {
+		t.Fatal("no rules applied to file.go")
+	}
+	if got, want := string(rewrite([]byte("old internal  \n"))), "// Copyright\nold public\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	// Headers are not added twice, and binary content is unchanged.
+	if got, want := string(rewrite([]byte("// Copyright\ninternal\n"))), "// Copyright\npublic\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, want := string(rewrite([]byte("internal\x00"))), "internal\x00"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestHeaderTracker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	header := filepath.Join(dir, "header")
+	if err := ioutil.WriteFile(header, []byte("// Copyright\n// License\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r := parse(t, "add-header:\\.go$:"+header)
+	// The tracker looks up files that it has not seen in the
+	// destination, which is not needed here.
+	tracker := r.HeaderTracker(nil, nil)
+
+	steps := []struct {
+		diff git.Diff
+		want string
+	}{
+		{
+			git.Diff{Path: "file.go", Meta: []byte("new file mode 100644\nindex 0000000..1111111\n--- /dev/null\n+++ b/file.go"), Body: []byte("@@ -0,0 +1,2 @@\n+package main\n+")},
+			"@@ -0,0 +1,4 @@\n+// Copyright\n+// License\n+package main\n+",
+		},
+		{
+			git.Diff{Path: "file.go", Meta: []byte("index 1111111..2222222 100644\n--- a/file.go\n+++ b/file.go"), Body: []byte("@@ -1,2 +1,3 @@\n package main\n \n+func main() {}")},
+			"@@ -3,2 +3,3 @@\n package main\n \n+func main() {}",
+		},
+		{
+			git.Diff{Path: "file.go", Meta: []byte("deleted file mode 100644\nindex 2222222..0000000\n--- a/file.go\n+++ /dev/null"), Body: []byte("@@ -1,3 +0,0 @@\n-package main\n-\n-func main() {}")},
+			"@@ -1,5 +0,0 @@\n-// Copyright\n-// License\n-package main\n-\n-func main() {}",
+		},
+		{
+			git.Diff{Path: "file.txt", Meta: []byte("new file mode 100644\nindex 0000000..1111111\n--- /dev/null\n+++ b/file.txt"), Body: []byte("@@ -0,0 +1 @@\n+text")},
+			"@@ -0,0 +1 @@\n+text",
+		},
+	}
+	for i, step := range steps {
+		diff := step.diff
+		if err := tracker.Adjust(&diff); err != nil {
+			t.Fatalf("step %d: %v", i, err)
+		}
+		if got := string(diff.Body); got != step.want {
+			t.Errorf("step %d: got %q, want %q", i, got, step.want)
+		}
+	}
+}
+
+func TestLastSynced(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	run := func(script string) string {
+		cmd := exec.Command("bash", "-e", "-c", script)
+		cmd.Dir = dir
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("%v\n%s", err, stderr.String())
+		}
+		return strings.TrimSpace(string(out))
+	}
+	// The destination's last commit records a source commit, but only
+	// changes a file that the rules strip.
+	id := run(`
+		export GIT_AUTHOR_NAME=a GIT_AUTHOR_EMAIL=a@example.com GIT_COMMITTER_NAME=a GIT_COMMITTER_EMAIL=a@example.com
+		git init -q --bare src
+		git clone -q src srcwork
+		cd srcwork
+		echo 1 > file
+		git add .
+		git commit -q -m'first commit'
+		git push -q origin HEAD:master
+		id=$(git rev-parse HEAD)
+		cd ..
+		git init -q --bare dst
+		git clone -q dst dstwork
+		cd dstwork
+		echo 1 > file
+		git add .
+		git commit -q -m'first commit' -m"fbshipit-source-id: ${id:0:7}"
+		echo build > BUILD
+		git add .
+		git commit -q -m'build commit' -m'fbshipit-source-id: deadbee'
+		git push -q origin HEAD:master
+		echo $id
+	`)
+	src, err := git.Open(filepath.Join(dir, "src"), "", "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	dst, err := git.Open(filepath.Join(dir, "dst"), "", "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+
+	last, err := parse(t, "strip:^BUILD$").LastSynced(src, dst, SearchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last == nil {
+		t.Fatal("no last synchronized commit")
+	}
+	if got, want := last.Commit.Title(), "first commit"; got != want {
+		t.Errorf("got commit %q, want %q", got, want)
+	}
+	if got, want := last.SourceID, id[:7]; got != want {
+		t.Errorf("got source ID %s, want %s", got, want)
+	}
+	if last.Source == nil || last.Source.Digest.Hex() != id {
+		t.Errorf("got source commit %v, want %s", last.Source, id)
+	}
+
+	_, err = parse(t, "strip:^BUILD$").LastSynced(src, dst, SearchOptions{Limit: 1})
+	if _, ok := err.(*SearchLimitError); !ok {
+		t.Errorf("got %v, want search limit error", err)
+	}
+
+	// Without the rule, the last commit applies, but its source commit
+	// is not in the source.
+	last, err = parse(t).LastSynced(src, dst, SearchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last == nil || last.SourceID != "deadbee" || last.Source != nil {
+		t.Errorf("got %+v, want source ID deadbee without source commit", last)
+	}
+
+	// The source records no source commits.
+	if last, err := parse(t).LastSynced(dst, src, SearchOptions{}); err != nil || last != nil {
+		t.Errorf("got %+v, %v, want none", last, err)
+	}
+}
+
+func TestRouteDir(t *testing.T) {
+	r := parse(t, `route:\.proto$:!^// grit-dir: (\S+)!protos/$1!`).route[0]
+	for _, c := range []struct {
+		content, dir string
+		ok           bool
+		err          string
+	}{
+		{"syntax = \"proto3\";\n", "", false, ""},
+		{"// grit-dir: api\nsyntax = \"proto3\";\n", "protos/api", true, ""},
+		{"// grit-dir: api/v1/\n// grit-dir: other\n", "protos/api/v1", true, ""},
+		{"// grit-dir: ..\n", ".", true, ""},
+		{"// grit-dir: ../..\n", "", false, "outside of the destination"},
+	} {
+		dir, ok, err := r.dirFor(bytes.Split([]byte(c.content), []byte("\n")))
+		switch {
+		case c.err != "":
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("%q: got %v, want %q", c.content, err, c.err)
+			}
+		case err != nil:
+			t.Errorf("%q: %v", c.content, err)
+		case dir != c.dir || ok != c.ok:
+			t.Errorf("%q: got %q, %v, want %q, %v", c.content, dir, ok, c.dir, c.ok)
+		}
+	}
+}
+
+func TestWarnings(t *testing.T) {
+	for _, c := range []struct {
+		rule string
+		want []string
+	}{
+		{"rewrite:.*:/(a)(?P<b>b)/$1${b}${2}$$3/", nil},
+		{"rewrite:.*:/(a)/$1x/", []string{"'to' refers to $1x, which 'from' does not define"}},
+		{"rewrite:.*:/(a)/${2}/", []string{"'to' refers to ${2}, which 'from' does not define"}},
+		{"redact:/secret/$name/", []string{"replacement refers to $name, which the regexp does not define"}},
+		{"strip:(a)", nil},
+	} {
+		r := parse(t, c.rule)
+		got := r.Warnings()
+		if strings.Join(got, "\n") != strings.Join(c.want, "\n") {
+			t.Errorf("%s: got %q, want %q", c.rule, got, c.want)
+		}
+	}
+}
+
+func TestString(t *testing.T) {
+	rules := []string{
+		"strip:^internal/",
+		"strip-commit:abcdef0",
+		"rewrite:\\.go$:/internal/public/",
+		"redact:/it's secret/REDACTED/",
+		"strip-message:",
+	}
+	r := parse(t, rules...)
+	if got, want := r.String(), `'strip:^internal/' strip-commit:abcdef0 'rewrite:\.go$:/internal/public/' 'redact:/it'\''s secret/REDACTED/' strip-message:`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	got := r.Strings()
+	if strings.Join(got, "\n") != strings.Join(rules, "\n") {
+		t.Errorf("got %q, want %q", got, rules)
+	}
+	// The rules round-trip.
+	if got, want := parse(t, got...).String(), r.String(); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2018 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package rules
+
+import (
+	"fmt"
+
+	"github.com/grailbio/base/log"
+	"github.com/grailbio/grit/git"
+)
+
+// syncedRe matches the messages, or notes, of destination commits that
+// record the source commits from which they were copied.
+const syncedRe = `^\s*\(fb\)\?shipit-source-id: [a-z0-9]\+$`
+
+// SearchOptions configures the search for the last synchronized commit
+// by LastSynced.
+type SearchOptions struct {
+	// LogArgs are additional arguments with which destination commits
+	// are logged, e.g., to show the notes in which source commits are
+	// recorded.
+	LogArgs []string
+	// KeepEmpty makes empty commits applicable, as with
+	// IsCommitApplicable.
+	KeepEmpty bool
+	// Limit is the maximum number of destination commits with source
+	// IDs that are examined. If zero, there is no limit.
+	Limit int
+}
+
+// A Sync describes the last synchronization of a destination
+// repository from a source repository.
+type Sync struct {
+	// Commit is the newest destination commit that records source
+	// commits and that is applicable under the rules.
+	Commit *git.Commit
+	// SourceID is the ID of the newest source commit recorded by
+	// Commit: its full hash if recorded, otherwise its abbreviated
+	// hash. The source commits of squashed commits are recorded in
+	// chronological order, so this is the last of them.
+	SourceID string
+	// Source is the source commit named by SourceID, or nil if it is
+	// not in the history of the source's branch, e.g., because the
+	// branch was force-pushed.
+	Source *git.Commit
+}
+
+// A SearchLimitError is returned by LastSynced if no applicable
+// synchronized commit is found within the search limit.
+type SearchLimitError struct {
+	Dst   *git.Repo
+	Limit int
+}
+
+func (e *SearchLimitError) Error() string {
+	return fmt.Sprintf("no applicable synchronized commit found among the last %d with source IDs in %s", e.Limit, e.Dst)
+}
+
+// LastSynced returns the last synchronization of dst from src: the
+// newest destination commit that records source commits, and the
+// newest source commit it records. Destination commits that record
+// source commits but are not applicable under the rules are skipped:
+// when a repository is the destination of several sources, commits
+// copied from one may touch the files copied from another, such as
+// Bazel BUILD files or go.mod files that are modified independently in
+// the source and destination repositories. LastSynced returns nil if
+// dst has no such commit.
+func (r Rules) LastSynced(src, dst *git.Repo, opts SearchOptions) (*Sync, error) {
+	var last *git.Commit
+	for head, n := "HEAD", 0; ; n++ {
+		if opts.Limit > 0 && n == opts.Limit {
+			return nil, &SearchLimitError{Dst: dst, Limit: n}
+		}
+		commits, err := dst.Log(append(append([]string(nil), opts.LogArgs...), "-1", "--grep", syncedRe, head)...)
+		if err != nil {
+			return nil, err
+		}
+		if len(commits) == 0 {
+			return nil, nil
+		}
+		applies, err := r.IsCommitApplicable(commits[0], dst, opts.KeepEmpty)
+		if err != nil {
+			return nil, fmt.Errorf("commit %s: %v", commits[0], err)
+		}
+		if applies {
+			last = commits[0]
+			break
+		}
+		log.Printf("commit %s is not applicable to %s: skipping", commits[0], dst)
+		head = commits[0].Digest.Hex() + "^"
+	}
+	// Prefer full source hashes, which are unambiguous.
+	ids := last.SourceCommits()
+	if len(ids) == 0 {
+		ids = last.ShipitID()
+	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("commit %s: no fbshipit-source-id found", last)
+	}
+	s := &Sync{Commit: last, SourceID: ids[len(ids)-1]}
+	ok, err := src.Contains(s.SourceID)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		if s.Source, err = src.Commit(s.SourceID); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}